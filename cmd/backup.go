@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+	"github.com/wu/keyop/util"
+
+	"github.com/spf13/cobra"
+)
+
+// NewBackupCmd builds the backup command, which archives configuration and state.
+func NewBackupCmd(deps core.Dependencies) *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Archive the conf directory and state store",
+		Long: `Write the conf directory (services, messenger.yaml, plugins.yaml), every state store key and a
+summary of the messenger data directory to a zstd-compressed tar archive with a manifest and
+checksums. Messages are not included; use channel export for those. Encrypted state stays
+encrypted, so keep the keys separately.
+
+The file defaults to keyop-backup-<hostname>-<time>.tar.zst; give - to write to stdout.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			} else {
+				hostname, err := util.GetShortHostname(deps.MustGetOsProvider())
+				if err != nil {
+					return err
+				}
+				name = fmt.Sprintf("keyop-backup-%s-%s.tar.zst", hostname, time.Now().UTC().Format("20060102T150405Z"))
+			}
+
+			var w io.Writer = cmd.OutOrStdout()
+			var f *os.File
+			if name != "-" {
+				var err error
+				if f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600); err != nil { //nolint:gosec // path is given by the operator
+					return err
+				}
+				w = f
+			}
+			manifest, err := runtime.CreateBackup(deps, w, runtime.BackupOptions{KeyopVersion: Version})
+			if f != nil {
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					_ = os.Remove(name)
+				}
+			}
+			if err != nil || f == nil {
+				return err
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(), "wrote %s: %d files, %d state keys\n", name, len(manifest.Files), manifest.StateKeys)
+			return err
+		},
+	}
+}
+
+// NewRestoreCmd builds the restore command, which unpacks an archive written by backup.
+func NewRestoreCmd(deps core.Dependencies) *cobra.Command {
+	var (
+		maps   []string
+		force  bool
+		dryRun bool
+	)
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Restore configuration and state from a backup archive",
+		Long: `Check a backup archive against its manifest and checksums, then write its conf files to the
+conf directory and load its state into the state store configured by the restored messenger.yaml.
+Run it while keyop is stopped.
+
+To restore onto a new machine, --map-hostname old=new replaces a hostname in the conf files, in
+conf file names, which name the services, and in the service names of state keys, so the state
+follows the renamed services. Without it everything is restored unchanged. Existing conf files
+make the restore fail and existing state keys are kept, unless --force is given. Give - to read
+from stdin.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := runtime.RestoreOptions{Force: force, DryRun: dryRun, Hostnames: map[string]string{}}
+			for _, m := range maps {
+				from, to, ok := strings.Cut(m, "=")
+				if !ok || from == "" || to == "" {
+					return fmt.Errorf("--map-hostname %q: want old=new", m)
+				}
+				opts.Hostnames[from] = to
+			}
+
+			r := cmd.InOrStdin()
+			if args[0] != "-" {
+				f, err := os.Open(args[0]) //nolint:gosec // path is given by the operator
+				if err != nil {
+					return err
+				}
+				defer func() { _ = f.Close() }()
+				r = f
+			}
+			res, err := runtime.RestoreBackup(deps, r, opts)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			m := res.Manifest
+			_, _ = fmt.Fprintf(out, "backup of %s taken %s (keyop %s)\n", m.Hostname, m.CreatedAt.Format(time.RFC3339), m.KeyopVersion)
+			verb := "restored"
+			if dryRun {
+				verb = "would restore"
+			}
+			for _, f := range res.ConfFiles {
+				_, _ = fmt.Fprintf(out, "%s conf %s\n", verb, f)
+			}
+			for _, key := range res.SkippedState {
+				_, _ = fmt.Fprintf(out, "kept state %s: already set\n", key)
+			}
+			if res.ExpiredState > 0 {
+				_, _ = fmt.Fprintf(out, "left out %d state keys that expired since the backup\n", res.ExpiredState)
+			}
+			_, err = fmt.Fprintf(out, "%s %d conf files and %d state keys\n", verb, len(res.ConfFiles), res.StateKeys)
+			return err
+		},
+	}
+	cmd.Flags().StringArrayVar(&maps, "map-hostname", nil, "replace a hostname in the conf files and service names, as old=new (repeatable)")
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite existing conf files and state keys")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "check the archive and show what would be restored")
+	return cmd
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	deps, store := setupStateTest(t)
+	deps.SetOsProvider(testutil.FakeOsProvider{Host: "oldhost"})
+	confDir := os.Getenv("KEYOP_CONF_DIR")
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "heartbeat.yaml"), []byte("type: heartbeat\nremote: oldhost\n"), 0o600))
+	require.NoError(t, store.Save("service/heartbeat/beats", 3))
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.zst")
+	out, err := executeBusCmd(t, deps, "", "backup", archive)
+	require.NoError(t, err)
+	assert.Contains(t, out, "3 files, 1 state keys")
+	_, err = executeBusCmd(t, deps, "", "backup", archive)
+	assert.Error(t, err, "an existing archive is not overwritten")
+
+	newDeps, newStore := setupStateTest(t)
+	newDeps.SetOsProvider(testutil.FakeOsProvider{Host: "newhost"})
+	newConf := os.Getenv("KEYOP_CONF_DIR")
+	require.NoError(t, os.Remove(filepath.Join(newConf, "messenger.yaml")))
+
+	out, err = executeBusCmd(t, newDeps, "", "restore", archive, "--dry-run")
+	require.NoError(t, err)
+	assert.Contains(t, out, "backup of oldhost taken")
+	assert.Contains(t, out, "would restore 2 conf files and 1 state keys")
+
+	out, err = executeBusCmd(t, newDeps, "", "restore", archive, "--map-hostname", "oldhost=newhost")
+	require.NoError(t, err)
+	assert.Contains(t, out, "restored conf heartbeat.yaml")
+	svc, err := os.ReadFile(filepath.Join(newConf, "heartbeat.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "type: heartbeat\nremote: newhost\n", string(svc))
+	var beats int
+	require.NoError(t, newStore.Load("service/heartbeat/beats", &beats))
+	assert.Equal(t, 3, beats)
+
+	_, err = executeBusCmd(t, newDeps, "", "restore", archive)
+	assert.ErrorContains(t, err, "would overwrite existing files")
+	_, err = executeBusCmd(t, newDeps, "", "restore", archive, "--force")
+	require.NoError(t, err)
+	svc, err = os.ReadFile(filepath.Join(newConf, "heartbeat.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "type: heartbeat\nremote: oldhost\n", string(svc), "hostnames are only replaced on request")
+
+	_, err = executeBusCmd(t, newDeps, "", "restore", archive, "--map-hostname", "bad")
+	assert.ErrorContains(t, err, "want old=new")
+}
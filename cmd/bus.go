@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+
+	"github.com/spf13/cobra"
+	km "github.com/wu/keyop-messenger"
+	"gopkg.in/yaml.v3"
+)
+
+// cliServiceName is stamped on messages published from the command line.
+const cliServiceName = "keyop-cli"
+
+const followPollInterval = 250 * time.Millisecond
+
+// NewPubCmd builds the pub command that publishes a single message to a channel.
+func NewPubCmd(deps core.Dependencies) *cobra.Command {
+	var (
+		payloadType string
+		data        string
+		file        string
+		sets        []string
+		force       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "pub <channel>",
+		Short: "Publish a message to a channel",
+		Long: `Publish a JSON or YAML payload to a channel using the messenger configured in messenger.yaml.
+
+The payload is read from --data, --file, or stdin, and individual fields can be set with
+--set key=value (dotted keys create nested objects). The payload must decode cleanly into the
+registered type for --type unless --force is given.
+
+The message is written to local channel storage; the hub listener and hub connections are not
+started.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var input io.Reader
+			switch {
+			case data != "":
+				input = strings.NewReader(data)
+			case file == "-":
+				input = cmd.InOrStdin()
+			case file != "":
+				f, err := os.Open(file) //nolint:gosec // operator-supplied payload file
+				if err != nil {
+					return fmt.Errorf("open payload file: %w", err)
+				}
+				defer func() { _ = f.Close() }()
+				input = f
+			case len(sets) == 0:
+				input = cmd.InOrStdin()
+			}
+			payload, err := buildPubPayload(input, sets)
+			if err != nil {
+				return err
+			}
+			return runPub(cmd.Context(), deps, args[0], payloadType, payload, force)
+		},
+	}
+	cmd.Flags().StringVarP(&payloadType, "type", "t", "", "payload type, e.g. core.alert.v1")
+	cmd.Flags().StringVarP(&data, "data", "d", "", "payload as JSON or YAML")
+	cmd.Flags().StringVarP(&file, "file", "f", "", "read the payload from a file ('-' for stdin)")
+	cmd.Flags().StringArrayVar(&sets, "set", nil, "set a payload field, e.g. --set level=info (repeatable)")
+	cmd.Flags().BoolVar(&force, "force", false, "publish even if the payload type is not registered")
+	_ = cmd.MarkFlagRequired("type")
+	return cmd
+}
+
+// NewSubCmd builds the sub command that streams new messages from a channel.
+func NewSubCmd(deps core.Dependencies) *cobra.Command {
+	var opts streamOptions
+	cmd := &cobra.Command{
+		Use:   "sub <channel>",
+		Short: "Stream new messages from a channel",
+		Long: `Stream messages as they are appended to a channel until interrupted.
+
+Messages are read directly from the channel storage configured in messenger.yaml, so messages
+published by a running keyop daemon are visible and no subscriber offset is left behind.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runFollow(ctx, deps, cmd.OutOrStdout(), args[0], opts)
+		},
+	}
+	addStreamFlags(cmd, &opts)
+	return cmd
+}
+
+// NewTailCmd builds the tail command that prints the last messages stored for a channel.
+func NewTailCmd(deps core.Dependencies) *cobra.Command {
+	var (
+		opts   streamOptions
+		count  int
+		follow bool
+	)
+	cmd := &cobra.Command{
+		Use:   "tail <channel>",
+		Short: "Show the last messages of a channel",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := runTail(deps, cmd.OutOrStdout(), args[0], count, opts); err != nil {
+				return err
+			}
+			if !follow {
+				return nil
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runFollow(ctx, deps, cmd.OutOrStdout(), args[0], opts)
+		},
+	}
+	addStreamFlags(cmd, &opts)
+	cmd.Flags().IntVarP(&count, "lines", "n", 10, "number of messages to show")
+	cmd.Flags().BoolVarP(&follow, "follow", "F", false, "keep streaming new messages")
+	return cmd
+}
+
+// streamOptions holds the output format and filters shared by sub and tail.
+type streamOptions struct {
+	format string
+	types  []string
+	where  []string
+}
+
+func addStreamFlags(cmd *cobra.Command, opts *streamOptions) {
+	cmd.Flags().StringVar(&opts.format, "format", "pretty", "output format: pretty or ndjson")
+	cmd.Flags().StringArrayVar(&opts.types, "type", nil, "only show messages with this payload type (repeatable)")
+	cmd.Flags().StringArrayVar(&opts.where, "where", nil, "only show messages whose payload field equals a value, e.g. --where hostname=pi1 (repeatable)")
+}
+
+func runPub(ctx context.Context, deps core.Dependencies, channel, payloadType string, payload []byte, force bool) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+
+	value, err := decodePubPayload(payloadType, payload, force)
+	if err != nil {
+		return err
+	}
+
+	msgr, err := runtime.OpenLocalMessenger(deps)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = msgr.Close() }()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := msgr.Publish(km.WithServiceName(ctx, cliServiceName), channel, payloadType, value); err != nil {
+		return fmt.Errorf("publish to %q: %w", channel, err)
+	}
+	deps.MustGetLogger().Info("published message", "channel", channel, "type", payloadType)
+	return nil
+}
+
+// buildPubPayload reads a JSON or YAML document from input (if any), applies --set overrides,
+// and returns the result as JSON.
+func buildPubPayload(input io.Reader, sets []string) ([]byte, error) {
+	var doc interface{}
+	if input != nil {
+		raw, err := io.ReadAll(input)
+		if err != nil {
+			return nil, fmt.Errorf("read payload: %w", err)
+		}
+		if len(bytes.TrimSpace(raw)) > 0 {
+			if err := yaml.Unmarshal(raw, &doc); err != nil {
+				return nil, fmt.Errorf("parse payload: %w", err)
+			}
+		}
+	}
+
+	if len(sets) > 0 {
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("--set requires the payload to be an object")
+		}
+		for _, s := range sets {
+			key, val, found := strings.Cut(s, "=")
+			if !found || key == "" {
+				return nil, fmt.Errorf("invalid --set %q, expected key=value", s)
+			}
+			setPayloadField(obj, strings.Split(key, "."), parseSetValue(val))
+		}
+	}
+
+	if doc == nil {
+		return nil, fmt.Errorf("no payload given; use --data, --file, --set or stdin")
+	}
+	return json.Marshal(doc)
+}
+
+// parseSetValue interprets a --set value as a JSON scalar when possible, otherwise as a string.
+func parseSetValue(val string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(val), &v); err == nil {
+		return v
+	}
+	return val
+}
+
+func setPayloadField(obj map[string]interface{}, path []string, val interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			obj[key] = next
+		}
+		obj = next
+	}
+	obj[path[len(path)-1]] = val
+}
+
+// decodePubPayload decodes payload strictly into the registered prototype for payloadType.
+// Unregistered types are rejected unless force is set, in which case the raw JSON is published.
+func decodePubPayload(payloadType string, payload []byte, force bool) (interface{}, error) {
+	info, ok := core.LookupPayload(payloadType)
+	if !ok {
+		if !force {
+			return nil, fmt.Errorf("payload type %q is not registered (use --force to publish anyway)", payloadType)
+		}
+		return json.RawMessage(payload), nil
+	}
+
+	value := info.NewPrototype()
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(value); err != nil {
+		return nil, fmt.Errorf("payload does not match %s: %w", payloadType, err)
+	}
+	return value, nil
+}
+
+func runTail(deps core.Dependencies, out io.Writer, channel string, count int, opts streamOptions) error {
+	dataDir, err := messengerDataDir(deps)
+	if err != nil {
+		return err
+	}
+	msgs, err := runtime.ReadChannelMessages(dataDir, channel)
+	if err != nil {
+		return err
+	}
+
+	var matched []runtime.StoredMessage
+	for _, msg := range msgs {
+		msg.CorrelationID = core.PlainCorrelationID(msg.CorrelationID)
+		ok, err := opts.matches(msg)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matched = append(matched, msg)
+		}
+	}
+	if count >= 0 && len(matched) > count {
+		matched = matched[len(matched)-count:]
+	}
+	for _, msg := range matched {
+		if err := writeStoredMessage(out, msg, opts.format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runFollow(ctx context.Context, deps core.Dependencies, out io.Writer, channel string, opts streamOptions) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+	dataDir, err := messengerDataDir(deps)
+	if err != nil {
+		return err
+	}
+	return runtime.FollowChannel(ctx, dataDir, channel, false, followPollInterval, func(msg runtime.StoredMessage) error {
+		msg.CorrelationID = core.PlainCorrelationID(msg.CorrelationID)
+		ok, err := opts.matches(msg)
+		if err != nil || !ok {
+			return err
+		}
+		return writeStoredMessage(out, msg, opts.format)
+	})
+}
+
+func messengerDataDir(deps core.Dependencies) (string, error) {
+	cfg, err := runtime.LoadMessengerConfig(deps.MustGetLogger())
+	if err != nil {
+		return "", err
+	}
+	if cfg == nil {
+		return "", fmt.Errorf("messenger.yaml not found")
+	}
+	return cfg.Storage.DataDir, nil
+}
+
+// matches reports whether msg passes the payload type and field filters.
+func (o streamOptions) matches(msg runtime.StoredMessage) (bool, error) {
+	if len(o.types) > 0 {
+		found := false
+		for _, t := range o.types {
+			if t == msg.PayloadType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if len(o.where) == 0 {
+		return true, nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return false, nil
+	}
+	for _, w := range o.where {
+		key, want, found := strings.Cut(w, "=")
+		if !found || key == "" {
+			return false, fmt.Errorf("invalid --where %q, expected field=value", w)
+		}
+		got, ok := lookupPayloadField(payload, strings.Split(key, "."))
+		if !ok || fmt.Sprint(got) != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func lookupPayloadField(v interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func writeStoredMessage(out io.Writer, msg runtime.StoredMessage, format string) error {
+	var (
+		b   []byte
+		err error
+	)
+	switch format {
+	case "ndjson":
+		b, err = json.Marshal(msg)
+	case "pretty", "":
+		b, err = json.MarshalIndent(msg, "", "  ")
+	default:
+		return fmt.Errorf("unknown format %q (expected pretty or ndjson)", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
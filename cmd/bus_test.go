@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupBusTest writes a messenger.yaml pointing at a temporary data dir and returns deps.
+func setupBusTest(t *testing.T) core.Dependencies {
+	t.Helper()
+	confDir := t.TempDir()
+	dataDir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", confDir)
+	messengerYAML := "name: cli-test\nstorage:\n  data_dir: " + dataDir + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "messenger.yaml"), []byte(messengerYAML), 0o600))
+
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+	return deps
+}
+
+func executeBusCmd(t *testing.T, deps core.Dependencies, stdin string, args ...string) (string, error) {
+	t.Helper()
+	root := NewRootCmd(deps)
+	var out bytes.Buffer
+	root.SetOut(&out)
+	root.SetErr(&out)
+	root.SetIn(strings.NewReader(stdin))
+	root.SetArgs(args)
+	err := root.ExecuteContext(context.Background())
+	return out.String(), err
+}
+
+func TestPubAndTail(t *testing.T) {
+	deps := setupBusTest(t)
+
+	_, err := executeBusCmd(t, deps, "", "pub", "alerts", "--type", "core.alert.v1", "--data", `{"summary":"first","text":"one"}`)
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, "summary: second\ntext: two\n", "pub", "alerts", "--type", "core.alert.v1", "-f", "-", "--set", "level=warning")
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, "", "pub", "alerts", "--type", "core.alert.v1", "--set", "summary=third")
+	require.NoError(t, err)
+
+	out, err := executeBusCmd(t, deps, "", "tail", "alerts", "-n", "2", "--format", "ndjson")
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+
+	var msg struct {
+		PayloadType string          `json:"payload_type"`
+		Origin      string          `json:"origin"`
+		ServiceName string          `json:"service_name"`
+		Payload     core.AlertEvent `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &msg))
+	assert.Equal(t, "core.alert.v1", msg.PayloadType)
+	assert.Equal(t, "cli-test", msg.Origin)
+	assert.Equal(t, cliServiceName, msg.ServiceName)
+	assert.Equal(t, "second", msg.Payload.Summary)
+	assert.Equal(t, "warning", msg.Payload.Level)
+
+	out, err = executeBusCmd(t, deps, "", "tail", "alerts", "--where", "level=warning", "--format", "ndjson")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+}
+
+func TestTail_ShowsPlainCorrelationID(t *testing.T) {
+	deps := setupBusTest(t)
+
+	const stored = `{"v":1,"id":"m1","ts":"2026-01-02T10:00:00Z","channel":"switch","payload_type":"core.switch.command.v1","correlation_id":"c1;cause=m0;expires=2026-01-02T10:01:00Z","payload":{"deviceName":"lamp","state":"ON"}}` + "\n"
+	_, err := executeBusCmd(t, deps, stored, "channel", "import", "switch")
+	require.NoError(t, err)
+
+	out, err := executeBusCmd(t, deps, "", "tail", "switch", "--format", "ndjson")
+	require.NoError(t, err)
+	var msg struct {
+		CorrelationID string `json:"correlation_id"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out), &msg))
+	assert.Equal(t, "c1", msg.CorrelationID)
+
+	// exports keep the metadata so import and replay can restore it, except the expiry, which
+	// import dropped
+	out, err = executeBusCmd(t, deps, "", "channel", "export", "switch")
+	require.NoError(t, err)
+	assert.Contains(t, out, `"correlation_id":"c1;cause=m0"`)
+}
+
+func TestPub_RejectsInvalidPayload(t *testing.T) {
+	deps := setupBusTest(t)
+
+	_, err := executeBusCmd(t, deps, "", "pub", "alerts", "--type", "core.alert.v1", "--data", `{"unknownField":1}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "payload does not match core.alert.v1")
+
+	_, err = executeBusCmd(t, deps, "", "pub", "custom", "--type", "custom.thing.v1", "--data", `{"a":1}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not registered")
+
+	_, err = executeBusCmd(t, deps, "", "pub", "custom", "--type", "custom.thing.v1", "--data", `{"a":1}`, "--force")
+	assert.NoError(t, err)
+}
+
+func TestSub_StreamsNewMessages(t *testing.T) {
+	deps := setupBusTest(t)
+
+	// existing messages are not replayed by sub
+	_, err := executeBusCmd(t, deps, "", "pub", "metrics", "--type", "core.metric.v1", "--set", "name=old")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- runFollow(ctx, deps, &out, "metrics", streamOptions{format: "ndjson", types: []string{"core.metric.v1"}})
+	}()
+
+	// give the follower time to record the current end of the channel
+	time.Sleep(2 * followPollInterval)
+	_, err = executeBusCmd(t, deps, "", "pub", "metrics", "--type", "core.metric.v1", "--set", "name=new", "--set", "value=4.5")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), `"name":"new"`) }, 3*time.Second, 50*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.NotContains(t, out.String(), `"name":"old"`)
+}
+
+func TestBuildPubPayload_NestedSet(t *testing.T) {
+	payload, err := buildPubPayload(nil, []string{"a.b=1", "a.c=x", "flag=true"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a":{"b":1,"c":"x"},"flag":true}`, string(payload))
+
+	_, err = buildPubPayload(nil, nil)
+	assert.Error(t, err)
+}
+
+// syncBuffer is a bytes.Buffer safe for one writer and one reader goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+
+	"github.com/spf13/cobra"
+	km "github.com/wu/keyop-messenger"
+)
+
+// maxImportLineSize bounds a single NDJSON line read by import and replay.
+const maxImportLineSize = 16 * 1024 * 1024
+
+// NewChannelCmd builds the channel command group for exporting, importing and replaying channel traffic.
+func NewChannelCmd(deps core.Dependencies) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "channel",
+		Short: "Export, import and replay channel messages",
+		Long: `Tools for recording and reproducing channel traffic.
+
+Exports are NDJSON, one message envelope per line with its id, timestamp (ts), origin,
+payload_type, correlation_id, service_name and payload. The same format is accepted by import
+and replay.`,
+	}
+	cmd.AddCommand(newChannelExportCmd(deps))
+	cmd.AddCommand(newChannelImportCmd(deps))
+	cmd.AddCommand(newChannelReplayCmd(deps))
+	return cmd
+}
+
+// timeRange is an optional [since, until) filter on message timestamps.
+type timeRange struct {
+	since time.Time
+	until time.Time
+}
+
+func (r timeRange) contains(ts time.Time) bool {
+	if !r.since.IsZero() && ts.Before(r.since) {
+		return false
+	}
+	if !r.until.IsZero() && !ts.Before(r.until) {
+		return false
+	}
+	return true
+}
+
+// parseTimeRange parses --since/--until values. Each may be an RFC 3339 timestamp or a duration
+// such as 2h, meaning that long before now.
+func parseTimeRange(since, until string, now time.Time) (timeRange, error) {
+	var r timeRange
+	var err error
+	if r.since, err = parseTimeFlag(since, now); err != nil {
+		return r, fmt.Errorf("invalid --since: %w", err)
+	}
+	if r.until, err = parseTimeFlag(until, now); err != nil {
+		return r, fmt.Errorf("invalid --until: %w", err)
+	}
+	if !r.since.IsZero() && !r.until.IsZero() && !r.since.Before(r.until) {
+		return r, fmt.Errorf("--since must be before --until")
+	}
+	return r, nil
+}
+
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", value)
+	}
+	return now.Add(-d), nil
+}
+
+func addTimeRangeFlags(cmd *cobra.Command, since, until *string) {
+	cmd.Flags().StringVar(since, "since", "", "only messages at or after this time (RFC 3339, or a duration ago such as 2h)")
+	cmd.Flags().StringVar(until, "until", "", "only messages before this time (RFC 3339, or a duration ago such as 30m)")
+}
+
+func newChannelExportCmd(deps core.Dependencies) *cobra.Command {
+	var since, until, output string
+	cmd := &cobra.Command{
+		Use:   "export <channel>",
+		Short: "Write a channel's stored messages to NDJSON",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r, err := parseTimeRange(since, until, time.Now())
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if output != "" && output != "-" {
+				f, err := os.Create(output) //nolint:gosec // operator-supplied export path
+				if err != nil {
+					return fmt.Errorf("create export file: %w", err)
+				}
+				defer func() { _ = f.Close() }()
+				out = f
+			}
+			return runExport(deps, out, args[0], r)
+		},
+	}
+	addTimeRangeFlags(cmd, &since, &until)
+	cmd.Flags().StringVar(&output, "output", "", "write to a file instead of stdout")
+	return cmd
+}
+
+func newChannelImportCmd(deps core.Dependencies) *cobra.Command {
+	var file string
+	cmd := &cobra.Command{
+		Use:   "import <channel>",
+		Short: "Publish messages from an NDJSON export into a channel",
+		Long: `Publish every message in an NDJSON export into a channel, in file order and without delay.
+
+Payload, payload type, correlation id and service name are preserved. The messenger assigns a
+new id, timestamp and origin to each imported message.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, closeFn, err := openNDJSONInput(cmd, file)
+			if err != nil {
+				return err
+			}
+			defer closeFn()
+			msgs, err := readNDJSONMessages(in)
+			if err != nil {
+				return err
+			}
+			return runReplay(cmd.Context(), deps, args[0], msgs, 0)
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "-", "NDJSON file to import ('-' for stdin)")
+	return cmd
+}
+
+func newChannelReplayCmd(deps core.Dependencies) *cobra.Command {
+	var (
+		file, source string
+		since, until string
+		speed        float64
+	)
+	cmd := &cobra.Command{
+		Use:   "replay <target-channel>",
+		Short: "Re-publish recorded messages with their original timing",
+		Long: `Re-publish recorded messages into a target channel, preserving the gaps between their
+original timestamps.
+
+Messages come from an NDJSON export (--file) or directly from another channel's storage
+(--source). --speed scales the timing: 1 is real time, 10 is ten times faster, and 0 publishes
+as fast as possible.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if speed < 0 {
+				return fmt.Errorf("--speed must not be negative")
+			}
+			r, err := parseTimeRange(since, until, time.Now())
+			if err != nil {
+				return err
+			}
+
+			var msgs []runtime.StoredMessage
+			switch {
+			case source != "" && file != "":
+				return fmt.Errorf("use either --file or --source, not both")
+			case source != "":
+				dataDir, err := messengerDataDir(deps)
+				if err != nil {
+					return err
+				}
+				if msgs, err = runtime.ReadChannelMessages(dataDir, source); err != nil {
+					return err
+				}
+			default:
+				in, closeFn, err := openNDJSONInput(cmd, file)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				if msgs, err = readNDJSONMessages(in); err != nil {
+					return err
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runReplay(ctx, deps, args[0], filterTimeRange(msgs, r), speed)
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "NDJSON file to replay ('-' for stdin, the default)")
+	cmd.Flags().StringVar(&source, "source", "", "replay messages stored in this channel instead of a file")
+	cmd.Flags().Float64Var(&speed, "speed", 1, "timing multiplier; 0 disables delays")
+	addTimeRangeFlags(cmd, &since, &until)
+	return cmd
+}
+
+func runExport(deps core.Dependencies, out io.Writer, channel string, r timeRange) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+	dataDir, err := messengerDataDir(deps)
+	if err != nil {
+		return err
+	}
+	msgs, err := runtime.ReadChannelMessages(dataDir, channel)
+	if err != nil {
+		return err
+	}
+
+	// Correlation IDs are exported as stored, so import and replay keep the messages' metadata;
+	// only the expiry is dropped when they are published again.
+	w := bufio.NewWriter(out)
+	count := 0
+	for _, msg := range filterTimeRange(msgs, r) {
+		if err := writeStoredMessage(w, msg, "ndjson"); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	deps.MustGetLogger().Info("exported messages", "channel", channel, "count", count)
+	return nil
+}
+
+// runReplay publishes msgs to channel in order. When speed is positive it waits between messages
+// for the gap between their original timestamps divided by speed.
+func runReplay(ctx context.Context, deps core.Dependencies, channel string, msgs []runtime.StoredMessage, speed float64) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+	msgr, err := runtime.OpenLocalMessenger(deps)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = msgr.Close() }()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for i, msg := range msgs {
+		if speed > 0 && i > 0 {
+			if gap := msg.Timestamp.Sub(msgs[i-1].Timestamp); gap > 0 {
+				if err := replaySleep(ctx, time.Duration(float64(gap)/speed)); err != nil {
+					deps.MustGetLogger().Info("replay interrupted", "channel", channel, "published", i)
+					return nil
+				}
+			}
+		}
+		if err := publishStoredMessage(ctx, msgr, channel, msg); err != nil {
+			return err
+		}
+	}
+	deps.MustGetLogger().Info("replayed messages", "channel", channel, "count", len(msgs))
+	return nil
+}
+
+// publishStoredMessage re-publishes a recorded message, keeping its payload bytes, payload type,
+// correlation id and service name. The expiry recorded in the correlation id is dropped, since it
+// would have passed by the time the copy is delivered.
+func publishStoredMessage(ctx context.Context, msgr *km.Messenger, channel string, msg runtime.StoredMessage) error {
+	if msg.PayloadType == "" {
+		return fmt.Errorf("message %q has no payload_type", msg.ID)
+	}
+	if correlationID := core.WithoutExpiry(msg.CorrelationID); correlationID != "" {
+		ctx = km.WithCorrelationID(ctx, correlationID)
+	}
+	serviceName := msg.ServiceName
+	if serviceName == "" {
+		serviceName = cliServiceName
+	}
+	ctx = km.WithServiceName(ctx, serviceName)
+
+	payload := msg.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+	if err := msgr.Publish(ctx, channel, msg.PayloadType, payload); err != nil {
+		return fmt.Errorf("publish %q to %q: %w", msg.ID, channel, err)
+	}
+	return nil
+}
+
+// replaySleep waits for d or until ctx is done. Tests replace it to avoid real delays.
+var replaySleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func filterTimeRange(msgs []runtime.StoredMessage, r timeRange) []runtime.StoredMessage {
+	var out []runtime.StoredMessage
+	for _, msg := range msgs {
+		if r.contains(msg.Timestamp) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func openNDJSONInput(cmd *cobra.Command, file string) (io.Reader, func(), error) {
+	if file == "" || file == "-" {
+		return cmd.InOrStdin(), func() {}, nil
+	}
+	f, err := os.Open(file) //nolint:gosec // operator-supplied export file
+	if err != nil {
+		return nil, nil, fmt.Errorf("open %q: %w", file, err)
+	}
+	return f, func() { _ = f.Close() }, nil
+}
+
+// readNDJSONMessages parses one StoredMessage per non-empty line.
+func readNDJSONMessages(in io.Reader) ([]runtime.StoredMessage, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	var msgs []runtime.StoredMessage
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var msg runtime.StoredMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read NDJSON: %w", err)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+const channelTestExport = `{"v":1,"id":"m1","ts":"2026-01-02T10:00:00Z","channel":"temps","origin":"pi1","payload_type":"core.metric.v1","correlation_id":"c1","payload":{"name":"temp","value":20}}
+{"v":1,"id":"m2","ts":"2026-01-02T10:00:02Z","channel":"temps","origin":"pi1","payload_type":"core.metric.v1","payload":{"name":"temp","value":21}}
+
+{"v":1,"id":"m3","ts":"2026-01-02T10:00:07Z","channel":"temps","origin":"pi2","payload_type":"core.metric.v1","service_name":"thermo","payload":{"name":"temp","value":22}}
+`
+
+func TestChannelImportAndExport(t *testing.T) {
+	deps := setupBusTest(t)
+
+	_, err := executeBusCmd(t, deps, channelTestExport, "channel", "import", "temps")
+	require.NoError(t, err)
+
+	out, err := executeBusCmd(t, deps, "", "channel", "export", "temps")
+	require.NoError(t, err)
+	msgs, err := readNDJSONMessages(strings.NewReader(out))
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+
+	assert.Equal(t, "core.metric.v1", msgs[0].PayloadType)
+	assert.Equal(t, "cli-test", msgs[0].Origin)
+	assert.Equal(t, "c1", msgs[0].CorrelationID)
+	assert.Equal(t, cliServiceName, msgs[0].ServiceName)
+	assert.Equal(t, "thermo", msgs[2].ServiceName)
+	assert.JSONEq(t, `{"name":"temp","value":22}`, string(msgs[2].Payload))
+	assert.NotEmpty(t, msgs[0].ID)
+	assert.False(t, msgs[0].Timestamp.IsZero())
+
+	// everything was just imported, so a window ending an hour ago is empty
+	out, err = executeBusCmd(t, deps, "", "channel", "export", "temps", "--until", "1h")
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestChannelReplay_ScalesTiming(t *testing.T) {
+	deps := setupBusTest(t)
+
+	var waits []time.Duration
+	orig := replaySleep
+	replaySleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	t.Cleanup(func() { replaySleep = orig })
+
+	_, err := executeBusCmd(t, deps, channelTestExport, "channel", "replay", "temps-replay", "--speed", "2")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2500 * time.Millisecond}, waits)
+
+	out, err := executeBusCmd(t, deps, "", "tail", "temps-replay", "--format", "ndjson")
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(out, "\n"))
+
+	// replay straight from stored channel data without delays
+	waits = nil
+	_, err = executeBusCmd(t, deps, "", "channel", "replay", "temps-copy", "--source", "temps-replay", "--speed", "0")
+	require.NoError(t, err)
+	assert.Empty(t, waits)
+	out, err = executeBusCmd(t, deps, "", "tail", "temps-copy", "--format", "ndjson")
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(out, "\n"))
+}
+
+func TestChannelReplay_DropsExpiry(t *testing.T) {
+	deps := setupBusTest(t)
+	export := `{"v":1,"id":"m1","ts":"2020-01-01T00:00:00Z","channel":"cmds","payload_type":"core.metric.v1","correlation_id":"c1;cause=m0;expires=2020-01-01T00:00:30Z","payload":{"name":"temp","value":20}}` + "\n"
+	_, err := executeBusCmd(t, deps, export, "channel", "replay", "cmds", "--speed", "0")
+	require.NoError(t, err)
+
+	dataDir, err := messengerDataDir(deps)
+	require.NoError(t, err)
+	stored, err := runtime.ReadChannelMessages(dataDir, "cmds")
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.Equal(t, "c1;cause=m0", stored[0].CorrelationID, "the chain is kept without the expiry")
+
+	// a subscriber that skips expired messages gets the replayed copy
+	fake := testutil.NewFakeMessenger()
+	m := core.NewExpiryMessenger(fake, core.ServiceConfig{Name: "switch"}, &testutil.FakeLogger{})
+	delivered := 0
+	require.NoError(t, m.Subscribe(context.Background(), "cmds", "switch", func(context.Context, km.Message) error {
+		delivered++
+		return nil
+	}))
+	msg := km.Message{ID: stored[0].ID, Channel: "cmds", PayloadType: stored[0].PayloadType, CorrelationID: stored[0].CorrelationID, Timestamp: stored[0].Timestamp}
+	require.NoError(t, fake.Handlers["cmds"](context.Background(), msg))
+	assert.Equal(t, 1, delivered)
+	assert.Empty(t, m.Skipped())
+}
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	r, err := parseTimeRange("2026-01-02T10:00:00Z", "1h", now)
+	require.NoError(t, err)
+	assert.True(t, r.contains(time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)))
+	assert.False(t, r.contains(time.Date(2026, 1, 2, 11, 0, 0, 0, time.UTC)))
+	assert.False(t, r.contains(time.Date(2026, 1, 2, 9, 59, 59, 0, time.UTC)))
+
+	_, err = parseTimeRange("1h", "2h", now)
+	assert.Error(t, err)
+	_, err = parseTimeRange("yesterday", "", now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+
+	"github.com/spf13/cobra"
+	km "github.com/wu/keyop-messenger"
+)
+
+// deadLetterEntry is a dead letter together with the id of the message that carried it and the
+// channel it is stored on.
+type deadLetterEntry struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"ts"`
+	Source    string    `json:"source"`
+	core.DeadLetterEvent
+}
+
+// NewDeadLetterCmd builds the deadletter command group for inspecting and re-driving failed messages.
+func NewDeadLetterCmd(deps core.Dependencies) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deadletter",
+		Short: "Inspect and re-drive dead-lettered messages",
+		Long: `Messages whose handlers keep failing are published to the "` + core.DeadLetterChannel + `" channel with the
+original envelope and the last error. Messages that still fail in handlers outside that policy,
+or whose dead letter could not be published, are dead-lettered by the messenger itself to a
+"<channel>` + runtime.MessengerDeadLetterSuffix + `" channel after its own retries (subscribers.max_retries). These
+commands read both from the storage configured in messenger.yaml; the SUBSCRIBER column is empty
+for the messenger's records, which do not name one.`,
+	}
+
+	var channel, format string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List dead-lettered messages",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			entries, err := readDeadLetters(deps, channel)
+			if err != nil {
+				return err
+			}
+			return writeDeadLetterList(cmd.OutOrStdout(), entries, format)
+		},
+	}
+	listCmd.Flags().StringVar(&channel, "channel", "", "only show messages that failed on this channel")
+	listCmd.Flags().StringVar(&format, "format", "table", "output format: table or ndjson")
+
+	showCmd := &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a dead-lettered message with its payload and error",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := readDeadLetters(deps, "")
+			if err != nil {
+				return err
+			}
+			entry, err := findDeadLetter(entries, args[0])
+			if err != nil {
+				return err
+			}
+			b, err := json.MarshalIndent(entry, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			return err
+		},
+	}
+
+	var (
+		all          bool
+		redriveChan  string
+		redriveTo    string
+		redriveForce bool
+	)
+	redriveCmd := &cobra.Command{
+		Use:   "redrive [id...]",
+		Short: "Re-publish dead-lettered messages to their original channel",
+		Long: `Re-publish dead-lettered messages with their original payload, payload type, correlation id
+and service name. Every subscriber of the target channel receives the message again, not only
+the one that failed. The dead-letter records are kept.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return fmt.Errorf("give message ids or --all")
+			}
+			entries, err := readDeadLetters(deps, redriveChan)
+			if err != nil {
+				return err
+			}
+			selected := entries
+			if !all {
+				selected = nil
+				for _, id := range args {
+					entry, err := findDeadLetter(entries, id)
+					if err != nil {
+						return err
+					}
+					selected = append(selected, entry)
+				}
+			}
+			return runRedrive(cmd, deps, selected, redriveTo, redriveForce)
+		},
+	}
+	redriveCmd.Flags().BoolVar(&all, "all", false, "re-drive every dead-lettered message (combine with --channel to narrow)")
+	redriveCmd.Flags().StringVar(&redriveChan, "channel", "", "only re-drive messages that failed on this channel")
+	redriveCmd.Flags().StringVar(&redriveTo, "to", "", "publish to this channel instead of the original one")
+	redriveCmd.Flags().BoolVar(&redriveForce, "force", false, "also re-drive messages that were already re-driven")
+
+	cmd.AddCommand(listCmd, showCmd, redriveCmd)
+	return cmd
+}
+
+// readDeadLetters returns the stored dead letters from the core dead-letter channel and the
+// messenger's <channel>.dead-letter channels, oldest first, optionally for one channel.
+func readDeadLetters(deps core.Dependencies, channel string) ([]deadLetterEntry, error) {
+	dataDir, err := messengerDataDir(deps)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := runtime.ReadChannelMessages(dataDir, core.DeadLetterChannel)
+	if err != nil {
+		return nil, err
+	}
+	var entries []deadLetterEntry
+	for _, msg := range msgs {
+		if msg.PayloadType != core.PayloadTypeOf[core.DeadLetterEvent]() {
+			continue
+		}
+		var ev core.DeadLetterEvent
+		if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+			continue
+		}
+		if channel != "" && ev.Channel != channel {
+			continue
+		}
+		entries = append(entries, deadLetterEntry{ID: msg.ID, Timestamp: msg.Timestamp, Source: core.DeadLetterChannel, DeadLetterEvent: ev})
+	}
+
+	channels, err := runtime.ListChannels(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range channels {
+		failed, ok := strings.CutSuffix(source, runtime.MessengerDeadLetterSuffix)
+		if !ok || (channel != "" && failed != channel) {
+			continue
+		}
+		msgs, err := runtime.ReadChannelMessages(dataDir, source)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.PayloadType != runtime.MessengerDeadLetterPayloadType {
+				continue
+			}
+			var dl runtime.MessengerDeadLetter
+			if err := json.Unmarshal(msg.Payload, &dl); err != nil {
+				continue
+			}
+			entries = append(entries, deadLetterEntry{ID: msg.ID, Timestamp: msg.Timestamp, Source: source, DeadLetterEvent: messengerDeadLetterEvent(failed, dl)})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	return entries, nil
+}
+
+// messengerDeadLetterEvent converts a record the messenger dead-lettered from channel.
+func messengerDeadLetterEvent(channel string, dl runtime.MessengerDeadLetter) core.DeadLetterEvent {
+	return core.DeadLetterEvent{
+		Channel:          channel,
+		MessageID:        dl.Original.ID,
+		Origin:           dl.Original.Origin,
+		OriginalType:     dl.Original.PayloadType,
+		CorrelationID:    dl.Original.CorrelationID,
+		ServiceName:      dl.Original.ServiceName,
+		MessageTimestamp: dl.Original.Timestamp,
+		Payload:          dl.Original.Payload,
+		Error:            dl.LastError,
+		Attempts:         dl.Retries + 1,
+		FailedAt:         dl.FailedAt,
+	}
+}
+
+// findDeadLetter matches a full id or a unique id prefix.
+func findDeadLetter(entries []deadLetterEntry, id string) (deadLetterEntry, error) {
+	var found []deadLetterEntry
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+		if strings.HasPrefix(e.ID, id) {
+			found = append(found, e)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return deadLetterEntry{}, fmt.Errorf("no dead letter with id %q", id)
+	case 1:
+		return found[0], nil
+	default:
+		return deadLetterEntry{}, fmt.Errorf("id prefix %q matches %d dead letters", id, len(found))
+	}
+}
+
+// redrivenServiceName is stamped on re-drive records.
+const redrivenServiceName = cliServiceName + "-redrive"
+
+func runRedrive(cmd *cobra.Command, deps core.Dependencies, entries []deadLetterEntry, to string, force bool) error {
+	if to != "" {
+		if err := km.ValidateChannelName(to); err != nil {
+			return err
+		}
+	}
+
+	msgr, err := runtime.OpenLocalMessenger(deps)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = msgr.Close() }()
+
+	redriven, err := redrivenMessageIDs(deps)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, e := range entries {
+		if redriven[e.ID] && !force {
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "skipped %s (already re-driven)\n", e.ID)
+			continue
+		}
+		target := e.Channel
+		if to != "" {
+			target = to
+		}
+		stored := runtime.StoredMessage{
+			ID:            e.MessageID,
+			PayloadType:   e.OriginalType,
+			CorrelationID: e.CorrelationID,
+			ServiceName:   e.ServiceName,
+			Payload:       e.Payload,
+		}
+		if err := publishStoredMessage(cmd.Context(), msgr, target, stored); err != nil {
+			return err
+		}
+		// record the re-drive so later runs skip this dead letter
+		if err := msgr.Publish(km.WithServiceName(cmd.Context(), redrivenServiceName), deadLetterRedriveChannel, "core.deadletter.redrive.v1", map[string]string{"id": e.ID, "channel": target}); err != nil {
+			return fmt.Errorf("record re-drive of %s: %w", e.ID, err)
+		}
+		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "re-drove %s to %s\n", e.ID, target)
+		count++
+	}
+	deps.MustGetLogger().Info("re-drove dead letters", "count", count)
+	return nil
+}
+
+// deadLetterRedriveChannel records which dead letters were re-driven so repeated runs skip them.
+const deadLetterRedriveChannel = core.DeadLetterChannel + "-redriven"
+
+func redrivenMessageIDs(deps core.Dependencies) (map[string]bool, error) {
+	dataDir, err := messengerDataDir(deps)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := runtime.ReadChannelMessages(dataDir, deadLetterRedriveChannel)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, msg := range msgs {
+		var rec struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(msg.Payload, &rec) == nil && rec.ID != "" {
+			ids[rec.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+func writeDeadLetterList(out io.Writer, entries []deadLetterEntry, format string) error {
+	switch format {
+	case "ndjson":
+		for _, e := range entries {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(out, string(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "table", "":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "ID\tFAILED AT\tCHANNEL\tSUBSCRIBER\tTYPE\tATTEMPTS\tERROR")
+		for _, e := range entries {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				e.ID, e.FailedAt.Local().Format(time.RFC3339), e.Channel, e.SubscriberID, e.OriginalType, e.Attempts, truncate(e.Error, 60))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q (expected table or ndjson)", format)
+	}
+}
+
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const deadLetterTestData = `{"v":1,"id":"dl-a1","ts":"2026-01-02T10:00:00Z","channel":"deadletter","origin":"pi1","payload_type":"core.deadletter.v1","payload":{"channel":"temps","subscriberId":"archiver","messageId":"m1","originalPayloadType":"core.metric.v1","correlationId":"c1","serviceName":"thermo","messageTimestamp":"2026-01-02T09:59:59Z","payload":{"name":"temp","value":20},"error":"disk full","attempts":4,"failedAt":"2026-01-02T10:00:00Z"}}
+{"v":1,"id":"dl-b2","ts":"2026-01-02T10:00:05Z","channel":"deadletter","origin":"pi1","payload_type":"core.deadletter.v1","payload":{"channel":"alerts","subscriberId":"notifier","messageId":"m2","originalPayloadType":"core.alert.v1","messageTimestamp":"2026-01-02T10:00:04Z","payload":{"summary":"hot"},"error":"smtp timeout","attempts":4,"failedAt":"2026-01-02T10:00:05Z"}}
+`
+
+func TestDeadLetterListAndShow(t *testing.T) {
+	deps := setupBusTest(t)
+	_, err := executeBusCmd(t, deps, deadLetterTestData, "channel", "import", "deadletter")
+	require.NoError(t, err)
+
+	out, err := executeBusCmd(t, deps, "", "deadletter", "list")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[1], "temps")
+	assert.Contains(t, lines[1], "disk full")
+	assert.Contains(t, lines[2], "smtp timeout")
+
+	out, err = executeBusCmd(t, deps, "", "deadletter", "list", "--channel", "alerts", "--format", "ndjson")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+	assert.Contains(t, out, `"subscriberId":"notifier"`)
+
+	entries, err := readDeadLetters(deps, "temps")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	out, err = executeBusCmd(t, deps, "", "deadletter", "show", entries[0].ID)
+	require.NoError(t, err)
+	assert.Contains(t, out, `"originalPayloadType": "core.metric.v1"`)
+	assert.Contains(t, out, `"error": "disk full"`)
+
+	_, err = executeBusCmd(t, deps, "", "deadletter", "show", "no-such-id")
+	assert.ErrorContains(t, err, "no dead letter")
+}
+
+func TestDeadLetterRedrive(t *testing.T) {
+	deps := setupBusTest(t)
+	_, err := executeBusCmd(t, deps, deadLetterTestData, "channel", "import", "deadletter")
+	require.NoError(t, err)
+
+	_, err = executeBusCmd(t, deps, "", "deadletter", "redrive")
+	assert.ErrorContains(t, err, "--all")
+
+	out, err := executeBusCmd(t, deps, "", "deadletter", "redrive", "--all", "--channel", "temps")
+	require.NoError(t, err)
+	assert.Contains(t, out, "to temps")
+
+	stored, err := executeBusCmd(t, deps, "", "channel", "export", "temps")
+	require.NoError(t, err)
+	msgs, err := readNDJSONMessages(strings.NewReader(stored))
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "core.metric.v1", msgs[0].PayloadType)
+	assert.Equal(t, "c1", msgs[0].CorrelationID)
+	assert.Equal(t, "thermo", msgs[0].ServiceName)
+	assert.JSONEq(t, `{"name":"temp","value":20}`, string(msgs[0].Payload))
+
+	// a second run skips what was already re-driven unless forced
+	out, err = executeBusCmd(t, deps, "", "deadletter", "redrive", "--all", "--channel", "temps")
+	require.NoError(t, err)
+	assert.Contains(t, out, "skipped")
+
+	out, err = executeBusCmd(t, deps, "", "deadletter", "redrive", "--all", "--channel", "temps", "--force", "--to", "temps-retry")
+	require.NoError(t, err)
+	assert.Contains(t, out, "to temps-retry")
+}
+
+// messengerDeadLetterTestData is a record keyop-messenger wrote after its own retries.
+const messengerDeadLetterTestData = `{"v":1,"id":"dl-c3","ts":"2026-01-02T10:00:03Z","channel":"temps.dead-letter","origin":"pi1","payload_type":"com.keyop.messenger.DeadLetterPayload","payload":{"original":{"v":1,"id":"m3","ts":"2026-01-02T10:00:02Z","channel":"temps","origin":"pi1","payload_type":"core.metric.v1","correlation_id":"c3","payload":{"name":"temp","value":23}},"retries":5,"last_error":"publish dead letter: closed","failed_at":"2026-01-02T10:00:03Z"}}
+`
+
+func TestDeadLetter_ReadsMessengerDeadLetters(t *testing.T) {
+	deps := setupBusTest(t)
+	_, err := executeBusCmd(t, deps, deadLetterTestData, "channel", "import", "deadletter")
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, messengerDeadLetterTestData, "channel", "import", "temps.dead-letter")
+	require.NoError(t, err)
+
+	entries, err := readDeadLetters(deps, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	got := entries[2] // imported last, so the newest
+	assert.Equal(t, "temps.dead-letter", got.Source)
+	assert.Equal(t, "temps", got.Channel)
+	assert.Equal(t, "m3", got.MessageID)
+	assert.Equal(t, "c3", got.CorrelationID)
+	assert.Equal(t, 6, got.Attempts)
+	assert.Equal(t, "publish dead letter: closed", got.Error)
+
+	out, err := executeBusCmd(t, deps, "", "deadletter", "list", "--channel", "temps")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 3)
+	assert.Contains(t, out, "publish dead letter")
+
+	out, err = executeBusCmd(t, deps, "", "deadletter", "redrive", got.ID)
+	require.NoError(t, err)
+	assert.Contains(t, out, "to temps")
+	stored, err := executeBusCmd(t, deps, "", "channel", "export", "temps")
+	require.NoError(t, err)
+	msgs, err := readNDJSONMessages(strings.NewReader(stored))
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "c3", msgs[0].CorrelationID)
+	assert.JSONEq(t, `{"name":"temp","value":23}`, string(msgs[0].Payload))
+}
+
+func TestFindDeadLetter_Prefix(t *testing.T) {
+	entries := []deadLetterEntry{{ID: "abc1"}, {ID: "abc2"}, {ID: "def"}}
+	e, err := findDeadLetter(entries, "de")
+	require.NoError(t, err)
+	assert.Equal(t, "def", e.ID)
+	_, err = findDeadLetter(entries, "abc")
+	assert.ErrorContains(t, err, "matches 2")
+}
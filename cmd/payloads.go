@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/spf13/cobra"
+)
+
+// NewPayloadsCmd builds the payloads command for browsing the registered payload types.
+func NewPayloadsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "payloads",
+		Short: "List and describe registered message payload types",
+		Long: `Browse the payload types known to this keyop build: core event types and the types
+registered by each compiled-in service. Schemas are generated from the Go struct definitions.`,
+	}
+
+	var format string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registered payload types",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return writePayloadList(cmd.OutOrStdout(), core.Payloads(), format)
+		},
+	}
+	listCmd.Flags().StringVar(&format, "format", "table", "output format: table or json")
+
+	showCmd := &cobra.Command{
+		Use:   "show <payload-type>",
+		Short: "Show a payload type's metadata and fields",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := lookupPayloadArg(args[0])
+			if err != nil {
+				return err
+			}
+			return writePayloadDetails(cmd.OutOrStdout(), info)
+		},
+	}
+
+	schemaCmd := &cobra.Command{
+		Use:   "schema <payload-type>",
+		Short: "Print a payload type's JSON Schema",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := lookupPayloadArg(args[0])
+			if err != nil {
+				return err
+			}
+			b, err := json.MarshalIndent(info.JSONSchema(), "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			return err
+		},
+	}
+
+	cmd.AddCommand(listCmd, showCmd, schemaCmd)
+	return cmd
+}
+
+func lookupPayloadArg(name string) (core.PayloadInfo, error) {
+	info, ok := core.LookupPayload(name)
+	if !ok {
+		return info, fmt.Errorf("unknown payload type %q (see 'keyop payloads list')", name)
+	}
+	return info, nil
+}
+
+func writePayloadList(out io.Writer, payloads []core.PayloadInfo, format string) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(payloads, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(b))
+		return err
+	case "table", "":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "NAME\tVERSION\tSERVICE\tGO TYPE\tDESCRIPTION")
+		for _, p := range payloads {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", p.Name, p.Version, p.Service, p.GoType, p.Description)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q (expected table or json)", format)
+	}
+}
+
+func writePayloadDetails(out io.Writer, info core.PayloadInfo) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	_, _ = fmt.Fprintf(w, "Version:\t%d\n", info.Version)
+	_, _ = fmt.Fprintf(w, "Service:\t%s\n", info.Service)
+	_, _ = fmt.Fprintf(w, "Go type:\t%s\n", info.GoType)
+	_, _ = fmt.Fprintf(w, "Description:\t%s\n", info.Description)
+	if conv := core.PayloadConversions(info.Name); len(conv) > 0 {
+		_, _ = fmt.Fprintf(w, "Converts to:\t%s\n", strings.Join(conv, ", "))
+	}
+	_, _ = fmt.Fprintln(w)
+
+	schema := info.JSONSchema()
+	props, _ := schema["properties"].(map[string]any)
+	required := map[string]bool{}
+	if req, ok := schema["required"].([]string); ok {
+		for _, r := range req {
+			required[r] = true
+		}
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, _ = fmt.Fprintln(w, "FIELD\tTYPE\tREQUIRED")
+	for _, name := range names {
+		prop, _ := props[name].(map[string]any)
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%t\n", name, schemaTypeLabel(prop), required[name])
+	}
+	return w.Flush()
+}
+
+// schemaTypeLabel summarizes a property schema as a short type name.
+func schemaTypeLabel(prop map[string]any) string {
+	typ, _ := prop["type"].(string)
+	switch {
+	case typ == "":
+		return "any"
+	case typ == "array":
+		items, _ := prop["items"].(map[string]any)
+		return "[]" + schemaTypeLabel(items)
+	case prop["format"] != nil:
+		return fmt.Sprintf("%s (%v)", typ, prop["format"])
+	default:
+		return typ
+	}
+}
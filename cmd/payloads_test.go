@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadsCmd(t *testing.T) {
+	deps := setupBusTest(t)
+
+	out, err := executeBusCmd(t, deps, "", "payloads", "list", "--format", "json")
+	require.NoError(t, err)
+	var listed []core.PayloadInfo
+	require.NoError(t, json.Unmarshal([]byte(out), &listed))
+	assert.NotEmpty(t, listed)
+
+	out, err = executeBusCmd(t, deps, "", "payloads", "show", "core.metric.v1")
+	require.NoError(t, err)
+	assert.Contains(t, out, "core.MetricEvent")
+	assert.Regexp(t, `value\s+number\s+true`, out)
+
+	out, err = executeBusCmd(t, deps, "", "payloads", "schema", "core.metric.v1")
+	require.NoError(t, err)
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out), &schema))
+	assert.Equal(t, "core.metric.v1", schema["$id"])
+
+	_, err = executeBusCmd(t, deps, "", "payloads", "schema", "missing.v1")
+	assert.Error(t, err)
+}
@@ -27,6 +27,16 @@ func NewRootCmd(deps core.Dependencies) *cobra.Command {
 	rootCmd.AddCommand(systemctl.NewCmd(deps))
 	rootCmd.AddCommand(NewSelfUpdateCmd(deps))
 	rootCmd.AddCommand(NewVersionCmd())
+	rootCmd.AddCommand(NewPubCmd(deps))
+	rootCmd.AddCommand(NewSubCmd(deps))
+	rootCmd.AddCommand(NewTailCmd(deps))
+	rootCmd.AddCommand(NewChannelCmd(deps))
+	rootCmd.AddCommand(NewPayloadsCmd())
+	rootCmd.AddCommand(NewDeadLetterCmd(deps))
+	rootCmd.AddCommand(NewStateCmd(deps))
+	rootCmd.AddCommand(NewBackupCmd(deps))
+	rootCmd.AddCommand(NewRestoreCmd(deps))
+	rootCmd.AddCommand(NewTasksCmd(deps))
 
 	return rootCmd
 }
@@ -3,4 +3,5 @@ package cmd
 
 import (
 	_ "github.com/wu/keyop/services/heartbeat"
+	_ "github.com/wu/keyop/services/router"
 )
@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// NewStateCmd builds the state command group for managing the service state store.
+func NewStateCmd(deps core.Dependencies) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Manage the service state store",
+		Long: `Services persist state in the store selected with state.backend in messenger.yaml: one JSON
+file per key under ~/.keyop/data (file, the default) or a single SQLite database (sqlite).
+
+Each service keeps its keys under service/<name>/ and the kernel keeps its own, such as when a
+service last ran, under kernel/. Keys are given in full to these commands.`,
+	}
+
+	var from, to string
+	var overwrite bool
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Import state files into the SQLite state store",
+		Long: `Copy every state_*.json file from the file store's data directory into the SQLite database
+in one transaction. Keys already in the database are kept unless --overwrite is given, and the
+files are left in place. Set state.backend to sqlite in messenger.yaml afterwards, and run this
+while keyop is stopped.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if to == "" {
+				cfg, err := runtime.LoadStateConfig(deps.MustGetLogger())
+				if err != nil {
+					return err
+				}
+				to = cfg.Path
+			}
+			store, err := adapter.NewSQLiteStateStore(to)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = store.Close() }()
+
+			res, err := store.ImportFiles(from, overwrite)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, name := range res.Invalid {
+				_, _ = fmt.Fprintf(out, "skipped %s: not valid JSON\n", name)
+			}
+			for _, key := range res.Skipped {
+				_, _ = fmt.Fprintf(out, "skipped %s: already in the database\n", key)
+			}
+			_, err = fmt.Fprintf(out, "imported %d keys from %s into %s\n", len(res.Imported), from, to)
+			return err
+		},
+	}
+	migrateCmd.Flags().StringVar(&from, "from", runtime.StateDataDir(), "directory holding the state files")
+	migrateCmd.Flags().StringVar(&to, "to", "", "SQLite database (default state.path from messenger.yaml)")
+	migrateCmd.Flags().BoolVar(&overwrite, "overwrite", false, "replace keys that are already in the database")
+
+	cmd.AddCommand(migrateCmd)
+	cmd.AddCommand(newStateInspectCmds(deps)...)
+	return cmd
+}
+
+// withStateStore opens the configured state store, which must support listing keys, and runs fn
+// with it.
+func withStateStore(deps core.Dependencies, fn func(core.ExtendedStateStoreApi) error) error {
+	store, closeStore, err := runtime.OpenStateStore(deps)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = closeStore() }()
+	if store == nil {
+		return errors.New("no state store configured")
+	}
+	ext, ok := store.(core.ExtendedStateStoreApi)
+	if !ok {
+		return core.ErrStateNotExtended
+	}
+	return fn(ext)
+}
+
+// loadRawState returns the JSON stored under key, or nil when the key is missing.
+func loadRawState(store core.StateStoreApi, key string) (json.RawMessage, error) {
+	var value json.RawMessage
+	if err := store.Load(key, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// readStateInput reads from stdin for "-" and from the named file otherwise.
+func readStateInput(cmd *cobra.Command, name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(cmd.InOrStdin())
+	}
+	return os.ReadFile(name) //nolint:gosec // path is given by the operator
+}
+
+// newStateInspectCmds builds the state subcommands that read and edit individual keys.
+func newStateInspectCmds(deps core.Dependencies) []*cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list [prefix]",
+		Short: "List state keys, optionally only those starting with prefix",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				keys, err := store.List(prefix)
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					if _, err := fmt.Fprintln(cmd.OutOrStdout(), key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	}
+
+	getCmd := &cobra.Command{
+		Use:   "get <key>",
+		Short: "Print the JSON value stored under key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				value, err := loadRawState(store, args[0])
+				if err != nil {
+					return err
+				}
+				if value == nil {
+					return fmt.Errorf("no state for key %q", args[0])
+				}
+				b, err := json.MarshalIndent(value, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+				return err
+			})
+		},
+	}
+
+	var setFile string
+	var setTTL time.Duration
+	setCmd := &cobra.Command{
+		Use:   "set <key> [json]",
+		Short: "Store a JSON value under key",
+		Long: `Store a JSON value under key, replacing any previous value. The value is given as an argument
+or read with -f from a file, or from stdin with -f -.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (len(args) == 2) == (setFile != "") {
+				return fmt.Errorf("give the value as an argument or with -f")
+			}
+			var data []byte
+			if len(args) == 2 {
+				data = []byte(args[1])
+			} else {
+				var err error
+				if data, err = readStateInput(cmd, setFile); err != nil {
+					return err
+				}
+			}
+			if !json.Valid(data) {
+				return fmt.Errorf("value for %q is not valid JSON", args[0])
+			}
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				if setTTL > 0 {
+					return store.SaveWithTTL(args[0], json.RawMessage(data), setTTL)
+				}
+				return store.Save(args[0], json.RawMessage(data))
+			})
+		},
+	}
+	setCmd.Flags().StringVarP(&setFile, "file", "f", "", "read the value from a file, - for stdin")
+	setCmd.Flags().DurationVar(&setTTL, "ttl", 0, "expire the key after this long")
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <key>...",
+		Short: "Delete state keys",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				for _, key := range args {
+					if err := store.Delete(key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	}
+
+	var exportOut string
+	exportCmd := &cobra.Command{
+		Use:   "export [prefix]",
+		Short: "Write state as a JSON object of key to value",
+		Long: `Write every key, or those starting with prefix, as a JSON object mapping keys to values. The
+output can be loaded again with state import. Expiries are not exported.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				keys, err := store.List(prefix)
+				if err != nil {
+					return err
+				}
+				values := make(map[string]json.RawMessage, len(keys))
+				for _, key := range keys {
+					value, err := loadRawState(store, key)
+					if err != nil {
+						return err
+					}
+					if value != nil { // expired since listing
+						values[key] = value
+					}
+				}
+				b, err := json.MarshalIndent(values, "", "  ")
+				if err != nil {
+					return err
+				}
+				b = append(b, '\n')
+				if exportOut != "" && exportOut != "-" {
+					return os.WriteFile(exportOut, b, 0o600)
+				}
+				_, err = cmd.OutOrStdout().Write(b)
+				return err
+			})
+		},
+	}
+	exportCmd.Flags().StringVar(&exportOut, "output", "", "write to a file instead of stdout")
+
+	var importOverwrite bool
+	importCmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Load state written by state export",
+		Long: `Load a JSON object of key to value, as written by state export, from a file or from stdin
+with -. Keys that already exist are kept unless --overwrite is given.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := readStateInput(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			var values map[string]json.RawMessage
+			if err := json.Unmarshal(data, &values); err != nil {
+				return fmt.Errorf("%s is not a JSON object of state keys: %w", args[0], err)
+			}
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				imported := 0
+				for _, key := range sortedKeys(values) {
+					if !importOverwrite {
+						existing, err := loadRawState(store, key)
+						if err != nil {
+							return err
+						}
+						if existing != nil {
+							_, _ = fmt.Fprintf(cmd.OutOrStdout(), "skipped %s: already set\n", key)
+							continue
+						}
+					}
+					if err := store.Save(key, values[key]); err != nil {
+						return err
+					}
+					imported++
+				}
+				_, err := fmt.Fprintf(cmd.OutOrStdout(), "imported %d keys\n", imported)
+				return err
+			})
+		},
+	}
+	importCmd.Flags().BoolVar(&importOverwrite, "overwrite", false, "replace keys that are already set")
+
+	resetCmd := &cobra.Command{
+		Use:   "reset-schedule <service>",
+		Short: "Make a service run immediately on the next start",
+		Long: `Forget when the service's task last ran. Otherwise the kernel waits out the rest of the
+interval after a restart.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				found, err := runtime.ResetServiceSchedule(store, args[0])
+				if err != nil {
+					return err
+				}
+				if !found {
+					_, err = fmt.Fprintf(cmd.OutOrStdout(), "%s has no recorded run\n", args[0])
+					return err
+				}
+				_, err = fmt.Fprintf(cmd.OutOrStdout(), "%s will run on the next start\n", args[0])
+				return err
+			})
+		},
+	}
+
+	keygenCmd := &cobra.Command{
+		Use:   "keygen",
+		Short: "Print a new key for state.encryption",
+		Long: `Print a random base64-encoded 32-byte key. Save it to a file referenced from state.encryption
+in messenger.yaml, or put it in an environment variable.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintln(cmd.OutOrStdout(), base64.StdEncoding.EncodeToString(secret))
+			return err
+		},
+	}
+
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt state with the first key in state.encryption",
+		Long: `Re-encrypt every value written with an older key, and encrypt plaintext values in the
+encrypted namespaces. To rotate keys, add the new key first in state.encryption.keys, run rekey,
+then remove the old key. Plaintext values are only read while state.encryption.allow_plaintext
+is set: to encrypt state written before encryption was enabled, set it, run rekey, then turn it
+off again. Rewritten keys keep their expiry.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return withStateStore(deps, func(store core.ExtendedStateStoreApi) error {
+				n, err := core.RekeyState(store)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(cmd.OutOrStdout(), "re-encrypted %d keys\n", n)
+				return err
+			})
+		},
+	}
+
+	return []*cobra.Command{listCmd, getCmd, setCmd, deleteCmd, exportCmd, importCmd, resetCmd, keygenCmd, rekeyCmd}
+}
+
+// sortedKeys returns the keys of m in order, so imports are reproducible.
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateMigrate(t *testing.T) {
+	deps := setupBusTest(t)
+	dataDir := t.TempDir()
+	files := adapter.NewFileStateStore(dataDir, adapter.OsProvider{})
+	require.NoError(t, files.Save("heartbeat", map[string]int{"beats": 3}))
+	require.NoError(t, files.Save("wasm_plugin_x", "plugin"))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "state_broken.json"), []byte("{"), 0o600))
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	out, err := executeBusCmd(t, deps, "", "state", "migrate", "--from", dataDir, "--to", dbPath)
+	require.NoError(t, err)
+	assert.Contains(t, out, "skipped state_broken.json: not valid JSON")
+	assert.Contains(t, out, "imported 2 keys")
+
+	out, err = executeBusCmd(t, deps, "", "state", "migrate", "--from", dataDir, "--to", dbPath)
+	require.NoError(t, err)
+	assert.Contains(t, out, "skipped heartbeat: already in the database")
+	assert.Contains(t, out, "imported 0 keys")
+
+	store, err := adapter.NewSQLiteStateStore(dbPath)
+	require.NoError(t, err)
+	defer func() { _ = store.Close() }()
+	var beats map[string]int
+	require.NoError(t, store.Load("heartbeat", &beats))
+	assert.Equal(t, map[string]int{"beats": 3}, beats)
+}
+
+func setupStateTest(t *testing.T) (core.Dependencies, *testutil.MemoryStateStore) {
+	t.Helper()
+	deps := setupBusTest(t)
+	store := testutil.NewMemoryStateStore()
+	deps.SetStateStore(store)
+	return deps, store
+}
+
+func TestStateGetSetDelete(t *testing.T) {
+	deps, store := setupStateTest(t)
+
+	_, err := executeBusCmd(t, deps, "", "state", "set", "service/heartbeat/beats", `{"count":3}`)
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, `"from stdin"`, "state", "set", "service/other/note", "-f", "-")
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, "", "state", "set", "bad", "{")
+	assert.ErrorContains(t, err, "not valid JSON")
+
+	out, err := executeBusCmd(t, deps, "", "state", "list", "service/heartbeat/")
+	require.NoError(t, err)
+	assert.Equal(t, "service/heartbeat/beats\n", out)
+
+	out, err = executeBusCmd(t, deps, "", "state", "get", "service/heartbeat/beats")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"count":3}`, out)
+
+	var note string
+	require.NoError(t, store.Load("service/other/note", &note))
+	assert.Equal(t, "from stdin", note)
+
+	_, err = executeBusCmd(t, deps, "", "state", "delete", "service/heartbeat/beats")
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps, "", "state", "get", "service/heartbeat/beats")
+	assert.ErrorContains(t, err, "no state for key")
+}
+
+func TestStateExportImport(t *testing.T) {
+	deps, store := setupStateTest(t)
+	require.NoError(t, store.Save("service/a/x", 1))
+	require.NoError(t, store.Save("service/b/y", map[string]string{"k": "v"}))
+
+	out, err := executeBusCmd(t, deps, "", "state", "export")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"service/a/x":1,"service/b/y":{"k":"v"}}`, out)
+
+	deps2, store2 := setupStateTest(t)
+	require.NoError(t, store2.Save("service/a/x", 5))
+	res, err := executeBusCmd(t, deps2, out, "state", "import", "-")
+	require.NoError(t, err)
+	assert.Contains(t, res, "skipped service/a/x: already set")
+	assert.Contains(t, res, "imported 1 keys")
+
+	var x int
+	require.NoError(t, store2.Load("service/a/x", &x))
+	assert.Equal(t, 5, x)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	_, err = executeBusCmd(t, deps, "", "state", "export", "service/a/", "--output", path)
+	require.NoError(t, err)
+	_, err = executeBusCmd(t, deps2, "", "state", "import", path, "--overwrite")
+	require.NoError(t, err)
+	require.NoError(t, store2.Load("service/a/x", &x))
+	assert.Equal(t, 1, x)
+}
+
+func TestStateResetSchedule(t *testing.T) {
+	deps, store := setupStateTest(t)
+	require.NoError(t, store.Save("kernel/last_check_heartbeat", time.Now()))
+	require.NoError(t, store.Save("last_check_heartbeat", time.Now()))
+
+	out, err := executeBusCmd(t, deps, "", "state", "reset-schedule", "heartbeat")
+	require.NoError(t, err)
+	assert.Contains(t, out, "heartbeat will run on the next start")
+	keys, err := store.List("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	out, err = executeBusCmd(t, deps, "", "state", "reset-schedule", "heartbeat")
+	require.NoError(t, err)
+	assert.Contains(t, out, "heartbeat has no recorded run")
+}
+
+func TestStateRequiresExtendedStore(t *testing.T) {
+	deps := setupBusTest(t)
+	deps.SetStateStore(&testutil.NoOpStateStore{})
+	_, err := executeBusCmd(t, deps, "", "state", "list")
+	assert.ErrorIs(t, err, core.ErrStateNotExtended)
+}
+
+func TestStateKeygenAndRekey(t *testing.T) {
+	deps, store := setupStateTest(t)
+	out, err := executeBusCmd(t, deps, "", "state", "keygen")
+	require.NoError(t, err)
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	require.NoError(t, store.Save("service/tokens/t", "secret"))
+	t.Setenv("KEYOP_TEST_STATE_KEY", strings.TrimSpace(out))
+	confDir := os.Getenv("KEYOP_CONF_DIR")
+	messengerYAML, err := os.ReadFile(filepath.Join(confDir, "messenger.yaml"))
+	require.NoError(t, err)
+	encryptionYAML := "state:\n  encryption:\n    namespaces: [service/tokens]\n    keys:\n      - id: k1\n        env: KEYOP_TEST_STATE_KEY\n"
+	writeEncryption := func(extra string) {
+		require.NoError(t, os.WriteFile(filepath.Join(confDir, "messenger.yaml"), append(slices.Clone(messengerYAML), encryptionYAML+extra...), 0o600))
+	}
+
+	writeEncryption("")
+	_, err = executeBusCmd(t, deps, "", "state", "rekey")
+	assert.ErrorIs(t, err, core.ErrStateNotEncrypted, "plaintext is only read while migrating")
+
+	writeEncryption("    allow_plaintext: true\n")
+	out, err = executeBusCmd(t, deps, "", "state", "rekey")
+	require.NoError(t, err)
+	assert.Contains(t, out, "re-encrypted 1 keys")
+	writeEncryption("")
+	var raw json.RawMessage
+	require.NoError(t, store.Load("service/tokens/t", &raw))
+	assert.NotContains(t, string(raw), "secret")
+
+	out, err = executeBusCmd(t, deps, "", "state", "get", "service/tokens/t")
+	require.NoError(t, err)
+	assert.Equal(t, "\"secret\"\n", out)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// NewTasksCmd builds the tasks command group for inspecting the kernel's record of service runs.
+func NewTasksCmd(deps core.Dependencies) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tasks",
+		Short: "Show how service checks have been running",
+		Long: `The kernel keeps the last ` + fmt.Sprint(core.DefaultTaskHistorySize) + ` runs of every service's check in the state store, with
+their start time, duration and outcome. Statistics are also published to the "` + core.MetricsChannel + `" channel
+after every run as <service>.task.duration, duration_p50, duration_p95 and failure_rate.`,
+	}
+
+	var statsFormat string
+	statsCmd := &cobra.Command{
+		Use:   "stats [service...]",
+		Short: "Show run duration percentiles and failure rates",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			histories, err := loadTaskHistories(deps)
+			if err != nil {
+				return err
+			}
+			names := args
+			if len(names) == 0 {
+				for name := range histories {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+			}
+			stats := make([]core.TaskStats, 0, len(names))
+			for _, name := range names {
+				history, ok := histories[name]
+				if !ok {
+					return fmt.Errorf("no run history for service %q", name)
+				}
+				stats = append(stats, history.Stats(name))
+			}
+			return writeTaskStats(cmd.OutOrStdout(), stats, statsFormat)
+		},
+	}
+	statsCmd.Flags().StringVar(&statsFormat, "format", "table", "output format: table or ndjson")
+
+	var historyFormat string
+	var limit int
+	historyCmd := &cobra.Command{
+		Use:   "history <service>",
+		Short: "List a service's recent runs, newest first",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			histories, err := loadTaskHistories(deps)
+			if err != nil {
+				return err
+			}
+			history, ok := histories[args[0]]
+			if !ok {
+				return fmt.Errorf("no run history for service %q", args[0])
+			}
+			runs := make([]core.TaskRun, 0, len(history.Runs))
+			for i := len(history.Runs) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+				runs = append(runs, history.Runs[i])
+			}
+			return writeTaskRuns(cmd.OutOrStdout(), runs, historyFormat)
+		},
+	}
+	historyCmd.Flags().IntVarP(&limit, "limit", "n", 20, "show at most this many runs, 0 for all")
+	historyCmd.Flags().StringVar(&historyFormat, "format", "table", "output format: table or ndjson")
+
+	cmd.AddCommand(statsCmd, historyCmd)
+	return cmd
+}
+
+func loadTaskHistories(deps core.Dependencies) (map[string]core.TaskHistory, error) {
+	store, closeStore, err := runtime.OpenStateStore(deps)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = closeStore() }()
+	if store == nil {
+		return nil, fmt.Errorf("no state store configured")
+	}
+	return runtime.LoadTaskHistories(store)
+}
+
+func writeTaskStats(out io.Writer, stats []core.TaskStats, format string) error {
+	switch format {
+	case "ndjson":
+		return writeNDJSON(out, stats)
+	case "table", "":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "SERVICE\tRUNS\tFAILURES\tFAILURE RATE\tP50\tP95\tMAX\tLAST RUN\tLAST ERROR")
+		for _, s := range stats {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s\t%s\n",
+				s.Service, s.Runs, s.Failures, s.FailureRate*100, roundDuration(s.P50), roundDuration(s.P95), roundDuration(s.Max),
+				formatTaskTime(s.LastRun), truncate(s.LastError, 60))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q (expected table or ndjson)", format)
+	}
+}
+
+func writeTaskRuns(out io.Writer, runs []core.TaskRun, format string) error {
+	switch format {
+	case "ndjson":
+		return writeNDJSON(out, runs)
+	case "table", "":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "START\tTRIGGER\tDURATION\tOUTCOME\tERROR")
+		for _, r := range runs {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", formatTaskTime(r.Start), r.Trigger, roundDuration(r.Duration), r.Outcome, truncate(r.Error, 60))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q (expected table or ndjson)", format)
+	}
+}
+
+func writeNDJSON[T any](out io.Writer, items []T) error {
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(out, string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roundDuration trims durations to a readable precision.
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d
+	}
+}
+
+func formatTaskTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTasksStatsAndHistory(t *testing.T) {
+	deps, store := setupStateTest(t)
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var h core.TaskHistory
+	h.Add(core.TaskRun{Start: start, Duration: 2 * time.Second, Outcome: core.TaskRunOK}, core.DefaultTaskHistorySize)
+	h.Add(core.TaskRun{Start: start.Add(time.Minute), Duration: 4 * time.Second, Outcome: core.TaskRunError, Error: "timeout"}, core.DefaultTaskHistorySize)
+	require.NoError(t, store.Save("kernel/history_weather", h))
+	require.NoError(t, store.Save("kernel/history_heartbeat", core.TaskHistory{Runs: h.Runs[:1]}))
+
+	out, err := executeBusCmd(t, deps, "", "tasks", "stats")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "FAILURE RATE")
+	assert.True(t, strings.HasPrefix(lines[1], "heartbeat"))
+	assert.Contains(t, lines[2], "50.0%")
+	assert.Contains(t, lines[2], "timeout")
+
+	out, err = executeBusCmd(t, deps, "", "tasks", "stats", "weather", "--format", "ndjson")
+	require.NoError(t, err)
+	var stats core.TaskStats
+	require.NoError(t, json.Unmarshal([]byte(out), &stats))
+	assert.Equal(t, 4*time.Second, stats.P95)
+
+	_, err = executeBusCmd(t, deps, "", "tasks", "stats", "missing")
+	assert.ErrorContains(t, err, `no run history for service "missing"`)
+
+	out, err = executeBusCmd(t, deps, "", "tasks", "history", "weather", "-n", "1")
+	require.NoError(t, err)
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], "error")
+	assert.Contains(t, lines[1], "4s")
+}
@@ -0,0 +1,627 @@
+//nolint:revive
+package adapter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+const (
+	defaultMemoryBufferSize = 1024
+	defaultMemoryMaxRetries = 5
+	defaultMemoryRetryDelay = 100 * time.Millisecond
+	maxMemoryRetryDelay     = 5 * time.Second
+
+	// deadLetterPayloadType matches the payload type keyop-messenger uses for dead letters.
+	deadLetterPayloadType = "com.keyop.messenger.DeadLetterPayload"
+)
+
+// ErrMemoryBufferFull is returned when a handler publishes to a channel with a subscriber whose
+// buffer is full and no spill directory is configured. Waiting could deadlock: the full
+// subscriber may be the one running the handler, or be waiting on it.
+var ErrMemoryBufferFull = errors.New("subscriber buffer is full")
+
+// MemoryMessengerConfig configures a MemoryMessenger.
+type MemoryMessengerConfig struct {
+	// Name is the instance name stamped as the origin of published messages.
+	Name string
+	// BufferSize is the number of undelivered messages held per subscriber (default 1024).
+	// When a subscriber's buffer is full, Publish blocks until it drains, unless SpillDir is set;
+	// a Publish from inside a handler fails with ErrMemoryBufferFull instead of blocking.
+	BufferSize int
+	// SpillDir, when set, holds overflow messages on disk instead of blocking publishers.
+	SpillDir string
+	// MaxRetries is the number of redeliveries after a failed handler call before the message is
+	// sent to <channel>.dead-letter. Zero uses the default of 5; negative disables retries.
+	MaxRetries int
+	// RetryDelay is the backoff before the first retry, doubling per attempt up to 5s (default 100ms).
+	RetryDelay time.Duration
+}
+
+// MemoryMessenger is an in-process core.MessengerApi for single-host setups and tests.
+//
+// It mirrors keyop-messenger's delivery semantics without persistent storage: subscribers
+// receive messages published after they subscribe, in publish order per channel; payloads are
+// round-tripped through JSON and decoded into the registered type (or map[string]any);
+// failed handlers are retried with backoff and then dead-lettered.
+type MemoryMessenger struct {
+	cfg    MemoryMessengerConfig
+	logger core.Logger
+
+	mu       sync.Mutex
+	closed   bool
+	types    map[string]reflect.Type
+	warned   map[string]bool
+	channels map[string]*memChannel
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// memChannel serializes publishers on one channel so every subscriber sees the same order.
+type memChannel struct {
+	pubMu sync.Mutex
+	subs  map[string]*memSubscriber
+}
+
+// memEnvelope is the wire form of a message, matching keyop-messenger's stored envelope.
+type memEnvelope struct {
+	V             int             `json:"v"`
+	ID            string          `json:"id"`
+	Timestamp     time.Time       `json:"ts"`
+	Channel       string          `json:"channel"`
+	Origin        string          `json:"origin"`
+	PayloadType   string          `json:"payload_type"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	ServiceName   string          `json:"service_name,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+type memDeadLetter struct {
+	Original  memEnvelope `json:"original"`
+	Retries   int         `json:"retries"`
+	LastError string      `json:"last_error"`
+	FailedAt  time.Time   `json:"failed_at"`
+}
+
+// NewMemoryMessenger creates a MemoryMessenger with defaults applied to cfg.
+func NewMemoryMessenger(cfg MemoryMessengerConfig, logger core.Logger) *MemoryMessenger {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultMemoryBufferSize
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMemoryMaxRetries
+	} else if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultMemoryRetryDelay
+	}
+	return &MemoryMessenger{
+		cfg:      cfg,
+		logger:   logger,
+		types:    make(map[string]reflect.Type),
+		warned:   make(map[string]bool),
+		channels: make(map[string]*memChannel),
+		stop:     make(chan struct{}),
+	}
+}
+
+// InstanceName returns the configured instance name.
+func (m *MemoryMessenger) InstanceName() string {
+	return m.cfg.Name
+}
+
+// RegisterPayloadType associates typeStr with the Go type of prototype for decoding delivered
+// payloads. Registering the same typeStr twice returns km.ErrPayloadTypeAlreadyRegistered.
+func (m *MemoryMessenger) RegisterPayloadType(typeStr string, prototype interface{}) error {
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		return fmt.Errorf("register %q: prototype must not be nil", typeStr)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.types[typeStr]; exists {
+		return fmt.Errorf("%w: %q", km.ErrPayloadTypeAlreadyRegistered, typeStr)
+	}
+	m.types[typeStr] = t
+	return nil
+}
+
+// Publish encodes payload and queues it for every current subscriber of channel. It blocks while
+// a subscriber's buffer is full and no spill directory is configured, except when called with the
+// context of a handler of this messenger, where it returns ErrMemoryBufferFull.
+func (m *MemoryMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("publish %q: %w", channel, err)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("publish %q: encode payload: %w", channel, err)
+	}
+	return m.publishEnvelope(ctx, memEnvelope{
+		V:             1,
+		ID:            core.NewUUID(),
+		Timestamp:     time.Now().UTC(),
+		Channel:       channel,
+		Origin:        m.cfg.Name,
+		PayloadType:   payloadType,
+		CorrelationID: km.CorrelationIDFromContext(ctx),
+		ServiceName:   km.ServiceNameFromContext(ctx),
+		Payload:       raw,
+	})
+}
+
+// memHandlerKey marks the context passed to handlers with the messenger that called them.
+type memHandlerKey struct{}
+
+// publishEnvelope queues env for every subscriber of its channel at once, so all of them see the
+// channel's messages in the same order. ch.pubMu is never held while waiting for buffer space, so
+// a handler publishing to a channel with a blocked publisher does not wait on that publisher.
+func (m *MemoryMessenger) publishEnvelope(ctx context.Context, env memEnvelope) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return km.ErrMessengerClosed
+	}
+	ch := m.channelLocked(env.Channel)
+	m.mu.Unlock()
+	inHandler := ctx.Value(memHandlerKey{}) == m
+
+	for {
+		ch.pubMu.Lock()
+		m.mu.Lock()
+		subs := make([]*memSubscriber, 0, len(ch.subs))
+		for _, s := range ch.subs {
+			subs = append(subs, s)
+		}
+		m.mu.Unlock()
+
+		// only publishers holding pubMu add to the buffers, so room found here stays available
+		var full *memSubscriber
+		for _, s := range subs {
+			if !s.hasRoom() {
+				full = s
+				break
+			}
+		}
+		if full == nil {
+			var err error
+			for _, s := range subs {
+				if pushErr := s.push(env); pushErr != nil && err == nil {
+					err = fmt.Errorf("publish %q: %w", env.Channel, pushErr)
+				}
+			}
+			ch.pubMu.Unlock()
+			return err
+		}
+		ch.pubMu.Unlock()
+
+		if inHandler {
+			return fmt.Errorf("publish %q: subscriber %q: %w", env.Channel, full.id, ErrMemoryBufferFull)
+		}
+		if err := full.waitForSpace(ctx); err != nil {
+			return fmt.Errorf("publish %q: %w", env.Channel, err)
+		}
+	}
+}
+
+// channelLocked returns the state for channel, creating it. m.mu must be held.
+func (m *MemoryMessenger) channelLocked(channel string) *memChannel {
+	ch, ok := m.channels[channel]
+	if !ok {
+		ch = &memChannel{subs: make(map[string]*memSubscriber)}
+		m.channels[channel] = ch
+	}
+	return ch
+}
+
+// Subscribe delivers messages published to channel after this call to handler, one at a time and
+// in order, until ctx is done or the messenger is closed.
+func (m *MemoryMessenger) Subscribe(ctx context.Context, channel string, subscriberID string, handler km.HandlerFunc) error {
+	if err := km.ValidateChannelName(channel); err != nil {
+		return err
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	s := &memSubscriber{
+		m:       m,
+		channel: channel,
+		id:      subscriberID,
+		handler: handler,
+		ctx:     subCtx,
+		cancel:  cancel,
+		notify:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if m.cfg.SpillDir != "" {
+		s.spillPath = filepath.Join(m.cfg.SpillDir, channel, subscriberID+".jsonl")
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		cancel()
+		return km.ErrMessengerClosed
+	}
+	ch := m.channelLocked(channel)
+	if _, exists := ch.subs[subscriberID]; exists {
+		m.mu.Unlock()
+		cancel()
+		return fmt.Errorf("subscribe %q/%q: already registered", channel, subscriberID)
+	}
+	ch.subs[subscriberID] = s
+	m.wg.Add(2)
+	m.mu.Unlock()
+
+	go func() {
+		defer m.wg.Done()
+		s.run()
+	}()
+	go func() {
+		defer m.wg.Done()
+		select {
+		case <-subCtx.Done():
+		case <-m.stop:
+		}
+		m.unsubscribe(s)
+	}()
+	return nil
+}
+
+func (m *MemoryMessenger) unsubscribe(s *memSubscriber) {
+	m.mu.Lock()
+	if ch, ok := m.channels[s.channel]; ok && ch.subs[s.id] == s {
+		delete(ch.subs, s.id)
+	}
+	m.mu.Unlock()
+	s.shutdown()
+}
+
+// Close stops all subscribers and waits for in-flight handlers to return. Undelivered messages
+// are discarded.
+func (m *MemoryMessenger) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stop)
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	return nil
+}
+
+// decode converts a raw payload into the registered type, or map[string]any when unregistered.
+func (m *MemoryMessenger) decode(payloadType string, raw json.RawMessage) (interface{}, error) {
+	m.mu.Lock()
+	t, ok := m.types[payloadType]
+	warn := !ok && !m.warned[payloadType]
+	if warn {
+		m.warned[payloadType] = true
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		if warn {
+			m.logger.Warn("unregistered payload type; delivering as map[string]any", "payload_type", payloadType)
+		}
+		var v map[string]any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("decode unregistered payload %q: %w", payloadType, err)
+		}
+		return v, nil
+	}
+
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("decode payload %q: %w", payloadType, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func (m *MemoryMessenger) retryDelay(attempt int) time.Duration {
+	d := time.Duration(float64(m.cfg.RetryDelay) * math.Pow(2, float64(attempt-1)))
+	if d > maxMemoryRetryDelay {
+		return maxMemoryRetryDelay
+	}
+	return d
+}
+
+// memSubscriber owns one subscriber's buffer and delivery goroutine.
+type memSubscriber struct {
+	m       *MemoryMessenger
+	channel string
+	id      string
+	handler km.HandlerFunc
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	queue     []memEnvelope
+	spillPath string
+	spill     *memSpill
+	stopped   bool
+
+	notify chan struct{} // a message was queued
+	space  chan struct{} // a buffer slot was freed
+	done   chan struct{} // the subscriber stopped
+}
+
+// hasRoom reports whether push can queue a message without waiting: the buffer has space, the
+// overflow is spilled to disk, or the subscriber stopped and drops it.
+func (s *memSubscriber) hasRoom() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped || s.spillPath != "" || len(s.queue) < s.m.cfg.BufferSize
+}
+
+// push queues env, spilling to disk when the buffer is full. The caller checks hasRoom first.
+// Messages pushed after the subscriber stopped are dropped.
+func (s *memSubscriber) push(env memEnvelope) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.spillPath != "" && (len(s.queue) >= s.m.cfg.BufferSize || s.spill != nil) {
+		err := s.appendSpill(env)
+		s.mu.Unlock()
+		signal(s.notify)
+		return err
+	}
+	s.queue = append(s.queue, env)
+	s.mu.Unlock()
+	signal(s.notify)
+	return nil
+}
+
+// waitForSpace waits until the subscriber frees a buffer slot or stops.
+func (s *memSubscriber) waitForSpace(ctx context.Context) error {
+	select {
+	case <-s.space:
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// next returns the oldest undelivered message, waiting until one is available or the subscriber
+// stops. Buffered messages are always older than spilled ones.
+func (s *memSubscriber) next() (memEnvelope, bool) {
+	for {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return memEnvelope{}, false
+		}
+		if len(s.queue) > 0 {
+			env := s.queue[0]
+			s.queue[0] = memEnvelope{}
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			signal(s.space)
+			return env, true
+		}
+		if s.spill != nil {
+			env, err := s.spill.next()
+			if err != nil {
+				s.m.logger.Error("memory messenger: read spill", "channel", s.channel, "subscriber", s.id, "error", err)
+			}
+			if err != nil || s.spill.pending == 0 {
+				s.spill.remove()
+				s.spill = nil
+			}
+			s.mu.Unlock()
+			if err != nil {
+				continue
+			}
+			return env, true
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return memEnvelope{}, false
+		}
+	}
+}
+
+func (s *memSubscriber) run() {
+	for {
+		env, ok := s.next()
+		if !ok {
+			return
+		}
+		s.dispatch(env)
+	}
+}
+
+// dispatch calls the handler with up to MaxRetries+1 attempts, then dead-letters the message.
+func (s *memSubscriber) dispatch(env memEnvelope) {
+	payload, err := s.m.decode(env.PayloadType, env.Payload)
+	if err != nil {
+		s.deadLetter(env, 0, err)
+		return
+	}
+	msg := km.Message{
+		ID:            env.ID,
+		Channel:       env.Channel,
+		Origin:        env.Origin,
+		PayloadType:   env.PayloadType,
+		CorrelationID: env.CorrelationID,
+		ServiceName:   env.ServiceName,
+		Payload:       payload,
+		Timestamp:     env.Timestamp,
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.m.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(s.m.retryDelay(attempt)):
+			case <-s.done:
+				return
+			}
+		}
+		if lastErr = s.call(msg); lastErr == nil {
+			return
+		}
+	}
+	s.deadLetter(env, s.m.cfg.MaxRetries, lastErr)
+}
+
+// call invokes the handler and converts a panic into an error.
+func (s *memSubscriber) call(msg km.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return s.handler(context.WithValue(s.ctx, memHandlerKey{}, s.m), msg)
+}
+
+func (s *memSubscriber) deadLetter(env memEnvelope, retries int, lastErr error) {
+	if strings.HasSuffix(env.Channel, ".dead-letter") {
+		s.m.logger.Error("dead-letter handler failed, skipping", "channel", env.Channel, "id", env.ID, "error", lastErr)
+		return
+	}
+	raw, err := json.Marshal(memDeadLetter{
+		Original:  env,
+		Retries:   retries,
+		LastError: lastErr.Error(),
+		FailedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		s.m.logger.Error("build dead-letter", "channel", env.Channel, "id", env.ID, "error", err)
+		return
+	}
+	err = s.m.publishEnvelope(context.Background(), memEnvelope{
+		V:           1,
+		ID:          core.NewUUID(),
+		Timestamp:   time.Now().UTC(),
+		Channel:     env.Channel + ".dead-letter",
+		Origin:      env.Origin,
+		PayloadType: deadLetterPayloadType,
+		Payload:     raw,
+	})
+	if err != nil && !errors.Is(err, km.ErrMessengerClosed) {
+		s.m.logger.Error("write dead-letter", "channel", env.Channel, "id", env.ID, "error", err)
+	}
+}
+
+// shutdown stops delivery, discards buffered messages and removes any spill file.
+func (s *memSubscriber) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.cancel()
+	close(s.done)
+	s.queue = nil
+	if s.spill != nil {
+		s.spill.remove()
+		s.spill = nil
+	}
+}
+
+// appendSpill writes env to the spill file, creating it on first use. s.mu must be held.
+func (s *memSubscriber) appendSpill(env memEnvelope) error {
+	if s.spill == nil {
+		sp, err := openMemSpill(s.spillPath)
+		if err != nil {
+			return err
+		}
+		s.spill = sp
+	}
+	return s.spill.append(env)
+}
+
+// memSpill is an append-only JSONL file read back in order.
+type memSpill struct {
+	path    string
+	w       *os.File
+	r       *os.File
+	br      *bufio.Reader
+	pending int
+}
+
+func openMemSpill(path string) (*memSpill, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("create spill dir: %w", err)
+	}
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600) //nolint:gosec // path built from configured spill dir
+	if err != nil {
+		return nil, fmt.Errorf("open spill file: %w", err)
+	}
+	r, err := os.Open(path) //nolint:gosec // path built from configured spill dir
+	if err != nil {
+		_ = w.Close()
+		return nil, fmt.Errorf("open spill file: %w", err)
+	}
+	return &memSpill{path: path, w: w, r: r, br: bufio.NewReader(r)}, nil
+}
+
+func (sp *memSpill) append(env memEnvelope) error {
+	line, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("encode spill: %w", err)
+	}
+	if _, err := sp.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write spill: %w", err)
+	}
+	sp.pending++
+	return nil
+}
+
+func (sp *memSpill) next() (memEnvelope, error) {
+	var env memEnvelope
+	line, err := sp.br.ReadBytes('\n')
+	if err != nil {
+		return env, err
+	}
+	sp.pending--
+	return env, json.Unmarshal(line, &env)
+}
+
+func (sp *memSpill) remove() {
+	_ = sp.w.Close()
+	_ = sp.r.Close()
+	_ = os.Remove(sp.path)
+}
+
+// signal performs a non-blocking send on a 1-buffered channel.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,242 @@
+//nolint:revive
+package adapter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+func newTestMemoryMessenger(t *testing.T, cfg MemoryMessengerConfig) *MemoryMessenger {
+	t.Helper()
+	if cfg.Name == "" {
+		cfg.Name = "test-host"
+	}
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = time.Millisecond
+	}
+	m := NewMemoryMessenger(cfg, &testutil.FakeLogger{})
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+// collector records delivered messages for assertions.
+type collector struct {
+	mu   sync.Mutex
+	msgs []km.Message
+}
+
+func (c *collector) handle(_ context.Context, msg km.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func (c *collector) snapshot() []km.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]km.Message(nil), c.msgs...)
+}
+
+func (c *collector) waitFor(t *testing.T, n int) []km.Message {
+	t.Helper()
+	require.Eventually(t, func() bool { return len(c.snapshot()) >= n }, 5*time.Second, 5*time.Millisecond)
+	return c.snapshot()
+}
+
+func TestMemoryMessenger_OrderedTypedDelivery(t *testing.T) {
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{})
+	require.NoError(t, m.RegisterPayloadType("core.metric.v1", &core.MetricEvent{}))
+	err := m.RegisterPayloadType("core.metric.v1", core.MetricEvent{})
+	assert.ErrorIs(t, err, km.ErrPayloadTypeAlreadyRegistered)
+
+	ctx := context.Background()
+	// published before subscribing: not delivered
+	require.NoError(t, m.Publish(ctx, "metrics", "core.metric.v1", core.MetricEvent{Name: "early"}))
+
+	var c collector
+	require.NoError(t, m.Subscribe(ctx, "metrics", "sub", c.handle))
+	assert.Error(t, m.Subscribe(ctx, "metrics", "sub", c.handle))
+
+	pubCtx := km.WithServiceName(km.WithCorrelationID(ctx, "corr-1"), "svc")
+	for i := 0; i < 100; i++ {
+		require.NoError(t, m.Publish(pubCtx, "metrics", "core.metric.v1", &core.MetricEvent{Name: "load", Value: float64(i)}))
+	}
+	require.NoError(t, m.Publish(ctx, "metrics", "custom.v1", map[string]any{"k": "v"}))
+
+	msgs := c.waitFor(t, 101)
+	require.Len(t, msgs, 101)
+	for i := 0; i < 100; i++ {
+		ev, ok := msgs[i].Payload.(core.MetricEvent)
+		require.True(t, ok, "registered payload decodes into the value type")
+		assert.Equal(t, float64(i), ev.Value)
+	}
+	assert.Equal(t, "test-host", msgs[0].Origin)
+	assert.Equal(t, "corr-1", msgs[0].CorrelationID)
+	assert.Equal(t, "svc", msgs[0].ServiceName)
+	assert.NotEmpty(t, msgs[0].ID)
+	assert.Equal(t, map[string]any{"k": "v"}, msgs[100].Payload)
+}
+
+func TestMemoryMessenger_BoundedBufferBlocksPublisher(t *testing.T) {
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{BufferSize: 2})
+
+	release := make(chan struct{})
+	var c collector
+	require.NoError(t, m.Subscribe(context.Background(), "slow", "sub", func(ctx context.Context, msg km.Message) error {
+		<-release
+		return c.handle(ctx, msg)
+	}))
+
+	// one in the handler, two buffered
+	for i := 0; i < 3; i++ {
+		require.NoError(t, m.Publish(context.Background(), "slow", "t", map[string]any{"i": i}))
+	}
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		return errors.Is(m.Publish(ctx, "slow", "t", map[string]any{"i": 99}), context.DeadlineExceeded)
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	assert.Len(t, c.waitFor(t, 3), 3)
+}
+
+// TestMemoryMessenger_HandlerPublishDoesNotDeadlock has a handler publish back to its own
+// channel faster than it can drain, while another publisher is blocked on the same buffer.
+func TestMemoryMessenger_HandlerPublishDoesNotDeadlock(t *testing.T) {
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{BufferSize: 2, MaxRetries: -1})
+
+	release := make(chan struct{})
+	errs := make(chan error, 10)
+	require.NoError(t, m.Subscribe(context.Background(), "loop", "sub", func(ctx context.Context, msg km.Message) error {
+		if msg.PayloadType != "start" {
+			return nil
+		}
+		<-release
+		for i := 0; i < 5; i++ {
+			errs <- m.Publish(ctx, "loop", "echo", map[string]any{"i": i})
+		}
+		return nil
+	}))
+
+	require.NoError(t, m.Publish(context.Background(), "loop", "start", nil))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, m.Publish(context.Background(), "loop", "fill", nil))
+	}
+	blocked := make(chan error, 1)
+	go func() { blocked <- m.Publish(context.Background(), "loop", "blocked", nil) }()
+	close(release)
+
+	var full int
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				assert.ErrorIs(t, err, ErrMemoryBufferFull)
+				full++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler publish deadlocked")
+		}
+	}
+	assert.Positive(t, full)
+	select {
+	case err := <-blocked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked publisher never resumed")
+	}
+}
+
+func TestMemoryMessenger_SpillPreservesOrder(t *testing.T) {
+	spillDir := t.TempDir()
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{BufferSize: 2, SpillDir: spillDir})
+
+	release := make(chan struct{})
+	var c collector
+	require.NoError(t, m.Subscribe(context.Background(), "burst", "sub", func(ctx context.Context, msg km.Message) error {
+		<-release
+		return c.handle(ctx, msg)
+	}))
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, m.Publish(context.Background(), "burst", "t", map[string]any{"i": i}))
+	}
+	_, err := os.Stat(filepath.Join(spillDir, "burst", "sub.jsonl"))
+	require.NoError(t, err, "overflow is spilled to disk")
+
+	close(release)
+	msgs := c.waitFor(t, 50)
+	for i, msg := range msgs {
+		assert.Equal(t, float64(i), msg.Payload.(map[string]any)["i"])
+	}
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(spillDir, "burst", "sub.jsonl"))
+		return os.IsNotExist(err)
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMemoryMessenger_RetriesThenDeadLetters(t *testing.T) {
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{MaxRetries: 2})
+
+	var dead collector
+	require.NoError(t, m.Subscribe(context.Background(), "jobs.dead-letter", "dl", dead.handle))
+
+	var mu sync.Mutex
+	attempts := 0
+	require.NoError(t, m.Subscribe(context.Background(), "jobs", "worker", func(_ context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if msg.Payload.(map[string]any)["fail"] == true {
+			panic("boom")
+		}
+		return nil
+	}))
+
+	require.NoError(t, m.Publish(context.Background(), "jobs", "job.v1", map[string]any{"fail": true}))
+	msgs := dead.waitFor(t, 1)
+
+	mu.Lock()
+	assert.Equal(t, 3, attempts)
+	mu.Unlock()
+	assert.Equal(t, deadLetterPayloadType, msgs[0].PayloadType)
+	payload := msgs[0].Payload.(map[string]any)
+	assert.Equal(t, float64(2), payload["retries"])
+	assert.Contains(t, payload["last_error"], "handler panic: boom")
+	assert.Equal(t, "jobs", payload["original"].(map[string]any)["channel"])
+}
+
+func TestMemoryMessenger_UnsubscribeAndClose(t *testing.T) {
+	m := newTestMemoryMessenger(t, MemoryMessengerConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var c collector
+	require.NoError(t, m.Subscribe(ctx, "ch", "sub", c.handle))
+	cancel()
+
+	// the subscriber ID becomes free once the watcher has removed it
+	require.Eventually(t, func() bool {
+		return m.Subscribe(context.Background(), "ch", "sub", c.handle) == nil
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, m.Close())
+	require.NoError(t, m.Close())
+	assert.ErrorIs(t, m.Publish(context.Background(), "ch", "t", 1), km.ErrMessengerClosed)
+	assert.ErrorIs(t, m.Subscribe(context.Background(), "ch", "other", c.handle), km.ErrMessengerClosed)
+}
+
+var _ core.MessengerApi = (*MemoryMessenger)(nil)
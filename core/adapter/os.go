@@ -37,6 +37,9 @@ func (OsProvider) Chtimes(name string, atime time.Time, mtime time.Time) error {
 func (OsProvider) Remove(name string) error {
 	return os.Remove(name)
 }
+func (OsProvider) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
 func (OsProvider) Command(name string, arg ...string) core.CommandApi {
 	return exec.Command(name, arg...) //nolint:gosec // intentional OS wrapper for executing configured commands
 }
@@ -89,6 +89,23 @@ func TestOsProvider_Remove(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
+func TestOsProvider_Rename(t *testing.T) {
+	provider := OsProvider{}
+	dir := t.TempDir()
+	oldPath := dir + "/old"
+	newPath := dir + "/new"
+	if err := os.WriteFile(oldPath, []byte("test"), 0600); err != nil {
+		assert.NoError(t, err)
+	}
+	err := provider.Rename(oldPath, newPath)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(oldPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(newPath)
+	assert.NoError(t, err)
+}
+
 func TestOsProvider_Chtimes(t *testing.T) {
 	provider := OsProvider{}
 	tmpFile := t.TempDir() + "/testfile"
@@ -0,0 +1,294 @@
+//nolint:revive
+package adapter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	_ "modernc.org/sqlite" // registers the pure-Go sqlite driver, so builds need no cgo
+)
+
+// SQLiteStateStore persists state as JSON values in a single SQLite database, in WAL mode so
+// readers do not block the writer. It suits services that keep many small entries, which would
+// otherwise each be a file with FileStateStore.
+type SQLiteStateStore struct {
+	Path string
+	db   *sql.DB
+}
+
+// expires_at is in Unix milliseconds, NULL for keys without a TTL. Expired rows are hidden by
+// every query and purged when the store is opened.
+const sqliteStateSchema = `
+CREATE TABLE IF NOT EXISTS state (
+	key        TEXT PRIMARY KEY,
+	value      TEXT NOT NULL CHECK (json_valid(value)),
+	updated_at INTEGER NOT NULL,
+	expires_at INTEGER
+)`
+
+// sqliteStateLive restricts a query on the state table to keys that have not expired.
+const sqliteStateLive = `(expires_at IS NULL OR expires_at > ?)`
+
+// NewSQLiteStateStore opens, or creates, the state database at path.
+func NewSQLiteStateStore(path string) (*SQLiteStateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("SQLiteStateStore: open %s: %w", path, err)
+	}
+	if err := migrateSQLiteState(db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("SQLiteStateStore: create schema in %s: %w", path, err)
+	}
+	if _, err := db.Exec(`DELETE FROM state WHERE NOT `+sqliteStateLive, time.Now().UnixMilli()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("SQLiteStateStore: purge expired keys in %s: %w", path, err)
+	}
+	return &SQLiteStateStore{Path: path, db: db}, nil
+}
+
+// migrateSQLiteState creates the state table, adding columns missing from older databases.
+func migrateSQLiteState(db *sql.DB) error {
+	if _, err := db.Exec(sqliteStateSchema); err != nil {
+		return err
+	}
+	var hasExpiry bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_table_info('state') WHERE name = 'expires_at')`).Scan(&hasExpiry); err != nil {
+		return err
+	}
+	if !hasExpiry {
+		if _, err := db.Exec(`ALTER TABLE state ADD COLUMN expires_at INTEGER`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (s *SQLiteStateStore) Close() error {
+	return s.db.Close()
+}
+
+// Save writes a value as JSON under key, replacing any previous value.
+func (s *SQLiteStateStore) Save(key string, value interface{}) error {
+	return s.save(key, value, time.Time{})
+}
+
+// SaveWithTTL writes value like Save; after ttl the key is treated as deleted.
+func (s *SQLiteStateStore) SaveWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return s.save(key, value, time.Now().Add(ttl))
+}
+
+func (s *SQLiteStateStore) save(key string, value interface{}, expiresAt time.Time) error {
+	if err := validateStateKey(key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return saveState(s.db, key, data, expiresAt)
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func saveState(db sqlQuerier, key string, data []byte, expiresAt time.Time) error {
+	var expires sql.NullInt64
+	if !expiresAt.IsZero() {
+		expires = sql.NullInt64{Int64: expiresAt.UnixMilli(), Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO state (key, value, updated_at, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at, expires_at = excluded.expires_at`,
+		key, string(data), time.Now().UnixMilli(), expires)
+	if err != nil {
+		return fmt.Errorf("SQLiteStateStore: save %q: %w", key, err)
+	}
+	return nil
+}
+
+// loadState returns the JSON stored under key, or nil when it is missing or expired.
+func loadState(db sqlQuerier, key string) ([]byte, error) {
+	var data string
+	err := db.QueryRow(`SELECT value FROM state WHERE key = ? AND `+sqliteStateLive, key, time.Now().UnixMilli()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SQLiteStateStore: load %q: %w", key, err)
+	}
+	return []byte(data), nil
+}
+
+// Load decodes the value stored under key into value. A missing key leaves value unchanged.
+func (s *SQLiteStateStore) Load(key string, value interface{}) error {
+	if err := validateStateKey(key); err != nil {
+		return err
+	}
+	data, err := loadState(s.db, key)
+	if err != nil || data == nil {
+		return err // No state yet is not an error
+	}
+	return json.Unmarshal(data, value)
+}
+
+// Delete removes key.
+func (s *SQLiteStateStore) Delete(key string) error {
+	if err := validateStateKey(key); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM state WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("SQLiteStateStore: delete %q: %w", key, err)
+	}
+	return nil
+}
+
+// ExpiresAt returns when key expires, or the zero time when it has no expiry or is missing.
+func (s *SQLiteStateStore) ExpiresAt(key string) (time.Time, error) {
+	if err := validateStateKey(key); err != nil {
+		return time.Time{}, err
+	}
+	var expires sql.NullInt64
+	err := s.db.QueryRow(`SELECT expires_at FROM state WHERE key = ? AND `+sqliteStateLive, key, time.Now().UnixMilli()).Scan(&expires)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !expires.Valid {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("SQLiteStateStore: expiry of %q: %w", key, err)
+	}
+	return time.UnixMilli(expires.Int64), nil
+}
+
+// List returns the keys starting with prefix in sorted order.
+func (s *SQLiteStateStore) List(prefix string) ([]string, error) {
+	// substr rather than LIKE, which would treat % and _ in the prefix as wildcards
+	rows, err := s.db.Query(`SELECT key FROM state WHERE substr(key, 1, length(?)) = ? AND `+sqliteStateLive+` ORDER BY key`,
+		prefix, prefix, time.Now().UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("SQLiteStateStore: list %q: %w", prefix, err)
+	}
+	defer func() { _ = rows.Close() }()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// CompareAndSwap saves new under key in a transaction if the stored value equals old.
+func (s *SQLiteStateStore) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	if err := validateStateKey(key); err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(new)
+	if err != nil {
+		return false, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("SQLiteStateStore: begin compare-and-swap: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stored, err := loadState(tx, key)
+	if err != nil {
+		return false, err
+	}
+	if equal, err := core.StateValueEqual(stored, old); err != nil || !equal {
+		return false, err
+	}
+	if err := saveState(tx, key, data, time.Time{}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("SQLiteStateStore: commit compare-and-swap: %w", err)
+	}
+	return true, nil
+}
+
+// ImportResult reports what ImportFiles did.
+type ImportResult struct {
+	Imported []string // keys written to the database
+	Skipped  []string // keys already in the database
+	Invalid  []string // files that are not valid JSON
+}
+
+// ImportFiles copies the state files a FileStateStore wrote to dataDir into the database in a
+// single transaction, with their expiries. Keys that already exist are skipped unless overwrite
+// is set, and expired keys are not imported. The files are left in place.
+func (s *SQLiteStateStore) ImportFiles(dataDir string, overwrite bool) (ImportResult, error) {
+	var res ImportResult
+	paths, err := filepath.Glob(filepath.Join(dataDir, "state_*.json"))
+	if err != nil {
+		return res, err
+	}
+	sort.Strings(paths)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return res, fmt.Errorf("SQLiteStateStore: begin import: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	files := NewFileStateStore(dataDir, OsProvider{})
+	for _, path := range paths {
+		name := filepath.Base(path)
+		key := DecodeStateKey(strings.TrimSuffix(strings.TrimPrefix(name, "state_"), ".json"))
+		data, err := os.ReadFile(path) //nolint:gosec // path comes from globbing the data dir
+		if err != nil {
+			return res, err
+		}
+		if !json.Valid(data) {
+			res.Invalid = append(res.Invalid, name)
+			continue
+		}
+		if !overwrite {
+			var exists bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM state WHERE key = ?)`, key).Scan(&exists); err != nil {
+				return res, fmt.Errorf("SQLiteStateStore: import %q: %w", key, err)
+			}
+			if exists {
+				res.Skipped = append(res.Skipped, key)
+				continue
+			}
+		}
+		expiresAt := files.readExpiry(path)
+		if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+			continue
+		}
+		if err := saveState(tx, key, data, expiresAt); err != nil {
+			return res, err
+		}
+		res.Imported = append(res.Imported, key)
+	}
+	if err := tx.Commit(); err != nil {
+		return ImportResult{}, fmt.Errorf("SQLiteStateStore: commit import: %w", err)
+	}
+	return res, nil
+}
+
+// Compile-time check that SQLiteStateStore satisfies core.ExtendedStateStoreApi and
+// core.StateExpiryApi.
+var (
+	_ core.ExtendedStateStoreApi = (*SQLiteStateStore)(nil)
+	_ core.StateExpiryApi        = (*SQLiteStateStore)(nil)
+)
@@ -0,0 +1,194 @@
+//nolint:revive
+package adapter
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteStateStore(t *testing.T) *SQLiteStateStore {
+	t.Helper()
+	store, err := NewSQLiteStateStore(filepath.Join(t.TempDir(), "nested", "state.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestSQLiteStateStore(t *testing.T) {
+	store := newTestSQLiteStateStore(t)
+
+	t.Run("Save and Load Struct", func(t *testing.T) {
+		type TestData struct {
+			Name  string
+			Value int
+			When  time.Time
+		}
+		val := TestData{Name: "hello", Value: 42, When: time.Now().Round(time.Second).UTC()}
+		require.NoError(t, store.Save("test_struct", val))
+
+		var loaded TestData
+		require.NoError(t, store.Load("test_struct", &loaded))
+		assert.Equal(t, val, loaded)
+	})
+
+	t.Run("Save replaces", func(t *testing.T) {
+		require.NoError(t, store.Save("counter", 1))
+		require.NoError(t, store.Save("counter", 2))
+		var n int
+		require.NoError(t, store.Load("counter", &n))
+		assert.Equal(t, 2, n)
+	})
+
+	t.Run("Load non-existent", func(t *testing.T) {
+		loaded := "unchanged"
+		require.NoError(t, store.Load("does_not_exist", &loaded))
+		assert.Equal(t, "unchanged", loaded)
+	})
+
+	t.Run("Any key is allowed", func(t *testing.T) {
+		require.NoError(t, store.Save("../odd key/ü", "x"))
+		var val string
+		require.NoError(t, store.Load("../odd key/ü", &val))
+		assert.Equal(t, "x", val)
+		assert.ErrorIs(t, store.Save("", "x"), ErrStateKey)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Error(t, store.Save("test_marshal", func() {}))
+		require.NoError(t, store.Save("mismatch", "not a map"))
+		var val map[string]string
+		assert.Error(t, store.Load("mismatch", &val))
+	})
+
+	t.Run("WAL mode", func(t *testing.T) {
+		var mode string
+		require.NoError(t, store.db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+		assert.Equal(t, "wal", mode)
+	})
+
+	t.Run("Concurrent saves", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, store.Save(fmt.Sprintf("concurrent_%d", i), i))
+			}()
+		}
+		wg.Wait()
+		var n int
+		require.NoError(t, store.Load("concurrent_19", &n))
+		assert.Equal(t, 19, n)
+	})
+}
+
+func TestSQLiteStateStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := NewSQLiteStateStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Save("kept", "value"))
+	require.NoError(t, store.Close())
+
+	store, err = NewSQLiteStateStore(path)
+	require.NoError(t, err)
+	defer func() { _ = store.Close() }()
+	var val string
+	require.NoError(t, store.Load("kept", &val))
+	assert.Equal(t, "value", val)
+}
+
+func TestSQLiteStateStore_ImportFiles(t *testing.T) {
+	dataDir := t.TempDir()
+	files := NewFileStateStore(dataDir, OsProvider{})
+	require.NoError(t, files.Save("heartbeat", map[string]int{"beats": 3}))
+	require.NoError(t, files.Save("wasm_plugin/a b", "plugin"))
+	require.NoError(t, files.Save("existing", "from file"))
+	require.NoError(t, files.Save("existing", "from file, second save"))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "state_broken.json"), []byte("{"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "unrelated.json"), []byte("{}"), 0600))
+
+	store := newTestSQLiteStateStore(t)
+	require.NoError(t, store.Save("existing", "from db"))
+
+	res, err := store.ImportFiles(dataDir, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"heartbeat", "wasm_plugin/a b"}, res.Imported)
+	assert.Equal(t, []string{"existing"}, res.Skipped)
+	assert.Equal(t, []string{"state_broken.json"}, res.Invalid)
+
+	var beats map[string]int
+	require.NoError(t, store.Load("heartbeat", &beats))
+	assert.Equal(t, map[string]int{"beats": 3}, beats)
+	var s string
+	require.NoError(t, store.Load("wasm_plugin/a b", &s))
+	assert.Equal(t, "plugin", s)
+	require.NoError(t, store.Load("existing", &s))
+	assert.Equal(t, "from db", s)
+
+	res, err = store.ImportFiles(dataDir, true)
+	require.NoError(t, err)
+	assert.Contains(t, res.Imported, "existing")
+	require.NoError(t, store.Load("existing", &s))
+	assert.Equal(t, "from file, second save", s, "the backup file is not imported")
+}
+
+func TestDecodeStateKey(t *testing.T) {
+	for _, key := range []string{"heartbeat", "a/b\\c%d", "../x", "ü", "100%"} {
+		assert.Equal(t, key, DecodeStateKey(EncodeStateKey(key)), key)
+	}
+	assert.Equal(t, "legacy%zz", DecodeStateKey("legacy%zz"))
+	assert.Equal(t, "trailing%4", DecodeStateKey("trailing%4"))
+}
+
+func TestSQLiteStateStore_Extended(t *testing.T) {
+	testutil.StateStoreConformance(t, func(t *testing.T) core.ExtendedStateStoreApi {
+		return newTestSQLiteStateStore(t)
+	})
+}
+
+func TestSQLiteStateStore_UpgradesSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE state (key TEXT PRIMARY KEY, value TEXT NOT NULL CHECK (json_valid(value)), updated_at INTEGER NOT NULL);
+		INSERT INTO state VALUES ('old', '"value"', 0)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := NewSQLiteStateStore(path)
+	require.NoError(t, err)
+	defer func() { _ = store.Close() }()
+	var val string
+	require.NoError(t, store.Load("old", &val))
+	assert.Equal(t, "value", val)
+	require.NoError(t, store.SaveWithTTL("new", 1, time.Hour))
+}
+
+func TestSQLiteStateStore_ImportFilesExpiry(t *testing.T) {
+	dataDir := t.TempDir()
+	files := NewFileStateStore(dataDir, OsProvider{})
+	require.NoError(t, files.SaveWithTTL("session", "s", time.Hour))
+	require.NoError(t, files.SaveWithTTL("stale", "s", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	store := newTestSQLiteStateStore(t)
+	res, err := store.ImportFiles(dataDir, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"session"}, res.Imported)
+
+	var expires sql.NullInt64
+	require.NoError(t, store.db.QueryRow(`SELECT expires_at FROM state WHERE key = 'session'`).Scan(&expires))
+	assert.True(t, expires.Valid)
+	assert.InDelta(t, time.Now().Add(time.Hour).UnixMilli(), expires.Int64, float64(time.Minute.Milliseconds()))
+}
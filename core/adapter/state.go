@@ -3,17 +3,37 @@ package adapter
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/wu/keyop/core"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wu/keyop/core"
 )
 
+// ErrStateKey is returned for keys that cannot be stored.
+var ErrStateKey = errors.New("invalid state key")
+
 // FileStateStore persists state to files under a data directory.
+//
+// Each key is stored as state_<key>.json, with bytes outside [A-Za-z0-9._-] percent-encoded so a
+// key can never name a file outside DataDir. Saves write a temporary file, sync it and rename it
+// over the previous version, which is kept as a .bak file. A state file that is not valid JSON
+// is moved aside with a .corrupt-<time> suffix and the backup is loaded instead. Expiries set
+// with SaveWithTTL are kept in a .expires file next to the state file. Files written under
+// unencoded keys by earlier versions are renamed once per DataDir, on first use.
 type FileStateStore struct {
-	DataDir string
-	os      core.OsProviderApi
+	DataDir  string
+	os       core.OsProviderApi
+	mu       sync.Mutex
+	migrated bool // legacy file names have been renamed; see migrateLegacyLocked
 }
 
 // NewFileStateStore creates a FileStateStore rooted at the given dataDir.
@@ -24,13 +44,123 @@ func NewFileStateStore(dataDir string, os core.OsProviderApi) *FileStateStore {
 	}
 }
 
+// EncodeStateKey returns the file name component used for key.
+func EncodeStateKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeStateKey reverses EncodeStateKey. Names written before keys were encoded are returned
+// unchanged when they contain an invalid escape.
+func DecodeStateKey(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b = append(b, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return name
+		}
+		v, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return name
+		}
+		b = append(b, byte(v))
+		i += 2
+	}
+	return string(b)
+}
+
 func (s *FileStateStore) getFilePath(key string) string {
-	return filepath.Join(s.DataDir, fmt.Sprintf("state_%s.json", key))
+	return filepath.Join(s.DataDir, fmt.Sprintf("state_%s.json", EncodeStateKey(key)))
+}
+
+// stateKeysEncodedMarker is created in DataDir once files written under unencoded keys by earlier
+// versions have been renamed.
+const stateKeysEncodedMarker = ".state-keys-encoded"
+
+// migrateLegacyLocked renames, once per DataDir, state files written by earlier versions under
+// the unencoded key to their encoded name. A name that is already a valid encoding is left
+// alone, since it may belong to a current key: state_a%20b.json is the key "a b", never the
+// legacy file of the key "a%20b". Called with s.mu held.
+func (s *FileStateStore) migrateLegacyLocked() error {
+	if s.migrated {
+		return nil
+	}
+	marker := filepath.Join(s.DataDir, stateKeysEncodedMarker)
+	if _, err := s.os.Stat(marker); err == nil {
+		s.migrated = true
+		return nil
+	}
+	entries, err := s.os.ReadDir(s.DataDir)
+	if os.IsNotExist(err) {
+		return nil // nothing written yet; checked again once the directory exists
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "state_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(name, "state_"), ".json")
+		if EncodeStateKey(DecodeStateKey(key)) == key {
+			continue
+		}
+		legacy := filepath.Join(s.DataDir, name)
+		path := s.getFilePath(key)
+		if _, err := s.os.Stat(path); err == nil {
+			log.Printf("FileStateStore: not migrating %s, %s already exists", legacy, path)
+			continue
+		}
+		if err := s.os.Rename(legacy, path); err != nil {
+			return fmt.Errorf("FileStateStore: migrate %s: %w", legacy, err)
+		}
+		log.Printf("FileStateStore: migrated %s to %s", legacy, path)
+	}
+	if err := s.writeSynced(marker, nil); err != nil {
+		// the scan is repeated by the next process, which finds nothing left to rename
+		log.Printf("FileStateStore: failed to mark %s migrated: %v", s.DataDir, err)
+	}
+	s.migrated = true
+	return nil
+}
+
+func validateStateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: key must not be empty", ErrStateKey)
+	}
+	return nil
 }
 
 // Save writes a value as JSON to the state file identified by key.
 func (s *FileStateStore) Save(key string, value interface{}) error {
-	path := s.getFilePath(key)
+	return s.save(key, value, time.Time{})
+}
+
+// SaveWithTTL writes value like Save; after ttl the key is treated as deleted. The expiry is
+// kept next to the state file in state_<key>.json.expires.
+func (s *FileStateStore) SaveWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return s.save(key, value, time.Now().Add(ttl))
+}
+
+func (s *FileStateStore) save(key string, value interface{}, expiresAt time.Time) error {
+	if err := validateStateKey(key); err != nil {
+		return err
+	}
 
 	err := s.os.MkdirAll(s.DataDir, 0750)
 	if err != nil {
@@ -42,40 +172,283 @@ func (s *FileStateStore) Save(key string, value interface{}) error {
 		return err
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(key, data, expiresAt)
+}
+
+// writeLocked atomically replaces the state file for key. Called with s.mu held.
+func (s *FileStateStore) writeLocked(key string, data []byte, expiresAt time.Time) error {
+	if err := s.migrateLegacyLocked(); err != nil {
+		return err
+	}
+	path := s.getFilePath(key)
+	if err := s.writeExpiry(path, expiresAt); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := s.writeSynced(tmp, data); err != nil {
+		_ = s.os.Remove(tmp)
+		return err
+	}
+	if err := s.os.Rename(path, path+".bak"); err != nil && !os.IsNotExist(err) {
+		_ = s.os.Remove(tmp)
+		return fmt.Errorf("FileStateStore: keep backup of %s: %w", path, err)
+	}
+	if err := s.os.Rename(tmp, path); err != nil {
+		_ = s.os.Remove(tmp)
+		return fmt.Errorf("FileStateStore: replace %s: %w", path, err)
+	}
+	s.syncDir()
+	return nil
+}
+
+func (s *FileStateStore) writeExpiry(path string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		if err := s.os.Remove(path + ".expires"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return s.writeSynced(path+".expires", []byte(expiresAt.UTC().Format(time.RFC3339Nano)))
+}
+
+// readExpiry returns the expiry recorded for the state file at path, or the zero time.
+func (s *FileStateStore) readExpiry(path string) time.Time {
+	data, err := s.readFile(path + ".expires")
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Printf("FileStateStore: ignoring unreadable expiry for %s: %v", path, err)
+		return time.Time{}
+	}
+	return t
+}
+
+func (s *FileStateStore) writeSynced(path string, data []byte) error {
 	f, err := s.os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Printf("FileStateStore: failed to close file %s: %v", path, err)
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if syncer, ok := f.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			_ = f.Close()
+			return err
 		}
-	}()
+	}
+	return f.Close()
+}
 
-	_, err = f.WriteString(string(data))
-	return err
+// syncDir makes the rename durable; failures are logged, the data itself is already synced.
+func (s *FileStateStore) syncDir() {
+	d, err := s.os.OpenFile(s.DataDir, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	if syncer, ok := d.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			log.Printf("FileStateStore: failed to sync %s: %v", s.DataDir, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		log.Printf("FileStateStore: failed to close %s: %v", s.DataDir, err)
+	}
 }
 
 // Load reads and decodes JSON state from the file identified by key into value.
 func (s *FileStateStore) Load(key string, value interface{}) error {
+	if err := validateStateKey(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.loadLocked(key)
+	if err != nil || data == nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// loadLocked returns the stored JSON for key, or nil when there is none or it has expired.
+// Called with s.mu held.
+func (s *FileStateStore) loadLocked(key string) ([]byte, error) {
+	if err := s.migrateLegacyLocked(); err != nil {
+		return nil, err
+	}
 	path := s.getFilePath(key)
 
-	f, err := s.os.OpenFile(path, os.O_RDONLY, 0600)
-	if err != nil {
+	data, err := s.readFile(path)
+	if err == nil && !json.Valid(data) {
+		s.quarantine(path)
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		// a crash between the two renames in Save, or a quarantined file: fall back to the backup
+		data, err = s.readFile(path + ".bak")
 		if os.IsNotExist(err) {
-			return nil // No state yet, not an error
+			return nil, nil // No state yet, not an error
+		}
+		if err == nil && !json.Valid(data) {
+			s.quarantine(path + ".bak")
+			return nil, nil
+		}
+		if err == nil {
+			log.Printf("FileStateStore: recovered %s from backup", path)
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt := s.readExpiry(path); !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		return nil, s.deleteLocked(key)
+	}
+	return data, nil
+}
+
+// Delete removes the state file for key with its backup and expiry.
+func (s *FileStateStore) Delete(key string) error {
+	if err := validateStateKey(key); err != nil {
 		return err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteLocked(key)
+}
+
+func (s *FileStateStore) deleteLocked(key string) error {
+	if err := s.migrateLegacyLocked(); err != nil {
+		return err
+	}
+	path := s.getFilePath(key)
+	var errs []error
+	for _, p := range []string{path, path + ".bak", path + ".expires"} {
+		if err := s.os.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ExpiresAt returns when key expires, or the zero time when it has no expiry or is missing.
+func (s *FileStateStore) ExpiresAt(key string) (time.Time, error) {
+	if err := validateStateKey(key); err != nil {
+		return time.Time{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.migrateLegacyLocked(); err != nil {
+		return time.Time{}, err
+	}
+	expiresAt := s.readExpiry(s.getFilePath(key))
+	if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		return time.Time{}, nil
+	}
+	return expiresAt, nil
+}
+
+// List returns the keys in DataDir that start with prefix, in sorted order.
+func (s *FileStateStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.migrateLegacyLocked(); err != nil {
+		return nil, err
+	}
+	entries, err := s.os.ReadDir(s.DataDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, entry := range entries {
+		// a key whose rename was interrupted only has its .bak file
+		name := strings.TrimSuffix(entry.Name(), ".bak")
+		if entry.IsDir() || !strings.HasPrefix(name, "state_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key := DecodeStateKey(strings.TrimSuffix(strings.TrimPrefix(name, "state_"), ".json"))
+		if seen[key] || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		seen[key] = true
+		if expiresAt := s.readExpiry(filepath.Join(s.DataDir, name)); !expiresAt.IsZero() && !now.Before(expiresAt) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// CompareAndSwap saves new under key if the stored value equals old. It is atomic with respect
+// to other calls on this store, not to other processes writing the same directory.
+func (s *FileStateStore) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	if err := validateStateKey(key); err != nil {
+		return false, err
+	}
+	if err := s.os.MkdirAll(s.DataDir, 0750); err != nil {
+		return false, err
+	}
+	data, err := json.MarshalIndent(new, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.loadLocked(key)
+	if err != nil {
+		return false, err
+	}
+	if equal, err := core.StateValueEqual(stored, old); err != nil || !equal {
+		return false, err
+	}
+	if err := s.writeLocked(key, data, time.Time{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileStateStore) readFile(path string) ([]byte, error) {
+	f, err := s.os.OpenFile(path, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		if err := f.Close(); err != nil {
 			log.Printf("FileStateStore: failed to close file %s: %v", path, err)
 		}
 	}()
+	return io.ReadAll(f)
+}
 
-	decoder := json.NewDecoder(f)
-	return decoder.Decode(value)
+// quarantine moves a corrupt state file aside so it no longer blocks Load but can be inspected.
+func (s *FileStateStore) quarantine(path string) {
+	dest := fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := s.os.Rename(path, dest); err != nil {
+		log.Printf("FileStateStore: failed to quarantine corrupt state file %s: %v", path, err)
+		return
+	}
+	log.Printf("FileStateStore: quarantined corrupt state file %s as %s", path, dest)
 }
 
-// Compile-time check that FileStateStore satisfies core.StateStoreApi.
-var _ core.StateStoreApi = (*FileStateStore)(nil)
+// Compile-time check that FileStateStore satisfies core.ExtendedStateStoreApi and
+// core.StateExpiryApi.
+var (
+	_ core.ExtendedStateStoreApi = (*FileStateStore)(nil)
+	_ core.StateExpiryApi        = (*FileStateStore)(nil)
+)
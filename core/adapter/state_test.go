@@ -117,6 +117,15 @@ func TestFileStateStore(t *testing.T) {
 	})
 
 	t.Run("Load error - Decode", func(t *testing.T) {
+		key := "mismatch"
+		require.NoError(t, store.Save(key, "not a map"))
+
+		var val map[string]string
+		err := store.Load(key, &val)
+		assert.Error(t, err, "valid JSON of the wrong type is still an error")
+	})
+
+	t.Run("Corrupt file is quarantined", func(t *testing.T) {
 		key := "malformed"
 		path := filepath.Join(tmpDir, "state_"+key+".json")
 		err := os.WriteFile(path, []byte("{invalid json}"), 0600)
@@ -124,6 +133,135 @@ func TestFileStateStore(t *testing.T) {
 
 		var val map[string]string
 		err = store.Load(key, &val)
-		assert.Error(t, err)
+		assert.NoError(t, err)
+		assert.Empty(t, val)
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		quarantined, err := filepath.Glob(path + ".corrupt-*")
+		require.NoError(t, err)
+		assert.Len(t, quarantined, 1)
+	})
+
+	t.Run("Corrupt file recovers from backup", func(t *testing.T) {
+		key := "recover"
+		require.NoError(t, store.Save(key, map[string]int{"n": 1}))
+		require.NoError(t, store.Save(key, map[string]int{"n": 2}))
+		// simulate a torn write of the current version
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "state_recover.json"), []byte(`{"n": `), 0600))
+
+		var val map[string]int
+		require.NoError(t, store.Load(key, &val))
+		assert.Equal(t, map[string]int{"n": 1}, val)
+	})
+
+	t.Run("Save leaves no temporary file", func(t *testing.T) {
+		require.NoError(t, store.Save("atomic", 1))
+		_, err := os.Stat(filepath.Join(tmpDir, "state_atomic.json.tmp"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Keys cannot escape DataDir", func(t *testing.T) {
+		dir := t.TempDir()
+		s := NewFileStateStore(filepath.Join(dir, "data"), osProvider)
+		require.NoError(t, s.Save("../../escape", "x"))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "only the data dir is created")
+		_, err = os.Stat(filepath.Join(dir, "data", "state_..%2F..%2Fescape.json"))
+		assert.NoError(t, err)
+
+		var val string
+		require.NoError(t, s.Load("../../escape", &val))
+		assert.Equal(t, "x", val)
+
+		assert.ErrorIs(t, s.Save("", "x"), ErrStateKey)
+	})
+
+	t.Run("Legacy file names are migrated", func(t *testing.T) {
+		dir := t.TempDir()
+		s := NewFileStateStore(dir, osProvider)
+		legacy := filepath.Join(dir, "state_wasm_plugin_a b.json")
+		require.NoError(t, os.WriteFile(legacy, []byte(`"old"`), 0600))
+
+		var val string
+		require.NoError(t, s.Load("wasm_plugin_a b", &val))
+		assert.Equal(t, "old", val)
+		_, err := os.Stat(legacy)
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(dir, "state_wasm_plugin_a%20b.json"))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(dir, stateKeysEncodedMarker))
+		assert.NoError(t, err, "the migration runs once per data dir")
+	})
+
+	t.Run("Encoded names are never mistaken for legacy names", func(t *testing.T) {
+		dir := t.TempDir()
+		s := NewFileStateStore(dir, osProvider)
+		require.NoError(t, s.Save("a b", "space"))
+		require.NoError(t, s.Save("a%20b", "percent"))
+
+		var val string
+		require.NoError(t, s.Load("a b", &val))
+		assert.Equal(t, "space", val)
+		require.NoError(t, s.Load("a%20b", &val))
+		assert.Equal(t, "percent", val)
+
+		require.NoError(t, s.Delete("a%20b"))
+		val = ""
+		require.NoError(t, s.Load("a b", &val))
+		assert.Equal(t, "space", val)
+
+		// a fresh store over the same directory does not rename anything
+		s = NewFileStateStore(dir, osProvider)
+		require.NoError(t, s.Save("a%20b", "percent"))
+		keys, err := s.List("")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a b", "a%20b"}, keys)
+		require.NoError(t, s.Load("a b", &val))
+		assert.Equal(t, "space", val)
+	})
+}
+
+func TestEncodeStateKey(t *testing.T) {
+	assert.Equal(t, "heartbeat_last-run.v1", EncodeStateKey("heartbeat_last-run.v1"))
+	assert.Equal(t, "a%2Fb%5Cc%25d%00", EncodeStateKey("a/b\\c%d\x00"))
+}
+
+func TestFileStateStore_Extended(t *testing.T) {
+	testutil.StateStoreConformance(t, func(t *testing.T) core.ExtendedStateStoreApi {
+		return NewFileStateStore(t.TempDir(), OsProvider{})
+	})
+
+	t.Run("Delete removes backup and expiry", func(t *testing.T) {
+		dir := t.TempDir()
+		s := NewFileStateStore(dir, OsProvider{})
+		require.NoError(t, s.SaveWithTTL("k", 1, time.Hour))
+		require.NoError(t, s.SaveWithTTL("k", 2, time.Hour))
+		_, err := os.Stat(filepath.Join(dir, "state_k.json.expires"))
+		require.NoError(t, err)
+
+		require.NoError(t, s.Delete("k"))
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, stateKeysEncodedMarker, entries[0].Name())
+		}
+	})
+
+	t.Run("List finds keys left as backups", func(t *testing.T) {
+		dir := t.TempDir()
+		s := NewFileStateStore(dir, OsProvider{})
+		require.NoError(t, s.Save("k", 1))
+		require.NoError(t, s.Save("k", 2))
+		// simulate a crash between the two renames in Save
+		require.NoError(t, os.Remove(filepath.Join(dir, "state_k.json")))
+		keys, err := s.List("")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"k"}, keys)
+
+		keys, err = NewFileStateStore(filepath.Join(dir, "missing"), OsProvider{}).List("")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
 	})
 }
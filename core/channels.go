@@ -0,0 +1,57 @@
+package core
+
+import "fmt"
+
+// Well-known channel names, used as defaults when a service does not configure its own.
+const (
+	AlertsChannel  = "alerts"
+	MetricsChannel = "metrics"
+	ErrorsChannel  = "errors"
+	StatusChannel  = "status"
+)
+
+// PubChannel resolves the logical pub key (e.g. "events", "metrics", "alerts") to the channel
+// name configured under the service's pubs, falling back to def when the key is not declared or
+// has no name.
+func (c ServiceConfig) PubChannel(key, def string) string {
+	return resolveChannel(c.Pubs, key, def)
+}
+
+// SubChannel resolves a logical sub key like PubChannel.
+func (c ServiceConfig) SubChannel(key, def string) string {
+	return resolveChannel(c.Subs, key, def)
+}
+
+func resolveChannel(channels map[string]ChannelInfo, key, def string) string {
+	if info, ok := channels[key]; ok && info.Name != "" {
+		return info.Name
+	}
+	return def
+}
+
+// Strict reports whether the service may only publish to channels declared in its pubs. It is
+// enabled with enforce_pubs in the interceptors section of messenger.yaml or the service config.
+func (c ServiceConfig) Strict() bool {
+	return enabled(c.Interceptors.EnforcePubs)
+}
+
+// ValidatePubs returns an error for each logical pub key that is not declared with a channel
+// name, or that sets a Remote name other than its Name, which PubChannel does not apply. It only
+// checks in strict mode, where the defaults passed to PubChannel would be rejected at publish
+// time; services call it from ValidateConfig with the keys they use.
+func (c ServiceConfig) ValidatePubs(keys ...string) []error {
+	if !c.Strict() {
+		return nil
+	}
+	var errs []error
+	for _, key := range keys {
+		name := c.PubChannel(key, "")
+		switch remote := c.Pubs[key].Remote; {
+		case name == "":
+			errs = append(errs, fmt.Errorf("strict mode: pub %q is not declared with a channel name", key))
+		case remote != "" && remote != name:
+			errs = append(errs, fmt.Errorf("strict mode: pub %q sets remote %q, which is not supported; messages are published to %q", key, remote, name))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,47 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceConfig_PubChannel(t *testing.T) {
+	cfg := core.ServiceConfig{
+		Pubs: map[string]core.ChannelInfo{
+			"events": {Name: "garage-heartbeat"},
+			"alerts": {Description: "no name"},
+		},
+		Subs: map[string]core.ChannelInfo{"temps": {Name: "garage-temps"}},
+	}
+	assert.Equal(t, "garage-heartbeat", cfg.PubChannel("events", "heartbeat"))
+	assert.Equal(t, core.AlertsChannel, cfg.PubChannel("alerts", core.AlertsChannel))
+	assert.Equal(t, core.MetricsChannel, cfg.PubChannel("metrics", core.MetricsChannel))
+	assert.Equal(t, "garage-temps", cfg.SubChannel("temps", "temps"))
+	assert.Equal(t, "x", cfg.SubChannel("missing", "x"))
+}
+
+func TestServiceConfig_ValidatePubs(t *testing.T) {
+	cfg := core.ServiceConfig{Pubs: map[string]core.ChannelInfo{"events": {Name: "hb"}}}
+	assert.False(t, cfg.Strict())
+	assert.Empty(t, cfg.ValidatePubs("events", "metrics"))
+
+	strict := true
+	cfg.Interceptors.EnforcePubs = &strict
+	assert.True(t, cfg.Strict())
+	errs := cfg.ValidatePubs("events", "metrics", "alerts")
+	if assert.Len(t, errs, 2) {
+		assert.ErrorContains(t, errs[0], `"metrics"`)
+		assert.ErrorContains(t, errs[1], `"alerts"`)
+	}
+
+	// a remote name is not applied, so strict mode rejects one that differs from the name
+	cfg.Pubs["alerts"] = core.ChannelInfo{Name: "alerts", Remote: "hub-alerts"}
+	cfg.Pubs["metrics"] = core.ChannelInfo{Name: "metrics", Remote: "metrics"}
+	errs = cfg.ValidatePubs("events", "metrics", "alerts")
+	if assert.Len(t, errs, 1) {
+		assert.ErrorContains(t, errs[0], `remote "hub-alerts"`)
+	}
+}
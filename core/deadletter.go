@@ -0,0 +1,208 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// DeadLetterChannel receives messages that a handler could not process.
+const DeadLetterChannel = "deadletter"
+
+// DeadLetterEvent records a message a subscriber gave up on, with the original envelope and the
+// failure details needed to inspect and re-drive it.
+type DeadLetterEvent struct {
+	Channel          string          `json:"channel"`
+	SubscriberID     string          `json:"subscriberId"`
+	MessageID        string          `json:"messageId"`
+	Origin           string          `json:"origin,omitempty"`
+	OriginalType     string          `json:"originalPayloadType"`
+	CorrelationID    string          `json:"correlationId,omitempty"`
+	ServiceName      string          `json:"serviceName,omitempty"`
+	MessageTimestamp time.Time       `json:"messageTimestamp"`
+	Payload          json.RawMessage `json:"payload"`
+	Error            string          `json:"error"`
+	Attempts         int             `json:"attempts"`
+	FailedAt         time.Time       `json:"failedAt"`
+	Hostname         string          `json:"hostname,omitempty"`
+}
+
+func (d DeadLetterEvent) PayloadType() string { return "core.deadletter.v1" }
+
+// DeadLetterPolicy controls how often a failing handler is retried before its message is
+// dead-lettered. Zero fields take the defaults from DefaultDeadLetterPolicy. Retries run inline,
+// so while a message backs off no later message on that subscription is delivered; with the
+// defaults a failing message holds up its subscription for 1.4s.
+type DeadLetterPolicy struct {
+	MaxRetries     int           `yaml:"max_retries"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// DefaultDeadLetterPolicy retries three times, backing off from 200ms up to 10s.
+var DefaultDeadLetterPolicy = DeadLetterPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+func (p DeadLetterPolicy) withDefaults() DeadLetterPolicy {
+	if p.MaxRetries == 0 {
+		p.MaxRetries = DefaultDeadLetterPolicy.MaxRetries
+	} else if p.MaxRetries < 0 {
+		p.MaxRetries = 0
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultDeadLetterPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultDeadLetterPolicy.MaxBackoff
+	}
+	return p
+}
+
+// backoff returns the delay before retry attempt n (1-based).
+func (p DeadLetterPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// WithDeadLetter wraps handler so failures are retried with backoff per policy and then published
+// to DeadLetterChannel instead of being returned to the messenger. Panics count as failures.
+// Payloads that cannot be decoded (ErrPayloadTypeMismatch) are dead-lettered without retrying.
+// If the dead letter itself cannot be published, the error is returned so the messenger
+// redelivers the message; the redelivery only retries publishing the dead letter, without
+// calling handler again. After its own retries (subscribers.max_retries) the messenger
+// dead-letters the message to "<channel>.dead-letter"; keyop deadletter reads both. The backoff
+// blocks the subscription, so the subscriber's later messages wait until the message succeeds or
+// is dead-lettered.
+func WithDeadLetter(m MessengerApi, channel, subscriberID string, policy DeadLetterPolicy, handler km.HandlerFunc) km.HandlerFunc {
+	policy = policy.withDefaults()
+	// the dead letter of the last message, while it could not be published; a subscription
+	// redelivers that message before any later one
+	var mu sync.Mutex
+	var pending *DeadLetterEvent
+	publish := func(ctx context.Context, dl *DeadLetterEvent) error {
+		if pubErr := m.Publish(ctx, DeadLetterChannel, dl.PayloadType(), dl); pubErr != nil {
+			mu.Lock()
+			pending = dl
+			mu.Unlock()
+			return fmt.Errorf("dead-letter %q: %w (handler error: %s)", dl.MessageID, pubErr, dl.Error)
+		}
+		mu.Lock()
+		pending = nil
+		mu.Unlock()
+		return nil
+	}
+	return func(ctx context.Context, msg km.Message) error {
+		mu.Lock()
+		dl := pending
+		mu.Unlock()
+		if dl != nil && dl.MessageID == msg.ID {
+			return publish(ctx, dl)
+		}
+
+		var err error
+		attempts := 0
+		for attempts <= policy.MaxRetries {
+			if attempts > 0 {
+				select {
+				case <-time.After(policy.backoff(attempts)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			attempts++
+			if err = callHandler(ctx, handler, msg); err == nil {
+				return nil
+			}
+			if errors.Is(err, ErrPayloadTypeMismatch) || ctx.Err() != nil {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		dl, encErr := newDeadLetterEvent(msg, subscriberID, attempts, err)
+		if encErr != nil {
+			return fmt.Errorf("dead-letter %q: %w (handler error: %v)", msg.ID, encErr, err)
+		}
+		if channel != "" {
+			dl.Channel = channel
+		}
+		dl.Hostname = m.InstanceName()
+		return publish(ctx, dl)
+	}
+}
+
+func callHandler(ctx context.Context, handler km.HandlerFunc, msg km.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return handler(ctx, msg)
+}
+
+func newDeadLetterEvent(msg km.Message, subscriberID string, attempts int, handlerErr error) (*DeadLetterEvent, error) {
+	var payload json.RawMessage
+	if raw, ok := msg.Payload.(json.RawMessage); ok {
+		payload = raw
+	} else {
+		b, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("encode payload: %w", err)
+		}
+		payload = b
+	}
+	return &DeadLetterEvent{
+		Channel:          msg.Channel,
+		SubscriberID:     subscriberID,
+		MessageID:        msg.ID,
+		Origin:           msg.Origin,
+		OriginalType:     msg.PayloadType,
+		CorrelationID:    msg.CorrelationID,
+		ServiceName:      msg.ServiceName,
+		MessageTimestamp: msg.Timestamp,
+		Payload:          payload,
+		Error:            handlerErr.Error(),
+		Attempts:         attempts,
+		FailedAt:         time.Now().UTC(),
+	}, nil
+}
+
+// DeadLetterMessenger is a MessengerApi decorator that wraps every subscribed handler with
+// WithDeadLetter. Subscriptions to DeadLetterChannel itself are passed through unwrapped.
+type DeadLetterMessenger struct {
+	MessengerApi
+	Policy DeadLetterPolicy
+}
+
+// NewDeadLetterMessenger wraps m so handlers registered through it are dead-lettered per policy.
+func NewDeadLetterMessenger(m MessengerApi, policy DeadLetterPolicy) *DeadLetterMessenger {
+	return &DeadLetterMessenger{MessengerApi: m, Policy: policy}
+}
+
+// Subscribe registers handler wrapped with WithDeadLetter.
+func (d *DeadLetterMessenger) Subscribe(ctx context.Context, channel string, subscriberID string, handler km.HandlerFunc) error {
+	if channel != DeadLetterChannel {
+		handler = WithDeadLetter(d.MessengerApi, channel, subscriberID, d.Policy, handler)
+	}
+	return d.MessengerApi.Subscribe(ctx, channel, subscriberID, handler)
+}
+
+func init() {
+	RegisterPayload("core.deadletter.v1", DeadLetterEvent{}, CorePayloadService, "A message a subscriber failed to process, with the original envelope and error details.")
+}
@@ -0,0 +1,144 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+var fastPolicy = core.DeadLetterPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+func TestWithDeadLetter_RetriesThenPublishes(t *testing.T) {
+	m := testutil.NewFakeMessenger()
+	m.InstanceNameValue = "host1"
+	calls := 0
+	handler := core.WithDeadLetter(m, "jobs", "worker", fastPolicy, func(_ context.Context, _ km.Message) error {
+		calls++
+		return errors.New("database unavailable")
+	})
+
+	msg := km.Message{ID: "m1", Channel: "jobs", Origin: "pi", PayloadType: "core.alert.v1", CorrelationID: "c1",
+		Payload: core.AlertEvent{Summary: "disk"}, Timestamp: time.Now()}
+	require.NoError(t, handler(context.Background(), msg))
+	assert.Equal(t, 3, calls)
+
+	require.Len(t, m.PublishedMessages, 1)
+	pub := m.PublishedMessages[0]
+	assert.Equal(t, core.DeadLetterChannel, pub.Channel)
+	assert.Equal(t, "core.deadletter.v1", pub.PayloadType)
+	dl := pub.Payload.(*core.DeadLetterEvent)
+	assert.Equal(t, "jobs", dl.Channel)
+	assert.Equal(t, "worker", dl.SubscriberID)
+	assert.Equal(t, "m1", dl.MessageID)
+	assert.Equal(t, "core.alert.v1", dl.OriginalType)
+	assert.Equal(t, "c1", dl.CorrelationID)
+	assert.Equal(t, "host1", dl.Hostname)
+	assert.Equal(t, 3, dl.Attempts)
+	assert.Equal(t, "database unavailable", dl.Error)
+	assert.JSONEq(t, `{"timestamp":"0001-01-01T00:00:00Z","summary":"disk","text":""}`, string(dl.Payload))
+}
+
+func TestWithDeadLetter_RecoversAfterRetry(t *testing.T) {
+	m := testutil.NewFakeMessenger()
+	calls := 0
+	handler := core.WithDeadLetter(m, "jobs", "worker", fastPolicy, func(_ context.Context, _ km.Message) error {
+		calls++
+		if calls == 1 {
+			panic("flaky")
+		}
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), km.Message{ID: "m1"}))
+	assert.Equal(t, 2, calls)
+	assert.Empty(t, m.PublishedMessages)
+}
+
+func TestWithDeadLetter_UndecodableIsNotRetried(t *testing.T) {
+	m := testutil.NewFakeMessenger()
+	calls := 0
+	typed := core.TypedHandler(func(_ context.Context, _ core.MetricEvent) error {
+		calls++
+		return nil
+	})
+	handler := core.WithDeadLetter(m, "metrics", "worker", fastPolicy, typed)
+
+	msg := km.Message{ID: "m1", PayloadType: "core.metric.v1", Payload: json.RawMessage(`{"value":"NaN?"}`)}
+	require.NoError(t, handler(context.Background(), msg))
+	assert.Equal(t, 0, calls)
+	require.Len(t, m.PublishedMessages, 1)
+	dl := m.PublishedMessages[0].Payload.(*core.DeadLetterEvent)
+	assert.Equal(t, 1, dl.Attempts)
+	assert.Contains(t, dl.Error, "payload type mismatch")
+	assert.JSONEq(t, `{"value":"NaN?"}`, string(dl.Payload))
+}
+
+type failingPublisher struct {
+	*testutil.FakeMessenger
+	failures int // publishes to fail before succeeding; negative fails them all
+}
+
+func (f *failingPublisher) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	if f.failures == 0 {
+		return f.FakeMessenger.Publish(ctx, channel, payloadType, payload)
+	}
+	f.failures--
+	return errors.New("bus down")
+}
+
+func TestWithDeadLetter_PublishFailureIsReturned(t *testing.T) {
+	m := &failingPublisher{FakeMessenger: testutil.NewFakeMessenger(), failures: -1}
+	handler := core.WithDeadLetter(m, "jobs", "worker", core.DeadLetterPolicy{MaxRetries: -1}, func(_ context.Context, _ km.Message) error {
+		return errors.New("boom")
+	})
+	err := handler(context.Background(), km.Message{ID: "m1"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bus down")
+	assert.Contains(t, err.Error(), "boom")
+}
+
+// TestWithDeadLetter_RedeliveryOnlyRetriesDeadLetter checks that the messenger's redeliveries
+// after a failed dead-letter publish do not run the handler's retries again.
+func TestWithDeadLetter_RedeliveryOnlyRetriesDeadLetter(t *testing.T) {
+	m := &failingPublisher{FakeMessenger: testutil.NewFakeMessenger(), failures: 2}
+	calls := 0
+	handler := core.WithDeadLetter(m, "jobs", "worker", fastPolicy, func(_ context.Context, _ km.Message) error {
+		calls++
+		return errors.New("boom")
+	})
+	msg := km.Message{ID: "m1"}
+	require.Error(t, handler(context.Background(), msg))
+	require.Error(t, handler(context.Background(), msg))
+	require.NoError(t, handler(context.Background(), msg))
+	assert.Equal(t, 3, calls, "only the policy's attempts")
+	require.Len(t, m.PublishedMessages, 1)
+	assert.Equal(t, 3, m.PublishedMessages[0].Payload.(*core.DeadLetterEvent).Attempts)
+
+	// later messages get the full retries again
+	require.NoError(t, handler(context.Background(), km.Message{ID: "m2"}))
+	assert.Equal(t, 6, calls)
+}
+
+func TestDeadLetterMessenger_WrapsSubscriptions(t *testing.T) {
+	fake := testutil.NewFakeMessenger()
+	m := core.NewDeadLetterMessenger(fake, core.DeadLetterPolicy{MaxRetries: -1})
+
+	failing := func(_ context.Context, _ km.Message) error { return errors.New("nope") }
+	require.NoError(t, m.Subscribe(context.Background(), "jobs", "worker", failing))
+	require.NoError(t, m.Subscribe(context.Background(), core.DeadLetterChannel, "auditor", failing))
+
+	assert.NoError(t, fake.Handlers["jobs"](context.Background(), km.Message{ID: "m1", Channel: "jobs"}))
+	assert.Len(t, fake.PublishedMessages, 1)
+
+	// dead-letter subscribers are not wrapped, so they cannot loop back into the channel
+	assert.Error(t, fake.Handlers[core.DeadLetterChannel](context.Background(), km.Message{ID: "d1"}))
+	assert.Len(t, fake.PublishedMessages, 1)
+}
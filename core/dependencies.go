@@ -97,3 +97,8 @@ func (d *Dependencies) MustGetMessenger() MessengerApi {
 	}
 	return d.messenger
 }
+
+// GetMessenger returns the messenger if set, otherwise nil.
+func (d *Dependencies) GetMessenger() MessengerApi {
+	return d.messenger
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// ExpiryMessenger is a MessengerApi decorator that applies the max_age of a service's channels.
+//
+// Messages the service publishes to a pub with a MaxAge expire that long after publishing, unless
+// the caller set its own expiry with WithExpiry. Handlers for a sub with a MaxAge are not called
+// for messages older than that, e.g. after a long outage, and no handler is called for a message
+// whose expiry has passed. Skipped messages are acknowledged and counted.
+type ExpiryMessenger struct {
+	MessengerApi
+	service string
+	pubAges map[string]time.Duration // channel name -> max age
+	subAges map[string]time.Duration
+	logger  Logger
+	now     func() time.Time
+
+	mu      sync.Mutex
+	skipped map[[2]string]*SkipCount
+}
+
+// SkipCount is the number of messages a subscriber skipped on a channel.
+type SkipCount struct {
+	Service    string `json:"service"`
+	Channel    string `json:"channel"`
+	Subscriber string `json:"subscriber"`
+	Expired    uint64 `json:"expired"` // past the expiry set by the publisher
+	Stale      uint64 `json:"stale"`   // older than the sub's max_age
+}
+
+// NewExpiryMessenger wraps m with the max ages from svc's pubs and subs.
+func NewExpiryMessenger(m MessengerApi, svc ServiceConfig, logger Logger) *ExpiryMessenger {
+	return &ExpiryMessenger{
+		MessengerApi: m,
+		service:      svc.Name,
+		pubAges:      maxAges(svc.Pubs),
+		subAges:      maxAges(svc.Subs),
+		logger:       logger,
+		now:          time.Now,
+		skipped:      map[[2]string]*SkipCount{},
+	}
+}
+
+func maxAges(channels map[string]ChannelInfo) map[string]time.Duration {
+	ages := map[string]time.Duration{}
+	for _, info := range channels {
+		if info.Name != "" && info.MaxAge > 0 {
+			ages[info.Name] = info.MaxAge
+		}
+	}
+	return ages
+}
+
+// Publish sets an expiry of the channel's max age on the message when ctx has none.
+func (e *ExpiryMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	if maxAge := e.pubAges[channel]; maxAge > 0 && ExpiryFromContext(ctx).IsZero() {
+		ctx = WithExpiry(ctx, e.now().Add(maxAge))
+	}
+	return e.MessengerApi.Publish(ctx, channel, payloadType, payload)
+}
+
+// Subscribe registers handler so it is not called for expired or stale messages.
+func (e *ExpiryMessenger) Subscribe(ctx context.Context, channel string, subscriberID string, handler km.HandlerFunc) error {
+	maxAge := e.subAges[channel]
+	return e.MessengerApi.Subscribe(ctx, channel, subscriberID, func(ctx context.Context, msg km.Message) error {
+		md := MetadataFromContext(ctx)
+		if md.MessageID != msg.ID {
+			md = MetadataOf(msg)
+		}
+		now := e.now()
+		switch {
+		case md.Expired(now):
+			e.skip(channel, subscriberID, true)
+			e.logger.Debug("expiry: skipped expired message", "service", e.service, "channel", channel, "subscriber", subscriberID, "id", msg.ID, "expiresAt", md.ExpiresAt)
+			return nil
+		case maxAge > 0 && !msg.Timestamp.IsZero() && now.Sub(msg.Timestamp) > maxAge:
+			e.skip(channel, subscriberID, false)
+			e.logger.Debug("expiry: skipped stale message", "service", e.service, "channel", channel, "subscriber", subscriberID, "id", msg.ID, "age", now.Sub(msg.Timestamp))
+			return nil
+		}
+		return handler(ctx, msg)
+	})
+}
+
+func (e *ExpiryMessenger) skip(channel, subscriberID string, expired bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := [2]string{channel, subscriberID}
+	sc, ok := e.skipped[key]
+	if !ok {
+		sc = &SkipCount{Service: e.service, Channel: channel, Subscriber: subscriberID}
+		e.skipped[key] = sc
+	}
+	if expired {
+		sc.Expired++
+	} else {
+		sc.Stale++
+	}
+}
+
+// Skipped returns the skip counts sorted by channel and subscriber.
+func (e *ExpiryMessenger) Skipped() []SkipCount {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]SkipCount, 0, len(e.skipped))
+	for _, sc := range e.skipped {
+		out = append(out, *sc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Channel != out[j].Channel {
+			return out[i].Channel < out[j].Channel
+		}
+		return out[i].Subscriber < out[j].Subscriber
+	})
+	return out
+}
@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+func TestExpiryMessenger_SkipsStaleAndExpired(t *testing.T) {
+	fake := testutil.NewFakeMessenger()
+	svc := core.ServiceConfig{
+		Name: "switcher",
+		Subs: map[string]core.ChannelInfo{
+			"commands": {Name: "switch-commands", MaxAge: time.Minute},
+			"events":   {Name: "events"},
+		},
+	}
+	m := core.NewExpiryMessenger(fake, svc, &testutil.FakeLogger{})
+	ctx := context.Background()
+
+	var handled []string
+	handler := func(_ context.Context, msg km.Message) error {
+		handled = append(handled, msg.ID)
+		return nil
+	}
+	require.NoError(t, m.Subscribe(ctx, "switch-commands", "switcher", handler))
+	require.NoError(t, m.Subscribe(ctx, "events", "switcher", handler))
+
+	now := time.Now()
+	past := now.Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	future := now.Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	commands := fake.Handlers["switch-commands"]
+	events := fake.Handlers["events"]
+
+	require.NoError(t, commands(ctx, km.Message{ID: "fresh", Timestamp: now}))
+	require.NoError(t, commands(ctx, km.Message{ID: "stale", Timestamp: now.Add(-time.Hour)}))
+	require.NoError(t, commands(ctx, km.Message{ID: "expired", Timestamp: now, CorrelationID: ";expires=" + past}))
+	require.NoError(t, commands(ctx, km.Message{ID: "unexpired", Timestamp: now, CorrelationID: "c1;expires=" + future}))
+	// without a max_age only the publisher's expiry applies
+	require.NoError(t, events(ctx, km.Message{ID: "old", Timestamp: now.Add(-time.Hour)}))
+	require.NoError(t, events(ctx, km.Message{ID: "expired-event", Timestamp: now, CorrelationID: ";expires=" + past}))
+
+	assert.Equal(t, []string{"fresh", "unexpired", "old"}, handled)
+	assert.Equal(t, []core.SkipCount{
+		{Service: "switcher", Channel: "events", Subscriber: "switcher", Expired: 1},
+		{Service: "switcher", Channel: "switch-commands", Subscriber: "switcher", Expired: 1, Stale: 1},
+	}, m.Skipped())
+}
+
+// TestExpiryMessenger_PublishExpiry publishes through the same stack as a running service and
+// checks that the pub's max_age, or an explicit expiry, reaches the subscriber, including on
+// messages published without a correlation ID.
+func TestExpiryMessenger_PublishExpiry(t *testing.T) {
+	inner := newMetadataTestMessenger(t)
+	svc := core.ServiceConfig{
+		Name: "scheduler",
+		Pubs: map[string]core.ChannelInfo{"commands": {Name: "switch-commands", MaxAge: 30 * time.Second}},
+	}
+	m := core.NewExpiryMessenger(inner, svc, &testutil.FakeLogger{})
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	got := map[string]core.MessageMetadata{}
+	require.NoError(t, m.Subscribe(ctx, "switch-commands", "switch", func(ctx context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		cmd, ok := msg.Payload.(map[string]any)
+		require.True(t, ok, "payload %T", msg.Payload)
+		name := cmd["deviceName"].(string)
+		got[name] = core.MetadataFromContext(ctx)
+		if strings.HasPrefix(name, "uncorrelated") {
+			assert.NotEmpty(t, msg.CorrelationID, "an expiring message starts its own chain")
+			assert.NotContains(t, msg.CorrelationID, ";")
+		} else {
+			assert.Equal(t, "c1", msg.CorrelationID, "the expiry is not part of the correlation ID")
+		}
+		return nil
+	}))
+
+	correlated := km.WithCorrelationID(ctx, "c1")
+	before := time.Now()
+	require.NoError(t, m.Publish(correlated, "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "default", State: "ON"}))
+	require.NoError(t, m.Publish(core.WithTTL(correlated, time.Hour), "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "explicit", State: "ON"}))
+	require.NoError(t, m.Publish(core.WithExpiry(correlated, before.Add(-time.Second)), "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "late", State: "ON"}))
+	require.NoError(t, m.Publish(ctx, "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "uncorrelated", State: "ON"}))
+	require.NoError(t, m.Publish(core.WithExpiry(ctx, before.Add(-time.Second)), "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "uncorrelated-late", State: "ON"}))
+	require.NoError(t, m.Publish(correlated, "switch-commands", "core.switch.command.v1", core.SwitchCommand{DeviceName: "last", State: "OFF"}))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := got["last"]
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.WithinDuration(t, before.Add(30*time.Second), got["default"].ExpiresAt, 5*time.Second)
+	assert.WithinDuration(t, before.Add(time.Hour), got["explicit"].ExpiresAt, 5*time.Second)
+	assert.NotContains(t, got, "late")
+	assert.WithinDuration(t, before.Add(30*time.Second), got["uncorrelated"].ExpiresAt, 5*time.Second)
+	assert.NotContains(t, got, "uncorrelated-late")
+	assert.Equal(t, []core.SkipCount{{Service: "scheduler", Channel: "switch-commands", Subscriber: "switch", Expired: 2}}, m.Skipped())
+}
+
+func TestMetadataOf_Expiry(t *testing.T) {
+	md := core.MetadataOf(km.Message{ID: "m1", CorrelationID: "c1;cause=m0;expires=2026-01-02T03:04:05Z"})
+	assert.Equal(t, "c1", md.CorrelationID)
+	assert.Equal(t, "m0", md.CausationID)
+	assert.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), md.ExpiresAt)
+	assert.True(t, md.Expired(md.ExpiresAt.Add(time.Nanosecond)))
+	assert.False(t, md.Expired(md.ExpiresAt))
+	assert.False(t, core.MessageMetadata{}.Expired(time.Now()))
+}
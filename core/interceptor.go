@@ -0,0 +1,284 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// ErrChannelNotDeclared is returned when a service publishes to a channel missing from its pubs
+// and channel enforcement is enabled.
+var ErrChannelNotDeclared = errors.New("channel not declared in pubs")
+
+// PublishFunc publishes a single message.
+type PublishFunc func(ctx context.Context, channel string, payloadType string, payload interface{}) error
+
+// PublishInterceptor wraps the next step of a publish. It may change the arguments, reject the
+// message by returning an error without calling next, or observe the result.
+type PublishInterceptor func(next PublishFunc) PublishFunc
+
+// InterceptedMessenger is a MessengerApi decorator that runs every Publish through a chain of
+// interceptors. The first interceptor is the outermost.
+type InterceptedMessenger struct {
+	MessengerApi
+	publish PublishFunc
+}
+
+// NewInterceptedMessenger wraps m with interceptors.
+func NewInterceptedMessenger(m MessengerApi, interceptors ...PublishInterceptor) *InterceptedMessenger {
+	publish := PublishFunc(m.Publish)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		publish = interceptors[i](publish)
+	}
+	return &InterceptedMessenger{MessengerApi: m, publish: publish}
+}
+
+// Publish runs the interceptor chain.
+func (i *InterceptedMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	return i.publish(ctx, channel, payloadType, payload)
+}
+
+// InterceptorConfig selects the built-in interceptors. Unset fields inherit from the global
+// settings in messenger.yaml, then from DefaultInterceptorConfig.
+type InterceptorConfig struct {
+	StampMetadata *bool `yaml:"stamp_metadata"` // stamp the service name and fill an empty Hostname field
+	Validate      *bool `yaml:"validate"`       // reject payloads that do not match their registered type
+	EnforcePubs   *bool `yaml:"enforce_pubs"`   // only allow channels declared in the service's pubs
+	Count         *bool `yaml:"count"`          // count messages per service and channel that pass throttling
+	Log           *bool `yaml:"log"`            // log every publish at debug level
+}
+
+// DefaultInterceptorConfig counts messages. Stamping metadata is opt-in, since it changes the
+// payloads services put on the wire.
+var DefaultInterceptorConfig = InterceptorConfig{
+	StampMetadata: boolPtr(false),
+	Validate:      boolPtr(false),
+	EnforcePubs:   boolPtr(false),
+	Count:         boolPtr(true),
+	Log:           boolPtr(false),
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// Merge returns c with unset fields taken from fallback.
+func (c InterceptorConfig) Merge(fallback InterceptorConfig) InterceptorConfig {
+	pick := func(v, fb *bool) *bool {
+		if v != nil {
+			return v
+		}
+		return fb
+	}
+	return InterceptorConfig{
+		StampMetadata: pick(c.StampMetadata, fallback.StampMetadata),
+		Validate:      pick(c.Validate, fallback.Validate),
+		EnforcePubs:   pick(c.EnforcePubs, fallback.EnforcePubs),
+		Count:         pick(c.Count, fallback.Count),
+		Log:           pick(c.Log, fallback.Log),
+	}
+}
+
+func enabled(b *bool) bool { return b != nil && *b }
+
+// ServiceInterceptors builds the interceptor chain cfg selects for the service described by
+// svc. Counting is not part of the chain; see ServiceCounter.
+func ServiceInterceptors(cfg InterceptorConfig, svc ServiceConfig, hostname string, logger Logger) []PublishInterceptor {
+	var chain []PublishInterceptor
+	if enabled(cfg.Log) {
+		chain = append(chain, LogPublishes(logger, svc.Name))
+	}
+	if enabled(cfg.EnforcePubs) {
+		chain = append(chain, RestrictChannels(svc.Name, svc.Pubs))
+	}
+	if enabled(cfg.StampMetadata) {
+		chain = append(chain, StampMetadata(svc.Name, hostname))
+	}
+	if enabled(cfg.Validate) {
+		chain = append(chain, ValidatePayloads())
+	}
+	return chain
+}
+
+// ServiceCounter returns the interceptor that counts the service's publishes in counter, or nil
+// when cfg disables counting or counter is nil. It belongs below any layer that drops messages
+// without an error, such as throttling, so drops are not counted as published.
+func ServiceCounter(cfg InterceptorConfig, svc ServiceConfig, counter *PublishCounter) PublishInterceptor {
+	if !enabled(cfg.Count) || counter == nil {
+		return nil
+	}
+	return CountPublishes(counter, svc.Name)
+}
+
+// LogPublishes logs each publish and its outcome at debug level.
+func LogPublishes(logger Logger, service string) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+			err := next(ctx, channel, payloadType, payload)
+			logger.Debug("publish", "service", service, "channel", channel, "payloadType", payloadType, "error", err)
+			return err
+		}
+	}
+}
+
+// RestrictChannels rejects publishes to channels that are not named in pubs with
+// ErrChannelNotDeclared.
+func RestrictChannels(service string, pubs map[string]ChannelInfo) PublishInterceptor {
+	allowed := make(map[string]bool, len(pubs))
+	for _, info := range pubs {
+		allowed[info.Name] = true
+	}
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+			if !allowed[channel] {
+				return fmt.Errorf("%s: publish to %q: %w", service, channel, ErrChannelNotDeclared)
+			}
+			return next(ctx, channel, payloadType, payload)
+		}
+	}
+}
+
+// StampMetadata sets the service name on the context when it is missing, and fills an empty
+// string Hostname field of struct payloads. The caller's payload is never modified.
+func StampMetadata(service, hostname string) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+			if km.ServiceNameFromContext(ctx) == "" {
+				ctx = km.WithServiceName(ctx, service)
+			}
+			return next(ctx, channel, payloadType, withHostname(payload, hostname))
+		}
+	}
+}
+
+func withHostname(payload interface{}, hostname string) interface{} {
+	v := reflect.ValueOf(payload)
+	isPtr := v.Kind() == reflect.Ptr
+	if isPtr {
+		if v.IsNil() {
+			return payload
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return payload
+	}
+	field := v.FieldByName("Hostname")
+	if !field.IsValid() || field.Kind() != reflect.String || field.String() != "" {
+		return payload
+	}
+	cp := reflect.New(v.Type())
+	cp.Elem().Set(v)
+	cp.Elem().FieldByName("Hostname").SetString(hostname)
+	if isPtr {
+		return cp.Interface()
+	}
+	return cp.Elem().Interface()
+}
+
+// ValidatePayloads rejects payloads that cannot be decoded into the Go type registered for their
+// payload type, including objects with unknown fields. Unregistered payload types pass through.
+func ValidatePayloads() PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+			if err := validatePayload(payloadType, payload); err != nil {
+				return fmt.Errorf("publish to %q: %w", channel, err)
+			}
+			return next(ctx, channel, payloadType, payload)
+		}
+	}
+}
+
+func validatePayload(payloadType string, payload interface{}) error {
+	info, ok := LookupPayload(payloadType)
+	if !ok {
+		return nil
+	}
+	t := reflect.TypeOf(payload)
+	if t == info.Type || (t != nil && t.Kind() == reflect.Ptr && t.Elem() == info.Type) {
+		return nil
+	}
+	var raw []byte
+	if r, ok := payload.(json.RawMessage); ok {
+		raw = r
+	} else {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("%w: encode %q payload: %v", ErrPayloadTypeMismatch, payloadType, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(reflect.New(info.Type).Interface()); err != nil {
+		return fmt.Errorf("%w: %q payload: %v", ErrPayloadTypeMismatch, payloadType, err)
+	}
+	return nil
+}
+
+// CountPublishes records successful publishes in counter.
+func CountPublishes(counter *PublishCounter, service string) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+			err := next(ctx, channel, payloadType, payload)
+			counter.add(service, channel, err)
+			return err
+		}
+	}
+}
+
+// PublishCount is the number of messages a service published to a channel.
+type PublishCount struct {
+	Service   string `json:"service"`
+	Channel   string `json:"channel"`
+	Published uint64 `json:"published"`
+	Failed    uint64 `json:"failed"`
+}
+
+// PublishCounter tallies publishes per service and channel. It is safe for concurrent use.
+type PublishCounter struct {
+	mu     sync.Mutex
+	counts map[[2]string]*PublishCount
+}
+
+// NewPublishCounter returns an empty counter.
+func NewPublishCounter() *PublishCounter {
+	return &PublishCounter{counts: map[[2]string]*PublishCount{}}
+}
+
+func (c *PublishCounter) add(service, channel string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := [2]string{service, channel}
+	pc, ok := c.counts[key]
+	if !ok {
+		pc = &PublishCount{Service: service, Channel: channel}
+		c.counts[key] = pc
+	}
+	if err != nil {
+		pc.Failed++
+	} else {
+		pc.Published++
+	}
+}
+
+// Snapshot returns the current counts sorted by service and channel.
+func (c *PublishCounter) Snapshot() []PublishCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]PublishCount, 0, len(c.counts))
+	for _, pc := range c.counts {
+		out = append(out, *pc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Service != out[j].Service {
+			return out[i].Service < out[j].Service
+		}
+		return out[i].Channel < out[j].Channel
+	})
+	return out
+}
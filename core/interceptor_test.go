@@ -0,0 +1,106 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+func TestInterceptedMessenger_Order(t *testing.T) {
+	fake := testutil.NewFakeMessenger()
+	var calls []string
+	tag := func(name string) core.PublishInterceptor {
+		return func(next core.PublishFunc) core.PublishFunc {
+			return func(ctx context.Context, channel, payloadType string, payload interface{}) error {
+				calls = append(calls, name)
+				return next(ctx, channel, payloadType, payload)
+			}
+		}
+	}
+	m := core.NewInterceptedMessenger(fake, tag("outer"), tag("inner"))
+	require.NoError(t, m.Publish(context.Background(), "c", "t", map[string]any{}))
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+	assert.Len(t, fake.PublishedMessages, 1)
+}
+
+func TestStampMetadata(t *testing.T) {
+	var gotCtx context.Context
+	var got interface{}
+	next := func(ctx context.Context, _, _ string, payload interface{}) error {
+		gotCtx, got = ctx, payload
+		return nil
+	}
+	publish := core.StampMetadata("monitor", "pi1")(next)
+
+	alert := &core.AlertEvent{Summary: "x"}
+	require.NoError(t, publish(context.Background(), "alerts", "core.alert.v1", alert))
+	assert.Equal(t, "monitor", km.ServiceNameFromContext(gotCtx))
+	assert.Equal(t, "pi1", got.(*core.AlertEvent).Hostname)
+	assert.Empty(t, alert.Hostname, "the caller's payload is not modified")
+
+	require.NoError(t, publish(km.WithServiceName(context.Background(), "other"), "metrics", "core.metric.v1", core.MetricEvent{Hostname: "pi2"}))
+	assert.Equal(t, "other", km.ServiceNameFromContext(gotCtx))
+	assert.Equal(t, "pi2", got.(core.MetricEvent).Hostname)
+
+	require.NoError(t, publish(context.Background(), "raw", "x", map[string]any{"a": 1}))
+	assert.Equal(t, map[string]any{"a": 1}, got)
+}
+
+func TestValidatePayloads(t *testing.T) {
+	next := func(context.Context, string, string, interface{}) error { return nil }
+	publish := core.ValidatePayloads()(next)
+	ctx := context.Background()
+
+	assert.NoError(t, publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{}))
+	assert.NoError(t, publish(ctx, "alerts", "core.alert.v1", &core.AlertEvent{}))
+	assert.NoError(t, publish(ctx, "alerts", "core.alert.v1", map[string]any{"summary": "ok"}))
+	assert.NoError(t, publish(ctx, "misc", "unregistered.v1", map[string]any{"anything": true}))
+
+	err := publish(ctx, "alerts", "core.alert.v1", map[string]any{"sumary": "typo"})
+	assert.ErrorIs(t, err, core.ErrPayloadTypeMismatch)
+	err = publish(ctx, "metrics", "core.metric.v1", json.RawMessage(`{"value":"high"}`))
+	assert.ErrorIs(t, err, core.ErrPayloadTypeMismatch)
+}
+
+func TestRestrictChannels(t *testing.T) {
+	next := func(context.Context, string, string, interface{}) error { return nil }
+	publish := core.RestrictChannels("monitor", map[string]core.ChannelInfo{"events": {Name: "monitor-events"}})(next)
+	assert.NoError(t, publish(context.Background(), "monitor-events", "t", nil))
+	assert.ErrorIs(t, publish(context.Background(), "alerts", "t", nil), core.ErrChannelNotDeclared)
+}
+
+func TestServiceInterceptors_CountAndConfig(t *testing.T) {
+	off, on := false, true
+	global := core.InterceptorConfig{EnforcePubs: &on}.Merge(core.DefaultInterceptorConfig)
+	cfg := core.InterceptorConfig{EnforcePubs: &off}.Merge(global)
+	assert.False(t, *cfg.EnforcePubs)
+	assert.False(t, *cfg.StampMetadata)
+
+	counter := core.NewPublishCounter()
+	svc := core.ServiceConfig{Name: "monitor", Pubs: map[string]core.ChannelInfo{"events": {Name: "events"}}}
+
+	failing := testutil.NewFakeMessenger()
+	m := core.NewInterceptedMessenger(core.NewInterceptedMessenger(&failingPublisher{FakeMessenger: failing, failures: -1}, core.ServiceCounter(global, svc, counter)),
+		core.ServiceInterceptors(global, svc, "pi1", &testutil.FakeLogger{})...)
+	assert.Error(t, m.Publish(context.Background(), "events", "t", map[string]any{}))
+	assert.ErrorIs(t, m.Publish(context.Background(), "alerts", "t", map[string]any{}), core.ErrChannelNotDeclared)
+
+	fake := testutil.NewFakeMessenger()
+	m = core.NewInterceptedMessenger(core.NewInterceptedMessenger(fake, core.ServiceCounter(cfg, svc, counter)),
+		core.ServiceInterceptors(cfg, svc, "pi1", &testutil.FakeLogger{})...)
+	require.NoError(t, m.Publish(context.Background(), "events", "t", map[string]any{}))
+	require.NoError(t, m.Publish(context.Background(), "alerts", "t", map[string]any{}))
+	require.NoError(t, m.Publish(context.Background(), "alerts", "t", map[string]any{}))
+
+	assert.Equal(t, []core.PublishCount{
+		{Service: "monitor", Channel: "alerts", Published: 2},
+		{Service: "monitor", Channel: "events", Published: 1, Failed: 1},
+	}, counter.Snapshot())
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// MessageMetadata traces a message back through the chain of events that produced it.
+//
+// CorrelationID is shared by every message in a chain and defaults to the ID of the message that
+// started it. CausationID is the ID of the message whose handler published this one, and
+// OriginService is the service that published the first message of the chain. ExpiresAt is set
+// when the publisher marked the message with WithExpiry; it is not inherited by the chain.
+type MessageMetadata struct {
+	MessageID     string    `json:"messageId,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	CausationID   string    `json:"causationId,omitempty"`
+	OriginService string    `json:"originService,omitempty"`
+	ExpiresAt     time.Time `json:"expiresAt,omitzero"`
+}
+
+// Expired reports whether the message has an expiry that is before now.
+func (md MessageMetadata) Expired(now time.Time) bool {
+	return !md.ExpiresAt.IsZero() && now.After(md.ExpiresAt)
+}
+
+// The messenger envelope only has a correlation ID field, so causation and origin are appended
+// to it as ";cause=<id>;origin=<service>" when a message is published from inside a handler, and
+// an expiry as ";expires=<RFC 3339 time>". Messages with neither a correlation ID nor an expiry
+// are left untouched, other messages keep a plain correlation ID, and ';' is reserved in
+// correlation IDs. Readers that show correlation IDs to people use PlainCorrelationID.
+const (
+	metadataSeparator = ";"
+	causationKey      = "cause="
+	originKey         = "origin="
+	expiresKey        = "expires="
+)
+
+type expiryKey struct{}
+
+// WithExpiry returns a context that marks messages published with it through a MetadataMessenger
+// as expiring at t. Subscribers behind an ExpiryMessenger skip them once t has passed, so
+// commands such as SwitchCommand are never acted on late. The expiry travels with the message's
+// correlation ID; a message published without one starts a new chain so it can carry it.
+func WithExpiry(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, expiryKey{}, t)
+}
+
+// WithTTL is WithExpiry with an expiry of ttl from now.
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return WithExpiry(ctx, time.Now().Add(ttl))
+}
+
+// ExpiryFromContext returns the expiry set with WithExpiry, or the zero time.
+func ExpiryFromContext(ctx context.Context) time.Time {
+	t, _ := ctx.Value(expiryKey{}).(time.Time)
+	return t
+}
+
+type messageMetadataKey struct{}
+
+// WithMessageMetadata returns a context carrying md. Messages published with it through a
+// MetadataMessenger become part of md's chain, caused by md.MessageID.
+func WithMessageMetadata(ctx context.Context, md MessageMetadata) context.Context {
+	return context.WithValue(ctx, messageMetadataKey{}, md)
+}
+
+// MetadataFromContext returns the metadata of the message being handled, or the zero value
+// outside a handler.
+func MetadataFromContext(ctx context.Context) MessageMetadata {
+	md, _ := ctx.Value(messageMetadataKey{}).(MessageMetadata)
+	return md
+}
+
+// MetadataOf returns msg's metadata decoded from its envelope. A message without a correlation
+// ID starts its own chain.
+func MetadataOf(msg km.Message) MessageMetadata {
+	md := parseCorrelation(msg.CorrelationID)
+	md.MessageID = msg.ID
+	if md.CorrelationID == "" {
+		md.CorrelationID = msg.ID
+	}
+	if md.OriginService == "" {
+		md.OriginService = msg.ServiceName
+	}
+	return md
+}
+
+// ContextForMessage returns ctx carrying msg's metadata, so handlers can read it with
+// MetadataFromContext and events they publish are linked to msg.
+func ContextForMessage(ctx context.Context, msg km.Message) context.Context {
+	return WithMessageMetadata(ctx, MetadataOf(msg))
+}
+
+// PlainCorrelationID returns the chain ID of an envelope correlation ID, without the causation,
+// origin and expiry appended to it.
+func PlainCorrelationID(s string) string {
+	return parseCorrelation(s).CorrelationID
+}
+
+// WithoutExpiry returns an envelope correlation ID with its expiry removed, keeping the chain ID,
+// causation and origin. Tools that publish stored messages again, such as replay and re-drive,
+// use it so the copies are not skipped for an expiry that passed long ago.
+func WithoutExpiry(s string) string {
+	parts := strings.Split(s, metadataSeparator)
+	kept := parts[:1]
+	for _, p := range parts[1:] {
+		if !strings.HasPrefix(p, expiresKey) {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 1 && kept[0] == "" {
+		return ""
+	}
+	return strings.Join(kept, metadataSeparator)
+}
+
+func parseCorrelation(s string) MessageMetadata {
+	parts := strings.Split(s, metadataSeparator)
+	md := MessageMetadata{CorrelationID: parts[0]}
+	for _, p := range parts[1:] {
+		switch {
+		case strings.HasPrefix(p, causationKey):
+			md.CausationID = strings.TrimPrefix(p, causationKey)
+		case strings.HasPrefix(p, originKey):
+			md.OriginService = strings.TrimPrefix(p, originKey)
+		case strings.HasPrefix(p, expiresKey):
+			if t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(p, expiresKey)); err == nil {
+				md.ExpiresAt = t
+			}
+		}
+	}
+	return md
+}
+
+// encodeCorrelation builds the envelope correlation ID for a message published by
+// serviceName; the origin is only recorded when another service started the chain. A message
+// without a correlation ID carries no metadata.
+func encodeCorrelation(correlationID, causationID, originService, serviceName string, expiresAt time.Time) string {
+	if correlationID == "" {
+		return ""
+	}
+	s := correlationID
+	if causationID != "" {
+		s += metadataSeparator + causationKey + causationID
+	}
+	if originService != "" && originService != serviceName {
+		s += metadataSeparator + originKey + originService
+	}
+	if !expiresAt.IsZero() {
+		s += metadataSeparator + expiresKey + expiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// MetadataMessenger is a MessengerApi decorator that propagates MessageMetadata. Handlers are
+// called with a context from ContextForMessage and a message whose CorrelationID is the plain
+// chain ID. Messages published with such a context carry the chain's correlation ID, the
+// handled message as their cause and the chain's origin service.
+type MetadataMessenger struct {
+	MessengerApi
+}
+
+// NewMetadataMessenger wraps m so metadata flows from handled messages to published ones.
+func NewMetadataMessenger(m MessengerApi) *MetadataMessenger {
+	return &MetadataMessenger{MessengerApi: m}
+}
+
+// Publish stamps the metadata and expiry from ctx on the message. A correlation ID set explicitly
+// with km.WithCorrelationID takes precedence over the one from the handled message, and a message
+// with neither starts a new chain when it has an expiry and is published unchanged otherwise.
+func (d *MetadataMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	md := MetadataFromContext(ctx)
+	correlationID := km.CorrelationIDFromContext(ctx)
+	if correlationID == "" {
+		correlationID = md.CorrelationID
+	}
+	if correlationID == "" && !ExpiryFromContext(ctx).IsZero() {
+		correlationID = NewUUID()
+	}
+	if correlationID != "" {
+		ctx = km.WithCorrelationID(ctx, encodeCorrelation(correlationID, md.MessageID, md.OriginService, km.ServiceNameFromContext(ctx), ExpiryFromContext(ctx)))
+	}
+	return d.MessengerApi.Publish(ctx, channel, payloadType, payload)
+}
+
+// Subscribe registers handler with the message's metadata added to its context.
+func (d *MetadataMessenger) Subscribe(ctx context.Context, channel string, subscriberID string, handler km.HandlerFunc) error {
+	return d.MessengerApi.Subscribe(ctx, channel, subscriberID, func(ctx context.Context, msg km.Message) error {
+		md := MetadataOf(msg)
+		msg.CorrelationID = PlainCorrelationID(msg.CorrelationID)
+		return handler(WithMessageMetadata(ctx, md), msg)
+	})
+}
@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+func newMetadataTestMessenger(t *testing.T) core.MessengerApi {
+	t.Helper()
+	m := adapter.NewMemoryMessenger(adapter.MemoryMessengerConfig{Name: "trace", RetryDelay: time.Millisecond}, &testutil.FakeLogger{})
+	t.Cleanup(func() { _ = m.Close() })
+	return core.NewMetadataMessenger(m)
+}
+
+// TestMetadataMessenger_TracesChain follows temp -> metric -> status through two services and
+// checks that the status can be traced back to the reading.
+func TestMetadataMessenger_TracesChain(t *testing.T) {
+	m := newMetadataTestMessenger(t)
+	ctx := context.Background()
+
+	metricsCtx := km.WithServiceName(ctx, "metrics")
+	require.NoError(t, m.Subscribe(metricsCtx, "temps", "metrics", func(ctx context.Context, msg km.Message) error {
+		return m.Publish(km.WithServiceName(ctx, "metrics"), "metrics", "core.metric.v1", core.MetricEvent{Name: "temp", Value: 20})
+	}))
+	require.NoError(t, m.Subscribe(ctx, "metrics", "monitor", func(ctx context.Context, msg km.Message) error {
+		return m.Publish(km.WithServiceName(ctx, "monitor"), "status", "core.status.v1", core.StatusEvent{Name: "temp", Status: "ok"})
+	}))
+
+	var mu sync.Mutex
+	var temp, metric, status km.Message
+	var statusMD core.MessageMetadata
+	require.NoError(t, m.Subscribe(ctx, "temps", "recorder", func(_ context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		temp = msg
+		return nil
+	}))
+	require.NoError(t, m.Subscribe(ctx, "metrics", "recorder", func(_ context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		metric = msg
+		return nil
+	}))
+	require.NoError(t, m.Subscribe(ctx, "status", "recorder", func(ctx context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		status = msg
+		statusMD = core.MetadataFromContext(ctx)
+		return nil
+	}))
+
+	require.NoError(t, m.Publish(km.WithServiceName(ctx, "sensor"), "temps", "core.temp.v1", core.TempEvent{TempC: 20}))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return status.ID != ""
+	}, 5*time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Empty(t, temp.CorrelationID, "a message starting a chain keeps a plain envelope")
+	assert.Equal(t, temp.ID, metric.CorrelationID)
+	assert.Equal(t, temp.ID, status.CorrelationID)
+
+	assert.Equal(t, core.MessageMetadata{
+		MessageID:     status.ID,
+		CorrelationID: temp.ID,
+		CausationID:   metric.ID,
+		OriginService: "sensor",
+	}, statusMD)
+	assert.Equal(t, "monitor", status.ServiceName)
+}
+
+func TestMetadataOf(t *testing.T) {
+	md := core.MetadataOf(km.Message{ID: "m1", ServiceName: "svc"})
+	assert.Equal(t, core.MessageMetadata{MessageID: "m1", CorrelationID: "m1", OriginService: "svc"}, md)
+
+	md = core.MetadataOf(km.Message{ID: "m3", ServiceName: "svc", CorrelationID: "c1;cause=m2;origin=sensor"})
+	assert.Equal(t, core.MessageMetadata{MessageID: "m3", CorrelationID: "c1", CausationID: "m2", OriginService: "sensor"}, md)
+
+	assert.Equal(t, core.MessageMetadata{}, core.MetadataFromContext(context.Background()))
+	ctx := core.ContextForMessage(context.Background(), km.Message{ID: "m4"})
+	assert.Equal(t, "m4", core.MetadataFromContext(ctx).CorrelationID)
+}
+
+func TestMetadataMessenger_RequestReply(t *testing.T) {
+	m := newMetadataTestMessenger(t)
+	ctx := context.Background()
+
+	var requestMD core.MessageMetadata
+	require.NoError(t, m.Subscribe(ctx, "echo", "echo", func(ctx context.Context, msg km.Message) error {
+		requestMD = core.MetadataFromContext(ctx)
+		return core.Reply(ctx, m, msg, "test.echo.v1", map[string]any{"ok": true})
+	}))
+	r, err := core.NewRequester(ctx, m, "echo-replies")
+	require.NoError(t, err)
+
+	// a request made while handling another message is caused by it
+	parent := core.WithMessageMetadata(ctx, core.MessageMetadata{MessageID: "p1", CorrelationID: "p1"})
+	reply, err := r.Request(parent, "echo", "test.echo.v1", map[string]any{"ping": true})
+	require.NoError(t, err)
+	assert.Equal(t, "p1", requestMD.CausationID)
+	assert.Equal(t, requestMD.CorrelationID, reply.CorrelationID)
+}
+
+func TestWithoutExpiry(t *testing.T) {
+	assert.Equal(t, "c1;cause=m0;origin=pi", core.WithoutExpiry("c1;cause=m0;expires=2026-01-02T03:04:05Z;origin=pi"))
+	assert.Equal(t, "c1", core.WithoutExpiry("c1;expires=2026-01-02T03:04:05Z"))
+	assert.Equal(t, "c1", core.WithoutExpiry("c1"))
+	assert.Empty(t, core.WithoutExpiry(";expires=2026-01-02T03:04:05Z"))
+	assert.Empty(t, core.WithoutExpiry(""))
+}
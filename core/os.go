@@ -19,6 +19,7 @@ type OsProviderApi interface {
 	Stat(name string) (os.FileInfo, error)
 	Chtimes(name string, atime time.Time, mtime time.Time) error
 	Remove(name string) error
+	Rename(oldpath, newpath string) error
 	Command(name string, arg ...string) CommandApi
 }
 
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PayloadCatalog exposes the payload registry to MCP and web UI consumers.
+// core/runtime registers it with the MCP and WebUI coordinators when they are configured.
+type PayloadCatalog struct{}
+
+const (
+	mcpToolListPayloadTypes = "list_payload_types"
+	mcpToolPayloadSchema    = "get_payload_schema"
+)
+
+// MCPTools lists the payload catalog tools.
+func (PayloadCatalog) MCPTools() []MCPTool {
+	return []MCPTool{
+		{
+			Name:        mcpToolListPayloadTypes,
+			Description: "List the message payload types known to keyop with their version, owning service and description.",
+			InputSchema: MCPToolInputSchema{Type: "object", Properties: map[string]interface{}{}},
+		},
+		{
+			Name:        mcpToolPayloadSchema,
+			Description: "Get the JSON Schema for a message payload type.",
+			InputSchema: MCPToolInputSchema{
+				Type: "object",
+				Properties: map[string]interface{}{
+					"name": map[string]interface{}{"type": "string", "description": "payload type name, e.g. core.alert.v1"},
+				},
+				Required: []string{"name"},
+			},
+		},
+	}
+}
+
+// HandleMCPToolCall answers a payload catalog tool call with JSON.
+func (PayloadCatalog) HandleMCPToolCall(_ context.Context, toolName string, args json.RawMessage) (string, error) {
+	var out any
+	switch toolName {
+	case mcpToolListPayloadTypes:
+		out = Payloads()
+	case mcpToolPayloadSchema:
+		var in struct {
+			Name string `json:"name"`
+		}
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &in); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+		}
+		info, ok := LookupPayload(in.Name)
+		if !ok {
+			return "", fmt.Errorf("unknown payload type %q", in.Name)
+		}
+		out = info.JSONSchema()
+	default:
+		return "", fmt.Errorf("unknown tool %q", toolName)
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// WebUITab renders the registered payload types and their schemas as a markdown tab.
+func (PayloadCatalog) WebUITab() TabInfo {
+	var b strings.Builder
+	b.WriteString("# Payload types\n\n")
+	b.WriteString("| Name | Version | Service | Description |\n|---|---|---|---|\n")
+	payloads := Payloads()
+	for _, p := range payloads {
+		fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", p.Name, p.Version, p.Service, p.Description)
+	}
+	for _, p := range payloads {
+		schema, _ := json.MarshalIndent(p.JSONSchema(), "", "  ")
+		fmt.Fprintf(&b, "\n## %s\n\n```json\n%s\n```\n", p.Name, schema)
+	}
+	return TabInfo{
+		ID:             "payloads",
+		Title:          "Payloads",
+		Content:        b.String(),
+		RenderMarkdown: true,
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// CorePayloadService is the owning service recorded for payload types defined in core.
+const CorePayloadService = "core"
+
+// PayloadInfo documents a registered payload type.
+type PayloadInfo struct {
+	Name        string       `json:"name"`
+	Version     int          `json:"version"`
+	Description string       `json:"description,omitempty"`
+	Service     string       `json:"service"`
+	GoType      string       `json:"goType"`
+	Type        reflect.Type `json:"-"`
+}
+
+// NewPrototype returns a pointer to a new zero value of the payload's Go type.
+func (p PayloadInfo) NewPrototype() any {
+	return reflect.New(p.Type).Interface()
+}
+
+// JSONSchema returns the JSON Schema for the payload, generated from its struct tags.
+func (p PayloadInfo) JSONSchema() map[string]any {
+	schema := JSONSchemaFor(p.Type)
+	schema["$schema"] = jsonSchemaDraft
+	schema["$id"] = p.Name
+	schema["title"] = p.Name
+	if p.Description != "" {
+		schema["description"] = p.Description
+	}
+	return schema
+}
+
+var (
+	payloadRegistryMu sync.RWMutex
+	payloadRegistry   = map[string]PayloadInfo{}
+)
+
+var payloadVersionRe = regexp.MustCompile(`\.v(\d+)$`)
+
+// RegisterPayload records a payload type with its Go prototype, owning service and description.
+// It is called from package init() functions; registering a name twice or a nil prototype panics.
+// The version is taken from a trailing ".vN" in the name.
+func RegisterPayload(name string, prototype any, service, description string) {
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		panic(fmt.Sprintf("core: RegisterPayload(%q): nil prototype", name))
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	info := PayloadInfo{
+		Name:        name,
+		Description: description,
+		Service:     service,
+		GoType:      t.String(),
+		Type:        t,
+	}
+	if m := payloadVersionRe.FindStringSubmatch(name); m != nil {
+		info.Version, _ = strconv.Atoi(m[1])
+	}
+
+	payloadRegistryMu.Lock()
+	defer payloadRegistryMu.Unlock()
+	if _, exists := payloadRegistry[name]; exists {
+		panic(fmt.Sprintf("core: RegisterPayload(%q): %v", name, ErrPayloadTypeAlreadyRegistered))
+	}
+	payloadRegistry[name] = info
+}
+
+// LookupPayload returns the registered info for a payload type name.
+func LookupPayload(name string) (PayloadInfo, bool) {
+	payloadRegistryMu.RLock()
+	defer payloadRegistryMu.RUnlock()
+	info, ok := payloadRegistry[name]
+	return info, ok
+}
+
+// Payloads returns all registered payload types sorted by name.
+func Payloads() []PayloadInfo {
+	payloadRegistryMu.RLock()
+	defer payloadRegistryMu.RUnlock()
+	out := make([]PayloadInfo, 0, len(payloadRegistry))
+	for _, info := range payloadRegistry {
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// RegisterServicePayloads registers every payload type owned by service with the messenger.
+// Types the messenger already knows are skipped.
+func RegisterServicePayloads(m interface {
+	RegisterPayloadType(typeStr string, prototype any) error
+}, service string) error {
+	for _, info := range Payloads() {
+		if info.Service != service {
+			continue
+		}
+		if err := m.RegisterPayloadType(info.Name, info.NewPrototype()); err != nil && !IsDuplicatePayloadRegistration(err) {
+			return fmt.Errorf("register payload type %q: %w", info.Name, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterPayload("core.metric.v1", MetricEvent{}, CorePayloadService, "A named numeric measurement, optionally embedding the source event it was derived from.")
+	RegisterPayload("core.alert.v1", AlertEvent{}, CorePayloadService, "A human-readable alert with an optional severity level.")
+	RegisterPayload("core.status.v1", StatusEvent{}, CorePayloadService, "The current status of a named check or component.")
+	RegisterPayload("core.service.state.v1", ServiceStateEvent{}, CorePayloadService, "A service lifecycle or health state change.")
+	RegisterPayload("core.error.v1", ErrorEvent{}, CorePayloadService, "An error reported by a service, e.g. a failed task run.")
+	RegisterPayload("core.temp.v1", TempEvent{}, CorePayloadService, "A temperature reading from a sensor.")
+	RegisterPayload("core.device.status.v1", DeviceStatusEvent{}, CorePayloadService, "Status and battery level reported by a device.")
+	RegisterPayload("core.switch.v1", SwitchEvent{}, CorePayloadService, "A switch changed state.")
+	RegisterPayload("core.switch.command.v1", SwitchCommand{}, CorePayloadService, "A request to change a switch's state.")
+	RegisterPayload("weatherstation.event.v1", WeatherStationEvent{}, CorePayloadService, "A full reading from a weather station.")
+	RegisterPayload("core.gps.v1", GpsEvent{}, CorePayloadService, "A GPS position fix.")
+}
@@ -0,0 +1,125 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadRegistry_CoreTypes(t *testing.T) {
+	info, ok := core.LookupPayload("core.alert.v1")
+	require.True(t, ok)
+	assert.Equal(t, 1, info.Version)
+	assert.Equal(t, core.CorePayloadService, info.Service)
+	assert.Equal(t, "core.AlertEvent", info.GoType)
+	assert.NotEmpty(t, info.Description)
+	assert.IsType(t, &core.AlertEvent{}, info.NewPrototype())
+
+	names := map[string]bool{}
+	for _, p := range core.Payloads() {
+		names[p.Name] = true
+	}
+	assert.True(t, names["core.metric.v1"])
+	assert.True(t, names["core.gps.v1"])
+
+	assert.Panics(t, func() { core.RegisterPayload("core.alert.v1", core.AlertEvent{}, "other", "") })
+	assert.Panics(t, func() { core.RegisterPayload("test.nil.v1", nil, "other", "") })
+}
+
+func TestRegisterServicePayloads(t *testing.T) {
+	m := &recordingRegistrar{}
+	require.NoError(t, core.RegisterServicePayloads(m, core.CorePayloadService))
+	assert.Contains(t, m.types, "core.alert.v1")
+	assert.IsType(t, &core.AlertEvent{}, m.types["core.alert.v1"])
+
+	// duplicates reported by the messenger are skipped
+	require.NoError(t, core.RegisterServicePayloads(testutil.NewFakeMessenger(), core.CorePayloadService))
+	m.err = core.ErrPayloadTypeAlreadyRegistered
+	assert.NoError(t, core.RegisterServicePayloads(m, core.CorePayloadService))
+}
+
+type recordingRegistrar struct {
+	types map[string]any
+	err   error
+}
+
+func (r *recordingRegistrar) RegisterPayloadType(typeStr string, prototype any) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.types == nil {
+		r.types = map[string]any{}
+	}
+	r.types[typeStr] = prototype
+	return nil
+}
+
+type schemaBase struct {
+	ID string `json:"id"`
+}
+
+type schemaNode struct {
+	schemaBase
+	Name     string            `json:"name" description:"display name"`
+	Count    int               `json:"count,omitempty"`
+	Ratio    float32           `json:"ratio"`
+	When     time.Time         `json:"when"`
+	Raw      json.RawMessage   `json:"raw,omitempty"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Parent   *schemaNode       `json:"parent"`
+	Children []schemaNode      `json:"children,omitempty"`
+	Skipped  string            `json:"-"`
+	Untagged bool
+}
+
+func TestJSONSchemaFor(t *testing.T) {
+	schema := core.JSONSchemaFor(reflect.TypeOf(schemaNode{}))
+	assert.Equal(t, "object", schema["type"])
+
+	props := schema["properties"].(map[string]any)
+	assert.Equal(t, map[string]any{"type": "string"}, props["id"], "embedded fields are inlined")
+	assert.Equal(t, map[string]any{"type": "string", "description": "display name"}, props["name"])
+	assert.Equal(t, map[string]any{"type": "integer"}, props["count"])
+	assert.Equal(t, map[string]any{"type": "number"}, props["ratio"])
+	assert.Equal(t, map[string]any{"type": "string", "format": "date-time"}, props["when"])
+	assert.Equal(t, map[string]any{}, props["raw"])
+	assert.Equal(t, map[string]any{"type": "array", "items": map[string]any{"type": "string"}}, props["tags"])
+	assert.Equal(t, map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}}, props["labels"])
+	assert.Equal(t, map[string]any{"type": "object"}, props["parent"], "recursion stops at the repeated type")
+	assert.Equal(t, map[string]any{"type": "boolean"}, props["Untagged"])
+	assert.NotContains(t, props, "Skipped")
+
+	assert.ElementsMatch(t, []string{"id", "name", "ratio", "when", "tags", "Untagged"}, schema["required"])
+}
+
+func TestPayloadCatalog(t *testing.T) {
+	catalog := core.PayloadCatalog{}
+	require.Len(t, catalog.MCPTools(), 2)
+
+	out, err := catalog.HandleMCPToolCall(context.Background(), "get_payload_schema", json.RawMessage(`{"name":"core.alert.v1"}`))
+	require.NoError(t, err)
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out), &schema))
+	assert.Equal(t, "core.alert.v1", schema["title"])
+	assert.Contains(t, schema["properties"], "summary")
+
+	out, err = catalog.HandleMCPToolCall(context.Background(), "list_payload_types", nil)
+	require.NoError(t, err)
+	assert.Contains(t, out, `"name": "core.metric.v1"`)
+
+	_, err = catalog.HandleMCPToolCall(context.Background(), "get_payload_schema", json.RawMessage(`{"name":"nope"}`))
+	assert.Error(t, err)
+
+	tab := catalog.WebUITab()
+	assert.True(t, tab.RenderMarkdown)
+	assert.Contains(t, tab.Content, "`core.alert.v1`")
+}
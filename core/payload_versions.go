@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// ErrNoPayloadConversion is returned when no chain of registered converters leads from a
+// message's payload type to the requested one.
+var ErrNoPayloadConversion = errors.New("no payload conversion")
+
+// PayloadConverter converts msg's payload into the converter's target type. msg.Payload may be
+// the registered Go value, a pointer to it, or generic JSON, as delivered by the messenger.
+type PayloadConverter func(msg km.Message) (any, error)
+
+var (
+	payloadConvertersMu sync.RWMutex
+	payloadConverters   = map[string]map[string]PayloadConverter{} // from -> to -> converter
+)
+
+// RegisterPayloadConverter registers a conversion from one payload type to another, typically
+// from a version to the next (core.metric.v1 -> core.metric.v2). Conversions chain, so
+// registering v1->v2 and v2->v3 lets v1 messages be read as v3. It is called from package
+// init() functions; registering the same pair twice panics.
+func RegisterPayloadConverter(from, to string, convert PayloadConverter) {
+	if from == to || convert == nil {
+		panic(fmt.Sprintf("core: RegisterPayloadConverter(%q, %q): invalid converter", from, to))
+	}
+	payloadConvertersMu.Lock()
+	defer payloadConvertersMu.Unlock()
+	if payloadConverters[from] == nil {
+		payloadConverters[from] = map[string]PayloadConverter{}
+	}
+	if _, exists := payloadConverters[from][to]; exists {
+		panic(fmt.Sprintf("core: RegisterPayloadConverter(%q, %q): already registered", from, to))
+	}
+	payloadConverters[from][to] = convert
+}
+
+// RegisterUpcaster registers a typed conversion between two payload types, deriving both type
+// strings from their PayloadType methods.
+func RegisterUpcaster[From, To TypedPayload](convert func(From) (To, error)) {
+	RegisterPayloadConverter(PayloadTypeOf[From](), PayloadTypeOf[To](), func(msg km.Message) (any, error) {
+		v, err := DecodePayload[From](msg)
+		if err != nil {
+			return nil, err
+		}
+		return convert(v)
+	})
+}
+
+// PayloadConversions returns the payload types directly reachable from a type, sorted.
+func PayloadConversions(from string) []string {
+	payloadConvertersMu.RLock()
+	defer payloadConvertersMu.RUnlock()
+	out := make([]string, 0, len(payloadConverters[from]))
+	for to := range payloadConverters[from] {
+		out = append(out, to)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ConvertPayload returns msg with its payload converted to the target payload type, following
+// the shortest chain of registered converters. A message already of the target type is returned
+// unchanged.
+func ConvertPayload(msg km.Message, target string) (km.Message, error) {
+	if msg.PayloadType == target {
+		return msg, nil
+	}
+	path := conversionPath(msg.PayloadType, target)
+	if path == nil {
+		return msg, fmt.Errorf("%w: %q to %q", ErrNoPayloadConversion, msg.PayloadType, target)
+	}
+	for _, step := range path {
+		out, err := step.convert(msg)
+		if err != nil {
+			return msg, fmt.Errorf("convert %q to %q: %w", msg.PayloadType, step.to, err)
+		}
+		msg.Payload = out
+		msg.PayloadType = step.to
+	}
+	return msg, nil
+}
+
+// VersionedHandler adapts handler so every message reaches it as the target payload type.
+// Messages of other types are converted with ConvertPayload; those that cannot be converted are
+// reported as errors so the messenger's retry and dead-letter handling applies.
+func VersionedHandler(target string, handler km.HandlerFunc) km.HandlerFunc {
+	return func(ctx context.Context, msg km.Message) error {
+		converted, err := ConvertPayload(msg, target)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, converted)
+	}
+}
+
+type conversionStep struct {
+	to      string
+	convert PayloadConverter
+}
+
+// conversionPath finds the shortest converter chain from one type to another, or nil.
+func conversionPath(from, to string) []conversionStep {
+	payloadConvertersMu.RLock()
+	defer payloadConvertersMu.RUnlock()
+
+	type node struct {
+		name string
+		path []conversionStep
+	}
+	seen := map[string]bool{from: true}
+	queue := []node{{name: from}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		// visit targets in a stable order so equal-length paths resolve deterministically
+		targets := make([]string, 0, len(payloadConverters[cur.name]))
+		for next := range payloadConverters[cur.name] {
+			targets = append(targets, next)
+		}
+		sort.Strings(targets)
+		for _, next := range targets {
+			if seen[next] {
+				continue
+			}
+			path := append(append([]conversionStep(nil), cur.path...), conversionStep{to: next, convert: payloadConverters[cur.name][next]})
+			if next == to {
+				return path
+			}
+			seen[next] = true
+			queue = append(queue, node{name: next, path: path})
+		}
+	}
+	return nil
+}
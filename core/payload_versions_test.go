@@ -0,0 +1,149 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+// readingV1 reported Celsius only; v2 generalised it to value+unit; v3 added the source.
+type readingV1 struct {
+	Celsius float64 `json:"celsius"`
+}
+
+func (readingV1) PayloadType() string { return "test.reading.v1" }
+
+type readingV2 struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+func (readingV2) PayloadType() string { return "test.reading.v2" }
+
+type readingV3 struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+	Source string  `json:"source"`
+}
+
+func (readingV3) PayloadType() string { return "test.reading.v3" }
+
+func init() {
+	core.RegisterUpcaster(func(v readingV1) (readingV2, error) {
+		return readingV2{Value: v.Celsius, Unit: "C"}, nil
+	})
+	core.RegisterUpcaster(func(v readingV2) (readingV3, error) {
+		if v.Unit == "" {
+			return readingV3{}, errors.New("missing unit")
+		}
+		return readingV3{Value: v.Value, Unit: v.Unit, Source: "unknown"}, nil
+	})
+}
+
+func TestConvertPayload_ChainsConverters(t *testing.T) {
+	msg := km.Message{PayloadType: "test.reading.v1", Payload: readingV1{Celsius: 21.5}}
+
+	v2, err := core.ConvertPayload(msg, "test.reading.v2")
+	require.NoError(t, err)
+	assert.Equal(t, "test.reading.v2", v2.PayloadType)
+	assert.Equal(t, readingV2{Value: 21.5, Unit: "C"}, v2.Payload)
+
+	v3, err := core.ConvertPayload(msg, "test.reading.v3")
+	require.NoError(t, err)
+	assert.Equal(t, readingV3{Value: 21.5, Unit: "C", Source: "unknown"}, v3.Payload)
+
+	// generic JSON, as delivered for unregistered or remote payloads
+	raw := km.Message{PayloadType: "test.reading.v1", Payload: json.RawMessage(`{"celsius":3}`)}
+	v3, err = core.ConvertPayload(raw, "test.reading.v3")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, v3.Payload.(readingV3).Value)
+
+	_, err = core.ConvertPayload(v3, "test.reading.v1")
+	assert.ErrorIs(t, err, core.ErrNoPayloadConversion)
+
+	_, err = core.ConvertPayload(km.Message{PayloadType: "test.reading.v2", Payload: readingV2{Value: 1}}, "test.reading.v3")
+	assert.ErrorContains(t, err, "missing unit")
+
+	assert.Equal(t, []string{"test.reading.v2"}, core.PayloadConversions("test.reading.v1"))
+	assert.Panics(t, func() {
+		core.RegisterUpcaster(func(v readingV1) (readingV2, error) { return readingV2{}, nil })
+	})
+}
+
+func TestDecodePayload_Upcasts(t *testing.T) {
+	got, err := core.DecodePayload[*readingV2](km.Message{PayloadType: "test.reading.v1", Payload: map[string]any{"celsius": 7.0}})
+	require.NoError(t, err)
+	assert.Equal(t, &readingV2{Value: 7, Unit: "C"}, got)
+
+	_, err = core.DecodePayload[readingV2](km.Message{PayloadType: "core.alert.v1", Payload: core.AlertEvent{}})
+	assert.ErrorIs(t, err, core.ErrPayloadTypeMismatch)
+}
+
+// TestMixedVersionFleet runs publishers and subscribers built against different payload
+// versions on one bus: old nodes publish v1, upgraded nodes publish v2 and v3, and each
+// subscriber sees every reading in the version it was written for.
+func TestMixedVersionFleet(t *testing.T) {
+	m := adapter.NewMemoryMessenger(adapter.MemoryMessengerConfig{Name: "fleet", RetryDelay: time.Millisecond}, &testutil.FakeLogger{})
+	t.Cleanup(func() { _ = m.Close() })
+	for _, proto := range []core.TypedPayload{readingV1{}, readingV2{}, readingV3{}} {
+		require.NoError(t, m.RegisterPayloadType(proto.PayloadType(), proto))
+	}
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var gotV2 []readingV2
+	var gotV3 []readingV3
+	var untyped []string
+	require.NoError(t, core.SubscribeTyped(ctx, m, "readings", "dashboard-v2", func(_ context.Context, v readingV2) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gotV2 = append(gotV2, v)
+		return nil
+	}))
+	require.NoError(t, core.SubscribeTyped(ctx, m, "readings", "archiver-v3", func(_ context.Context, v *readingV3) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gotV3 = append(gotV3, *v)
+		return nil
+	}))
+	require.NoError(t, m.Subscribe(ctx, "readings", "untyped-v3", core.VersionedHandler("test.reading.v3", func(_ context.Context, msg km.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		untyped = append(untyped, msg.PayloadType)
+		return nil
+	})))
+
+	// old node
+	require.NoError(t, core.PublishTyped(ctx, m, "readings", readingV1{Celsius: 20}))
+	// upgraded nodes
+	require.NoError(t, core.PublishTyped(ctx, m, "readings", readingV2{Value: 68, Unit: "F"}))
+	require.NoError(t, core.PublishTyped(ctx, m, "readings", &readingV3{Value: 293, Unit: "K", Source: "probe"}))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(gotV2) == 2 && len(gotV3) == 3 && len(untyped) == 3
+	}, 5*time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the v2 subscriber cannot read v3 (no downcast registered); that message is dead-lettered
+	assert.Equal(t, []readingV2{{Value: 20, Unit: "C"}, {Value: 68, Unit: "F"}}, gotV2)
+	assert.Equal(t, []readingV3{
+		{Value: 20, Unit: "C", Source: "unknown"},
+		{Value: 68, Unit: "F", Source: "unknown"},
+		{Value: 293, Unit: "K", Source: "probe"},
+	}, gotV3)
+	assert.Equal(t, []string{"test.reading.v3", "test.reading.v3", "test.reading.v3"}, untyped)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// DefaultRequestTimeout bounds Request calls whose context carries no deadline.
+const DefaultRequestTimeout = 30 * time.Second
+
+var (
+	// ErrRequestTimeout is returned by Request when no reply arrives in time.
+	ErrRequestTimeout = errors.New("request timed out waiting for reply")
+
+	// ErrNoReplyChannel is returned by Reply when the message was not sent with Request.
+	ErrNoReplyChannel = errors.New("message has no reply channel")
+)
+
+// Request/reply is layered on the message correlation ID so it works over any transport the
+// messenger supports. A request is published with a correlation ID of the form
+// "<uuid>@<replyChannel>"; Reply publishes its response to that channel carrying the same
+// correlation ID, and the Requester matches it to the waiting caller. Channel names cannot
+// contain '@', so the reply channel is always recoverable.
+const replyChannelSeparator = "@"
+
+// Requester publishes requests and waits for correlated replies on a dedicated reply channel.
+// Create one per service with NewRequester; it is safe for concurrent use. When requests cross
+// a hub, the reply channel must be federated back to the requesting instance.
+type Requester struct {
+	messenger      MessengerApi
+	replyChannel   string
+	DefaultTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]chan km.Message
+}
+
+// NewRequester subscribes to replyChannel and returns a Requester that delivers replies
+// arriving there to the matching Request call. The subscription ends when ctx is done.
+func NewRequester(ctx context.Context, m MessengerApi, replyChannel string) (*Requester, error) {
+	if strings.Contains(replyChannel, replyChannelSeparator) {
+		return nil, fmt.Errorf("invalid reply channel %q", replyChannel)
+	}
+	r := &Requester{
+		messenger:      m,
+		replyChannel:   replyChannel,
+		DefaultTimeout: DefaultRequestTimeout,
+		pending:        make(map[string]chan km.Message),
+	}
+	subscriberID := replyChannel + "-requester"
+	if err := m.Subscribe(ctx, replyChannel, subscriberID, r.handleReply); err != nil {
+		return nil, fmt.Errorf("subscribe to reply channel %q: %w", replyChannel, err)
+	}
+	return r, nil
+}
+
+// ReplyChannel returns the channel replies are expected on.
+func (r *Requester) ReplyChannel() string {
+	return r.replyChannel
+}
+
+// Request publishes payload to channel and blocks until a reply with the same correlation ID
+// arrives, ctx is done, or the default timeout elapses when ctx has no deadline.
+func (r *Requester) Request(ctx context.Context, channel string, payloadType string, payload interface{}) (km.Message, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && r.DefaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.DefaultTimeout)
+		defer cancel()
+	}
+
+	correlationID := NewUUID() + replyChannelSeparator + r.replyChannel
+	replyC := make(chan km.Message, 1)
+
+	r.mu.Lock()
+	r.pending[correlationID] = replyC
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, correlationID)
+		r.mu.Unlock()
+	}()
+
+	if err := r.messenger.Publish(km.WithCorrelationID(ctx, correlationID), channel, payloadType, payload); err != nil {
+		return km.Message{}, fmt.Errorf("publish request to %q: %w", channel, err)
+	}
+
+	select {
+	case reply := <-replyC:
+		return reply, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return km.Message{}, fmt.Errorf("%w: %s on %q", ErrRequestTimeout, payloadType, channel)
+		}
+		return km.Message{}, ctx.Err()
+	}
+}
+
+// handleReply routes a reply to its waiting request; late or unknown replies are dropped.
+func (r *Requester) handleReply(_ context.Context, msg km.Message) error {
+	correlationID := parseCorrelation(msg.CorrelationID).CorrelationID
+	r.mu.Lock()
+	replyC, ok := r.pending[correlationID]
+	if ok {
+		delete(r.pending, correlationID)
+	}
+	r.mu.Unlock()
+
+	if ok {
+		replyC <- msg
+	}
+	return nil
+}
+
+// ReplyChannelOf returns the reply channel encoded in a request's correlation ID.
+func ReplyChannelOf(req km.Message) (string, bool) {
+	correlationID := parseCorrelation(req.CorrelationID).CorrelationID
+	idx := strings.LastIndex(correlationID, replyChannelSeparator)
+	if idx < 0 || idx == len(correlationID)-1 {
+		return "", false
+	}
+	return correlationID[idx+1:], true
+}
+
+// Reply publishes payload as the response to req, for use inside subscription handlers.
+// It returns ErrNoReplyChannel if req was not published through a Requester.
+func Reply(ctx context.Context, m MessengerApi, req km.Message, payloadType string, payload interface{}) error {
+	replyChannel, ok := ReplyChannelOf(req)
+	if !ok {
+		return ErrNoReplyChannel
+	}
+	return m.Publish(km.WithCorrelationID(ctx, parseCorrelation(req.CorrelationID).CorrelationID), replyChannel, payloadType, payload)
+}
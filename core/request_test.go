@@ -0,0 +1,112 @@
+package core_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+// loopbackMessenger delivers every published message to the channel's subscribers asynchronously.
+type loopbackMessenger struct {
+	mu       sync.Mutex
+	handlers map[string][]km.HandlerFunc
+}
+
+func newLoopbackMessenger() *loopbackMessenger {
+	return &loopbackMessenger{handlers: make(map[string][]km.HandlerFunc)}
+}
+
+func (l *loopbackMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	l.mu.Lock()
+	handlers := append([]km.HandlerFunc(nil), l.handlers[channel]...)
+	l.mu.Unlock()
+	msg := km.Message{
+		ID:            core.NewUUID(),
+		Channel:       channel,
+		PayloadType:   payloadType,
+		CorrelationID: km.CorrelationIDFromContext(ctx),
+		Payload:       payload,
+		Timestamp:     time.Now(),
+	}
+	for _, h := range handlers {
+		go func(h km.HandlerFunc) { _ = h(context.Background(), msg) }(h)
+	}
+	return nil
+}
+
+func (l *loopbackMessenger) RegisterPayloadType(string, interface{}) error { return nil }
+
+func (l *loopbackMessenger) Subscribe(_ context.Context, channel string, _ string, handler km.HandlerFunc) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[channel] = append(l.handlers[channel], handler)
+	return nil
+}
+
+func (l *loopbackMessenger) InstanceName() string { return "loopback" }
+func (l *loopbackMessenger) Close() error         { return nil }
+
+func TestRequester_RequestReceivesReply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newLoopbackMessenger()
+
+	// switch controller: answer every command with the resulting state
+	require.NoError(t, m.Subscribe(ctx, "switch-commands", "controller", func(ctx context.Context, msg km.Message) error {
+		cmd := msg.Payload.(*core.SwitchCommand)
+		return core.Reply(ctx, m, msg, "core.switch.v1", &core.SwitchEvent{DeviceName: cmd.DeviceName, State: cmd.State})
+	}))
+
+	r, err := core.NewRequester(ctx, m, "replies.test")
+	require.NoError(t, err)
+
+	reply, err := r.Request(ctx, "switch-commands", "core.switch.command.v1", &core.SwitchCommand{DeviceName: "porch", State: "ON"})
+	require.NoError(t, err)
+	assert.Equal(t, "replies.test", reply.Channel)
+	assert.Equal(t, "core.switch.v1", reply.PayloadType)
+	event, ok := reply.Payload.(*core.SwitchEvent)
+	require.True(t, ok)
+	assert.Equal(t, "porch", event.DeviceName)
+	assert.Equal(t, "ON", event.State)
+}
+
+func TestRequester_RequestTimesOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newLoopbackMessenger()
+
+	r, err := core.NewRequester(ctx, m, "replies.test")
+	require.NoError(t, err)
+	r.DefaultTimeout = 20 * time.Millisecond
+
+	_, err = r.Request(ctx, "nobody-listens", "core.switch.command.v1", &core.SwitchCommand{DeviceName: "porch", State: "ON"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, core.ErrRequestTimeout)
+}
+
+func TestRequester_InvalidReplyChannel(t *testing.T) {
+	_, err := core.NewRequester(context.Background(), newLoopbackMessenger(), "bad@channel")
+	assert.Error(t, err)
+}
+
+func TestReply_WithoutReplyChannel(t *testing.T) {
+	m := newLoopbackMessenger()
+	err := core.Reply(context.Background(), m, km.Message{CorrelationID: "plain-correlation"}, "core.switch.v1", &core.SwitchEvent{})
+	assert.ErrorIs(t, err, core.ErrNoReplyChannel)
+}
+
+func TestReplyChannelOf(t *testing.T) {
+	ch, ok := core.ReplyChannelOf(km.Message{CorrelationID: "0190-abc@replies.host1"})
+	assert.True(t, ok)
+	assert.Equal(t, "replies.host1", ch)
+
+	_, ok = core.ReplyChannelOf(km.Message{CorrelationID: "0190-abc@"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,585 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/util"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// BackupFormatVersion is the archive layout written by CreateBackup. RestoreBackup refuses
+// archives with a newer version. Version 2 keeps the expiry of each state key.
+const BackupFormatVersion = 2
+
+// Paths inside a backup archive. The manifest comes first so a restore can check the archive
+// before writing anything.
+const (
+	backupManifestPath = "manifest.json"
+	backupStatePath    = "state.json"
+	backupConfPrefix   = "conf/"
+)
+
+// BackupManifest describes a backup archive.
+type BackupManifest struct {
+	Version      int                 `json:"version"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	Hostname     string              `json:"hostname"`
+	KeyopVersion string              `json:"keyopVersion,omitempty"`
+	StateBackend string              `json:"stateBackend"`
+	StateKeys    int                 `json:"stateKeys"`
+	Files        []BackupFile        `json:"files"`
+	Messenger    *BackupMessengerDir `json:"messenger,omitempty"`
+}
+
+// BackupFile is an archived file with its checksum.
+type BackupFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// BackupMessengerDir records what the messenger data directory held. Messages themselves are
+// not archived; channel export covers that.
+type BackupMessengerDir struct {
+	DataDir  string                 `json:"dataDir"`
+	Channels []BackupChannelSummary `json:"channels"`
+}
+
+// BackupChannelSummary is the size of one channel's storage.
+type BackupChannelSummary struct {
+	Name     string    `json:"name"`
+	Segments int       `json:"segments"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+}
+
+// BackupOptions controls CreateBackup.
+type BackupOptions struct {
+	KeyopVersion string
+}
+
+// backupStateValue is a key of state.json. Version 1 archives hold the bare values.
+type backupStateValue struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expiresAt,omitzero"`
+}
+
+// backupEntry is a file to archive.
+type backupEntry struct {
+	path string
+	mode fs.FileMode
+	data []byte
+}
+
+// CreateBackup writes the conf directory, every key of the state store and a summary of the
+// messenger data directory to w as a zstd-compressed tar archive. State is read without
+// decryption, so encrypted values stay encrypted in the archive. Expiries are kept when the
+// store implements core.StateExpiryApi.
+func CreateBackup(deps core.Dependencies, w io.Writer, opts BackupOptions) (BackupManifest, error) {
+	logger := deps.MustGetLogger()
+	hostname, err := util.GetShortHostname(deps.MustGetOsProvider())
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("error getting short hostname: %w", err)
+	}
+	manifest := BackupManifest{
+		Version:      BackupFormatVersion,
+		CreatedAt:    time.Now().UTC(),
+		Hostname:     hostname,
+		KeyopVersion: opts.KeyopVersion,
+	}
+
+	fileCfg, err := loadMessengerFile(logger)
+	if err != nil {
+		return manifest, err
+	}
+	var skipDir string
+	if fileCfg != nil {
+		skipDir = fileCfg.Storage.DataDir
+		if manifest.Messenger, err = summarizeMessengerDir(fileCfg.Storage.DataDir); err != nil {
+			return manifest, err
+		}
+	}
+
+	entries, err := readConfDir(configDirPath(), skipDir)
+	if err != nil {
+		return manifest, err
+	}
+
+	cfg, err := stateConfig(fileCfg)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.StateBackend = cfg.Backend
+	state, err := exportState(deps, cfg)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.StateKeys = len(state)
+	stateJSON, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	entries = append(entries, backupEntry{path: backupStatePath, mode: 0o600, data: stateJSON})
+
+	for _, e := range entries {
+		sum := sha256.Sum256(e.data)
+		manifest.Files = append(manifest.Files, BackupFile{
+			Path:   e.path,
+			Size:   int64(len(e.data)),
+			Mode:   e.mode,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return manifest, err
+	}
+	tw := tar.NewWriter(zw)
+	all := append([]backupEntry{{path: backupManifestPath, mode: 0o600, data: manifestJSON}}, entries...)
+	for _, e := range all {
+		hdr := &tar.Header{
+			Name:    e.path,
+			Mode:    int64(e.mode.Perm()),
+			Size:    int64(len(e.data)),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return manifest, err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return manifest, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, zw.Close()
+}
+
+// readConfDir returns the regular files under dir with their paths in the archive, leaving out
+// skipDir when the messenger data directory lives inside the conf directory.
+func readConfDir(dir, skipDir string) ([]backupEntry, error) {
+	var entries []backupEntry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && skipDir != "" && filepath.Clean(p) == filepath.Clean(skipDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p) //nolint:gosec // walking the conf directory
+		if err != nil {
+			return err
+		}
+		entries = append(entries, backupEntry{path: backupConfPrefix + filepath.ToSlash(rel), mode: info.Mode().Perm(), data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read conf directory: %w", err)
+	}
+	return entries, nil
+}
+
+// exportState returns every key of the configured store as stored, with its expiry.
+func exportState(deps core.Dependencies, cfg StateConfig) (map[string]backupStateValue, error) {
+	store, closeStore, err := openStateBackend(deps, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = closeStore() }()
+	ext, ok := store.(core.ExtendedStateStoreApi)
+	if !ok {
+		return nil, core.ErrStateNotExtended
+	}
+	keys, err := ext.List("")
+	if err != nil {
+		return nil, err
+	}
+	expiries, _ := store.(core.StateExpiryApi)
+	state := make(map[string]backupStateValue, len(keys))
+	for _, key := range keys {
+		var value json.RawMessage
+		if err := ext.Load(key, &value); err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		entry := backupStateValue{Value: value}
+		if expiries != nil {
+			if entry.ExpiresAt, err = expiries.ExpiresAt(key); err != nil {
+				return nil, err
+			}
+		}
+		state[key] = entry
+	}
+	return state, nil
+}
+
+// summarizeMessengerDir lists the channels stored under dataDir with their sizes.
+func summarizeMessengerDir(dataDir string) (*BackupMessengerDir, error) {
+	summary := &BackupMessengerDir{DataDir: dataDir, Channels: []BackupChannelSummary{}}
+	names, err := ListChannels(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		segs, err := listChannelSegments(ChannelDir(dataDir, name))
+		if err != nil {
+			return nil, err
+		}
+		ch := BackupChannelSummary{Name: name, Segments: len(segs)}
+		for _, seg := range segs {
+			ch.Bytes += seg.size
+			if info, err := os.Stat(seg.path); err == nil && info.ModTime().After(ch.Modified) {
+				ch.Modified = info.ModTime().UTC()
+			}
+		}
+		summary.Channels = append(summary.Channels, ch)
+	}
+	return summary, nil
+}
+
+// RestoreOptions controls RestoreBackup.
+type RestoreOptions struct {
+	// Hostnames maps hostnames in the backup to the ones to write, for restoring onto a new
+	// machine. They are replaced in the conf files, in conf file names, which name the
+	// services, and in the service names of state keys, where they are not part of a longer
+	// word. Nil restores everything unchanged.
+	Hostnames map[string]string
+	// Force overwrites conf files and state keys that already exist.
+	Force bool
+	// DryRun checks the archive and reports what would be restored without writing.
+	DryRun bool
+}
+
+// RestoreResult reports what RestoreBackup did.
+type RestoreResult struct {
+	Manifest     BackupManifest
+	ConfFiles    []string // conf files written, relative to the conf directory
+	StateKeys    int      // state keys written
+	SkippedState []string // state keys kept because they already existed
+	ExpiredState int      // state keys left out because they expired since the backup
+}
+
+// ErrBackupConflict is returned when restoring would overwrite conf files and Force is not set.
+var ErrBackupConflict = errors.New("restore would overwrite existing files")
+
+// RestoreBackup verifies the archive read from r against its manifest and checksums, then writes
+// the conf files to the conf directory and loads the state into the store configured by the
+// restored messenger.yaml, applying opts.Hostnames to both. State keys renamed by the mapping
+// are decrypted and encrypted again under their new names with the restored state.encryption
+// keys. Nothing is written when the archive is invalid or conf files would be overwritten
+// without Force.
+func RestoreBackup(deps core.Dependencies, r io.Reader, opts RestoreOptions) (RestoreResult, error) {
+	var res RestoreResult
+	manifest, files, err := readBackup(r)
+	if err != nil {
+		return res, err
+	}
+	res.Manifest = manifest
+	hostnames := opts.Hostnames
+
+	confDir := configDirPath()
+	var conf []string
+	dests := map[string]string{} // archived conf path -> path written, relative to confDir
+	for _, f := range manifest.Files {
+		if rel, ok := strings.CutPrefix(f.Path, backupConfPrefix); ok {
+			conf = append(conf, rel)
+			dests[rel] = string(remapHostnames([]byte(rel), hostnames))
+		}
+	}
+	if !opts.Force {
+		var existing []string
+		for _, rel := range conf {
+			if _, err := os.Stat(filepath.Join(confDir, filepath.FromSlash(dests[rel]))); err == nil {
+				existing = append(existing, dests[rel])
+			}
+		}
+		if len(existing) > 0 {
+			return res, fmt.Errorf("%w in %s: %s", ErrBackupConflict, confDir, strings.Join(existing, ", "))
+		}
+	}
+
+	archived, err := decodeBackupState(files[backupStatePath], manifest.Version)
+	if err != nil {
+		return res, fmt.Errorf("backup %s: %w", backupStatePath, err)
+	}
+	state := make(map[string]backupStateValue, len(archived))
+	renamed := map[string]string{} // remapped state key -> key in the backup
+	for key, value := range archived {
+		to := remapStateKey(key, hostnames)
+		state[to] = value
+		if to != key {
+			renamed[to] = key
+		}
+	}
+	if opts.DryRun {
+		for _, rel := range conf {
+			res.ConfFiles = append(res.ConfFiles, dests[rel])
+		}
+		res.StateKeys = len(state)
+		return res, nil
+	}
+
+	modes := map[string]fs.FileMode{}
+	for _, f := range manifest.Files {
+		modes[f.Path] = f.Mode
+	}
+	for _, rel := range conf {
+		dest := filepath.Join(confDir, filepath.FromSlash(dests[rel]))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+			return res, err
+		}
+		data := remapHostnames(files[backupConfPrefix+rel], hostnames)
+		mode := modes[backupConfPrefix+rel].Perm()
+		if mode == 0 {
+			mode = 0o600
+		}
+		if err := os.WriteFile(dest, data, mode); err != nil {
+			return res, err
+		}
+		res.ConfFiles = append(res.ConfFiles, dests[rel])
+	}
+
+	cfg, err := LoadStateConfig(deps.MustGetLogger())
+	if err != nil {
+		return res, err
+	}
+	store, closeStore, err := openStateBackend(deps, cfg)
+	if err != nil {
+		return res, err
+	}
+	defer func() { _ = closeStore() }()
+	if store == nil {
+		return res, errors.New("no state store configured")
+	}
+	// encrypted values are bound to their key, so remapped keys are sealed again for the new one
+	var sealer core.StateStoreApi
+	if cfg.Encryption != nil && len(renamed) > 0 {
+		if sealer, err = cfg.Encryption.wrap(store); err != nil {
+			return res, fmt.Errorf("invalid messenger.yaml: state.encryption: %w", err)
+		}
+	}
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	for _, key := range keys {
+		entry := state[key]
+		if !entry.ExpiresAt.IsZero() && !now.Before(entry.ExpiresAt) {
+			res.ExpiredState++
+			continue
+		}
+		if !opts.Force {
+			var existing json.RawMessage
+			if err := store.Load(key, &existing); err != nil {
+				return res, err
+			}
+			if existing != nil {
+				res.SkippedState = append(res.SkippedState, key)
+				continue
+			}
+		}
+		if from, ok := renamed[key]; ok && sealer != nil {
+			if entry.Value, err = core.ResealState(sealer, from, key, entry.Value); err != nil {
+				return res, fmt.Errorf("restore state %q: %w", key, err)
+			}
+		}
+		if err := restoreStateValue(store, key, entry, now); err != nil {
+			return res, fmt.Errorf("restore state %q: %w", key, err)
+		}
+		res.StateKeys++
+	}
+	return res, nil
+}
+
+// restoreStateValue saves entry under key, with the time left until its expiry as the TTL.
+func restoreStateValue(store core.StateStoreApi, key string, entry backupStateValue, now time.Time) error {
+	if entry.ExpiresAt.IsZero() {
+		return store.Save(key, entry.Value)
+	}
+	ext, ok := store.(core.ExtendedStateStoreApi)
+	if !ok {
+		return fmt.Errorf("keep expiry: %w", core.ErrStateNotExtended)
+	}
+	return ext.SaveWithTTL(key, entry.Value, entry.ExpiresAt.Sub(now))
+}
+
+// decodeBackupState parses state.json of an archive with the given format version.
+func decodeBackupState(data []byte, version int) (map[string]backupStateValue, error) {
+	if version >= 2 {
+		var state map[string]backupStateValue
+		return state, json.Unmarshal(data, &state)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	state := make(map[string]backupStateValue, len(values))
+	for key, value := range values {
+		state[key] = backupStateValue{Value: value}
+	}
+	return state, nil
+}
+
+// readBackup reads the whole archive and checks every file against the manifest.
+func readBackup(r io.Reader) (BackupManifest, map[string][]byte, error) {
+	var manifest BackupManifest
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer zr.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("read backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return manifest, nil, fmt.Errorf("read backup: unsafe path %q", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, fmt.Errorf("read backup %s: %w", name, err)
+		}
+		files[name] = data
+	}
+
+	raw, ok := files[backupManifestPath]
+	if !ok {
+		return manifest, nil, fmt.Errorf("read backup: %s is missing", backupManifestPath)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("read backup %s: %w", backupManifestPath, err)
+	}
+	if manifest.Version < 1 || manifest.Version > BackupFormatVersion {
+		return manifest, nil, fmt.Errorf("backup format version %d is not supported (want at most %d)", manifest.Version, BackupFormatVersion)
+	}
+	for _, f := range manifest.Files {
+		data, ok := files[f.Path]
+		if !ok {
+			return manifest, nil, fmt.Errorf("backup is missing %s", f.Path)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			return manifest, nil, fmt.Errorf("backup checksum mismatch for %s", f.Path)
+		}
+		if !strings.HasPrefix(f.Path, backupConfPrefix) && f.Path != backupStatePath {
+			return manifest, nil, fmt.Errorf("backup has unexpected file %s", f.Path)
+		}
+	}
+	if _, ok := files[backupStatePath]; !ok {
+		return manifest, nil, fmt.Errorf("backup is missing %s", backupStatePath)
+	}
+	return manifest, files, nil
+}
+
+// remapStateKey applies hostnames to the service name in a key of a service's namespace or of
+// the kernel's per-service bookkeeping, so the state follows services renamed with the host.
+func remapStateKey(key string, hostnames map[string]string) string {
+	remap := func(name string) string { return string(remapHostnames([]byte(name), hostnames)) }
+	if rest, ok := strings.CutPrefix(key, core.ServiceStateNamespace("")); ok {
+		name, tail, found := strings.Cut(rest, "/")
+		if found {
+			return core.ServiceStateNamespace(remap(name)) + "/" + tail
+		}
+		return key
+	}
+	if rest, ok := strings.CutPrefix(key, core.KernelStateNamespace+"/"); ok {
+		for _, keyFor := range []func(string) string{lastCheckKey, historyKey} {
+			if name, ok := strings.CutPrefix(rest, keyFor("")); ok {
+				return core.KernelStateNamespace + "/" + keyFor(remap(name))
+			}
+		}
+	}
+	return key
+}
+
+// remapHostnames replaces each old hostname in data with its new one where it is not part of a
+// longer word, so "web" is replaced in "web-heartbeat" but not in "webserver". All hostnames are
+// replaced in one pass over data, so a replacement is never mapped again and {a: b, b: a} swaps
+// them. Where several hostnames match at the same place, the longest wins.
+func remapHostnames(data []byte, hostnames map[string]string) []byte {
+	froms := make([]string, 0, len(hostnames))
+	for from := range hostnames {
+		if from != "" {
+			froms = append(froms, from)
+		}
+	}
+	sort.Slice(froms, func(i, j int) bool {
+		if len(froms[i]) != len(froms[j]) {
+			return len(froms[i]) > len(froms[j])
+		}
+		return froms[i] < froms[j]
+	})
+	var out []byte
+	last := 0
+	for pos := 0; pos < len(data); pos++ {
+		if pos > 0 && isWordByte(data[pos-1]) {
+			continue
+		}
+		for _, from := range froms {
+			end := pos + len(from)
+			if bytes.HasPrefix(data[pos:], []byte(from)) && (end == len(data) || !isWordByte(data[end])) {
+				out = append(out, data[last:pos]...)
+				out = append(out, hostnames[from]...)
+				last, pos = end, end-1
+				break
+			}
+		}
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, data[last:]...)
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
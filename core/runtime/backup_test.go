@@ -0,0 +1,303 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackupTestDeps(host string) (core.Dependencies, *testutil.MemoryStateStore) {
+	store := testutil.NewMemoryStateStore()
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+	deps.SetOsProvider(testutil.FakeOsProvider{Host: host})
+	deps.SetStateStore(store)
+	return deps, store
+}
+
+// writeTestBackup packs files into a tar.zst archive in the given order.
+func writeTestBackup(t *testing.T, names []string, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	tw := tar.NewWriter(zw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(files[name]))}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func createTestBackup(t *testing.T) []byte {
+	t.Helper()
+	writeStateMessengerYAML(t, "")
+	confDir := os.Getenv("KEYOP_CONF_DIR")
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "heartbeat.yaml"), []byte("type: heartbeat\npubs:\n  events:\n    name: oldhost-heartbeat\n    remote: oldhost-hub\n"), 0o640))
+	require.NoError(t, os.MkdirAll(filepath.Join(confDir, "tpl"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "tpl", "alert.tmpl"), []byte("{{.Summary}}"), 0o600))
+	channelDir := ChannelDir(filepath.Join(confDir, "msgs"), "alerts")
+	require.NoError(t, os.MkdirAll(channelDir, 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(channelDir, "0.jsonl"), []byte("{}\n"), 0o600))
+
+	deps, store := newBackupTestDeps("oldhost.example.com")
+	require.NoError(t, store.Save("service/heartbeat/beats", 3))
+	require.NoError(t, store.Save("kernel/last_check_heartbeat", "2026-10-01T00:00:00Z"))
+
+	var buf bytes.Buffer
+	manifest, err := CreateBackup(deps, &buf, BackupOptions{KeyopVersion: "v1.2.3"})
+	require.NoError(t, err)
+	assert.Equal(t, "oldhost", manifest.Hostname)
+	assert.Equal(t, 2, manifest.StateKeys)
+	assert.Equal(t, StateBackendFile, manifest.StateBackend)
+	require.NotNil(t, manifest.Messenger)
+	assert.Equal(t, []BackupChannelSummary{{Name: "alerts", Segments: 1, Bytes: 3, Modified: manifest.Messenger.Channels[0].Modified}}, manifest.Messenger.Channels)
+
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+	assert.Contains(t, paths, "conf/messenger.yaml")
+	assert.Contains(t, paths, "conf/heartbeat.yaml")
+	assert.Contains(t, paths, "conf/tpl/alert.tmpl")
+	assert.Contains(t, paths, "state.json")
+	return buf.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	archive := createTestBackup(t)
+
+	newConf := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", newConf)
+	deps, store := newBackupTestDeps("newhost")
+	require.NoError(t, store.Save("service/heartbeat/beats", 10))
+
+	res, err := RestoreBackup(deps, bytes.NewReader(archive), RestoreOptions{DryRun: true, Hostnames: map[string]string{"oldhost": "newhost"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.StateKeys)
+	_, err = os.Stat(filepath.Join(newConf, "heartbeat.yaml"))
+	assert.True(t, os.IsNotExist(err), "dry run writes nothing")
+
+	res, err = RestoreBackup(deps, bytes.NewReader(archive), RestoreOptions{Hostnames: map[string]string{"oldhost": "newhost"}})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.2.3", res.Manifest.KeyopVersion)
+	assert.Len(t, res.ConfFiles, 3)
+	assert.Equal(t, 1, res.StateKeys)
+	assert.Equal(t, []string{"service/heartbeat/beats"}, res.SkippedState)
+
+	svc, err := os.ReadFile(filepath.Join(newConf, "heartbeat.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "type: heartbeat\npubs:\n  events:\n    name: newhost-heartbeat\n    remote: newhost-hub\n", string(svc))
+	info, err := os.Stat(filepath.Join(newConf, "heartbeat.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(newConf, "tpl", "alert.tmpl"))
+	assert.NoError(t, err)
+
+	var last string
+	require.NoError(t, store.Load("kernel/last_check_heartbeat", &last))
+	assert.Equal(t, "2026-10-01T00:00:00Z", last)
+
+	_, err = RestoreBackup(deps, bytes.NewReader(archive), RestoreOptions{})
+	assert.ErrorIs(t, err, ErrBackupConflict)
+
+	res, err = RestoreBackup(deps, bytes.NewReader(archive), RestoreOptions{Force: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.StateKeys)
+	var beats int
+	require.NoError(t, store.Load("service/heartbeat/beats", &beats))
+	assert.Equal(t, 3, beats)
+
+	// without a mapping the conf files are restored as they were
+	res, err = RestoreBackup(deps, bytes.NewReader(archive), RestoreOptions{Force: true})
+	require.NoError(t, err)
+	svc, err = os.ReadFile(filepath.Join(newConf, "heartbeat.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(svc), "name: oldhost-heartbeat")
+}
+
+func TestRestoreBackup_MapsServiceNames(t *testing.T) {
+	writeStateMessengerYAML(t, "")
+	confDir := os.Getenv("KEYOP_CONF_DIR")
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "oldhost-ping.yaml"), []byte("service: ping\n"), 0o600))
+	deps, store := newBackupTestDeps("oldhost")
+	require.NoError(t, store.Save("service/oldhost-ping/count", 3))
+	require.NoError(t, store.Save("kernel/last_check_oldhost-ping", "2026-10-01T00:00:00Z"))
+	require.NoError(t, store.Save("kernel/history_oldhost-ping", core.TaskHistory{}))
+	require.NoError(t, store.Save("service/oldhostname/count", 1))
+	var buf bytes.Buffer
+	_, err := CreateBackup(deps, &buf, BackupOptions{})
+	require.NoError(t, err)
+
+	newConf := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", newConf)
+	deps, store = newBackupTestDeps("newhost")
+	res, err := RestoreBackup(deps, &buf, RestoreOptions{Hostnames: map[string]string{"oldhost": "newhost"}})
+	require.NoError(t, err)
+	assert.Contains(t, res.ConfFiles, "newhost-ping.yaml")
+	_, err = os.Stat(filepath.Join(newConf, "newhost-ping.yaml"))
+	assert.NoError(t, err)
+
+	keys, err := store.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"kernel/history_newhost-ping",
+		"kernel/last_check_newhost-ping",
+		"service/newhost-ping/count",
+		"service/oldhostname/count",
+	}, keys)
+}
+
+func TestRestoreBackup_ResealsRemappedEncryptedState(t *testing.T) {
+	t.Setenv("KEYOP_TEST_STATE_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32)))
+	writeStateMessengerYAML(t, "state:\n  encryption:\n    namespaces: [service]\n    keys:\n      - id: k1\n        env: KEYOP_TEST_STATE_KEY\n")
+	deps, _ := newBackupTestDeps("oldhost")
+	encrypted, closeStore, err := OpenStateStore(deps)
+	require.NoError(t, err)
+	require.NoError(t, encrypted.(core.ExtendedStateStoreApi).SaveWithTTL("service/oldhost-ping/token", "secret", time.Hour))
+	require.NoError(t, encrypted.Save("service/other/token", "kept"))
+	require.NoError(t, closeStore())
+	var buf bytes.Buffer
+	_, err = CreateBackup(deps, &buf, BackupOptions{})
+	require.NoError(t, err)
+
+	t.Setenv("KEYOP_CONF_DIR", t.TempDir())
+	deps, store := newBackupTestDeps("newhost")
+	res, err := RestoreBackup(deps, &buf, RestoreOptions{Hostnames: map[string]string{"oldhost": "newhost"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.StateKeys)
+
+	var raw json.RawMessage
+	require.NoError(t, store.Load("service/newhost-ping/token", &raw))
+	assert.NotContains(t, string(raw), "secret", "the remapped value stays encrypted")
+	expiresAt, err := store.ExpiresAt("service/newhost-ping/token")
+	require.NoError(t, err)
+	assert.False(t, expiresAt.IsZero())
+
+	encrypted, closeStore, err = OpenStateStore(deps)
+	require.NoError(t, err)
+	defer func() { _ = closeStore() }()
+	var token string
+	require.NoError(t, encrypted.Load("service/newhost-ping/token", &token))
+	assert.Equal(t, "secret", token)
+	require.NoError(t, encrypted.Load("service/other/token", &token))
+	assert.Equal(t, "kept", token)
+}
+
+func TestRestoreBackup_RejectsBadArchives(t *testing.T) {
+	archive := createTestBackup(t)
+	_, files, err := readBackup(bytes.NewReader(archive))
+	require.NoError(t, err)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+
+	t.Setenv("KEYOP_CONF_DIR", t.TempDir())
+	deps, _ := newBackupTestDeps("newhost")
+	restore := func(files map[string][]byte, names ...string) error {
+		_, err := RestoreBackup(deps, bytes.NewReader(writeTestBackup(t, names, files)), RestoreOptions{})
+		return err
+	}
+
+	tampered := copyFiles(files)
+	tampered["state.json"] = []byte(`{"service/x/y": 1}`)
+	assert.ErrorContains(t, restore(tampered, names...), "checksum mismatch for state.json")
+
+	newer := copyFiles(files)
+	newer["manifest.json"] = bytes.Replace(files["manifest.json"], fmt.Appendf(nil, `"version": %d`, BackupFormatVersion), []byte(`"version": 99`), 1)
+	assert.ErrorContains(t, restore(newer, names...), "version 99 is not supported")
+
+	missing := copyFiles(files)
+	delete(missing, "conf/heartbeat.yaml")
+	var without []string
+	for _, n := range names {
+		if n != "conf/heartbeat.yaml" {
+			without = append(without, n)
+		}
+	}
+	assert.ErrorContains(t, restore(missing, without...), "missing conf/heartbeat.yaml")
+
+	unsafe := copyFiles(files)
+	unsafe["../escape"] = []byte("x")
+	assert.ErrorContains(t, restore(unsafe, append(names, "../escape")...), "unsafe path")
+
+	_, err = RestoreBackup(deps, bytes.NewReader([]byte("not an archive")), RestoreOptions{})
+	assert.Error(t, err)
+}
+
+func TestBackupRestore_KeepsExpiries(t *testing.T) {
+	writeStateMessengerYAML(t, "")
+	oldConf := os.Getenv("KEYOP_CONF_DIR")
+	newConf := t.TempDir()
+	synctest.Test(t, func(t *testing.T) {
+		_ = os.Setenv("KEYOP_CONF_DIR", oldConf)
+		deps, store := newBackupTestDeps("oldhost")
+		require.NoError(t, store.SaveWithTTL("service/cache/token", "abc", time.Hour))
+		require.NoError(t, store.SaveWithTTL("service/cache/soon", "x", time.Minute))
+		require.NoError(t, store.Save("service/cache/config", 1))
+		var buf bytes.Buffer
+		_, err := CreateBackup(deps, &buf, BackupOptions{})
+		require.NoError(t, err)
+
+		time.Sleep(2 * time.Minute)
+		_ = os.Setenv("KEYOP_CONF_DIR", newConf)
+		newDeps, newStore := newBackupTestDeps("oldhost")
+		res, err := RestoreBackup(newDeps, &buf, RestoreOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 2, res.StateKeys)
+		assert.Equal(t, 1, res.ExpiredState, "a key that expired since the backup is left out")
+
+		expiresAt, err := newStore.ExpiresAt("service/cache/token")
+		require.NoError(t, err)
+		assert.Equal(t, time.Now().Add(time.Hour-2*time.Minute), expiresAt)
+		expiresAt, err = newStore.ExpiresAt("service/cache/config")
+		require.NoError(t, err)
+		assert.True(t, expiresAt.IsZero())
+	})
+}
+
+func TestRestoreBackup_ReadsVersion1State(t *testing.T) {
+	state, err := decodeBackupState([]byte(`{"service/x/y": 1}`), 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]backupStateValue{"service/x/y": {Value: json.RawMessage(`1`)}}, state)
+}
+
+func copyFiles(files map[string][]byte) map[string][]byte {
+	out := make(map[string][]byte, len(files))
+	for k, v := range files {
+		out[k] = v
+	}
+	return out
+}
+
+func TestRemapHostnames(t *testing.T) {
+	data := []byte("name: web\nremote: web-hub\nother: webserver\nurl: http://web:8080\n")
+	got := remapHostnames(data, map[string]string{"web": "db"})
+	assert.Equal(t, "name: db\nremote: db-hub\nother: webserver\nurl: http://db:8080\n", string(got))
+
+	assert.Equal(t, "db,db db", string(remapHostnames([]byte("web,web web"), map[string]string{"web": "db"})))
+	assert.Equal(t, "webweb web_1 db", string(remapHostnames([]byte("webweb web_1 web"), map[string]string{"web": "db"})))
+
+	// mappings apply to the original data only
+	assert.Equal(t, "b c", string(remapHostnames([]byte("a b"), map[string]string{"a": "b", "b": "c"})))
+	assert.Equal(t, "b-a a,b", string(remapHostnames([]byte("a-b b,a"), map[string]string{"a": "b", "b": "a"})))
+	assert.Equal(t, "new pi.lan", string(remapHostnames([]byte("pi.example.com pi"), map[string]string{"pi": "pi.lan", "pi.example.com": "new"})))
+}
@@ -0,0 +1,216 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoredMessage is a message envelope as persisted by keyop-messenger in a channel's segment files.
+type StoredMessage struct {
+	V             int             `json:"v"`
+	ID            string          `json:"id"`
+	Timestamp     time.Time       `json:"ts"`
+	Channel       string          `json:"channel"`
+	Origin        string          `json:"origin"`
+	PayloadType   string          `json:"payload_type"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	ServiceName   string          `json:"service_name,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// channelSegment is one <offset>.jsonl file in a channel directory.
+type channelSegment struct {
+	path        string
+	startOffset int64
+	size        int64
+}
+
+// ChannelDir returns the directory holding a channel's segment files under the messenger data dir.
+func ChannelDir(dataDir, channel string) string {
+	return filepath.Join(dataDir, "channels", channel)
+}
+
+// ListChannels returns the names of the channels stored under dataDir, sorted. A missing data
+// directory yields no channels.
+func ListChannels(dataDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "channels"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// MessengerDeadLetterSuffix names the channel keyop-messenger dead-letters a channel's messages
+// to when a handler still fails after the messenger's own retries (subscribers.max_retries).
+const MessengerDeadLetterSuffix = ".dead-letter"
+
+// MessengerDeadLetterPayloadType is the payload type of MessengerDeadLetter records.
+const MessengerDeadLetterPayloadType = "com.keyop.messenger.DeadLetterPayload"
+
+// MessengerDeadLetter is the payload keyop-messenger writes to a <channel>.dead-letter channel.
+// Retries is the messenger's max_retries; the message was delivered once more than that.
+type MessengerDeadLetter struct {
+	Original  StoredMessage `json:"original"`
+	Retries   int           `json:"retries"`
+	LastError string        `json:"last_error"`
+	FailedAt  time.Time     `json:"failed_at"`
+}
+
+// listChannelSegments returns the channel's segments ordered by start offset.
+// A missing channel directory yields no segments.
+func listChannelSegments(channelDir string) ([]channelSegment, error) {
+	entries, err := os.ReadDir(channelDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read channel directory %q: %w", channelDir, err)
+	}
+	var segs []channelSegment
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".jsonl"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		segs = append(segs, channelSegment{path: filepath.Join(channelDir, e.Name()), startOffset: start, size: info.Size()})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].startOffset < segs[j].startOffset })
+	return segs, nil
+}
+
+// ReadChannelMessages returns every message still stored for channel, oldest first.
+// Lines that cannot be parsed are skipped.
+func ReadChannelMessages(dataDir, channel string) ([]StoredMessage, error) {
+	var msgs []StoredMessage
+	_, err := readChannelFrom(ChannelDir(dataDir, channel), 0, func(msg StoredMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// FollowChannel polls channel storage and calls fn for each message appended after the call
+// starts (or from the oldest stored message when fromStart is true), until ctx is done or fn
+// returns an error. It reads the files directly, so it observes messages written by any process
+// sharing the data directory and leaves no subscriber offset behind.
+func FollowChannel(ctx context.Context, dataDir, channel string, fromStart bool, poll time.Duration, fn func(StoredMessage) error) error {
+	dir := ChannelDir(dataDir, channel)
+
+	var offset int64
+	if !fromStart {
+		segs, err := listChannelSegments(dir)
+		if err != nil {
+			return err
+		}
+		if len(segs) > 0 {
+			last := segs[len(segs)-1]
+			offset = last.startOffset + last.size
+		}
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		next, err := readChannelFrom(dir, offset, fn)
+		if err != nil {
+			return err
+		}
+		offset = next
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readChannelFrom calls fn for every complete line at or after the global offset and returns
+// the offset following the last complete line read.
+func readChannelFrom(dir string, offset int64, fn func(StoredMessage) error) (int64, error) {
+	segs, err := listChannelSegments(dir)
+	if err != nil {
+		return offset, err
+	}
+	if len(segs) > 0 && offset < segs[0].startOffset {
+		// older segments were compacted away
+		offset = segs[0].startOffset
+	}
+
+	for _, seg := range segs {
+		if seg.startOffset+seg.size <= offset {
+			continue
+		}
+		if offset < seg.startOffset {
+			offset = seg.startOffset
+		}
+		next, err := readSegmentFrom(seg, offset, fn)
+		if err != nil {
+			return next, err
+		}
+		offset = next
+	}
+	return offset, nil
+}
+
+func readSegmentFrom(seg channelSegment, offset int64, fn func(StoredMessage) error) (int64, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return offset, nil
+		}
+		return offset, err
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Seek(offset-seg.startOffset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// a partial trailing line is still being written; pick it up on the next read
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		var msg StoredMessage
+		if jsonErr := json.Unmarshal(bytes.TrimSpace(line), &msg); jsonErr != nil {
+			continue
+		}
+		if err := fn(msg); err != nil {
+			return offset, err
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadChannelMessages_MissingChannel(t *testing.T) {
+	msgs, err := ReadChannelMessages(t.TempDir(), "nothing-here")
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestReadChannelMessages_AcrossSegmentsSkipsPartialLine(t *testing.T) {
+	dataDir := t.TempDir()
+	dir := ChannelDir(dataDir, "alerts")
+	require.NoError(t, os.MkdirAll(dir, 0o750))
+
+	first := `{"v":1,"id":"a","channel":"alerts","payload_type":"core.alert.v1","payload":{"summary":"one"}}` + "\n" +
+		"not json\n"
+	second := `{"v":1,"id":"b","channel":"alerts","payload_type":"core.alert.v1","payload":{"summary":"two"}}` + "\n" +
+		`{"v":1,"id":"c","chan` // still being written
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000000.jsonl"), []byte(first), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000200.jsonl"), []byte(second), 0o600))
+
+	msgs, err := ReadChannelMessages(dataDir, "alerts")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "a", msgs[0].ID)
+	assert.Equal(t, "b", msgs[1].ID)
+	assert.JSONEq(t, `{"summary":"two"}`, string(msgs[1].Payload))
+}
@@ -20,24 +20,47 @@ This utility is a work in progress.
 		RunE: func(_ *cobra.Command, _ []string) error {
 			logger := deps.MustGetLogger()
 
-			// 1. Initialise the new keyop-messenger
-			msgr, err := initMessenger(deps)
+			// messenger.yaml is read once; nil when absent
+			fileCfg, err := loadMessengerFile(logger)
+			if err != nil {
+				logger.Error("messenger.yaml load", "error", err)
+				return err
+			}
+
+			// 1. Initialise the messenger (in-memory when messenger.yaml is absent)
+			msgr, err := initMessenger(deps, fileCfg)
 			if err != nil {
 				logger.Error("new messenger init", "error", err)
 				return err
 			}
-			if msgr != nil {
-				deps.SetMessenger(msgr)
-				ctx := deps.MustGetContext()
-				go func() {
-					<-ctx.Done()
-					if closeErr := msgr.Close(); closeErr != nil {
-						logger.Error("new messenger close error", "error", closeErr)
-					}
-				}()
+			deps.SetMessenger(msgr)
+			ctx := deps.MustGetContext()
+			go func() {
+				<-ctx.Done()
+				if closeErr := msgr.Close(); closeErr != nil {
+					logger.Error("new messenger close error", "error", closeErr)
+				}
+			}()
+
+			// 2. Open the state store selected in messenger.yaml
+			stateCfg, err := stateConfig(fileCfg)
+			if err != nil {
+				logger.Error("state store init", "error", err)
+				return err
+			}
+			store, closeStore, err := openStateStore(deps, stateCfg)
+			if err != nil {
+				logger.Error("state store init", "error", err)
+				return err
 			}
+			deps.SetStateStore(store)
+			defer func() {
+				if closeErr := closeStore(); closeErr != nil {
+					logger.Error("state store close error", "error", closeErr)
+				}
+			}()
 
-			// 2. Load plugins (and register their payload types)
+			// 3. Load plugins (and register their payload types)
 			// This must happen after registry is created (in InitializeDependencies)
 			// and before services/subscribers start.
 			if err := LoadPlugins(deps); err != nil {
@@ -45,15 +68,15 @@ This utility is a work in progress.
 				return err
 			}
 
-			// 3. Load the service configuration
+			// 4. Load the service configuration
 			svcs, err := loadServiceConfigs(deps)
 			if err != nil {
 				logger.Error("config load", "error", err)
 				return err
 			}
 
-			// 4. Start services/subscribers
-			return run(deps, svcs)
+			// 5. Start services/subscribers
+			return run(deps, svcs, fileCfg)
 		},
 	}
 
@@ -22,6 +22,12 @@ type serviceConfigYaml struct {
 	Pubs    map[string]eventChannelYaml `yaml:"pubs"`
 	Subs    map[string]eventChannelYaml `yaml:"subs"`
 	Config  map[string]interface{}      `yaml:"config,omitempty"`
+
+	Throttle     map[string]throttleYaml `yaml:"throttle,omitempty"`
+	Interceptors core.InterceptorConfig  `yaml:"interceptors,omitempty"`
+	RenamedFrom  string                  `yaml:"renamed_from,omitempty"`
+	Schedule     scheduleYaml            `yaml:"schedule,omitempty"`
+	Trigger      triggerYaml             `yaml:"trigger,omitempty"`
 }
 
 type eventChannelYaml struct {
@@ -31,6 +37,81 @@ type eventChannelYaml struct {
 	MaxAge      string `yaml:"max_age"`
 }
 
+type throttleYaml struct {
+	DedupWindow  string   `yaml:"dedup_window"`
+	DedupIgnore  []string `yaml:"dedup_ignore"`
+	Limit        int      `yaml:"limit"`
+	Window       string   `yaml:"window"`
+	Key          []string `yaml:"key"`
+	AlertChannel string   `yaml:"alert_channel"`
+}
+
+type scheduleYaml struct {
+	Catchup         string `yaml:"catchup"`
+	MaxCatchup      *int   `yaml:"max_catchup"`
+	RecordOnFailure *bool  `yaml:"record_on_failure"`
+	Stagger         string `yaml:"stagger"`
+}
+
+func (s scheduleYaml) toConfig() (core.ScheduleConfig, error) {
+	cfg := core.ScheduleConfig{
+		Catchup:         s.Catchup,
+		MaxCatchup:      s.MaxCatchup,
+		RecordOnFailure: s.RecordOnFailure,
+	}
+	if s.Stagger != "" {
+		stagger, err := time.ParseDuration(s.Stagger)
+		if err != nil {
+			return cfg, fmt.Errorf("stagger: %w", err)
+		}
+		cfg.Stagger = &stagger
+	}
+	return cfg, cfg.Validate()
+}
+
+type triggerYaml struct {
+	Channels []string `yaml:"channels"`
+	Debounce string   `yaml:"debounce"`
+	Throttle string   `yaml:"throttle"`
+}
+
+func (t triggerYaml) toConfig() (core.TriggerConfig, error) {
+	cfg := core.TriggerConfig{Channels: t.Channels}
+	var err error
+	if t.Debounce != "" {
+		if cfg.Debounce, err = time.ParseDuration(t.Debounce); err != nil {
+			return cfg, fmt.Errorf("debounce: %w", err)
+		}
+	}
+	if t.Throttle != "" {
+		if cfg.Throttle, err = time.ParseDuration(t.Throttle); err != nil {
+			return cfg, fmt.Errorf("throttle: %w", err)
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func (t throttleYaml) toConfig() (core.ThrottleConfig, error) {
+	cfg := core.ThrottleConfig{
+		DedupIgnore:  t.DedupIgnore,
+		Limit:        t.Limit,
+		Key:          t.Key,
+		AlertChannel: t.AlertChannel,
+	}
+	var err error
+	if t.DedupWindow != "" {
+		if cfg.DedupWindow, err = time.ParseDuration(t.DedupWindow); err != nil {
+			return cfg, fmt.Errorf("dedup_window: %w", err)
+		}
+	}
+	if t.Window != "" {
+		if cfg.Window, err = time.ParseDuration(t.Window); err != nil {
+			return cfg, fmt.Errorf("window: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
 func configDirPath() string {
 	if dir := os.Getenv("KEYOP_CONF_DIR"); dir != "" {
 		return dir
@@ -166,15 +247,42 @@ func loadServiceConfigs(deps core.Dependencies) ([]core.ServiceConfig, error) {
 			}
 		}
 
+		var throttle map[string]core.ThrottleConfig
+		for channel, value := range serviceConfigSource.Throttle {
+			cfg, err := value.toConfig()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing throttle for channel %s: %w", channel, err)
+			}
+			if throttle == nil {
+				throttle = make(map[string]core.ThrottleConfig)
+			}
+			throttle[channel] = cfg
+		}
+
+		schedule, err := serviceConfigSource.Schedule.toConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing schedule: %w", err)
+		}
+
+		trigger, err := serviceConfigSource.Trigger.toConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing trigger: %w", err)
+		}
+
 		// use filename
 		name := wrapper.filename
 
 		svcConfig := core.ServiceConfig{
-			Name:   name,
-			Type:   serviceConfigSource.Service,
-			Pubs:   pubs,
-			Subs:   subs,
-			Config: serviceConfigSource.Config,
+			Name:         name,
+			Type:         serviceConfigSource.Service,
+			Pubs:         pubs,
+			Subs:         subs,
+			Config:       serviceConfigSource.Config,
+			Throttle:     throttle,
+			Interceptors: serviceConfigSource.Interceptors,
+			RenamedFrom:  serviceConfigSource.RenamedFrom,
+			Schedule:     schedule,
+			Trigger:      trigger,
 		}
 
 		if serviceConfigSource.Freq != "" {
@@ -272,3 +272,141 @@ func Test_loadServiceConfigs_template_userhome(t *testing.T) {
 		assert.Equal(t, userHome+"/test", svcs[0].Config["path"])
 	}
 }
+
+func Test_loadServices_throttle_loaded(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	cfg := "service: heartbeat\n" +
+		"throttle:\n" +
+		"  alerts:\n" +
+		"    dedup_window: 5m\n" +
+		"    dedup_ignore: [timestamp]\n" +
+		"    limit: 3\n" +
+		"    window: 30s\n" +
+		"    key: [summary, hostname]\n" +
+		"    alert_channel: ops\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	deps := core.Dependencies{}
+	deps.SetLogger(logger)
+	deps.SetOsProvider(adapter.OsProvider{})
+
+	svcs, err := loadServiceConfigs(deps)
+	assert.NoError(t, err)
+	if assert.Len(t, svcs, 1) {
+		assert.Equal(t, core.ThrottleConfig{
+			DedupWindow:  5 * time.Minute,
+			DedupIgnore:  []string{"timestamp"},
+			Limit:        3,
+			Window:       30 * time.Second,
+			Key:          []string{"summary", "hostname"},
+			AlertChannel: "ops",
+		}, svcs[0].Throttle["alerts"])
+	}
+
+	cfg = "service: heartbeat\nthrottle:\n  alerts:\n    window: soon\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = loadServiceConfigs(deps)
+	assert.ErrorContains(t, err, "throttle for channel alerts")
+}
+
+func Test_loadServices_interceptors_loaded(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	cfg := "service: heartbeat\n" +
+		"interceptors:\n" +
+		"  enforce_pubs: true\n" +
+		"  count: false\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	deps := core.Dependencies{}
+	deps.SetLogger(logger)
+	deps.SetOsProvider(adapter.OsProvider{})
+
+	svcs, err := loadServiceConfigs(deps)
+	assert.NoError(t, err)
+	if assert.Len(t, svcs, 1) {
+		merged := svcs[0].Interceptors.Merge(core.DefaultInterceptorConfig)
+		assert.True(t, *merged.EnforcePubs)
+		assert.False(t, *merged.Count)
+		assert.False(t, *merged.StampMetadata)
+		assert.Nil(t, svcs[0].Interceptors.Validate)
+	}
+}
+
+func Test_loadServices_schedule_loaded(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	cfg := "service: heartbeat\n" +
+		"schedule:\n" +
+		"  catchup: all\n" +
+		"  max_catchup: 3\n" +
+		"  record_on_failure: false\n" +
+		"  stagger: 30s\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	deps := core.Dependencies{}
+	deps.SetLogger(logger)
+	deps.SetOsProvider(adapter.OsProvider{})
+
+	svcs, err := loadServiceConfigs(deps)
+	assert.NoError(t, err)
+	if assert.Len(t, svcs, 1) {
+		s := svcs[0].Schedule
+		assert.Equal(t, core.CatchupAll, s.Catchup)
+		assert.Equal(t, 3, *s.MaxCatchup)
+		assert.False(t, *s.RecordOnFailure)
+		assert.Equal(t, 30*time.Second, *s.Stagger)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("service: heartbeat\nschedule:\n  catchup: sometimes\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = loadServiceConfigs(deps)
+	assert.ErrorContains(t, err, "catchup must be")
+}
+
+func Test_loadServices_trigger_loaded(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	cfg := "service: heartbeat\n" +
+		"trigger:\n" +
+		"  channels: [readings, alerts]\n" +
+		"  debounce: 2s\n" +
+		"  throttle: 1m\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	deps := core.Dependencies{}
+	deps.SetLogger(logger)
+	deps.SetOsProvider(adapter.OsProvider{})
+
+	svcs, err := loadServiceConfigs(deps)
+	assert.NoError(t, err)
+	if assert.Len(t, svcs, 1) {
+		assert.Equal(t, core.TriggerConfig{Channels: []string{"readings", "alerts"}, Debounce: 2 * time.Second, Throttle: time.Minute}, svcs[0].Trigger)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("service: heartbeat\ntrigger:\n  channels: [readings]\n  throttle: -1s\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = loadServiceConfigs(deps)
+	assert.ErrorContains(t, err, "throttle must not be negative")
+}
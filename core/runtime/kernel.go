@@ -4,16 +4,22 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/wu/keyop/core"
+
+	km "github.com/wu/keyop-messenger"
 )
 
 // Task describes a scheduled runnable unit for the kernel; it contains the service name, interval, context and the Run function executed by the kernel.
 type Task struct {
 	Name     string
 	Interval time.Duration
+	Schedule core.ScheduleConfig // unset fields use core.DefaultScheduleConfig
+	Trigger  core.TriggerConfig  // debounce and throttle of runs started by Triggers
+	Triggers <-chan struct{}     // receives when a trigger message arrives; nil when the task has none
 	Run      func() error
 	Cancel   func()
 	Ctx      context.Context
@@ -23,7 +29,8 @@ type Task struct {
 func StartKernel(deps core.Dependencies, tasks []Task) error {
 	logger := deps.MustGetLogger()
 	globalCtx := deps.MustGetContext()
-	stateStore := deps.MustGetStateStore()
+	rootStore := deps.MustGetStateStore()
+	stateStore := core.NamespacedStateStore(rootStore, core.KernelStateNamespace)
 
 	logger.Info("kernel started")
 	logger.Info("Tasks: ", "count", len(tasks))
@@ -37,26 +44,44 @@ func StartKernel(deps core.Dependencies, tasks []Task) error {
 		go func(task Task) {
 			defer wg.Done()
 
-			stateKey := fmt.Sprintf("last_check_%s", task.Name)
+			stateKey := lastCheckKey(task.Name)
 			var lastRun time.Time
 			if err := stateStore.Load(stateKey, &lastRun); err != nil {
 				logger.Error("failed to load state", "service", task.Name, "error", err)
 			}
+			// before namespaces the kernel wrote to the shared keyspace
+			legacyKey := ""
+			if lastRun.IsZero() {
+				if err := rootStore.Load(stateKey, &lastRun); err == nil && !lastRun.IsZero() {
+					legacyKey = stateKey
+				}
+			}
 
-			if !lastRun.IsZero() && task.Interval > 0 {
-				nextRun := lastRun.Add(task.Interval)
-				wait := time.Until(nextRun)
-				if wait > 0 {
-					logger.Info("Scheduled next run based on cached state", "service", task.Name, "wait", wait)
-					timer := time.NewTimer(wait)
-					select {
-					case <-globalCtx.Done():
-						if !timer.Stop() {
-							<-timer.C
-						}
-						return
-					case <-timer.C:
-					}
+			var history core.TaskHistory
+			if err := stateStore.Load(historyKey(task.Name), &history); err != nil {
+				logger.Error("failed to load run history", "service", task.Name, "error", err)
+			}
+
+			policy := task.Schedule.Merge(core.DefaultScheduleConfig)
+			var stagger time.Duration
+			if *policy.Stagger > 0 {
+				//nolint:gosec // non-crypto randomness for scheduling jitter
+				stagger = time.Duration(rand.Int63n(int64(*policy.Stagger)))
+			}
+			wait, catchup := policy.FirstRun(lastRun, time.Now(), task.Interval, stagger)
+			if catchup > 0 {
+				logger.Info("Catching up missed runs", "service", task.Name, "runs", catchup+1, "lastRun", lastRun)
+			}
+			trigger := core.TaskRunScheduled
+			lastStart := lastRun
+			if wait > 0 {
+				logger.Info("Scheduled first run", "service", task.Name, "wait", wait, "lastRun", lastRun)
+				triggered, ok := waitForRun(globalCtx, task, wait, lastStart)
+				if !ok {
+					return
+				}
+				if triggered {
+					trigger = core.TaskRunTriggered
 				}
 			}
 
@@ -69,10 +94,14 @@ func StartKernel(deps core.Dependencies, tasks []Task) error {
 				}
 
 				done := make(chan struct{})
+				start := time.Now()
+				lastStart = start
 				go func() {
 					defer close(done)
-					logger.Debug("Starting task run", "service", task.Name)
+					logger.Debug("Starting task run", "service", task.Name, "trigger", trigger)
 					err := task.Run()
+					recordTaskRun(deps, stateStore, task.Name, &history, start, trigger, err)
+					record := err == nil || *policy.RecordOnFailure
 					if err == nil {
 						logger.Debug("Task run completed", "service", task.Name)
 					} else {
@@ -94,9 +123,16 @@ func StartKernel(deps core.Dependencies, tasks []Task) error {
 							}
 						}
 					}
-					// Always save last check time
+					if !record {
+						return
+					}
 					if err := stateStore.Save(stateKey, time.Now()); err != nil {
 						logger.Error("failed to save state", "service", task.Name, "error", err)
+					} else if ext, ok := rootStore.(core.ExtendedStateStoreApi); ok && legacyKey != "" {
+						if err := ext.Delete(legacyKey); err != nil {
+							logger.Warn("failed to delete legacy state", "service", task.Name, "key", legacyKey, "error", err)
+						}
+						legacyKey = ""
 					}
 				}()
 
@@ -122,23 +158,31 @@ func StartKernel(deps core.Dependencies, tasks []Task) error {
 					logger.Debug("Task completed normally", "service", task.Name)
 				}
 
-				if task.Interval <= 0 {
+				if task.Interval <= 0 && task.Triggers == nil {
 					logger.Info("Task has non-positive interval, not restarting", "service", task.Name)
 					return
 				}
+				if catchup > 0 {
+					catchup--
+					continue
+				}
 
-				// Delay before restart, unless shutting down
-				//nolint:gosec // non-crypto randomness for scheduling jitter
-				jitter := time.Duration(rand.Int63n(int64(task.Interval) / 20)) // up to 5% jitter
-				timer := time.NewTimer(task.Interval + jitter)
-				select {
-				case <-globalCtx.Done():
+				// Delay before restart, unless shutting down; a trigger message may start the
+				// next run sooner. Without an interval only triggers start runs.
+				wait := time.Duration(-1)
+				if task.Interval > 0 {
+					//nolint:gosec // non-crypto randomness for scheduling jitter
+					jitter := time.Duration(rand.Int63n(int64(task.Interval) / 20)) // up to 5% jitter
+					wait = task.Interval + jitter
+				}
+				triggered, ok := waitForRun(globalCtx, task, wait, lastStart)
+				if !ok {
 					logger.Error("task: global context done during interval wait, exiting check loop", "service", task.Name)
-					if !timer.Stop() {
-						<-timer.C
-					}
 					return
-				case <-timer.C:
+				}
+				trigger = core.TaskRunScheduled
+				if triggered {
+					trigger = core.TaskRunTriggered
 				}
 			}
 		}(task)
@@ -150,3 +194,143 @@ func StartKernel(deps core.Dependencies, tasks []Task) error {
 
 	return nil
 }
+
+// waitForRun blocks until the next run of task is due, which is after wait unless wait is
+// negative, or once a trigger message arrived and the task's debounce and throttle have passed.
+// Throttling counts from lastStart, the start of the previous run. A steady stream of messages
+// keeps restarting the debounce, so a triggered run is never put off for longer than the larger
+// of debounce and throttle after the first message. It reports whether a trigger started the
+// run, and false for ok when ctx is done first.
+func waitForRun(ctx context.Context, task Task, wait time.Duration, lastStart time.Time) (triggered bool, ok bool) {
+	var due <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		due = timer.C
+	}
+	var fire *time.Timer
+	var fired <-chan time.Time
+	var deadline time.Time // latest start of the triggered run, set by the first message
+	defer func() {
+		if fire != nil {
+			fire.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, false
+		case <-due:
+			return false, true
+		case <-task.Triggers:
+			// every message restarts the debounce, up to the deadline
+			now := time.Now()
+			if deadline.IsZero() {
+				deadline = now.Add(max(task.Trigger.Debounce, task.Trigger.Throttle))
+			}
+			at := now.Add(task.Trigger.Debounce)
+			if earliest := lastStart.Add(task.Trigger.Throttle); at.Before(earliest) {
+				at = earliest
+			}
+			if at.After(deadline) {
+				at = deadline
+			}
+			if fire == nil {
+				fire = time.NewTimer(time.Until(at))
+				fired = fire.C
+			} else {
+				fire.Reset(time.Until(at))
+			}
+		case <-fired:
+			return true, true
+		}
+	}
+}
+
+// subscribeTriggers subscribes service to the trigger channels and returns a channel that
+// receives when a message arrives on any of them. Messages that arrive before the kernel takes
+// the previous one collapse into it.
+func subscribeTriggers(ctx context.Context, msgr core.MessengerApi, service string, channels []string) (<-chan struct{}, error) {
+	triggers := make(chan struct{}, 1)
+	handler := func(context.Context, km.Message) error {
+		select {
+		case triggers <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	for _, channel := range channels {
+		if err := msgr.Subscribe(ctx, channel, service+"-trigger", handler); err != nil {
+			return nil, fmt.Errorf("subscribe to trigger channel %q: %w", channel, err)
+		}
+	}
+	return triggers, nil
+}
+
+// historyKey is the kernel's key for a service's run history.
+func historyKey(service string) string {
+	return "history_" + service
+}
+
+// LoadTaskHistories returns the run history the kernel kept for each service in root.
+func LoadTaskHistories(root core.StateStoreApi) (map[string]core.TaskHistory, error) {
+	kernel, ok := core.NamespacedStateStore(root, core.KernelStateNamespace).(core.ExtendedStateStoreApi)
+	if !ok {
+		return nil, core.ErrStateNotExtended
+	}
+	keys, err := kernel.List(historyKey(""))
+	if err != nil {
+		return nil, err
+	}
+	histories := make(map[string]core.TaskHistory, len(keys))
+	for _, key := range keys {
+		var history core.TaskHistory
+		if err := kernel.Load(key, &history); err != nil {
+			return nil, err
+		}
+		histories[strings.TrimPrefix(key, historyKey(""))] = history
+	}
+	return histories, nil
+}
+
+// recordTaskRun adds a finished run to history, saves it and publishes the updated statistics
+// to the metrics channel.
+func recordTaskRun(deps core.Dependencies, store core.StateStoreApi, service string, history *core.TaskHistory, start time.Time, trigger string, err error) {
+	logger := deps.MustGetLogger()
+	run := core.TaskRun{Start: start, Trigger: trigger, Duration: time.Since(start), Outcome: core.TaskRunOK}
+	if err != nil {
+		run.Outcome = core.TaskRunError
+		run.Error = err.Error()
+	}
+	history.Add(run, core.DefaultTaskHistorySize)
+	if err := store.Save(historyKey(service), history); err != nil {
+		logger.Error("failed to save run history", "service", service, "error", err)
+	}
+
+	msgr := deps.GetMessenger()
+	if msgr == nil {
+		return
+	}
+	stats := history.Stats(service)
+	for _, m := range []struct {
+		name  string
+		value float64
+		unit  string
+	}{
+		{"duration", run.Duration.Seconds(), "s"},
+		{"duration_p50", stats.P50.Seconds(), "s"},
+		{"duration_p95", stats.P95.Seconds(), "s"},
+		{"failure_rate", stats.FailureRate, ""},
+	} {
+		ev := &core.MetricEvent{
+			Hostname: msgr.InstanceName(),
+			Name:     fmt.Sprintf("%s.task.%s", service, m.name),
+			Value:    m.value,
+			Unit:     m.unit,
+		}
+		if err := msgr.Publish(deps.MustGetContext(), core.MetricsChannel, ev.PayloadType(), ev); err != nil {
+			logger.Warn("task: failed to publish run metrics", "service", service, "error", err)
+			return
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	km "github.com/wu/keyop-messenger"
 )
 
 func getDefaultTestDeps() core.Dependencies {
@@ -120,12 +121,12 @@ func TestStartKernelErrorChannel(t *testing.T) {
 		assert.NoError(t, err)
 
 		// Check that the error was published to the new messenger
-		assert.Len(t, messenger.PublishedMessages, 1)
-		assert.Equal(t, "errors", messenger.PublishedMessages[0].Channel)
-		assert.Equal(t, "core.error.v1", messenger.PublishedMessages[0].PayloadType)
+		errors := messenger.MessagesOn("errors")
+		assert.Len(t, errors, 1)
+		assert.Equal(t, "core.error.v1", errors[0].PayloadType)
 
 		// Verify the payload contains the error
-		payload := messenger.PublishedMessages[0].Payload.(*core.ErrorEvent)
+		payload := errors[0].Payload.(*core.ErrorEvent)
 		assert.NotNil(t, payload)
 		assert.Contains(t, payload.Text, "task failed")
 	})
@@ -206,7 +207,260 @@ func TestStartKernelStateCache(t *testing.T) {
 
 		// Check if state was updated
 		var updatedRun time.Time
-		assert.NoError(t, stateStore.Load("last_check_test-service", &updatedRun))
+		assert.NoError(t, stateStore.Load("kernel/last_check_test-service", &updatedRun))
 		assert.True(t, updatedRun.After(lastRun), "State should have been updated")
 	})
 }
+
+func TestStartKernelRecordOnFailure(t *testing.T) {
+	for _, record := range []bool{true, false} {
+		t.Run(fmt.Sprintf("record_on_failure=%v", record), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				deps := getDefaultTestDeps()
+				cancel := deps.MustGetCancel()
+				store := testutil.NewMemoryStateStore()
+				deps.SetStateStore(store)
+				deps.SetMessenger(testutil.NewFakeMessenger())
+
+				svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+				tasks := []Task{{
+					Name:     "failing",
+					Schedule: core.ScheduleConfig{RecordOnFailure: &record},
+					Run: func() error {
+						cancel()
+						return fmt.Errorf("task failed")
+					},
+					Cancel: svcCancel,
+					Ctx:    svcCtx,
+				}}
+				assert.NoError(t, StartKernel(deps, tasks))
+
+				var lastRun time.Time
+				assert.NoError(t, store.Load("kernel/last_check_failing", &lastRun))
+				assert.Equal(t, record, !lastRun.IsZero())
+			})
+		})
+	}
+}
+
+func TestStartKernelCatchupAll(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		deps := getDefaultTestDeps()
+		cancel := deps.MustGetCancel()
+		store := testutil.NewMemoryStateStore()
+		deps.SetStateStore(store)
+		assert.NoError(t, store.Save("kernel/last_check_catchup", time.Now().Add(-3*time.Hour-30*time.Minute)))
+
+		runCount := 0
+		svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+		tasks := []Task{{
+			Name:     "catchup",
+			Interval: time.Hour,
+			Schedule: core.ScheduleConfig{Catchup: core.CatchupAll},
+			Run: func() error {
+				runCount++
+				return nil
+			},
+			Cancel: svcCancel,
+			Ctx:    svcCtx,
+		}}
+		go func() { _ = StartKernel(deps, tasks) }()
+
+		time.Sleep(time.Minute)
+		assert.Equal(t, 3, runCount, "one run per missed interval, back to back")
+		time.Sleep(time.Hour + 5*time.Minute)
+		assert.Equal(t, 4, runCount, "then the normal interval")
+		cancel()
+		synctest.Wait()
+	})
+}
+
+func TestStartKernelStagger(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		deps := getDefaultTestDeps()
+		cancel := deps.MustGetCancel()
+
+		start := time.Now()
+		var ranAt time.Time
+		stagger := 10 * time.Second
+		svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+		tasks := []Task{{
+			Name:     "staggered",
+			Interval: time.Minute,
+			Schedule: core.ScheduleConfig{Stagger: &stagger},
+			Run: func() error {
+				ranAt = time.Now()
+				cancel()
+				return nil
+			},
+			Cancel: svcCancel,
+			Ctx:    svcCtx,
+		}}
+		assert.NoError(t, StartKernel(deps, tasks))
+		assert.False(t, ranAt.IsZero())
+		assert.Less(t, ranAt.Sub(start), stagger)
+	})
+}
+
+func TestStartKernelRecordsHistory(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		deps := getDefaultTestDeps()
+		cancel := deps.MustGetCancel()
+		store := testutil.NewMemoryStateStore()
+		deps.SetStateStore(store)
+		messenger := testutil.NewFakeMessenger()
+		deps.SetMessenger(messenger)
+
+		runCount := 0
+		svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+		tasks := []Task{{
+			Name:     "timed",
+			Interval: time.Minute,
+			Run: func() error {
+				runCount++
+				time.Sleep(time.Duration(runCount) * time.Second)
+				if runCount == 2 {
+					return fmt.Errorf("second run failed")
+				}
+				if runCount == 3 {
+					cancel()
+				}
+				return nil
+			},
+			Cancel: svcCancel,
+			Ctx:    svcCtx,
+		}}
+		assert.NoError(t, StartKernel(deps, tasks))
+
+		histories, err := LoadTaskHistories(store)
+		assert.NoError(t, err)
+		history := histories["timed"]
+		if assert.Len(t, history.Runs, 3) {
+			assert.Equal(t, time.Second, history.Runs[0].Duration)
+			assert.Equal(t, core.TaskRunError, history.Runs[1].Outcome)
+			assert.Equal(t, "second run failed", history.Runs[1].Error)
+			assert.Equal(t, 3*time.Second, history.Runs[2].Duration)
+		}
+
+		var names []string
+		for _, m := range messenger.MessagesOn(core.MetricsChannel) {
+			names = append(names, m.Payload.(*core.MetricEvent).Name)
+		}
+		assert.Contains(t, names, "timed.task.duration_p95")
+		assert.Contains(t, names, "timed.task.failure_rate")
+		last := messenger.MessagesOn(core.MetricsChannel)
+		rate := last[len(last)-1].Payload.(*core.MetricEvent)
+		assert.Equal(t, "timed.task.failure_rate", rate.Name)
+		assert.InDelta(t, 1.0/3, rate.Value, 1e-9)
+	})
+}
+
+func TestStartKernelTrigger(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		deps := getDefaultTestDeps()
+		cancel := deps.MustGetCancel()
+		store := testutil.NewMemoryStateStore()
+		deps.SetStateStore(store)
+		messenger := testutil.NewFakeMessenger()
+		deps.SetMessenger(messenger)
+
+		triggers, err := subscribeTriggers(deps.MustGetContext(), messenger, "triggered", []string{"readings"})
+		assert.NoError(t, err)
+		notify := func() { _ = messenger.Handlers["readings"](context.Background(), km.Message{}) }
+
+		runCount := 0
+		svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+		tasks := []Task{{
+			Name:     "triggered",
+			Trigger:  core.TriggerConfig{Channels: []string{"readings"}, Debounce: 5 * time.Second, Throttle: time.Minute},
+			Triggers: triggers,
+			Run: func() error {
+				runCount++
+				return nil
+			},
+			Cancel: svcCancel,
+			Ctx:    svcCtx,
+		}}
+		go func() { _ = StartKernel(deps, tasks) }()
+
+		synctest.Wait()
+		assert.Equal(t, 1, runCount, "first run at startup")
+
+		time.Sleep(10 * time.Second)
+		for range 3 {
+			notify()
+			time.Sleep(time.Second)
+		}
+		time.Sleep(20 * time.Second)
+		synctest.Wait()
+		assert.Equal(t, 1, runCount, "throttled until a minute after the previous run")
+		time.Sleep(30 * time.Second)
+		synctest.Wait()
+		assert.Equal(t, 2, runCount, "the burst collapses into one run")
+
+		time.Sleep(2 * time.Minute)
+		notify()
+		time.Sleep(3 * time.Second)
+		notify()
+		time.Sleep(4 * time.Second)
+		synctest.Wait()
+		assert.Equal(t, 2, runCount, "each message restarts the debounce")
+		time.Sleep(2 * time.Second)
+		synctest.Wait()
+		assert.Equal(t, 3, runCount)
+
+		cancel()
+		synctest.Wait()
+
+		histories, err := LoadTaskHistories(store)
+		assert.NoError(t, err)
+		var reasons []string
+		for _, run := range histories["triggered"].Runs {
+			reasons = append(reasons, run.Trigger)
+		}
+		assert.Equal(t, []string{core.TaskRunScheduled, core.TaskRunTriggered, core.TaskRunTriggered}, reasons)
+	})
+}
+
+func TestStartKernelTriggerSteadyStream(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		deps := getDefaultTestDeps()
+		cancel := deps.MustGetCancel()
+		deps.SetStateStore(testutil.NewMemoryStateStore())
+		messenger := testutil.NewFakeMessenger()
+		deps.SetMessenger(messenger)
+
+		triggers, err := subscribeTriggers(deps.MustGetContext(), messenger, "streamed", []string{"readings"})
+		assert.NoError(t, err)
+
+		var runs []time.Time
+		svcCtx, svcCancel := context.WithCancel(deps.MustGetContext())
+		tasks := []Task{{
+			Name:     "streamed",
+			Trigger:  core.TriggerConfig{Channels: []string{"readings"}, Debounce: 10 * time.Second},
+			Triggers: triggers,
+			Run: func() error {
+				runs = append(runs, time.Now())
+				return nil
+			},
+			Cancel: svcCancel,
+			Ctx:    svcCtx,
+		}}
+		go func() { _ = StartKernel(deps, tasks) }()
+		synctest.Wait()
+		start := time.Now()
+
+		// a message every two seconds never leaves the debounce quiet
+		for range 30 {
+			_ = messenger.Handlers["readings"](context.Background(), km.Message{})
+			time.Sleep(2 * time.Second)
+		}
+		synctest.Wait()
+		cancel()
+		synctest.Wait()
+
+		if assert.Len(t, runs, 7, "one startup run, then one per debounce period") {
+			assert.Equal(t, start.Add(10*time.Second), runs[1])
+		}
+	})
+}
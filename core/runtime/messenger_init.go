@@ -3,6 +3,7 @@ package runtime
 import (
 	"fmt"
 	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,28 +13,102 @@ import (
 )
 
 // messengerFileConfig is the structure of messenger.yaml.
-// It embeds the keyop-messenger Config (all fields inline).
+// It embeds the keyop-messenger Config (all fields inline) next to keyop's own settings.
 type messengerFileConfig struct {
-	km.Config `yaml:",inline"`
+	km.Config    `yaml:",inline"`
+	DeadLetter   core.DeadLetterPolicy  `yaml:"dead_letter"`
+	Interceptors core.InterceptorConfig `yaml:"interceptors"`
+	State        StateConfig            `yaml:"state"`
+	Schedule     scheduleYaml           `yaml:"schedule"`
 }
 
 // initMessenger looks for messenger.yaml in the keyop conf directory.
-// If the file is absent the function returns (nil, nil) and the caller
-// should proceed without the messenger.
+// If the file is absent it falls back to an in-process adapter.MemoryMessenger
+// named after the host, which is enough for single-host setups. Messages that overflow a
+// subscriber's buffer are spilled to ~/.keyop/spill rather than blocking the publisher.
 //
 // When the file is present it:
 //  1. Parses and validates the keyop-messenger config
 //  2. Expands ~ in storage.data_dir
 //  3. Creates and starts a *km.Messenger
-//  4. Registers all canonical core payload types with the new messenger
 //
+// In both cases all canonical core payload types are registered with the new messenger, and it
+// is wrapped in a core.DeadLetterMessenger using the dead_letter policy from messenger.yaml and a
+// core.MetadataMessenger that propagates correlation and causation IDs.
 // The caller is responsible for calling messenger.Close() when the context is done.
-func initMessenger(deps core.Dependencies) (*km.Messenger, error) {
+func initMessenger(deps core.Dependencies, fileCfg *messengerFileConfig) (core.MessengerApi, error) {
 	logger := deps.MustGetLogger()
 
+	if fileCfg == nil {
+		hostname, err := deps.MustGetOsProvider().Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("get hostname for in-memory messenger: %w", err)
+		}
+		spillDir := filepath.Join(filepath.Dir(StateDataDir()), "spill")
+		m := adapter.NewMemoryMessenger(adapter.MemoryMessengerConfig{Name: hostname, SpillDir: spillDir}, logger)
+		if err := registerCorePayloadTypes(m, logger); err != nil {
+			_ = m.Close()
+			return nil, err
+		}
+		logger.Info("In-memory messenger started", "name", hostname)
+		return core.NewMetadataMessenger(core.NewDeadLetterMessenger(m, core.DefaultDeadLetterPolicy)), nil
+	}
+
+	m, err := km.New(&fileCfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("create new messenger: %w", err)
+	}
+
+	if err := registerCorePayloadTypes(m, logger); err != nil {
+		_ = m.Close()
+		return nil, err
+	}
+
+	logger.Info("New messenger started",
+		"data_dir", fileCfg.Storage.DataDir,
+	)
+
+	return core.NewMetadataMessenger(core.NewDeadLetterMessenger(m, fileCfg.DeadLetter)), nil
+}
+
+// LoadMessengerConfig reads, defaults and validates messenger.yaml from the keyop conf directory.
+// It returns (nil, nil) when the file does not exist.
+func LoadMessengerConfig(logger core.Logger) (*km.Config, error) {
+	fileCfg, err := loadMessengerFile(logger)
+	if err != nil || fileCfg == nil {
+		return nil, err
+	}
+	return &fileCfg.Config, nil
+}
+
+// globalInterceptorConfig returns the interceptors section of messenger.yaml merged over
+// core.DefaultInterceptorConfig; services can override it in their own config. A nil fileCfg
+// means messenger.yaml does not exist.
+func globalInterceptorConfig(fileCfg *messengerFileConfig) core.InterceptorConfig {
+	if fileCfg == nil {
+		return core.DefaultInterceptorConfig
+	}
+	return fileCfg.Interceptors.Merge(core.DefaultInterceptorConfig)
+}
+
+// globalScheduleConfig returns the schedule section of messenger.yaml over the defaults.
+func globalScheduleConfig(fileCfg *messengerFileConfig) (core.ScheduleConfig, error) {
+	if fileCfg == nil {
+		return core.DefaultScheduleConfig, nil
+	}
+	cfg, err := fileCfg.Schedule.toConfig()
+	if err != nil {
+		return cfg, fmt.Errorf("invalid messenger.yaml: schedule: %w", err)
+	}
+	return cfg.Merge(core.DefaultScheduleConfig), nil
+}
+
+// loadMessengerFile reads, defaults and validates messenger.yaml. It returns (nil, nil) when the
+// file does not exist.
+func loadMessengerFile(logger core.Logger) (*messengerFileConfig, error) {
 	cfgPath := filepath.Join(configDirPath(), "messenger.yaml")
 	if _, err := os.Stat(cfgPath); os.IsNotExist(err) {
-		logger.Info("messenger.yaml not found; new messenger disabled", "path", cfgPath)
+		logger.Info("messenger.yaml not found", "path", cfgPath)
 		return nil, nil
 	}
 
@@ -60,49 +135,40 @@ func initMessenger(deps core.Dependencies) (*km.Messenger, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid messenger.yaml: %w", err)
 	}
+	return &fileCfg, nil
+}
+
+// OpenLocalMessenger opens the messenger configured in messenger.yaml for command-line tools.
+// The hub listener and client connections are disabled so it can run next to a keyop daemon
+// sharing the same data directory; published messages are written to local channel storage.
+func OpenLocalMessenger(deps core.Dependencies) (*km.Messenger, error) {
+	logger := deps.MustGetLogger()
+
+	cfg, err := LoadMessengerConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("messenger.yaml not found in %s", configDirPath())
+	}
+	cfg.Hub.Enabled = false
+	cfg.Client.Enabled = false
 
 	m, err := km.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("create new messenger: %w", err)
 	}
-
 	if err := registerCorePayloadTypes(m, logger); err != nil {
 		_ = m.Close()
 		return nil, err
 	}
-
-	logger.Info("New messenger started",
-		"data_dir", cfg.Storage.DataDir,
-	)
-
 	return m, nil
 }
 
-// registerCorePayloadTypes registers all canonical core payload types with the
-// new messenger so that the bridge and migrated services can decode them.
-func registerCorePayloadTypes(m *km.Messenger, _ core.Logger) error {
-	types := []struct {
-		name  string
-		proto any
-	}{
-		{"core.metric.v1", &core.MetricEvent{}},
-		{"core.alert.v1", &core.AlertEvent{}},
-		{"core.status.v1", &core.StatusEvent{}},
-		{"core.service.state.v1", &core.ServiceStateEvent{}},
-		{"core.error.v1", &core.ErrorEvent{}},
-		{"core.temp.v1", &core.TempEvent{}},
-		{"core.device.status.v1", &core.DeviceStatusEvent{}},
-		{"core.switch.v1", &core.SwitchEvent{}},
-		{"core.switch.command.v1", &core.SwitchCommand{}},
-		{"weatherstation.event.v1", &core.WeatherStationEvent{}},
-		{"core.gps.v1", &core.GpsEvent{}},
-	}
-	for _, t := range types {
-		if err := m.RegisterPayloadType(t.name, t.proto); err != nil {
-			return fmt.Errorf("register payload type %q: %w", t.name, err)
-		}
-	}
-	return nil
+// registerCorePayloadTypes registers all payload types owned by core in the
+// payload registry with the messenger so that services can decode them.
+func registerCorePayloadTypes(m core.MessengerApi, _ core.Logger) error {
+	return core.RegisterServicePayloads(m, core.CorePayloadService)
 }
 
 // expandHome replaces a leading ~ with the current user's home directory.
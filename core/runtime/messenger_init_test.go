@@ -2,13 +2,16 @@ package runtime
 
 import (
 	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
 	"github.com/wu/keyop/core/testutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
 )
 
 func TestExpandHome_WithTilde(t *testing.T) {
@@ -46,11 +49,24 @@ func TestInitNewMessenger_FileNotFound(t *testing.T) {
 	deps := core.Dependencies{}
 	logger := &testutil.FakeLogger{}
 	deps.SetLogger(logger)
+	deps.SetOsProvider(testutil.FakeOsProvider{Host: "solo"})
 
-	// Don't create messenger.yaml, should return nil gracefully
-	msgr, err := initMessenger(deps)
-	assert.NoError(t, err)
-	assert.Nil(t, msgr)
+	// Don't create messenger.yaml, should fall back to the in-memory messenger
+	fileCfg, err := loadMessengerFile(logger)
+	require.NoError(t, err)
+	require.Nil(t, fileCfg)
+	msgr, err := initMessenger(deps, fileCfg)
+	require.NoError(t, err)
+	require.IsType(t, &core.MetadataMessenger{}, msgr)
+	dl := msgr.(*core.MetadataMessenger).MessengerApi
+	require.IsType(t, &core.DeadLetterMessenger{}, dl)
+	require.IsType(t, &adapter.MemoryMessenger{}, dl.(*core.DeadLetterMessenger).MessengerApi)
+	defer func() { _ = msgr.Close() }()
+	assert.Equal(t, "solo", msgr.InstanceName())
+
+	// core payload types are registered
+	err = msgr.RegisterPayloadType("core.alert.v1", core.AlertEvent{})
+	assert.ErrorIs(t, err, km.ErrPayloadTypeAlreadyRegistered)
 }
 
 func TestInitNewMessenger_InvalidYAML(t *testing.T) {
@@ -66,9 +82,9 @@ func TestInitNewMessenger_InvalidYAML(t *testing.T) {
 	logger := &testutil.FakeLogger{}
 	deps.SetLogger(logger)
 
-	msgr, err := initMessenger(deps)
+	fileCfg, err := loadMessengerFile(logger)
 	assert.Error(t, err)
-	assert.Nil(t, msgr)
+	assert.Nil(t, fileCfg)
 	assert.Contains(t, err.Error(), "parse messenger.yaml")
 }
 
@@ -89,7 +105,10 @@ storage:
 	logger := &testutil.FakeLogger{}
 	deps.SetLogger(logger)
 
-	msgr, err := initMessenger(deps)
+	fileCfg, err := loadMessengerFile(logger)
+	require.NoError(t, err)
+	assert.NotContains(t, fileCfg.Storage.DataDir, "~")
+	msgr, err := initMessenger(deps, fileCfg)
 	// Should succeed and expand the ~ in data_dir
 	if err != nil {
 		// If it fails, that's OK - just verify the function runs
@@ -100,3 +119,33 @@ storage:
 		defer func() { _ = msgr.Close() }()
 	}
 }
+
+func TestInitNewMessenger_DeadLetterPolicy(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	messengerYAML := `
+name: dl-test
+storage:
+  data_dir: ` + filepath.Join(dir, "data") + `
+dead_letter:
+  max_retries: 1
+  initial_backoff: 50ms
+  max_backoff: 2s
+`
+	err := os.WriteFile(filepath.Join(dir, "messenger.yaml"), []byte(messengerYAML), 0o600)
+	require.NoError(t, err)
+
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+
+	fileCfg, err := loadMessengerFile(deps.MustGetLogger())
+	require.NoError(t, err)
+	msgr, err := initMessenger(deps, fileCfg)
+	require.NoError(t, err)
+	defer func() { _ = msgr.Close() }()
+	dl, ok := msgr.(*core.MetadataMessenger).MessengerApi.(*core.DeadLetterMessenger)
+	require.True(t, ok)
+	assert.Equal(t, core.DeadLetterPolicy{MaxRetries: 1, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 2 * time.Second},
+		dl.Policy)
+}
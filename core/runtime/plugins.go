@@ -17,10 +17,33 @@ type PluginsConfig struct {
 }
 
 // PluginInfo contains metadata for a single plugin entry (path, enabled flag, and configuration) as read from plugins.yaml.
+//
+// Kind selects the plugin loader: "go" (default) opens a Go .so plugin, "wasm" loads a sandboxed
+// WebAssembly module. Paths ending in .wasm default to the wasm kind. MaxMemoryMB and CallTimeout
+// only apply to wasm plugins.
 type PluginInfo struct {
-	Name    string `yaml:"name"`
-	Path    string `yaml:"path"`
-	Enabled bool   `yaml:"enabled"`
+	Name        string `yaml:"name"`
+	Path        string `yaml:"path"`
+	Enabled     bool   `yaml:"enabled"`
+	Kind        string `yaml:"kind,omitempty"`
+	MaxMemoryMB int    `yaml:"max_memory_mb,omitempty"`
+	CallTimeout string `yaml:"call_timeout,omitempty"`
+}
+
+const (
+	pluginKindGo   = "go"
+	pluginKindWasm = "wasm"
+)
+
+// pluginKind returns the effective loader kind for the plugin entry.
+func (p PluginInfo) pluginKind() string {
+	if p.Kind != "" {
+		return p.Kind
+	}
+	if filepath.Ext(p.Path) == ".wasm" {
+		return pluginKindWasm
+	}
+	return pluginKindGo
 }
 
 func pluginConfigPath() string {
@@ -70,14 +93,23 @@ func LoadPlugins(deps core.Dependencies) error {
 					files = dirEntries
 				}
 				logger.Error("Plugin file not found, skipping", "name", p.Name, "path", p.Path, "dir_listing", files)
-				logger.Error("Hint: ensure the plugin .so exists at the absolute path above (container paths: /root/.keyop or /.keyop)")
+				logger.Error("Hint: ensure the plugin .so or .wasm exists at the absolute path above (container paths: /root/.keyop or /.keyop)")
 				continue
 			}
 			return fmt.Errorf("error stating plugin file %s: %w", p.Path, statErr)
 		}
-		if err := loadPlugin(p, deps); err != nil {
-			logger.Error("Failed to load plugin", "name", p.Name, "error", err)
-			return err
+		var loadErr error
+		switch p.pluginKind() {
+		case pluginKindGo:
+			loadErr = loadPlugin(p, deps)
+		case pluginKindWasm:
+			loadErr = loadWasmPlugin(p, deps)
+		default:
+			loadErr = fmt.Errorf("unknown plugin kind %q", p.Kind)
+		}
+		if loadErr != nil {
+			logger.Error("Failed to load plugin", "name", p.Name, "kind", p.pluginKind(), "error", loadErr)
+			return loadErr
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/util"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,13 +16,25 @@ import (
 type ServiceWrapper struct {
 	Service core.Service
 	Config  core.ServiceConfig
+
+	triggers <-chan struct{} // signals from the service's trigger channels
 }
 
-func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
+// run starts serviceConfigs with the global settings of fileCfg, the parsed messenger.yaml or nil
+// when it does not exist.
+func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig, fileCfg *messengerFileConfig) error {
 	ctx := deps.MustGetContext()
 	logger := deps.MustGetLogger()
 	logger.Info("run called")
 
+	interceptorDefaults := globalInterceptorConfig(fileCfg)
+	scheduleDefaults, err := globalScheduleConfig(fileCfg)
+	if err != nil {
+		return err
+	}
+	publishCounter := core.NewPublishCounter()
+	var expiryMessengers []*core.ExpiryMessenger
+
 	// iterate over service configs and create service instances
 	logger.Info("Creating service instances")
 	var services []ServiceWrapper
@@ -35,7 +48,53 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 
 		// Create a service-specific context with the service name stamped on it
 		svcCtx := km.WithServiceName(ctx, serviceConfig.Name)
-		svcInstance := serviceFunc(deps, serviceConfig, svcCtx)
+		// resolve the effective interceptor settings so services can see whether they run strict
+		serviceConfig.Interceptors = serviceConfig.Interceptors.Merge(interceptorDefaults)
+		serviceConfig.Schedule = serviceConfig.Schedule.Merge(scheduleDefaults)
+		svcDeps := deps
+		if root := deps.GetStateStore(); root != nil {
+			if serviceConfig.RenamedFrom != "" {
+				moved, err := RenameServiceState(root, serviceConfig.RenamedFrom, serviceConfig.Name)
+				if err != nil {
+					return fmt.Errorf("service %s: move state from %s: %w", serviceConfig.Name, serviceConfig.RenamedFrom, err)
+				}
+				if moved > 0 {
+					logger.Info("moved service state", "from", serviceConfig.RenamedFrom, "to", serviceConfig.Name, "keys", moved)
+				}
+			}
+			// each service sees only its own keys
+			svcDeps.SetStateStore(ServiceStateStore(root, serviceConfig.Name))
+		}
+		if msgr := deps.GetMessenger(); msgr != nil {
+			// apply the max_age of the service's channels to its own publishes and deliveries
+			expiry := core.NewExpiryMessenger(msgr, serviceConfig, logger)
+			expiryMessengers = append(expiryMessengers, expiry)
+			msgr = expiry
+			// count below the throttle, which drops messages without an error
+			if count := core.ServiceCounter(serviceConfig.Interceptors, serviceConfig, publishCounter); count != nil {
+				msgr = core.NewInterceptedMessenger(msgr, count)
+			}
+			// throttle and intercept only what this service publishes
+			if len(serviceConfig.Throttle) > 0 {
+				msgr = util.NewThrottleMessenger(msgr, serviceConfig.Name, serviceConfig.Throttle, logger)
+			}
+			if chain := core.ServiceInterceptors(serviceConfig.Interceptors, serviceConfig, msgr.InstanceName(), logger); len(chain) > 0 {
+				msgr = core.NewInterceptedMessenger(msgr, chain...)
+			}
+			svcDeps.SetMessenger(msgr)
+		}
+		var triggers <-chan struct{}
+		if len(serviceConfig.Trigger.Channels) > 0 {
+			msgr := svcDeps.GetMessenger()
+			if msgr == nil {
+				return fmt.Errorf("service %s: trigger channels need the messenger", serviceConfig.Name)
+			}
+			triggers, err = subscribeTriggers(svcCtx, msgr, serviceConfig.Name, serviceConfig.Trigger.Channels)
+			if err != nil {
+				return fmt.Errorf("service %s: %w", serviceConfig.Name, err)
+			}
+		}
+		svcInstance := serviceFunc(svcDeps, serviceConfig, svcCtx)
 		service, ok := svcInstance.(core.Service)
 		if !ok {
 			logger.Error("service instance does not implement core.Service", "type", serviceConfig.Type)
@@ -134,7 +193,7 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 			}
 		}
 
-		services = append(services, ServiceWrapper{Service: service, Config: serviceConfig})
+		services = append(services, ServiceWrapper{Service: service, Config: serviceConfig, triggers: triggers})
 
 		// If this is the sqlite coordinator, backfill previously created services
 		if sqliteCoord, ok := service.(core.SQLiteCoordinator); ok {
@@ -222,6 +281,16 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 		}
 	}
 
+	// Expose the payload registry to the MCP and web UI coordinators
+	for _, sw := range services {
+		if mcpCoord, ok := sw.Service.(core.MCPCoordinator); ok {
+			mcpCoord.RegisterMCPToolProvider(core.PayloadCatalog{})
+		}
+		if webuiCoord, ok := sw.Service.(core.WebUICoordinator); ok {
+			webuiCoord.RegisterProvider("payloads", core.PayloadCatalog{})
+		}
+	}
+
 	// validate all service configs before initializing any services
 	// Propagate sqlite DB path mappings from the webui service configuration.
 	// Only the 'dbPaths' key is accepted (mapping: payloadType -> dbPath).
@@ -258,7 +327,7 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 		}
 	}
 	logger.Info("Validating service configurations")
-	err := validateServiceConfig(services, logger)
+	err = validateServiceConfig(services, logger)
 	if err != nil {
 		logger.Error("ERROR: Validation failed", "error", err)
 		return err
@@ -280,6 +349,9 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 		task := Task{
 			Name:     serviceWrapper.Config.Name,
 			Interval: serviceWrapper.Config.Freq,
+			Schedule: serviceWrapper.Config.Schedule,
+			Trigger:  serviceWrapper.Config.Trigger,
+			Triggers: serviceWrapper.triggers,
 			Run: func() error {
 				return serviceWrapper.Service.Check()
 			},
@@ -304,6 +376,14 @@ func run(deps core.Dependencies, serviceConfigs []core.ServiceConfig) error {
 	}
 
 	logger.Warn("run: All tasks successfully shut down")
+	for _, pc := range publishCounter.Snapshot() {
+		logger.Info("run: published messages", "service", pc.Service, "channel", pc.Channel, "published", pc.Published, "failed", pc.Failed)
+	}
+	for _, expiry := range expiryMessengers {
+		for _, sc := range expiry.Skipped() {
+			logger.Info("run: skipped messages", "service", sc.Service, "channel", sc.Channel, "subscriber", sc.Subscriber, "expired", sc.Expired, "stale", sc.Stale)
+		}
+	}
 
 	return nil
 }
@@ -54,7 +54,7 @@ func TestRun_WithUnregisteredServiceType(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "service type not registered")
 }
@@ -87,7 +87,7 @@ func TestRun_ValidatesConfigBeforeInitializing(t *testing.T) {
 	// Create channel to signal when validation happens
 	validationDone := make(chan bool, 1)
 	go func() {
-		_ = run(deps, serviceConfigs)
+		_ = run(deps, serviceConfigs, nil)
 		validationDone <- true
 	}()
 
@@ -110,7 +110,7 @@ func TestRun_WithEmptyServiceList(t *testing.T) {
 	deps.SetOsProvider(&testutil.FakeOsProvider{Host: "test-host"})
 	deps.SetStateStore(&testutil.NoOpStateStore{})
 
-	err := run(deps, []core.ServiceConfig{})
+	err := run(deps, []core.ServiceConfig{}, nil)
 	// Empty service list should be OK (no services to run)
 	// The function will complete successfully
 	assert.Nil(t, err) // Might be OK or error depending on implementation
@@ -291,7 +291,7 @@ func TestRun_ServiceDoesNotImplementCoreService(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "does not implement core.Service")
 }
@@ -322,7 +322,7 @@ func TestRun_ServiceInitializationFails(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "service initialization failed")
 }
@@ -353,7 +353,7 @@ func TestRun_ServiceValidationFails(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "service configuration errors detected")
 }
@@ -389,7 +389,7 @@ func TestRun_ServiceRegistersPayloadTypes(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	// Should succeed and service should have registered payloads
 	assert.NoError(t, err)
 	assert.True(t, svc.registerPayloadsCalled)
@@ -431,7 +431,7 @@ func TestRun_WithMultipleServices(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.NoError(t, err)
 }
 
@@ -488,7 +488,7 @@ func TestRun_PayloadRegistrationFails(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "service payload type registration failed")
 }
@@ -523,7 +523,7 @@ func TestRun_ServiceWithoutPayloadTypes(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	// Should succeed - service just doesn't have RegisterPayloadTypes
 	assert.NoError(t, err)
 }
@@ -576,7 +576,7 @@ func TestRun_ServiceWithFreqCreatesTask(t *testing.T) {
 	// Run in a goroutine and cancel quickly to stop the kernel
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- run(deps, serviceConfigs)
+		errChan <- run(deps, serviceConfigs, nil)
 	}()
 
 	// Cancel almost immediately - just let it start
@@ -621,7 +621,7 @@ func TestRun_ServiceWithConfig(t *testing.T) {
 	// Run and cancel
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- run(deps, serviceConfigs)
+		errChan <- run(deps, serviceConfigs, nil)
 	}()
 
 	time.Sleep(10 * time.Millisecond)
@@ -680,7 +680,7 @@ func TestRun_ServiceCheckIsCalled(t *testing.T) {
 	// Run and wait for Check to be called at least once
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- run(deps, serviceConfigs)
+		errChan <- run(deps, serviceConfigs, nil)
 	}()
 
 	// Wait a bit for the service to be initialized and Check to run
@@ -719,7 +719,7 @@ func TestRun_ServiceNameDefaultsToFilename(t *testing.T) {
 		},
 	}
 
-	err := run(deps, serviceConfigs)
+	err := run(deps, serviceConfigs, nil)
 	// Should error because Name is empty
 	assert.Error(t, err)
 }
@@ -760,7 +760,7 @@ func TestRun_WithThreeServices(t *testing.T) {
 
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- run(deps, serviceConfigs)
+		errChan <- run(deps, serviceConfigs, nil)
 	}()
 
 	time.Sleep(10 * time.Millisecond)
@@ -820,7 +820,7 @@ func TestRun_ServiceCheckReturnsError(t *testing.T) {
 
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- run(deps, serviceConfigs)
+		errChan <- run(deps, serviceConfigs, nil)
 	}()
 
 	// Let it run for a bit - the kernel will handle the error from Check
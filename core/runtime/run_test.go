@@ -34,7 +34,7 @@ func Test_run_logs_error_when_service_type_not_registered(t *testing.T) {
 	}
 
 	done := make(chan error, 1)
-	go func() { done <- run(deps, serviceConfigs) }()
+	go func() { done <- run(deps, serviceConfigs, nil) }()
 
 	// allow goroutine to attempt to construct the service and log error
 	time.Sleep(100 * time.Millisecond)
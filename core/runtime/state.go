@@ -0,0 +1,256 @@
+package runtime
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+)
+
+// State store backends selectable with state.backend in messenger.yaml.
+const (
+	StateBackendFile   = "file"
+	StateBackendSQLite = "sqlite"
+)
+
+// StateConfig is the state section of messenger.yaml:
+//
+//	state:
+//	  backend: sqlite               # file (default) or sqlite
+//	  path: ~/.keyop/data/state.db  # sqlite database
+//	  encryption:                   # optional
+//	    namespaces: [service/tokens] # all keys when omitted
+//	    allow_plaintext: false       # read values written before encryption, to migrate them
+//	    keys:                       # the first encrypts, the rest only decrypt
+//	      - id: k2
+//	        file: ~/.keyop/state-k2.key
+//	      - id: k1
+//	        env: KEYOP_STATE_KEY_K1
+type StateConfig struct {
+	Backend    string                 `yaml:"backend"`
+	Path       string                 `yaml:"path"`
+	Encryption *StateEncryptionConfig `yaml:"encryption"`
+}
+
+// StateEncryptionConfig selects the state namespaces encrypted at rest and the keys used.
+// AllowPlaintext is only meant for migrating existing state: set it, run keyop state rekey, then
+// turn it off again.
+type StateEncryptionConfig struct {
+	Namespaces     []string                `yaml:"namespaces"`
+	Keys           []StateEncryptionKeyRef `yaml:"keys"`
+	AllowPlaintext bool                    `yaml:"allow_plaintext"`
+}
+
+// StateEncryptionKeyRef names where a base64-encoded 32-byte key is read from: a file or an
+// environment variable.
+type StateEncryptionKeyRef struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// load reads and decodes the key.
+func (r StateEncryptionKeyRef) load() (core.StateEncryptionKey, error) {
+	var text string
+	switch {
+	case r.File != "" && r.Env != "":
+		return core.StateEncryptionKey{}, fmt.Errorf("state encryption key %q: set file or env, not both", r.ID)
+	case r.File != "":
+		b, err := os.ReadFile(expandHome(r.File))
+		if err != nil {
+			return core.StateEncryptionKey{}, fmt.Errorf("state encryption key %q: %w", r.ID, err)
+		}
+		text = string(b)
+	case r.Env != "":
+		text = os.Getenv(r.Env)
+		if text == "" {
+			return core.StateEncryptionKey{}, fmt.Errorf("state encryption key %q: %s is not set", r.ID, r.Env)
+		}
+	default:
+		return core.StateEncryptionKey{}, fmt.Errorf("state encryption key %q: set file or env", r.ID)
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return core.StateEncryptionKey{}, fmt.Errorf("state encryption key %q: not base64: %w", r.ID, err)
+	}
+	return core.StateEncryptionKey{ID: r.ID, Secret: secret}, nil
+}
+
+// wrap returns store encrypting the configured namespaces.
+func (c *StateEncryptionConfig) wrap(store core.StateStoreApi) (core.StateStoreApi, error) {
+	keys := make([]core.StateEncryptionKey, 0, len(c.Keys))
+	for _, ref := range c.Keys {
+		key, err := ref.load()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return core.NewEncryptedStateStore(store, keys, c.Namespaces, c.AllowPlaintext)
+}
+
+// StateDataDir is the directory the file state store writes to.
+func StateDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".keyop", "data")
+}
+
+func (c StateConfig) withDefaults() (StateConfig, error) {
+	if c.Backend == "" {
+		c.Backend = StateBackendFile
+	}
+	if c.Backend != StateBackendFile && c.Backend != StateBackendSQLite {
+		return c, fmt.Errorf("invalid messenger.yaml: state.backend must be %q or %q, got %q", StateBackendFile, StateBackendSQLite, c.Backend)
+	}
+	c.Path = expandHome(c.Path)
+	if c.Path == "" {
+		c.Path = filepath.Join(StateDataDir(), "state.db")
+	}
+	return c, nil
+}
+
+// LoadStateConfig returns the state section of messenger.yaml with defaults applied. Without
+// messenger.yaml the file backend is used.
+func LoadStateConfig(logger core.Logger) (StateConfig, error) {
+	fileCfg, err := loadMessengerFile(logger)
+	if err != nil {
+		return StateConfig{}, err
+	}
+	return stateConfig(fileCfg)
+}
+
+// stateConfig is LoadStateConfig for an already loaded messenger.yaml, nil when it does not exist.
+func stateConfig(fileCfg *messengerFileConfig) (StateConfig, error) {
+	var cfg StateConfig
+	if fileCfg != nil {
+		cfg = fileCfg.State
+	}
+	return cfg.withDefaults()
+}
+
+// OpenStateStore returns the state store selected in messenger.yaml and a function that closes
+// it. For the file backend it is the store already set on deps. With state.encryption set the
+// store is wrapped to encrypt the configured namespaces.
+func OpenStateStore(deps core.Dependencies) (core.StateStoreApi, func() error, error) {
+	cfg, err := LoadStateConfig(deps.MustGetLogger())
+	if err != nil {
+		return nil, nil, err
+	}
+	return openStateStore(deps, cfg)
+}
+
+// openStateStore is OpenStateStore for an already loaded state config.
+func openStateStore(deps core.Dependencies, cfg StateConfig) (core.StateStoreApi, func() error, error) {
+	logger := deps.MustGetLogger()
+	store, closeStore, err := openStateBackend(deps, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Encryption != nil && store != nil {
+		encrypted, err := cfg.Encryption.wrap(store)
+		if err != nil {
+			_ = closeStore()
+			return nil, nil, fmt.Errorf("invalid messenger.yaml: state.encryption: %w", err)
+		}
+		logger.Info("State encryption enabled", "namespaces", cfg.Encryption.Namespaces, "keys", len(cfg.Encryption.Keys))
+		store = encrypted
+	}
+	return store, closeStore, nil
+}
+
+// openStateBackend opens the configured store without encryption, so values are seen as stored.
+func openStateBackend(deps core.Dependencies, cfg StateConfig) (core.StateStoreApi, func() error, error) {
+	if cfg.Backend == StateBackendFile {
+		return deps.GetStateStore(), func() error { return nil }, nil
+	}
+	db, err := adapter.NewSQLiteStateStore(cfg.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	deps.MustGetLogger().Info("SQLite state store opened", "path", cfg.Path)
+	return db, db.Close, nil
+}
+
+// lastCheckKey is the kernel's key for the time a service's task last ran.
+func lastCheckKey(service string) string {
+	return "last_check_" + service
+}
+
+// ServiceStateStore returns the namespaced view of root given to the named service.
+func ServiceStateStore(root core.StateStoreApi, name string) core.StateStoreApi {
+	return core.NamespacedStateStore(root, core.ServiceStateNamespace(name))
+}
+
+// RenameServiceState moves the state of service from, including the kernel's bookkeeping, to
+// service to, keeping expiries. It does nothing when to already has state in its namespace, and
+// keeps kernel bookkeeping to already has, so it is safe to run on every start. It returns the
+// number of keys moved.
+func RenameServiceState(root core.StateStoreApi, from, to string) (int, error) {
+	ext, ok := root.(core.ExtendedStateStoreApi)
+	if !ok {
+		return 0, core.ErrStateNotExtended
+	}
+	existing, err := ext.List(core.ServiceStateNamespace(to) + "/")
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, nil
+	}
+	moved, err := core.MoveStateNamespace(ext, core.ServiceStateNamespace(from), core.ServiceStateNamespace(to))
+	if err != nil {
+		return moved, err
+	}
+	kernel := core.NamespacedStateStore(root, core.KernelStateNamespace).(core.ExtendedStateStoreApi)
+	for _, key := range []func(string) string{lastCheckKey, historyKey} {
+		var current json.RawMessage
+		if err := kernel.Load(key(to), &current); err != nil {
+			return moved, err
+		}
+		if current != nil {
+			continue
+		}
+		ok, err := core.MoveState(kernel, key(from), key(to))
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// ResetServiceSchedule forgets when the named service's task last ran, so the kernel runs it
+// immediately on the next start. It returns false when there was nothing to forget.
+func ResetServiceSchedule(root core.StateStoreApi, service string) (bool, error) {
+	ext, ok := root.(core.ExtendedStateStoreApi)
+	if !ok {
+		return false, core.ErrStateNotExtended
+	}
+	key := lastCheckKey(service)
+	found := false
+	// the legacy key is what the kernel falls back to before namespaces existed
+	for _, k := range []string{core.KernelStateNamespace + "/" + key, key} {
+		var value json.RawMessage
+		if err := ext.Load(k, &value); err != nil {
+			return found, err
+		}
+		if value == nil {
+			continue
+		}
+		if err := ext.Delete(k); err != nil {
+			return found, err
+		}
+		found = true
+	}
+	return found, nil
+}
@@ -0,0 +1,151 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeStateMessengerYAML(t *testing.T, state string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+	messengerYAML := "name: state-test\nstorage:\n  data_dir: " + filepath.Join(dir, "msgs") + "\n" + state
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "messenger.yaml"), []byte(messengerYAML), 0o600))
+}
+
+func TestLoadStateConfig(t *testing.T) {
+	t.Run("no messenger.yaml", func(t *testing.T) {
+		t.Setenv("KEYOP_CONF_DIR", t.TempDir())
+		cfg, err := LoadStateConfig(&testutil.FakeLogger{})
+		require.NoError(t, err)
+		assert.Equal(t, StateBackendFile, cfg.Backend)
+		assert.Equal(t, filepath.Join(StateDataDir(), "state.db"), cfg.Path)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		writeStateMessengerYAML(t, "state:\n  backend: sqlite\n  path: ~/keyop-state.db\n")
+		cfg, err := LoadStateConfig(&testutil.FakeLogger{})
+		require.NoError(t, err)
+		home, _ := os.UserHomeDir()
+		assert.Equal(t, StateConfig{Backend: StateBackendSQLite, Path: filepath.Join(home, "keyop-state.db")}, cfg)
+	})
+
+	t.Run("invalid backend", func(t *testing.T) {
+		writeStateMessengerYAML(t, "state:\n  backend: redis\n")
+		_, err := LoadStateConfig(&testutil.FakeLogger{})
+		assert.ErrorContains(t, err, "state.backend")
+	})
+}
+
+func TestOpenStateStore(t *testing.T) {
+	fileStore := &testutil.NoOpStateStore{}
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+	deps.SetStateStore(fileStore)
+
+	t.Run("file", func(t *testing.T) {
+		writeStateMessengerYAML(t, "")
+		store, closeStore, err := OpenStateStore(deps)
+		require.NoError(t, err)
+		assert.Same(t, fileStore, store)
+		assert.NoError(t, closeStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "state", "state.db")
+		writeStateMessengerYAML(t, "state:\n  backend: sqlite\n  path: "+dbPath+"\n")
+
+		store, closeStore, err := OpenStateStore(deps)
+		require.NoError(t, err)
+		require.IsType(t, &adapter.SQLiteStateStore{}, store)
+		require.NoError(t, store.Save("key", "value"))
+		require.NoError(t, closeStore())
+		_, err = os.Stat(dbPath)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRenameServiceState(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	require.NoError(t, root.Save("service/old/count", 3))
+	require.NoError(t, root.SaveWithTTL("service/old/token", "t", time.Hour))
+	require.NoError(t, root.Save("kernel/"+lastCheckKey("old"), "2026-01-01T00:00:00Z"))
+	require.NoError(t, root.Save("kernel/"+historyKey("old"), core.TaskHistory{}))
+	require.NoError(t, root.Save("kernel/"+historyKey("new"), "kept"))
+
+	moved, err := RenameServiceState(root, "old", "new")
+	require.NoError(t, err)
+	assert.Equal(t, 3, moved)
+	keys, err := root.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kernel/history_new", "kernel/history_old", "kernel/last_check_new", "service/new/count", "service/new/token"}, keys)
+	var history string
+	require.NoError(t, root.Load("kernel/"+historyKey("new"), &history))
+	assert.Equal(t, "kept", history, "kernel keys the new name already has are not overwritten")
+	expiresAt, err := root.ExpiresAt("service/new/token")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	// a second start finds the state already in place
+	require.NoError(t, root.Save("service/old/count", 9))
+	moved, err = RenameServiceState(root, "old", "new")
+	require.NoError(t, err)
+	assert.Zero(t, moved)
+	var n int
+	require.NoError(t, root.Load("service/new/count", &n))
+	assert.Equal(t, 3, n)
+
+	_, err = RenameServiceState(&testutil.NoOpStateStore{}, "old", "new")
+	assert.ErrorIs(t, err, core.ErrStateNotExtended)
+}
+
+func TestOpenStateStore_Encryption(t *testing.T) {
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+	root := testutil.NewMemoryStateStore()
+	deps.SetStateStore(root)
+
+	keyFile := filepath.Join(t.TempDir(), "state.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0o600))
+	t.Setenv("KEYOP_TEST_STATE_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+
+	t.Run("keys from file and env", func(t *testing.T) {
+		writeStateMessengerYAML(t, "state:\n  encryption:\n    namespaces: [service/tokens]\n    keys:\n      - id: k2\n        file: "+keyFile+"\n      - id: k1\n        env: KEYOP_TEST_STATE_KEY\n")
+		store, closeStore, err := OpenStateStore(deps)
+		require.NoError(t, err)
+		defer func() { _ = closeStore() }()
+
+		require.NoError(t, store.Save("service/tokens/t", "secret"))
+		var raw json.RawMessage
+		require.NoError(t, root.Load("service/tokens/t", &raw))
+		assert.Contains(t, string(raw), `"kid":"k2"`)
+		var s string
+		require.NoError(t, store.Load("service/tokens/t", &s))
+		assert.Equal(t, "secret", s)
+	})
+
+	t.Run("missing env", func(t *testing.T) {
+		writeStateMessengerYAML(t, "state:\n  encryption:\n    keys:\n      - id: k1\n        env: KEYOP_TEST_STATE_KEY_UNSET\n")
+		_, _, err := OpenStateStore(deps)
+		assert.ErrorContains(t, err, "KEYOP_TEST_STATE_KEY_UNSET is not set")
+	})
+
+	t.Run("wrong length", func(t *testing.T) {
+		t.Setenv("KEYOP_TEST_STATE_KEY_SHORT", base64.StdEncoding.EncodeToString([]byte("short")))
+		writeStateMessengerYAML(t, "state:\n  encryption:\n    keys:\n      - id: k1\n        env: KEYOP_TEST_STATE_KEY_SHORT\n")
+		_, _, err := OpenStateStore(deps)
+		assert.ErrorContains(t, err, "must be 32 bytes")
+	})
+}
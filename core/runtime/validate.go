@@ -3,6 +3,7 @@ package runtime
 import (
 	"fmt"
 	"github.com/wu/keyop/core"
+	"strings"
 )
 
 func validateServiceConfig(services []ServiceWrapper, logger core.Logger) error {
@@ -15,6 +16,10 @@ func validateServiceConfig(services []ServiceWrapper, logger core.Logger) error
 				logger.Error("service config is missing the required field 'name'", "config", serviceWrapper.Config)
 				errCount++
 			}
+			if strings.Contains(serviceWrapper.Config.Name, "/") {
+				logger.Error("service name must not contain '/'", "name", serviceWrapper.Config.Name)
+				errCount++
+			}
 			if serviceWrapper.Config.Type == "" {
 				logger.Error("service config is missing the required field 'type'", "name", serviceWrapper.Config.Name)
 				errCount++
@@ -47,6 +47,15 @@ func Test_validateServiceConfig(t *testing.T) {
 			wantErr: assert.Error,
 			logMsgs: []string{"service config is missing the required field 'type'"},
 		},
+		{
+			name: "slash in name",
+			services: []ServiceWrapper{{
+				Service: &fakeService{},
+				Config:  core.ServiceConfig{Name: "a/b", Type: "foo"},
+			}},
+			wantErr: assert.Error,
+			logMsgs: []string{"service name must not contain '/'"},
+		},
 		{
 			name: "validate config returns error",
 			services: []ServiceWrapper{{
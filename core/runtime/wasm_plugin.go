@@ -0,0 +1,455 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/wu/keyop/core"
+)
+
+// WebAssembly plugin ABI
+//
+// A wasm plugin is a module that exports its linear memory as "memory" and any of the
+// following functions, each taking no arguments and returning an i32 status (0 = success):
+//
+//	initialize() -> i32
+//	validate()   -> i32
+//	check()      -> i32
+//
+// Modules built for wasip1 may additionally export "_initialize" (reactor mode); it is run
+// once when the module is instantiated. WASI is provided without filesystem, environment or
+// network access.
+//
+// The host exposes a narrow API in the "keyop" import module. Strings and byte slices are
+// passed as (pointer, length) pairs into the guest's memory:
+//
+//	log(level, msg_ptr, msg_len)                                   level: 0 debug, 1 info, 2 warn, 3 error
+//	error(msg_ptr, msg_len)                                        records an error for the current call
+//	publish(pub_ptr, pub_len, type_ptr, type_len, json_ptr, json_len) -> i32
+//	config(buf_ptr, buf_len) -> i32                                writes the service Config as JSON
+//	state_load(key_ptr, key_len, buf_ptr, buf_len) -> i32          reads a JSON value from the state store
+//	state_save(key_ptr, key_len, json_ptr, json_len) -> i32        writes a JSON value to the state store
+//
+// publish takes the logical pub key as declared under `pubs` in the service YAML, not a raw
+// channel name, so a module can only reach the channels it was configured with. config and
+// state_load return the full length of the value; if it exceeds buf_len nothing is written and
+// the guest is expected to retry with a larger buffer; state_load returns 0 for unset keys.
+// State keys are limited to [a-zA-Z0-9._-] and scoped to the service instance. Negative return
+// values are one of the wasmErr* codes below.
+
+const (
+	wasmHostModule = "keyop"
+
+	defaultWasmMaxMemoryMB = 16
+	defaultWasmCallTimeout = 5 * time.Second
+
+	// wasm pages are 64KiB
+	wasmPagesPerMB = 16
+)
+
+// Error codes returned to the guest by host functions.
+const (
+	wasmErrDenied  int32 = -1 // pub key not declared in the service config
+	wasmErrInvalid int32 = -2 // bad arguments: out-of-range memory, invalid key or invalid JSON
+	wasmErrFailed  int32 = -3 // the host operation itself failed
+)
+
+var wasmStateKeyRE = regexp.MustCompile(`^[a-zA-Z0-9._\-]+$`)
+
+// wasmPlugin holds the compiled module and sandbox limits shared by all service instances of a wasm plugin.
+type wasmPlugin struct {
+	info        PluginInfo
+	runtime     wazero.Runtime
+	compiled    wazero.CompiledModule
+	callTimeout time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*wasmService // keyed by module instance name
+}
+
+// wasmService adapts a wasm module instance to core.Service.
+type wasmService struct {
+	plugin *wasmPlugin
+	deps   core.Dependencies
+	cfg    core.ServiceConfig
+	ctx    context.Context
+
+	// mu serializes calls into the module; host functions run while it is held.
+	mu       sync.Mutex
+	mod      api.Module
+	callErrs []string
+}
+
+// loadWasmPlugin compiles the module at info.Path and registers a service type that runs it in a sandbox.
+func loadWasmPlugin(info PluginInfo, deps core.Dependencies) error {
+	logger := deps.MustGetLogger()
+	ctx := deps.MustGetContext()
+
+	wasm, err := os.ReadFile(info.Path) //nolint:gosec // reading trusted plugin path from plugins config
+	if err != nil {
+		return fmt.Errorf("could not read wasm plugin: %w", err)
+	}
+
+	p, err := newWasmPlugin(ctx, info, wasm)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		if closeErr := p.runtime.Close(context.Background()); closeErr != nil {
+			logger.Error("wasm plugin runtime close error", "plugin", info.Name, "error", closeErr)
+		}
+	}()
+
+	core.RegisterService(info.Name, func(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Context) interface{} {
+		return p.newService(deps, cfg, ctx)
+	})
+	logger.Info("Registered wasm plugin service", "name", info.Name, "call_timeout", p.callTimeout)
+
+	return nil
+}
+
+// newWasmPlugin creates a runtime with the plugin's limits, installs the host API and compiles the module.
+func newWasmPlugin(ctx context.Context, info PluginInfo, wasm []byte) (*wasmPlugin, error) {
+	maxMemoryMB := info.MaxMemoryMB
+	if maxMemoryMB <= 0 {
+		maxMemoryMB = defaultWasmMaxMemoryMB
+	}
+	callTimeout := defaultWasmCallTimeout
+	if info.CallTimeout != "" {
+		d, err := time.ParseDuration(info.CallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing call_timeout for plugin %s: %w", info.Name, err)
+		}
+		callTimeout = d
+	}
+
+	rtCfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(maxMemoryMB * wasmPagesPerMB)). //nolint:gosec // bounded by config
+		WithCloseOnContextDone(true)
+	r := wazero.NewRuntimeWithConfig(ctx, rtCfg)
+
+	p := &wasmPlugin{
+		info:        info,
+		runtime:     r,
+		callTimeout: callTimeout,
+		instances:   make(map[string]*wasmService),
+	}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("instantiate wasi: %w", err)
+	}
+	if err := p.instantiateHostModule(ctx); err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("instantiate host module: %w", err)
+	}
+
+	compiled, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("could not compile wasm plugin: %w", err)
+	}
+	p.compiled = compiled
+
+	return p, nil
+}
+
+func (p *wasmPlugin) newService(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Context) *wasmService {
+	return &wasmService{
+		plugin: p,
+		deps:   deps,
+		cfg:    cfg,
+		ctx:    ctx,
+	}
+}
+
+// lookup returns the service instance that owns the calling module.
+func (p *wasmPlugin) lookup(m api.Module) *wasmService {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.instances[m.Name()]
+}
+
+// ValidateConfig calls the module's validate export and returns any errors it reported.
+func (svc *wasmService) ValidateConfig() []error {
+	err := svc.call("validate", false)
+	if err == nil {
+		return nil
+	}
+	var errs []error
+	for _, msg := range svc.takeCallErrs() {
+		errs = append(errs, errors.New(msg))
+	}
+	if len(errs) == 0 {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Initialize calls the module's initialize export.
+func (svc *wasmService) Initialize() error {
+	return svc.call("initialize", false)
+}
+
+// Check calls the module's check export; modules without one are rejected.
+func (svc *wasmService) Check() error {
+	return svc.call("check", true)
+}
+
+// call invokes an exported function under the plugin's call timeout, instantiating the module on first use.
+func (svc *wasmService) call(name string, required bool) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	svc.callErrs = nil
+
+	if err := svc.ensureInstance(); err != nil {
+		return err
+	}
+
+	fn := svc.mod.ExportedFunction(name)
+	if fn == nil {
+		if required {
+			return fmt.Errorf("wasm plugin %s does not export %q", svc.plugin.info.Name, name)
+		}
+		return nil
+	}
+
+	callCtx, cancel := context.WithTimeout(svc.ctx, svc.plugin.callTimeout)
+	defer cancel()
+
+	results, err := fn.Call(callCtx)
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) {
+			// the module has been closed; it is re-instantiated on the next call
+			svc.closeInstance()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("wasm plugin %s: %s exceeded call timeout of %s", svc.plugin.info.Name, name, svc.plugin.callTimeout)
+		}
+		return fmt.Errorf("wasm plugin %s: %s failed: %w", svc.plugin.info.Name, name, err)
+	}
+
+	if len(results) == 0 || int32(results[0]) == 0 { //nolint:gosec // i32 result
+		return nil
+	}
+	if len(svc.callErrs) > 0 {
+		return fmt.Errorf("wasm plugin %s: %s", svc.plugin.info.Name, svc.callErrs[len(svc.callErrs)-1])
+	}
+	return fmt.Errorf("wasm plugin %s: %s returned %d", svc.plugin.info.Name, name, int32(results[0])) //nolint:gosec // i32 result
+}
+
+// ensureInstance instantiates the module for this service if needed. Caller must hold svc.mu.
+func (svc *wasmService) ensureInstance() error {
+	if svc.mod != nil && !svc.mod.IsClosed() {
+		return nil
+	}
+	svc.closeInstance()
+
+	p := svc.plugin
+	modCfg := wazero.NewModuleConfig().
+		WithName(svc.cfg.Name).
+		WithStartFunctions("_initialize")
+
+	p.mu.Lock()
+	p.instances[svc.cfg.Name] = svc
+	p.mu.Unlock()
+
+	callCtx, cancel := context.WithTimeout(svc.ctx, p.callTimeout)
+	defer cancel()
+
+	mod, err := p.runtime.InstantiateModule(callCtx, p.compiled, modCfg)
+	if err != nil {
+		p.mu.Lock()
+		delete(p.instances, svc.cfg.Name)
+		p.mu.Unlock()
+		return fmt.Errorf("could not instantiate wasm plugin %s: %w", p.info.Name, err)
+	}
+	svc.mod = mod
+	return nil
+}
+
+// closeInstance releases the current module instance, if any. Caller must hold svc.mu.
+func (svc *wasmService) closeInstance() {
+	if svc.mod == nil {
+		return
+	}
+	if !svc.mod.IsClosed() {
+		_ = svc.mod.Close(context.Background())
+	}
+	svc.mod = nil
+	svc.deps.MustGetLogger().Warn("wasm plugin instance closed", "plugin", svc.plugin.info.Name, "service", svc.cfg.Name)
+}
+
+func (svc *wasmService) takeCallErrs() []string {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	errs := svc.callErrs
+	svc.callErrs = nil
+	return errs
+}
+
+// instantiateHostModule installs the "keyop" import module implementing the host API.
+func (p *wasmPlugin) instantiateHostModule(ctx context.Context) error {
+	_, err := p.runtime.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().WithFunc(p.hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(p.hostError).Export("error").
+		NewFunctionBuilder().WithFunc(p.hostPublish).Export("publish").
+		NewFunctionBuilder().WithFunc(p.hostConfig).Export("config").
+		NewFunctionBuilder().WithFunc(p.hostStateLoad).Export("state_load").
+		NewFunctionBuilder().WithFunc(p.hostStateSave).Export("state_save").
+		Instantiate(ctx)
+	return err
+}
+
+func (p *wasmPlugin) hostLog(_ context.Context, m api.Module, level, ptr, length uint32) {
+	svc := p.lookup(m)
+	if svc == nil {
+		return
+	}
+	msg, ok := readGuestString(m, ptr, length)
+	if !ok {
+		return
+	}
+	logger := svc.deps.MustGetLogger()
+	args := []interface{}{"plugin", p.info.Name, "service", svc.cfg.Name}
+	switch level {
+	case 0:
+		logger.Debug(msg, args...)
+	case 1:
+		logger.Info(msg, args...)
+	case 2:
+		logger.Warn(msg, args...)
+	default:
+		logger.Error(msg, args...)
+	}
+}
+
+func (p *wasmPlugin) hostError(_ context.Context, m api.Module, ptr, length uint32) {
+	svc := p.lookup(m)
+	if svc == nil {
+		return
+	}
+	if msg, ok := readGuestString(m, ptr, length); ok {
+		svc.callErrs = append(svc.callErrs, msg)
+	}
+}
+
+func (p *wasmPlugin) hostPublish(ctx context.Context, m api.Module, pubPtr, pubLen, typePtr, typeLen, dataPtr, dataLen uint32) int32 {
+	svc := p.lookup(m)
+	if svc == nil {
+		return wasmErrFailed
+	}
+	logger := svc.deps.MustGetLogger()
+
+	pubKey, ok := readGuestString(m, pubPtr, pubLen)
+	if !ok {
+		return wasmErrInvalid
+	}
+	payloadType, ok := readGuestString(m, typePtr, typeLen)
+	if !ok || payloadType == "" {
+		return wasmErrInvalid
+	}
+	data, ok := readGuestBytes(m, dataPtr, dataLen)
+	if !ok || !json.Valid(data) {
+		return wasmErrInvalid
+	}
+
+	chanInfo, declared := svc.cfg.Pubs[pubKey]
+	if !declared || chanInfo.Name == "" {
+		logger.Warn("wasm plugin attempted to publish to undeclared pub", "plugin", p.info.Name, "service", svc.cfg.Name, "pub", pubKey)
+		return wasmErrDenied
+	}
+
+	if err := svc.deps.MustGetMessenger().Publish(ctx, chanInfo.Name, payloadType, json.RawMessage(data)); err != nil {
+		logger.Error("wasm plugin publish failed", "plugin", p.info.Name, "service", svc.cfg.Name, "channel", chanInfo.Name, "error", err)
+		return wasmErrFailed
+	}
+	return 0
+}
+
+func (p *wasmPlugin) hostConfig(_ context.Context, m api.Module, bufPtr, bufLen uint32) int32 {
+	svc := p.lookup(m)
+	if svc == nil {
+		return wasmErrFailed
+	}
+	data, err := json.Marshal(svc.cfg.Config)
+	if err != nil {
+		return wasmErrFailed
+	}
+	return writeGuestBytes(m, bufPtr, bufLen, data)
+}
+
+func (p *wasmPlugin) hostStateLoad(_ context.Context, m api.Module, keyPtr, keyLen, bufPtr, bufLen uint32) int32 {
+	svc := p.lookup(m)
+	if svc == nil {
+		return wasmErrFailed
+	}
+	key, ok := readGuestString(m, keyPtr, keyLen)
+	if !ok || !wasmStateKeyRE.MatchString(key) {
+		return wasmErrInvalid
+	}
+	var value json.RawMessage
+	if err := svc.deps.MustGetStateStore().Load(key, &value); err != nil {
+		svc.deps.MustGetLogger().Error("wasm plugin state load failed", "plugin", p.info.Name, "service", svc.cfg.Name, "key", key, "error", err)
+		return wasmErrFailed
+	}
+	return writeGuestBytes(m, bufPtr, bufLen, value)
+}
+
+func (p *wasmPlugin) hostStateSave(_ context.Context, m api.Module, keyPtr, keyLen, dataPtr, dataLen uint32) int32 {
+	svc := p.lookup(m)
+	if svc == nil {
+		return wasmErrFailed
+	}
+	key, ok := readGuestString(m, keyPtr, keyLen)
+	if !ok || !wasmStateKeyRE.MatchString(key) {
+		return wasmErrInvalid
+	}
+	data, ok := readGuestBytes(m, dataPtr, dataLen)
+	if !ok || !json.Valid(data) {
+		return wasmErrInvalid
+	}
+	if err := svc.deps.MustGetStateStore().Save(key, json.RawMessage(data)); err != nil {
+		svc.deps.MustGetLogger().Error("wasm plugin state save failed", "plugin", p.info.Name, "service", svc.cfg.Name, "key", key, "error", err)
+		return wasmErrFailed
+	}
+	return 0
+}
+
+// readGuestBytes copies a byte range out of the guest's memory.
+func readGuestBytes(m api.Module, ptr, length uint32) ([]byte, bool) {
+	view, ok := m.Memory().Read(ptr, length)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), view...), true
+}
+
+func readGuestString(m api.Module, ptr, length uint32) (string, bool) {
+	b, ok := readGuestBytes(m, ptr, length)
+	return string(b), ok
+}
+
+// writeGuestBytes writes data into the guest buffer when it fits and returns len(data).
+func writeGuestBytes(m api.Module, bufPtr, bufLen uint32, data []byte) int32 {
+	if len(data) > int(bufLen) {
+		return int32(len(data)) //nolint:gosec // bounded by guest memory limits
+	}
+	if !m.Memory().Write(bufPtr, data) {
+		return wasmErrInvalid
+	}
+	return int32(len(data)) //nolint:gosec // bounded by guest memory limits
+}
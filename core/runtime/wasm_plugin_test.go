@@ -0,0 +1,334 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wasm opcodes used by the hand-assembled test modules
+const (
+	opLoop     = 0x03
+	opBr       = 0x0c
+	opCall     = 0x10
+	opDrop     = 0x1a
+	opI32Const = 0x41
+	opEnd      = 0x0b
+)
+
+// Function indices: imports come first, then the module's own functions.
+const (
+	fnImportLog = iota
+	fnImportPublish
+	fnImportError
+	fnImportStateLoad
+	fnImportStateSave
+	fnInitialize
+	fnValidate
+	fnCheck
+)
+
+// Static data laid out at offset 0 of the test module's memory.
+var wasmTestData = []struct {
+	offset byte
+	text   string
+}{
+	{0, "events"},
+	{6, "test.v1"},
+	{13, `{"ok":true}`},
+	{24, "bad config"},
+	{34, "hello"},
+	{39, "source"},
+	{45, "copy"},
+}
+
+// wasmTestBuffer is where guest functions let the host write, past the static data.
+const wasmTestBuffer = 64
+
+func uleb(n int) []byte {
+	var out []byte
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func wasmVec(items ...[]byte) []byte {
+	out := uleb(len(items))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func wasmName(s string) []byte {
+	return append(uleb(len(s)), s...)
+}
+
+func wasmSection(id byte, body []byte) []byte {
+	return append(append([]byte{id}, uleb(len(body))...), body...)
+}
+
+func wasmFuncType(params, results int) []byte {
+	out := []byte{0x60}
+	out = append(out, uleb(params)...)
+	for i := 0; i < params; i++ {
+		out = append(out, 0x7f)
+	}
+	out = append(out, uleb(results)...)
+	for i := 0; i < results; i++ {
+		out = append(out, 0x7f)
+	}
+	return out
+}
+
+// i32 pushes a non-negative constant (signed LEB128).
+func i32(v int) []byte {
+	out := []byte{opI32Const}
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && b&0x40 == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func wasmBody(instrs ...[]byte) []byte {
+	body := []byte{0x00} // no locals
+	for _, in := range instrs {
+		body = append(body, in...)
+	}
+	body = append(body, opEnd)
+	return append(uleb(len(body)), body...)
+}
+
+// buildTestWasmModule assembles a module importing keyop.log, keyop.publish, keyop.error,
+// keyop.state_load and keyop.state_save and exporting initialize, validate and check with the
+// given check body.
+func buildTestWasmModule(checkBody []byte) []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// types: 0 log(i32,i32,i32), 1 publish(6 x i32)->i32, 2 error(i32,i32), 3 ()->i32,
+	// 4 state_load and state_save(4 x i32)->i32
+	module = append(module, wasmSection(1, wasmVec(
+		wasmFuncType(3, 0),
+		wasmFuncType(6, 1),
+		wasmFuncType(2, 0),
+		wasmFuncType(0, 1),
+		wasmFuncType(4, 1),
+	))...)
+
+	importFunc := func(name string, typeIdx int) []byte {
+		out := append(wasmName(wasmHostModule), wasmName(name)...)
+		return append(append(out, 0x00), uleb(typeIdx)...)
+	}
+	module = append(module, wasmSection(2, wasmVec(
+		importFunc("log", 0),
+		importFunc("publish", 1),
+		importFunc("error", 2),
+		importFunc("state_load", 4),
+		importFunc("state_save", 4),
+	))...)
+
+	module = append(module, wasmSection(3, wasmVec([]byte{3}, []byte{3}, []byte{3}))...)
+	module = append(module, wasmSection(5, wasmVec([]byte{0x00, 0x01}))...)
+
+	exportItem := func(name string, kind byte, idx int) []byte {
+		return append(append(wasmName(name), kind), uleb(idx)...)
+	}
+	module = append(module, wasmSection(7, wasmVec(
+		exportItem("memory", 0x02, 0),
+		exportItem("initialize", 0x00, fnInitialize),
+		exportItem("validate", 0x00, fnValidate),
+		exportItem("check", 0x00, fnCheck),
+	))...)
+
+	initialize := wasmBody(i32(1), i32(34), i32(5), []byte{opCall, fnImportLog}, i32(0))
+	validate := wasmBody(i32(24), i32(10), []byte{opCall, fnImportError}, i32(1))
+	module = append(module, wasmSection(10, wasmVec(initialize, validate, checkBody))...)
+
+	var data []byte
+	for _, d := range wasmTestData {
+		data = append(data, d.text...)
+	}
+	segment := append([]byte{0x00, opI32Const, 0x00, opEnd}, wasmName(string(data))...)
+	module = append(module, wasmSection(11, wasmVec(segment))...)
+
+	return module
+}
+
+// publishCheckBody publishes {"ok":true} as test.v1 to the "events" pub and returns the host result.
+func publishCheckBody() []byte {
+	return wasmBody(i32(0), i32(6), i32(6), i32(7), i32(13), i32(11), []byte{opCall, fnImportPublish})
+}
+
+// stateCopyCheckBody loads the state key "source" and saves the value as "copy", returning the
+// result of the save. The loaded length is left on the stack as the save's length argument.
+func stateCopyCheckBody() []byte {
+	return wasmBody(
+		i32(45), i32(4), i32(wasmTestBuffer),
+		i32(39), i32(6), i32(wasmTestBuffer), i32(32), []byte{opCall, fnImportStateLoad},
+		[]byte{opCall, fnImportStateSave},
+	)
+}
+
+// spinCheckBody never returns.
+func spinCheckBody() []byte {
+	return wasmBody([]byte{opLoop, 0x40, opBr, 0x00, opEnd}, i32(0), []byte{opDrop}, i32(0))
+}
+
+func newWasmTestDeps(t *testing.T) (core.Dependencies, *testutil.FakeMessenger, *testutil.FakeLogger) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	logger := &testutil.FakeLogger{}
+	msgr := testutil.NewFakeMessenger()
+	deps := core.Dependencies{}
+	deps.SetLogger(logger)
+	deps.SetContext(ctx)
+	deps.SetCancel(cancel)
+	deps.SetMessenger(msgr)
+	deps.SetStateStore(&testutil.NoOpStateStore{})
+	return deps, msgr, logger
+}
+
+func newTestWasmService(t *testing.T, deps core.Dependencies, info PluginInfo, wasm []byte, cfg core.ServiceConfig) *wasmService {
+	t.Helper()
+	p, err := newWasmPlugin(deps.MustGetContext(), info, wasm)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = p.runtime.Close(context.Background()) })
+	return p.newService(deps, cfg, deps.MustGetContext())
+}
+
+func TestWasmPlugin_PublishToDeclaredPub(t *testing.T) {
+	deps, msgr, logger := newWasmTestDeps(t)
+	cfg := core.ServiceConfig{
+		Name: "sandboxed",
+		Type: "wasm-test",
+		Pubs: map[string]core.ChannelInfo{"events": {Name: "sandbox-events"}},
+	}
+	svc := newTestWasmService(t, deps, PluginInfo{Name: "wasm-test"}, buildTestWasmModule(publishCheckBody()), cfg)
+
+	require.NoError(t, svc.Initialize())
+	assert.Equal(t, "hello", logger.LastInfoMsg)
+
+	require.NoError(t, svc.Check())
+	require.Len(t, msgr.PublishedMessages, 1)
+	msg := msgr.PublishedMessages[0]
+	assert.Equal(t, "sandbox-events", msg.Channel)
+	assert.Equal(t, "test.v1", msg.PayloadType)
+	raw, ok := msg.Payload.(json.RawMessage)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"ok":true}`, string(raw))
+}
+
+func TestWasmPlugin_PublishToUndeclaredPubDenied(t *testing.T) {
+	deps, msgr, logger := newWasmTestDeps(t)
+	cfg := core.ServiceConfig{Name: "sandboxed", Type: "wasm-test", Pubs: map[string]core.ChannelInfo{}}
+	svc := newTestWasmService(t, deps, PluginInfo{Name: "wasm-test"}, buildTestWasmModule(publishCheckBody()), cfg)
+
+	err := svc.Check()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "returned -1")
+	assert.Empty(t, msgr.PublishedMessages)
+	assert.Equal(t, "wasm plugin attempted to publish to undeclared pub", logger.LastWarnMsg)
+}
+
+func TestWasmPlugin_ValidateReportsGuestErrors(t *testing.T) {
+	deps, _, _ := newWasmTestDeps(t)
+	cfg := core.ServiceConfig{Name: "sandboxed", Type: "wasm-test"}
+	svc := newTestWasmService(t, deps, PluginInfo{Name: "wasm-test"}, buildTestWasmModule(publishCheckBody()), cfg)
+
+	errs := svc.ValidateConfig()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "bad config")
+}
+
+func TestWasmPlugin_StateThroughHostAPI(t *testing.T) {
+	deps, _, _ := newWasmTestDeps(t)
+	root := testutil.NewMemoryStateStore()
+	require.NoError(t, root.Save("service/sandboxed/source", map[string]int{"v": 1}))
+	deps.SetStateStore(ServiceStateStore(root, "sandboxed"))
+
+	cfg := core.ServiceConfig{Name: "sandboxed", Type: "wasm-test"}
+	svc := newTestWasmService(t, deps, PluginInfo{Name: "wasm-test"}, buildTestWasmModule(stateCopyCheckBody()), cfg)
+	require.NoError(t, svc.Check())
+
+	keys, err := root.List("")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"service/sandboxed/source", "service/sandboxed/copy"}, keys, "guest keys are kept in the service namespace")
+	var copied map[string]int
+	require.NoError(t, root.Load("service/sandboxed/copy", &copied))
+	assert.Equal(t, map[string]int{"v": 1}, copied)
+
+	// an unset key loads as empty, which is not valid JSON to save
+	require.NoError(t, root.Delete("service/sandboxed/source"))
+	err = svc.Check()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "returned -2")
+}
+
+func TestWasmPlugin_CallTimeout(t *testing.T) {
+	deps, _, _ := newWasmTestDeps(t)
+	cfg := core.ServiceConfig{Name: "spinner", Type: "wasm-test"}
+	info := PluginInfo{Name: "wasm-test", CallTimeout: "50ms"}
+	svc := newTestWasmService(t, deps, info, buildTestWasmModule(spinCheckBody()), cfg)
+
+	err := svc.Check()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeded call timeout")
+
+	// the closed instance is replaced on the next call
+	require.NoError(t, svc.Initialize())
+}
+
+func TestWasmPlugin_InvalidCallTimeout(t *testing.T) {
+	_, err := newWasmPlugin(context.Background(), PluginInfo{Name: "bad", CallTimeout: "soon"}, buildTestWasmModule(publishCheckBody()))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "call_timeout")
+}
+
+func TestLoadPlugins_WasmPluginRegistersService(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEYOP_CONF_DIR", dir)
+
+	wasmPath := filepath.Join(dir, "sandboxed.wasm")
+	require.NoError(t, os.WriteFile(wasmPath, buildTestWasmModule(publishCheckBody()), 0o600))
+
+	pluginsYAML := `
+plugins:
+  - name: wasm_registered_plugin
+    path: ` + wasmPath + `
+    enabled: true
+    max_memory_mb: 1
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plugins.yaml"), []byte(pluginsYAML), 0o600))
+
+	deps, _, _ := newWasmTestDeps(t)
+	require.NoError(t, LoadPlugins(deps))
+
+	_, ok := core.LookupService("wasm_registered_plugin")
+	assert.True(t, ok)
+}
+
+func TestPluginInfo_PluginKind(t *testing.T) {
+	assert.Equal(t, pluginKindGo, PluginInfo{Path: "/p/x.so"}.pluginKind())
+	assert.Equal(t, pluginKindWasm, PluginInfo{Path: "/p/x.wasm"}.pluginKind())
+	assert.Equal(t, pluginKindWasm, PluginInfo{Path: "/p/x.bin", Kind: "wasm"}.pluginKind())
+}
@@ -0,0 +1,92 @@
+//nolint:revive
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Catchup policies for intervals a service missed while keyop was not running.
+const (
+	CatchupSkip = "skip" // wait for the next interval on the original schedule
+	CatchupOnce = "once" // run once right away, then resume the interval
+	CatchupAll  = "all"  // run once for every missed interval, up to MaxCatchup, then resume
+)
+
+// ScheduleConfig controls how the kernel schedules a service's runs. Unset fields inherit from
+// the global settings in messenger.yaml, then from DefaultScheduleConfig.
+type ScheduleConfig struct {
+	Catchup         string         // skip, once or all
+	MaxCatchup      *int           // most runs made up for with the all policy; 0 makes up for none
+	RecordOnFailure *bool          // remember a failed run as the last run, delaying the retry by an interval
+	Stagger         *time.Duration // delay runs due at startup by a random duration up to this long
+}
+
+// DefaultScheduleConfig runs overdue services once at startup and records failed runs.
+var DefaultScheduleConfig = ScheduleConfig{
+	Catchup:         CatchupOnce,
+	MaxCatchup:      intPtr(10),
+	RecordOnFailure: boolPtr(true),
+	Stagger:         durationPtr(0),
+}
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func intPtr(n int) *int { return &n }
+
+// Merge returns c with unset fields taken from fallback.
+func (c ScheduleConfig) Merge(fallback ScheduleConfig) ScheduleConfig {
+	if c.Catchup == "" {
+		c.Catchup = fallback.Catchup
+	}
+	if c.MaxCatchup == nil {
+		c.MaxCatchup = fallback.MaxCatchup
+	}
+	if c.RecordOnFailure == nil {
+		c.RecordOnFailure = fallback.RecordOnFailure
+	}
+	if c.Stagger == nil {
+		c.Stagger = fallback.Stagger
+	}
+	return c
+}
+
+// Validate reports settings the kernel cannot apply.
+func (c ScheduleConfig) Validate() error {
+	switch c.Catchup {
+	case "", CatchupSkip, CatchupOnce, CatchupAll:
+	default:
+		return fmt.Errorf("catchup must be %q, %q or %q, got %q", CatchupSkip, CatchupOnce, CatchupAll, c.Catchup)
+	}
+	if c.MaxCatchup != nil && *c.MaxCatchup < 0 {
+		return fmt.Errorf("max_catchup must not be negative, got %d", *c.MaxCatchup)
+	}
+	if c.Stagger != nil && *c.Stagger < 0 {
+		return fmt.Errorf("stagger must not be negative, got %s", *c.Stagger)
+	}
+	return nil
+}
+
+// FirstRun returns how long to wait before the first run of a service that last ran at lastRun
+// and runs every interval, and how many extra runs to make back to back after it to catch up.
+// stagger is a random delay, up to Stagger, applied when a run is due right away. A zero
+// lastRun means the service never ran.
+func (c ScheduleConfig) FirstRun(lastRun, now time.Time, interval, stagger time.Duration) (time.Duration, int) {
+	c = c.Merge(DefaultScheduleConfig)
+	if lastRun.IsZero() || interval <= 0 {
+		return stagger, 0
+	}
+	elapsed := max(now.Sub(lastRun), 0) // the clock may have gone back
+	if elapsed < interval {
+		return interval - elapsed, 0
+	}
+	missed := int(elapsed / interval)
+	switch {
+	case c.Catchup == CatchupSkip, c.Catchup == CatchupAll && *c.MaxCatchup == 0:
+		return interval - elapsed%interval, 0
+	case c.Catchup == CatchupAll:
+		return stagger, min(missed, *c.MaxCatchup) - 1
+	default:
+		return stagger, 0
+	}
+}
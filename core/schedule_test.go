@@ -0,0 +1,70 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleConfig_FirstRun(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	stagger := 7 * time.Second
+
+	tests := []struct {
+		name        string
+		catchup     string
+		lastRun     time.Time
+		wantWait    time.Duration
+		wantCatchup int
+	}{
+		{"never ran", core.CatchupSkip, time.Time{}, stagger, 0},
+		{"not due yet", core.CatchupAll, now.Add(-20 * time.Minute), 40 * time.Minute, 0},
+		{"clock went back", core.CatchupOnce, now.Add(time.Minute), hour, 0},
+		{"once", core.CatchupOnce, now.Add(-5*hour - 10*time.Minute), stagger, 0},
+		{"default is once", "", now.Add(-5 * hour), stagger, 0},
+		{"skip waits for the next slot", core.CatchupSkip, now.Add(-5*hour - 10*time.Minute), 50 * time.Minute, 0},
+		{"all", core.CatchupAll, now.Add(-5*hour - 10*time.Minute), stagger, 4},
+		{"all is capped", core.CatchupAll, now.Add(-500 * hour), stagger, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := core.ScheduleConfig{Catchup: tt.catchup}
+			wait, catchup := cfg.FirstRun(tt.lastRun, now, hour, stagger)
+			assert.Equal(t, tt.wantWait, wait)
+			assert.Equal(t, tt.wantCatchup, catchup)
+		})
+	}
+
+	wait, catchup := core.ScheduleConfig{}.FirstRun(now.Add(-hour), now, 0, stagger)
+	assert.Equal(t, stagger, wait, "tasks without an interval only get the stagger")
+	assert.Zero(t, catchup)
+
+	zero := 0
+	wait, catchup = core.ScheduleConfig{Catchup: core.CatchupAll, MaxCatchup: &zero}.FirstRun(now.Add(-5*hour-10*time.Minute), now, hour, stagger)
+	assert.Equal(t, 50*time.Minute, wait, "max_catchup 0 makes up for no missed runs")
+	assert.Zero(t, catchup)
+}
+
+func TestScheduleConfig_MergeAndValidate(t *testing.T) {
+	off := false
+	merged := core.ScheduleConfig{RecordOnFailure: &off}.Merge(core.DefaultScheduleConfig)
+	assert.Equal(t, core.CatchupOnce, merged.Catchup)
+	assert.Equal(t, 10, *merged.MaxCatchup)
+	assert.False(t, *merged.RecordOnFailure)
+	assert.Zero(t, *merged.Stagger)
+
+	assert.NoError(t, core.ScheduleConfig{}.Validate())
+	assert.Error(t, core.ScheduleConfig{Catchup: "never"}.Validate())
+	negativeCatchup := -1
+	assert.Error(t, core.ScheduleConfig{MaxCatchup: &negativeCatchup}.Validate())
+
+	// an explicit 0 is kept rather than replaced by the fallback
+	zero := 0
+	assert.Equal(t, 0, *core.ScheduleConfig{MaxCatchup: &zero}.Merge(core.DefaultScheduleConfig).MaxCatchup)
+	negative := -time.Second
+	assert.Error(t, core.ScheduleConfig{Stagger: &negative}.Validate())
+}
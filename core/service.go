@@ -21,20 +21,37 @@ type StateStoreApi interface {
 
 // ServiceConfig holds configuration for a service, including channels and arbitrary config.
 type ServiceConfig struct {
-	Name   string
-	Freq   time.Duration
-	Type   string
-	Pubs   map[string]ChannelInfo
-	Subs   map[string]ChannelInfo
-	Config map[string]interface{}
+	Name         string
+	Freq         time.Duration
+	Type         string
+	Pubs         map[string]ChannelInfo
+	Subs         map[string]ChannelInfo
+	Config       map[string]interface{}
+	Throttle     map[string]ThrottleConfig // publish limits keyed by channel name, or "*" for all channels
+	Interceptors InterceptorConfig         // overrides the global publish interceptor settings
+	RenamedFrom  string                    // previous name; its state is moved to this service on start
+	Schedule     ScheduleConfig            // overrides the global scheduling policy
+	Trigger      TriggerConfig             // channels whose messages also run the service's check
 }
 
 // ChannelInfo describes a channel's metadata used by services.
 type ChannelInfo struct {
 	Name        string
-	Remote      string // optional: channel name to use on the remote server; defaults to Name
+	Remote      string // optional: channel name on the remote server; not applied yet, so strict mode rejects one other than Name
 	Description string
-	MaxAge      time.Duration
+	// MaxAge, when set on a pub, expires published messages that long after publishing; on a sub
+	// it skips messages older than that on delivery. See ExpiryMessenger.
+	MaxAge time.Duration
+}
+
+// ThrottleConfig deduplicates and rate-limits what a service publishes to a channel.
+type ThrottleConfig struct {
+	DedupWindow  time.Duration // drop payloads identical to one published within this window
+	DedupIgnore  []string      // top-level payload fields ignored when comparing, e.g. timestamp
+	Limit        int           // messages published per key within Window, the rest are dropped; 0 disables rate limiting
+	Window       time.Duration // rate-limit window; defaults to one minute
+	Key          []string      // payload field paths that form the rate-limit key
+	AlertChannel string        // channel for the drop summary alerts; defaults to "alerts"
 }
 
 // AsType returns the error as a specific type, or false if it is not that type.
@@ -1,5 +1,66 @@
 //nolint:revive
 package core
 
-// Concrete implementations of StateStoreApi have moved to core/adapter.
-// This file is intentionally empty; StateStoreApi interface is defined in service.go.
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Concrete implementations of the state store interfaces live in core/adapter; StateStoreApi is
+// defined in service.go.
+
+// ExtendedStateStoreApi is implemented by state stores that can also enumerate, delete, expire
+// and atomically update keys. Services check for it with a type assertion on the store from
+// Dependencies.
+type ExtendedStateStoreApi interface {
+	StateStoreApi
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(key string) error
+	// List returns the keys starting with prefix in sorted order, excluding expired ones.
+	List(prefix string) ([]string, error)
+	// SaveWithTTL saves value under key; after ttl the key behaves as if it was deleted. Save and
+	// CompareAndSwap clear the expiry.
+	SaveWithTTL(key string, value interface{}, ttl time.Duration) error
+	// CompareAndSwap saves new under key only if the stored value equals old, compared as JSON,
+	// and reports whether it did. A nil old matches a missing or expired key.
+	CompareAndSwap(key string, old, new interface{}) (bool, error)
+}
+
+// StateExpiryApi is implemented by state stores that can report when a key expires, so tools
+// that copy state, such as backup, can keep expiries.
+type StateExpiryApi interface {
+	// ExpiresAt returns when key expires, or the zero time when it has no expiry or is missing.
+	ExpiresAt(key string) (time.Time, error)
+}
+
+// StateValueEqual reports whether the stored JSON equals value once both are normalised, so
+// field order and whitespace do not matter. A nil stored value only equals a nil value.
+func StateValueEqual(stored []byte, value interface{}) (bool, error) {
+	if stored == nil || value == nil {
+		return stored == nil && value == nil, nil
+	}
+	a, err := canonicalJSON(stored)
+	if err != nil {
+		return false, err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	b, err := canonicalJSON(raw)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(a, b), nil
+}
+
+func canonicalJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
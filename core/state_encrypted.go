@@ -0,0 +1,313 @@
+//nolint:revive
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StateEncryptionKey is an AES-256 key used to encrypt state. ID is stored with every value so
+// values written with a retired key can still be read after rotation.
+type StateEncryptionKey struct {
+	ID     string
+	Secret []byte // 32 bytes
+}
+
+// stateCipherAESGCM tags values in the stored envelope.
+const stateCipherAESGCM = "aes-256-gcm"
+
+// ErrStateKeyUnknown is returned when a value was encrypted with a key that is not configured.
+var ErrStateKeyUnknown = errors.New("state encrypted with an unknown key")
+
+// ErrStateNotEncrypted is returned when a value under an encrypted key is stored in plaintext
+// and the store does not allow plaintext.
+var ErrStateNotEncrypted = errors.New("state is not encrypted")
+
+// encryptedStateValue is what an encrypting store writes in place of the value.
+type encryptedStateValue struct {
+	Cipher string `json:"$enc"`
+	KeyID  string `json:"kid"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// NewEncryptedStateStore returns a view of store that encrypts values saved under any of
+// namespaces, or under every key when namespaces is empty, with the first of keys. The state
+// key is authenticated with the value, so ciphertext cannot be moved between keys. Plaintext
+// values under an encrypted key fail with ErrStateNotEncrypted, so a value swapped in on disk is
+// never trusted; while migrating state written before encryption was enabled, allowPlaintext
+// lets them load, and Save or RekeyState encrypts them. The view implements
+// ExtendedStateStoreApi when store does.
+func NewEncryptedStateStore(store StateStoreApi, keys []StateEncryptionKey, namespaces []string, allowPlaintext bool) (StateStoreApi, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("state encryption needs at least one key")
+	}
+	e := encryptedStore{store: store, aeads: map[string]cipher.AEAD{}, allowPlaintext: allowPlaintext}
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, errors.New("state encryption key is missing an id")
+		}
+		if _, dup := e.aeads[k.ID]; dup {
+			return nil, fmt.Errorf("state encryption key %q is configured twice", k.ID)
+		}
+		if len(k.Secret) != 32 {
+			return nil, fmt.Errorf("state encryption key %q must be 32 bytes, got %d", k.ID, len(k.Secret))
+		}
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		e.aeads[k.ID] = aead
+	}
+	e.primary = keys[0].ID
+	for _, ns := range namespaces {
+		e.prefixes = append(e.prefixes, strings.TrimSuffix(ns, stateNamespaceSeparator)+stateNamespaceSeparator)
+	}
+	if ext, ok := store.(ExtendedStateStoreApi); ok {
+		return &encryptedExtendedStore{encryptedStore: e, ext: ext}, nil
+	}
+	return &e, nil
+}
+
+type encryptedStore struct {
+	store          StateStoreApi
+	aeads          map[string]cipher.AEAD
+	primary        string
+	prefixes       []string
+	allowPlaintext bool
+}
+
+// encrypts reports whether values saved under key are encrypted.
+func (e *encryptedStore) encrypts(key string) bool {
+	if len(e.prefixes) == 0 {
+		return true
+	}
+	for _, p := range e.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// seal returns what is stored under key for value.
+func (e *encryptedStore) seal(key string, value interface{}) (interface{}, error) {
+	if !e.encrypts(key) {
+		return value, nil
+	}
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	aead := e.aeads[e.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return encryptedStateValue{
+		Cipher: stateCipherAESGCM,
+		KeyID:  e.primary,
+		Nonce:  nonce,
+		Data:   aead.Seal(nil, nonce, plain, []byte(key)),
+	}, nil
+}
+
+// open returns the plaintext JSON of stored and the id of the key it was encrypted with, which
+// is empty for a plaintext value.
+func (e *encryptedStore) open(key string, stored []byte) ([]byte, string, error) {
+	var env encryptedStateValue
+	if !bytes.HasPrefix(bytes.TrimSpace(stored), []byte("{")) || json.Unmarshal(stored, &env) != nil || env.Cipher == "" {
+		if e.encrypts(key) && !e.allowPlaintext {
+			return nil, "", fmt.Errorf("state %q: %w", key, ErrStateNotEncrypted)
+		}
+		return stored, "", nil
+	}
+	if env.Cipher != stateCipherAESGCM {
+		return nil, "", fmt.Errorf("state %q: unsupported cipher %q", key, env.Cipher)
+	}
+	aead, ok := e.aeads[env.KeyID]
+	if !ok {
+		return nil, "", fmt.Errorf("state %q: key %q: %w", key, env.KeyID, ErrStateKeyUnknown)
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, "", fmt.Errorf("state %q: invalid nonce", key)
+	}
+	plain, err := aead.Open(nil, env.Nonce, env.Data, []byte(key))
+	if err != nil {
+		return nil, "", fmt.Errorf("state %q: decrypt: %w", key, err)
+	}
+	return plain, env.KeyID, nil
+}
+
+// loadRaw returns the stored JSON under key, or nil when it is missing.
+func (e *encryptedStore) loadRaw(key string) (json.RawMessage, error) {
+	var stored json.RawMessage
+	if err := e.store.Load(key, &stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (e *encryptedStore) Save(key string, value interface{}) error {
+	sealed, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return e.store.Save(key, sealed)
+}
+
+func (e *encryptedStore) Load(key string, value interface{}) error {
+	stored, err := e.loadRaw(key)
+	if err != nil || stored == nil {
+		return err
+	}
+	plain, _, err := e.open(key, stored)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, value)
+}
+
+type encryptedExtendedStore struct {
+	encryptedStore
+	ext ExtendedStateStoreApi
+}
+
+func (e *encryptedExtendedStore) Delete(key string) error {
+	return e.ext.Delete(key)
+}
+
+func (e *encryptedExtendedStore) List(prefix string) ([]string, error) {
+	return e.ext.List(prefix)
+}
+
+// ExpiresAt reports the expiry from the underlying store, or none when it cannot tell.
+func (e *encryptedExtendedStore) ExpiresAt(key string) (time.Time, error) {
+	if expiries, ok := e.ext.(StateExpiryApi); ok {
+		return expiries.ExpiresAt(key)
+	}
+	return time.Time{}, nil
+}
+
+func (e *encryptedExtendedStore) SaveWithTTL(key string, value interface{}, ttl time.Duration) error {
+	sealed, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return e.ext.SaveWithTTL(key, sealed, ttl)
+}
+
+// CompareAndSwap compares old with the decrypted value, then swaps against the stored
+// ciphertext so a concurrent write still makes the swap fail.
+func (e *encryptedExtendedStore) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	stored, err := e.loadRaw(key)
+	if err != nil {
+		return false, err
+	}
+	var current []byte
+	if stored != nil {
+		if current, _, err = e.open(key, stored); err != nil {
+			return false, err
+		}
+	}
+	if equal, err := StateValueEqual(current, old); err != nil || !equal {
+		return false, err
+	}
+	sealed, err := e.seal(key, new)
+	if err != nil {
+		return false, err
+	}
+	var expected interface{}
+	if stored != nil {
+		expected = stored
+	}
+	return e.ext.CompareAndSwap(key, expected, sealed)
+}
+
+// ResealState returns stored, a value as an encrypting store keeps it under from, as it would be
+// kept under to. Encrypted values are authenticated against their key, so they must be resealed
+// when state is moved to another key without going through the store. Values in namespaces
+// that are not encrypted are returned decrypted, or unchanged when they were not encrypted.
+func ResealState(store StateStoreApi, from, to string, stored json.RawMessage) (json.RawMessage, error) {
+	var e *encryptedStore
+	switch s := store.(type) {
+	case *encryptedStore:
+		e = s
+	case *encryptedExtendedStore:
+		e = &s.encryptedStore
+	default:
+		return nil, errors.New("state store is not an encrypting store")
+	}
+	plain, _, err := e.open(from, stored)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := e.seal(to, json.RawMessage(plain))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// RekeyState re-encrypts every value of an encrypting store that is not yet encrypted with its
+// first key, which includes plaintext values in encrypted namespaces when the store allows
+// them. Run it after adding a new key in front of the old ones; once it reports nothing left, the
+// old keys can be removed. It returns the number of values rewritten. Rewritten keys keep their
+// expiry when the underlying store implements StateExpiryApi.
+func RekeyState(store StateStoreApi) (int, error) {
+	e, ok := store.(*encryptedExtendedStore)
+	if !ok {
+		return 0, errors.New("state store is not an encrypting store that supports listing keys")
+	}
+	expiries, _ := e.ext.(StateExpiryApi)
+	keys, err := e.ext.List("")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		stored, err := e.loadRaw(key)
+		if err != nil {
+			return count, err
+		}
+		if stored == nil {
+			continue
+		}
+		plain, kid, err := e.open(key, stored)
+		if err != nil {
+			return count, err
+		}
+		if kid == e.primary || (kid == "" && !e.encrypts(key)) {
+			continue
+		}
+		var expiresAt time.Time
+		if expiries != nil {
+			if expiresAt, err = expiries.ExpiresAt(key); err != nil {
+				return count, err
+			}
+		}
+		if expiresAt.IsZero() {
+			err = e.Save(key, json.RawMessage(plain))
+		} else if ttl := time.Until(expiresAt); ttl > 0 {
+			err = e.SaveWithTTL(key, json.RawMessage(plain), ttl)
+		} else {
+			continue // expired since it was loaded
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,138 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStateKey(id string, b byte) core.StateEncryptionKey {
+	return core.StateEncryptionKey{ID: id, Secret: bytes.Repeat([]byte{b}, 32)}
+}
+
+func newEncryptedStore(t *testing.T, root core.StateStoreApi, namespaces []string, allowPlaintext bool, keys ...core.StateEncryptionKey) core.ExtendedStateStoreApi {
+	t.Helper()
+	store, err := core.NewEncryptedStateStore(root, keys, namespaces, allowPlaintext)
+	require.NoError(t, err)
+	return store.(core.ExtendedStateStoreApi)
+}
+
+func loadRaw(t *testing.T, store core.StateStoreApi, key string) string {
+	t.Helper()
+	var raw json.RawMessage
+	require.NoError(t, store.Load(key, &raw))
+	return string(raw)
+}
+
+func TestEncryptedStateStore_Extended(t *testing.T) {
+	testutil.StateStoreConformance(t, func(t *testing.T) core.ExtendedStateStoreApi {
+		return newEncryptedStore(t, testutil.NewMemoryStateStore(), nil, false, testStateKey("k1", 1))
+	})
+}
+
+func TestEncryptedStateStore_EncryptsAtRest(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	store := newEncryptedStore(t, root, []string{"service/tokens"}, false, testStateKey("k1", 1))
+
+	require.NoError(t, store.Save("service/tokens/oauth", map[string]string{"token": "secret-token"}))
+	require.NoError(t, store.Save("service/heartbeat/beats", 3))
+
+	raw := loadRaw(t, root, "service/tokens/oauth")
+	assert.NotContains(t, raw, "secret-token")
+	assert.Contains(t, raw, `"kid":"k1"`)
+	assert.Equal(t, "3", loadRaw(t, root, "service/heartbeat/beats"), "other namespaces stay plaintext")
+
+	var got map[string]string
+	require.NoError(t, store.Load("service/tokens/oauth", &got))
+	assert.Equal(t, "secret-token", got["token"])
+
+	// ciphertext is bound to its key
+	require.NoError(t, root.Save("service/tokens/copy", json.RawMessage(raw)))
+	assert.ErrorContains(t, store.Load("service/tokens/copy", &got), "decrypt")
+	require.NoError(t, store.Delete("service/tokens/copy"))
+
+	// a plaintext value swapped in for the ciphertext is rejected
+	require.NoError(t, root.Save("service/tokens/oauth", map[string]string{"token": "forged"}))
+	assert.ErrorIs(t, store.Load("service/tokens/oauth", &got), core.ErrStateNotEncrypted)
+	_, err := store.CompareAndSwap("service/tokens/oauth", map[string]string{"token": "forged"}, nil)
+	assert.ErrorIs(t, err, core.ErrStateNotEncrypted)
+	_, err = core.RekeyState(store)
+	assert.ErrorIs(t, err, core.ErrStateNotEncrypted)
+}
+
+func TestEncryptedStateStore_PlaintextBeforeEncryption(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	require.NoError(t, root.Save("service/tokens/oauth", map[string]string{"token": "old"}))
+	store := newEncryptedStore(t, root, []string{"service/tokens/"}, true, testStateKey("k1", 1))
+
+	var got map[string]string
+	require.NoError(t, store.Load("service/tokens/oauth", &got))
+	assert.Equal(t, "old", got["token"])
+
+	ok, err := store.CompareAndSwap("service/tokens/oauth", map[string]string{"token": "old"}, map[string]string{"token": "new"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotContains(t, loadRaw(t, root, "service/tokens/oauth"), "new")
+}
+
+func TestEncryptedStateStore_Rotation(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	require.NoError(t, root.Save("plain", "p"))
+	oldStore := newEncryptedStore(t, root, nil, false, testStateKey("k1", 1))
+	require.NoError(t, oldStore.Save("a", "one"))
+	require.NoError(t, oldStore.(core.ExtendedStateStoreApi).SaveWithTTL("b", "two", time.Hour))
+
+	withoutOld := newEncryptedStore(t, root, nil, false, testStateKey("k2", 2))
+	var s string
+	assert.ErrorIs(t, withoutOld.Load("a", &s), core.ErrStateKeyUnknown)
+
+	rotated := newEncryptedStore(t, root, nil, true, testStateKey("k2", 2), testStateKey("k1", 1))
+	require.NoError(t, rotated.Load("a", &s))
+	assert.Equal(t, "one", s)
+
+	n, err := core.RekeyState(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n, "both old values and the plaintext one")
+	n, err = core.RekeyState(rotated)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	require.NoError(t, withoutOld.Load("b", &s))
+	assert.Equal(t, "two", s)
+	expiresAt, err := root.ExpiresAt("b")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute, "rekeying keeps the expiry")
+	expiresAt, err = root.ExpiresAt("a")
+	require.NoError(t, err)
+	assert.True(t, expiresAt.IsZero())
+	require.NoError(t, withoutOld.Load("plain", &s))
+	assert.Equal(t, "p", s)
+
+	_, err = core.RekeyState(root)
+	assert.Error(t, err)
+}
+
+func TestNewEncryptedStateStore_InvalidKeys(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	for name, keys := range map[string][]core.StateEncryptionKey{
+		"none":      nil,
+		"no id":     {{Secret: make([]byte, 32)}},
+		"short":     {{ID: "k", Secret: make([]byte, 16)}},
+		"duplicate": {testStateKey("k", 1), testStateKey("k", 2)},
+	} {
+		_, err := core.NewEncryptedStateStore(root, keys, nil, false)
+		assert.Error(t, err, name)
+	}
+
+	view, err := core.NewEncryptedStateStore(&testutil.NoOpStateStore{}, []core.StateEncryptionKey{testStateKey("k", 1)}, nil, false)
+	require.NoError(t, err)
+	_, ok := view.(core.ExtendedStateStoreApi)
+	assert.False(t, ok)
+}
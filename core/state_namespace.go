@@ -0,0 +1,173 @@
+//nolint:revive
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Namespaces partition the keys of the shared state store. Each service gets a view scoped to
+// ServiceStateNamespace(name) through its Dependencies; the kernel keeps its bookkeeping under
+// KernelStateNamespace, which no service can reach.
+const (
+	KernelStateNamespace    = "kernel"
+	serviceStateNamespace   = "service"
+	stateNamespaceSeparator = "/"
+)
+
+// ErrStateNotExtended is returned by operations that need an ExtendedStateStoreApi.
+var ErrStateNotExtended = errors.New("state store does not support listing keys")
+
+// ServiceStateNamespace returns the namespace holding the state of the named service.
+func ServiceStateNamespace(name string) string {
+	return serviceStateNamespace + stateNamespaceSeparator + name
+}
+
+// NamespacedStateStore returns a view of store in which every key is prefixed with namespace.
+// The view implements ExtendedStateStoreApi when store does.
+func NamespacedStateStore(store StateStoreApi, namespace string) StateStoreApi {
+	ns := namespacedStore{store: store, prefix: namespace + stateNamespaceSeparator}
+	if ext, ok := store.(ExtendedStateStoreApi); ok {
+		return &namespacedExtendedStore{namespacedStore: ns, ext: ext}
+	}
+	return &ns
+}
+
+type namespacedStore struct {
+	store  StateStoreApi
+	prefix string
+}
+
+func (n *namespacedStore) key(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("state key must not be empty")
+	}
+	return n.prefix + key, nil
+}
+
+func (n *namespacedStore) Save(key string, value interface{}) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.store.Save(k, value)
+}
+
+func (n *namespacedStore) Load(key string, value interface{}) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.store.Load(k, value)
+}
+
+type namespacedExtendedStore struct {
+	namespacedStore
+	ext ExtendedStateStoreApi
+}
+
+func (n *namespacedExtendedStore) Delete(key string) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.ext.Delete(k)
+}
+
+func (n *namespacedExtendedStore) List(prefix string) ([]string, error) {
+	keys, err := n.ext.List(n.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, n.prefix)
+	}
+	return keys, nil
+}
+
+func (n *namespacedExtendedStore) SaveWithTTL(key string, value interface{}, ttl time.Duration) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.ext.SaveWithTTL(k, value, ttl)
+}
+
+func (n *namespacedExtendedStore) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return false, err
+	}
+	return n.ext.CompareAndSwap(k, old, new)
+}
+
+// ExpiresAt reports the expiry from the underlying store, or none when it cannot tell.
+func (n *namespacedExtendedStore) ExpiresAt(key string) (time.Time, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expiries, ok := n.ext.(StateExpiryApi); ok {
+		return expiries.ExpiresAt(k)
+	}
+	return time.Time{}, nil
+}
+
+// MoveState moves the value stored under from to to, returning false when from is missing. The
+// expiry is carried over when store implements StateExpiryApi.
+func MoveState(store ExtendedStateStoreApi, from, to string) (bool, error) {
+	var value json.RawMessage
+	if err := store.Load(from, &value); err != nil {
+		return false, err
+	}
+	if value == nil {
+		return false, nil
+	}
+	var expiresAt time.Time
+	if expiries, ok := store.(StateExpiryApi); ok {
+		var err error
+		if expiresAt, err = expiries.ExpiresAt(from); err != nil {
+			return false, err
+		}
+	}
+	if expiresAt.IsZero() {
+		if err := store.Save(to, value); err != nil {
+			return false, err
+		}
+	} else if ttl := time.Until(expiresAt); ttl > 0 {
+		if err := store.SaveWithTTL(to, value, ttl); err != nil {
+			return false, err
+		}
+	} else {
+		return false, nil // expired since it was loaded
+	}
+	return true, store.Delete(from)
+}
+
+// MoveStateNamespace moves every key of namespace from into namespace to and returns how many
+// were moved. Keys already present in to are overwritten.
+func MoveStateNamespace(store StateStoreApi, from, to string) (int, error) {
+	ext, ok := store.(ExtendedStateStoreApi)
+	if !ok {
+		return 0, ErrStateNotExtended
+	}
+	fromPrefix := from + stateNamespaceSeparator
+	keys, err := ext.List(fromPrefix)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, key := range keys {
+		ok, err := MoveState(ext, key, to+stateNamespaceSeparator+strings.TrimPrefix(key, fromPrefix))
+		if err != nil {
+			return moved, fmt.Errorf("move state %q: %w", key, err)
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,89 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedStateStore_Isolation(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	a := core.NamespacedStateStore(root, core.ServiceStateNamespace("a"))
+	b := core.NamespacedStateStore(root, core.ServiceStateNamespace("b"))
+
+	require.NoError(t, a.Save("count", 1))
+	require.NoError(t, b.Save("count", 2))
+
+	var n int
+	require.NoError(t, a.Load("count", &n))
+	assert.Equal(t, 1, n)
+	require.NoError(t, b.Load("count", &n))
+	assert.Equal(t, 2, n)
+
+	keys, err := root.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"service/a/count", "service/b/count"}, keys)
+
+	keys, err = a.(core.ExtendedStateStoreApi).List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"count"}, keys, "List strips the namespace")
+
+	assert.Error(t, a.Save("", 1), "empty keys would address the namespace itself")
+}
+
+func TestNamespacedStateStore_NotExtended(t *testing.T) {
+	view := core.NamespacedStateStore(&testutil.NoOpStateStore{}, "ns")
+	_, ok := view.(core.ExtendedStateStoreApi)
+	assert.False(t, ok)
+	assert.NoError(t, view.Save("key", 1))
+
+	_, err := core.MoveStateNamespace(&testutil.NoOpStateStore{}, "a", "b")
+	assert.ErrorIs(t, err, core.ErrStateNotExtended)
+}
+
+func TestNamespacedStateStore_Extended(t *testing.T) {
+	testutil.StateStoreConformance(t, func(t *testing.T) core.ExtendedStateStoreApi {
+		return core.NamespacedStateStore(testutil.NewMemoryStateStore(), "ns").(core.ExtendedStateStoreApi)
+	})
+}
+
+func TestMoveStateNamespace(t *testing.T) {
+	root := testutil.NewMemoryStateStore()
+	require.NoError(t, root.Save("service/old/x", map[string]int{"n": 1}))
+	require.NoError(t, root.SaveWithTTL("service/old/y", "y", time.Hour))
+	require.NoError(t, root.Save("service/older/z", "not moved"))
+
+	moved, err := core.MoveStateNamespace(root, "service/old", "service/new")
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	keys, err := root.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"service/new/x", "service/new/y", "service/older/z"}, keys)
+
+	var x map[string]int
+	require.NoError(t, root.Load("service/new/x", &x))
+	assert.Equal(t, map[string]int{"n": 1}, x)
+	expiresAt, err := root.ExpiresAt("service/new/y")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute, "the expiry moves with the key")
+
+	// through a namespaced view as well
+	kernel := core.NamespacedStateStore(root, "kernel").(core.ExtendedStateStoreApi)
+	require.NoError(t, kernel.SaveWithTTL("a", 1, time.Hour))
+	ok, err := core.MoveState(kernel, "a", "b")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	expiresAt, err = root.ExpiresAt("kernel/b")
+	require.NoError(t, err)
+	assert.False(t, expiresAt.IsZero())
+
+	ok, err = core.MoveState(root, "missing", "elsewhere")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,88 @@
+//nolint:revive
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// Outcomes of a task run.
+const (
+	TaskRunOK    = "ok"
+	TaskRunError = "error"
+)
+
+// What started a task run.
+const (
+	TaskRunScheduled = "schedule"
+	TaskRunTriggered = "trigger"
+)
+
+// DefaultTaskHistorySize is how many runs the kernel keeps per service.
+const DefaultTaskHistorySize = 100
+
+// TaskRun is one run of a service's task as recorded by the kernel.
+type TaskRun struct {
+	Start    time.Time     `json:"start"`
+	Trigger  string        `json:"trigger,omitempty"` // schedule or trigger; empty in runs recorded before triggers
+	Duration time.Duration `json:"duration"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// TaskHistory holds the most recent runs of a service's task, oldest first.
+type TaskHistory struct {
+	Runs []TaskRun `json:"runs"`
+}
+
+// Add appends run, dropping the oldest runs beyond size.
+func (h *TaskHistory) Add(run TaskRun, size int) {
+	h.Runs = append(h.Runs, run)
+	if size > 0 && len(h.Runs) > size {
+		h.Runs = append([]TaskRun(nil), h.Runs[len(h.Runs)-size:]...)
+	}
+}
+
+// TaskStats summarizes a TaskHistory.
+type TaskStats struct {
+	Service     string        `json:"service"`
+	Runs        int           `json:"runs"`
+	Failures    int           `json:"failures"`
+	FailureRate float64       `json:"failureRate"` // 0 to 1
+	P50         time.Duration `json:"p50"`
+	P95         time.Duration `json:"p95"`
+	Max         time.Duration `json:"max"`
+	LastRun     time.Time     `json:"lastRun,omitzero"`
+	LastError   string        `json:"lastError,omitempty"`
+	LastErrorAt time.Time     `json:"lastErrorAt,omitzero"`
+}
+
+// Stats aggregates the runs in h for the named service.
+func (h TaskHistory) Stats(service string) TaskStats {
+	stats := TaskStats{Service: service, Runs: len(h.Runs)}
+	if len(h.Runs) == 0 {
+		return stats
+	}
+	durations := make([]time.Duration, 0, len(h.Runs))
+	for _, run := range h.Runs {
+		durations = append(durations, run.Duration)
+		if run.Outcome == TaskRunError {
+			stats.Failures++
+			stats.LastError = run.Error
+			stats.LastErrorAt = run.Start
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats.FailureRate = float64(stats.Failures) / float64(len(h.Runs))
+	stats.P50 = percentile(durations, 50)
+	stats.P95 = percentile(durations, 95)
+	stats.Max = durations[len(durations)-1]
+	stats.LastRun = h.Runs[len(h.Runs)-1].Start
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
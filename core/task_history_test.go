@@ -0,0 +1,48 @@
+package core_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskHistory_AddKeepsNewest(t *testing.T) {
+	var h core.TaskHistory
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		h.Add(core.TaskRun{Start: start.Add(time.Duration(i) * time.Minute), Outcome: core.TaskRunOK}, 3)
+	}
+	assert.Len(t, h.Runs, 3)
+	assert.Equal(t, start.Add(2*time.Minute), h.Runs[0].Start)
+	assert.Equal(t, start.Add(4*time.Minute), h.Runs[2].Start)
+}
+
+func TestTaskHistory_Stats(t *testing.T) {
+	assert.Equal(t, core.TaskStats{Service: "empty"}, core.TaskHistory{}.Stats("empty"))
+
+	var h core.TaskHistory
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 20; i++ {
+		run := core.TaskRun{Start: start.Add(time.Duration(i) * time.Minute), Duration: time.Duration(i) * time.Millisecond, Outcome: core.TaskRunOK}
+		if i%5 == 0 {
+			run.Outcome = core.TaskRunError
+			run.Error = fmt.Sprintf("failure %d", i)
+		}
+		h.Add(run, core.DefaultTaskHistorySize)
+	}
+
+	stats := h.Stats("svc")
+	assert.Equal(t, 20, stats.Runs)
+	assert.Equal(t, 4, stats.Failures)
+	assert.InDelta(t, 0.2, stats.FailureRate, 1e-9)
+	assert.Equal(t, 10*time.Millisecond, stats.P50)
+	assert.Equal(t, 19*time.Millisecond, stats.P95)
+	assert.Equal(t, 20*time.Millisecond, stats.Max)
+	assert.Equal(t, start.Add(20*time.Minute), stats.LastRun)
+	assert.Equal(t, "failure 20", stats.LastError)
+	assert.Equal(t, start.Add(20*time.Minute), stats.LastErrorAt)
+}
@@ -45,6 +45,19 @@ func (f *FakeMessenger) Publish(ctx context.Context, channel string, payloadType
 	return nil
 }
 
+// MessagesOn returns the messages published to channel, in order.
+func (f *FakeMessenger) MessagesOn(channel string) []PublishedMessage {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	var out []PublishedMessage
+	for _, m := range f.PublishedMessages {
+		if m.Channel == channel {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
 // RegisterPayloadType is a no-op for testing.
 func (f *FakeMessenger) RegisterPayloadType(typeStr string, prototype interface{}) error {
 	return nil
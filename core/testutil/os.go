@@ -67,6 +67,7 @@ type FakeOsProvider struct {
 	StatFunc        func(name string) (os.FileInfo, error)
 	ChtimesFunc     func(name string, atime time.Time, mtime time.Time) error
 	RemoveFunc      func(name string) error
+	RenameFunc      func(oldpath, newpath string) error
 	CommandFunc     func(name string, arg ...string) core.CommandApi
 
 	File core.FileApi
@@ -130,6 +131,12 @@ func (f FakeOsProvider) Remove(name string) error {
 	}
 	return nil
 }
+func (f FakeOsProvider) Rename(oldpath, newpath string) error {
+	if f.RenameFunc != nil {
+		return f.RenameFunc(oldpath, newpath)
+	}
+	return nil
+}
 func (f FakeOsProvider) Command(name string, arg ...string) core.CommandApi {
 	if f.CommandFunc != nil {
 		return f.CommandFunc(name, arg...)
@@ -130,6 +130,27 @@ func TestFakeOsProvider_Remove(t *testing.T) {
 	})
 }
 
+func TestFakeOsProvider_Rename(t *testing.T) {
+	t.Run("default behavior", func(t *testing.T) {
+		f := FakeOsProvider{}
+		err := f.Rename("a", "b")
+		assert.NoError(t, err)
+	})
+
+	t.Run("custom behavior", func(t *testing.T) {
+		testErr := assert.AnError
+		f := FakeOsProvider{
+			RenameFunc: func(oldpath, newpath string) error {
+				assert.Equal(t, "a", oldpath)
+				assert.Equal(t, "b", newpath)
+				return testErr
+			},
+		}
+		err := f.Rename("a", "b")
+		assert.ErrorIs(t, err, testErr)
+	})
+}
+
 func TestFakeFile(t *testing.T) {
 	t.Run("Close", func(t *testing.T) {
 		closed := false
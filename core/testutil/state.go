@@ -1,6 +1,14 @@
 package testutil
 
-import "github.com/wu/keyop/core"
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wu/keyop/core"
+)
 
 // NoOpStateStore is a StateStoreApi that performs no persistence (useful for tests).
 type NoOpStateStore struct{}
@@ -10,3 +18,131 @@ func (s *NoOpStateStore) Load(_ string, _ interface{}) error { return nil }
 
 // Compile-time check that *NoOpStateStore satisfies core.StateStoreApi.
 var _ core.StateStoreApi = (*NoOpStateStore)(nil)
+
+// MemoryStateStore is an in-memory core.ExtendedStateStoreApi for tests. Values are stored as
+// JSON, so Load behaves like the persistent stores. The zero value is ready to use.
+type MemoryStateStore struct {
+	mu      sync.Mutex
+	values  map[string]memoryStateEntry
+	nowFunc func() time.Time
+}
+
+type memoryStateEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// NewMemoryStateStore returns an empty store.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{}
+}
+
+// SetNow replaces the clock used for TTLs.
+func (s *MemoryStateStore) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nowFunc = now
+}
+
+func (s *MemoryStateStore) now() time.Time {
+	if s.nowFunc != nil {
+		return s.nowFunc()
+	}
+	return time.Now()
+}
+
+// get returns the live entry for key. Called with s.mu held.
+func (s *MemoryStateStore) get(key string) ([]byte, bool) {
+	e, ok := s.values[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.expiresAt.IsZero() && !s.now().Before(e.expiresAt) {
+		delete(s.values, key)
+		return nil, false
+	}
+	return e.data, true
+}
+
+func (s *MemoryStateStore) put(key string, value interface{}, expiresAt time.Time) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if s.values == nil {
+		s.values = map[string]memoryStateEntry{}
+	}
+	s.values[key] = memoryStateEntry{data: data, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryStateStore) Save(key string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(key, value, time.Time{})
+}
+
+func (s *MemoryStateStore) Load(key string, value interface{}) error {
+	s.mu.Lock()
+	data, ok := s.get(key)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (s *MemoryStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStateStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.values {
+		if _, ok := s.get(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemoryStateStore) SaveWithTTL(key string, value interface{}, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(key, value, s.now().Add(ttl))
+}
+
+func (s *MemoryStateStore) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, _ := s.get(key)
+	if equal, err := core.StateValueEqual(stored, old); err != nil || !equal {
+		return false, err
+	}
+	if err := s.put(key, new, time.Time{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MemoryStateStore) ExpiresAt(key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); !ok {
+		return time.Time{}, nil
+	}
+	return s.values[key].expiresAt, nil
+}
+
+// Compile-time check that *MemoryStateStore satisfies core.ExtendedStateStoreApi and
+// core.StateExpiryApi.
+var (
+	_ core.ExtendedStateStoreApi = (*MemoryStateStore)(nil)
+	_ core.StateExpiryApi        = (*MemoryStateStore)(nil)
+)
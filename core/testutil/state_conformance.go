@@ -0,0 +1,151 @@
+package testutil
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// StateStoreConformance checks the behaviour every core.ExtendedStateStoreApi implementation
+// shares. newStore must return an empty store.
+func StateStoreConformance(t *testing.T, newStore func(t *testing.T) core.ExtendedStateStoreApi) {
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.Save("gone", "x"))
+		require.NoError(t, s.Delete("gone"))
+		loaded := "unchanged"
+		require.NoError(t, s.Load("gone", &loaded))
+		assert.Equal(t, "unchanged", loaded)
+		assert.NoError(t, s.Delete("gone"), "deleting a missing key is not an error")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s := newStore(t)
+		keys, err := s.List("")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		for _, key := range []string{"svc_b", "svc_a", "other", "svc_%_odd", "svc/nested"} {
+			require.NoError(t, s.Save(key, 1))
+		}
+		keys, err = s.List("svc_")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"svc_%_odd", "svc_a", "svc_b"}, keys)
+		keys, err = s.List("svc_%")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"svc_%_odd"}, keys, "the prefix is not a pattern")
+		keys, err = s.List("")
+		require.NoError(t, err)
+		assert.Len(t, keys, 5)
+	})
+
+	t.Run("SaveWithTTL", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.SaveWithTTL("short", "x", 50*time.Millisecond))
+		require.NoError(t, s.SaveWithTTL("long", "y", time.Hour))
+		var val string
+		require.NoError(t, s.Load("short", &val))
+		assert.Equal(t, "x", val)
+
+		time.Sleep(100 * time.Millisecond)
+		val = ""
+		require.NoError(t, s.Load("short", &val))
+		assert.Empty(t, val, "expired keys load as missing")
+		keys, err := s.List("")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"long"}, keys)
+
+		require.NoError(t, s.SaveWithTTL("cleared", "x", 50*time.Millisecond))
+		require.NoError(t, s.Save("cleared", "kept"))
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, s.Load("cleared", &val))
+		assert.Equal(t, "kept", val, "Save clears the expiry")
+	})
+
+	t.Run("ExpiresAt", func(t *testing.T) {
+		s := newStore(t)
+		expiries, ok := s.(core.StateExpiryApi)
+		if !ok {
+			t.Skip("store does not report expiries")
+		}
+		require.NoError(t, s.SaveWithTTL("ttl", "x", time.Hour))
+		require.NoError(t, s.Save("plain", "y"))
+		expiresAt, err := expiries.ExpiresAt("ttl")
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+		for _, key := range []string{"plain", "missing"} {
+			expiresAt, err = expiries.ExpiresAt(key)
+			require.NoError(t, err)
+			assert.True(t, expiresAt.IsZero(), key)
+		}
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		s := newStore(t)
+		type counter struct {
+			N    int    `json:"n"`
+			Name string `json:"name"`
+		}
+		ok, err := s.CompareAndSwap("cas", nil, counter{N: 1, Name: "c"})
+		require.NoError(t, err)
+		assert.True(t, ok, "nil old matches a missing key")
+
+		ok, err = s.CompareAndSwap("cas", nil, counter{N: 5})
+		require.NoError(t, err)
+		assert.False(t, ok, "nil old does not match an existing key")
+
+		ok, err = s.CompareAndSwap("cas", counter{N: 2, Name: "c"}, counter{N: 3})
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		// field order does not matter
+		ok, err = s.CompareAndSwap("cas", map[string]any{"name": "c", "n": 1}, counter{N: 2, Name: "c"})
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		var loaded counter
+		require.NoError(t, s.Load("cas", &loaded))
+		assert.Equal(t, counter{N: 2, Name: "c"}, loaded)
+
+		require.NoError(t, s.SaveWithTTL("expiring", 1, 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+		ok, err = s.CompareAndSwap("expiring", nil, 2)
+		require.NoError(t, err)
+		assert.True(t, ok, "nil old matches an expired key")
+	})
+
+	t.Run("CompareAndSwap concurrent increments", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.Save("count", 0))
+		var wg sync.WaitGroup
+		var retries atomic.Int64
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					var n int
+					if err := s.Load("count", &n); !assert.NoError(t, err) {
+						return
+					}
+					ok, err := s.CompareAndSwap("count", n, n+1)
+					if !assert.NoError(t, err) || ok {
+						return
+					}
+					retries.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		var n int
+		require.NoError(t, s.Load("count", &n))
+		assert.Equal(t, 10, n, fmt.Sprintf("after %d retries", retries.Load()))
+	})
+}
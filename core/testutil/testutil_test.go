@@ -2,8 +2,12 @@ package testutil
 
 import (
 	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // FakeLogger additional tests
@@ -177,3 +181,24 @@ func TestNoOpStateStore_NoSideEffects(t *testing.T) {
 		assert.Equal(t, 0, val) // Should always be zero (no-op)
 	}
 }
+
+func TestMemoryStateStore(t *testing.T) {
+	StateStoreConformance(t, func(t *testing.T) core.ExtendedStateStoreApi {
+		return NewMemoryStateStore()
+	})
+
+	t.Run("zero value and clock", func(t *testing.T) {
+		var s MemoryStateStore
+		now := time.Now()
+		s.SetNow(func() time.Time { return now })
+		require.NoError(t, s.SaveWithTTL("k", "v", time.Minute))
+		var v string
+		require.NoError(t, s.Load("k", &v))
+		assert.Equal(t, "v", v)
+
+		now = now.Add(time.Minute)
+		v = ""
+		require.NoError(t, s.Load("k", &v))
+		assert.Empty(t, v)
+	})
+}
@@ -0,0 +1,32 @@
+//nolint:revive
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// TriggerConfig runs a service's check when a message arrives on any of its channels, in
+// addition to its interval. Triggered runs are serialized with scheduled runs; messages that
+// arrive while a run is in progress cause one more run after it.
+type TriggerConfig struct {
+	Channels []string      // channels whose messages trigger a run
+	Debounce time.Duration // wait until no message arrived for this long, but no longer than max(Debounce, Throttle) after the first
+	Throttle time.Duration // start a triggered run no sooner than this after the previous run
+}
+
+// Validate reports settings the kernel cannot apply.
+func (c TriggerConfig) Validate() error {
+	for _, ch := range c.Channels {
+		if ch == "" {
+			return fmt.Errorf("channels must not contain an empty name")
+		}
+	}
+	if c.Debounce < 0 {
+		return fmt.Errorf("debounce must not be negative, got %s", c.Debounce)
+	}
+	if c.Throttle < 0 {
+		return fmt.Errorf("throttle must not be negative, got %s", c.Throttle)
+	}
+	return nil
+}
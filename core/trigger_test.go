@@ -0,0 +1,18 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerConfig_Validate(t *testing.T) {
+	assert.NoError(t, core.TriggerConfig{}.Validate())
+	assert.NoError(t, core.TriggerConfig{Channels: []string{"readings"}, Debounce: time.Second, Throttle: time.Minute}.Validate())
+	assert.ErrorContains(t, core.TriggerConfig{Channels: []string{""}}.Validate(), "empty name")
+	assert.ErrorContains(t, core.TriggerConfig{Debounce: -time.Second}.Validate(), "debounce must not be negative")
+	assert.ErrorContains(t, core.TriggerConfig{Throttle: -time.Second}.Validate(), "throttle must not be negative")
+}
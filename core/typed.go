@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	km "github.com/wu/keyop-messenger"
+)
+
+// ErrPayloadTypeMismatch is returned by typed handlers when a message's payload type does not
+// match the type the handler was registered for, or its payload cannot be decoded into it.
+var ErrPayloadTypeMismatch = errors.New("payload type mismatch")
+
+// PayloadTypeOf returns the payload type string declared by T's PayloadType method.
+// T may be a struct type or a pointer to one.
+func PayloadTypeOf[T TypedPayload]() string {
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t != nil && t.Kind() == reflect.Ptr {
+		// avoid calling a value-receiver method through a nil pointer
+		return reflect.New(t.Elem()).Interface().(TypedPayload).PayloadType()
+	}
+	return zero.PayloadType()
+}
+
+// PublishTyped publishes v to channel using the payload type declared by v.
+func PublishTyped[T TypedPayload](ctx context.Context, m MessengerApi, channel string, v T) error {
+	return m.Publish(ctx, channel, PayloadTypeOf[T](), v)
+}
+
+// SubscribeTyped subscribes to channel and calls handler with each payload decoded as T.
+// Older or newer versions of T's payload type are converted when a converter is registered.
+// Messages with another payload type, or payloads that cannot be decoded into T, are
+// reported as errors wrapping ErrPayloadTypeMismatch so the messenger's retry and dead-letter
+// handling applies.
+func SubscribeTyped[T TypedPayload](ctx context.Context, m MessengerApi, channel string, subscriberID string, handler func(ctx context.Context, v T) error) error {
+	return m.Subscribe(ctx, channel, subscriberID, TypedHandler(handler))
+}
+
+// TypedHandler adapts a typed handler to km.HandlerFunc; see SubscribeTyped.
+func TypedHandler[T TypedPayload](handler func(ctx context.Context, v T) error) km.HandlerFunc {
+	return func(ctx context.Context, msg km.Message) error {
+		v, err := DecodePayload[T](msg)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, v)
+	}
+}
+
+// DecodePayload returns msg's payload as T. Registered payloads arrive as T or *T; unregistered
+// ones arrive as generic JSON values and are re-decoded into T. Messages of another payload type
+// are converted to T's type when a chain of registered converters exists (see ConvertPayload).
+func DecodePayload[T TypedPayload](msg km.Message) (T, error) {
+	var zero T
+	want := PayloadTypeOf[T]()
+	if msg.PayloadType != want {
+		converted, err := ConvertPayload(msg, want)
+		if errors.Is(err, ErrNoPayloadConversion) {
+			return zero, fmt.Errorf("%w: got %q, want %q", ErrPayloadTypeMismatch, msg.PayloadType, want)
+		}
+		if err != nil {
+			return zero, fmt.Errorf("%w: %v", ErrPayloadTypeMismatch, err)
+		}
+		msg = converted
+	}
+
+	switch p := msg.Payload.(type) {
+	case T:
+		return p, nil
+	case nil:
+		return zero, fmt.Errorf("%w: empty %q payload", ErrPayloadTypeMismatch, want)
+	}
+
+	// value <-> pointer of the same underlying struct
+	tType := reflect.TypeOf(zero)
+	pv := reflect.ValueOf(msg.Payload)
+	if tType != nil {
+		if tType.Kind() == reflect.Ptr && pv.Type() == tType.Elem() {
+			ptr := reflect.New(tType.Elem())
+			ptr.Elem().Set(pv)
+			return ptr.Interface().(T), nil
+		}
+		if pv.Kind() == reflect.Ptr && !pv.IsNil() && pv.Type().Elem() == tType {
+			return pv.Elem().Interface().(T), nil
+		}
+	}
+
+	var raw []byte
+	if r, ok := msg.Payload.(json.RawMessage); ok {
+		raw = r
+	} else {
+		var err error
+		if raw, err = json.Marshal(msg.Payload); err != nil {
+			return zero, fmt.Errorf("%w: re-encode %q payload: %v", ErrPayloadTypeMismatch, want, err)
+		}
+	}
+
+	var out T
+	if tType != nil && tType.Kind() == reflect.Ptr {
+		ptr := reflect.New(tType.Elem())
+		if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+			return zero, fmt.Errorf("%w: decode %q payload: %v", ErrPayloadTypeMismatch, want, err)
+		}
+		return ptr.Interface().(T), nil
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return zero, fmt.Errorf("%w: decode %q payload: %v", ErrPayloadTypeMismatch, want, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+)
+
+func TestPayloadTypeOf(t *testing.T) {
+	assert.Equal(t, "core.metric.v1", core.PayloadTypeOf[core.MetricEvent]())
+	assert.Equal(t, "core.metric.v1", core.PayloadTypeOf[*core.MetricEvent]())
+}
+
+func TestPublishTyped_DerivesPayloadType(t *testing.T) {
+	m := testutil.NewFakeMessenger()
+	err := core.PublishTyped(context.Background(), m, "metrics", &core.MetricEvent{Name: "load", Value: 1.5})
+	require.NoError(t, err)
+
+	require.Len(t, m.PublishedMessages, 1)
+	assert.Equal(t, "metrics", m.PublishedMessages[0].Channel)
+	assert.Equal(t, "core.metric.v1", m.PublishedMessages[0].PayloadType)
+}
+
+func TestSubscribeTyped_DecodesPayloadForms(t *testing.T) {
+	m := testutil.NewFakeMessenger()
+	var got []core.MetricEvent
+	err := core.SubscribeTyped(context.Background(), m, "metrics", "test", func(_ context.Context, v core.MetricEvent) error {
+		got = append(got, v)
+		return nil
+	})
+	require.NoError(t, err)
+	handler := m.Handlers["metrics"]
+	require.NotNil(t, handler)
+
+	payloads := []interface{}{
+		core.MetricEvent{Name: "value"},
+		&core.MetricEvent{Name: "pointer"},
+		map[string]any{"name": "map", "value": 2.0},
+		json.RawMessage(`{"name":"raw","value":3}`),
+	}
+	for _, p := range payloads {
+		require.NoError(t, handler(context.Background(), km.Message{PayloadType: "core.metric.v1", Payload: p}))
+	}
+
+	require.Len(t, got, 4)
+	assert.Equal(t, "value", got[0].Name)
+	assert.Equal(t, "pointer", got[1].Name)
+	assert.Equal(t, "map", got[2].Name)
+	assert.Equal(t, 2.0, got[2].Value)
+	assert.Equal(t, "raw", got[3].Name)
+}
+
+func TestSubscribeTyped_PointerHandler(t *testing.T) {
+	handler := core.TypedHandler(func(_ context.Context, v *core.AlertEvent) error {
+		assert.Equal(t, "disk full", v.Summary)
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), km.Message{PayloadType: "core.alert.v1", Payload: core.AlertEvent{Summary: "disk full"}}))
+	require.NoError(t, handler(context.Background(), km.Message{PayloadType: "core.alert.v1", Payload: map[string]any{"summary": "disk full"}}))
+}
+
+func TestSubscribeTyped_MismatchedPayloadType(t *testing.T) {
+	called := false
+	handler := core.TypedHandler(func(_ context.Context, _ core.MetricEvent) error {
+		called = true
+		return nil
+	})
+
+	err := handler(context.Background(), km.Message{PayloadType: "core.alert.v1", Payload: core.AlertEvent{}})
+	assert.ErrorIs(t, err, core.ErrPayloadTypeMismatch)
+
+	err = handler(context.Background(), km.Message{PayloadType: "core.metric.v1", Payload: map[string]any{"value": "not a number"}})
+	assert.ErrorIs(t, err, core.ErrPayloadTypeMismatch)
+
+	assert.False(t, called)
+}
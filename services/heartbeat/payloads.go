@@ -24,15 +24,9 @@ type HeartbeatEvent struct {
 func (h HeartbeatEvent) PayloadType() string { return "service.heartbeat.v1" }
 
 // RegisterPayloadTypes registers heartbeat payload types with the new messenger.
-func RegisterPayloadTypes(msgr core.MessengerApi, logger core.Logger) error {
-	heartbeatProto := &HeartbeatEvent{}
-	if err := msgr.RegisterPayloadType("service.heartbeat.v1", heartbeatProto); err != nil {
-		if core.IsDuplicatePayloadRegistration(err) {
-			logger.Warn("heartbeat: payload type already registered (skipping)", "type", "service.heartbeat.v1", "error", err)
-			return nil
-		}
-		return fmt.Errorf("heartbeat: failed to register service.heartbeat.v1: %w", err)
+func RegisterPayloadTypes(msgr core.MessengerApi, _ core.Logger) error {
+	if err := core.RegisterServicePayloads(msgr, "heartbeat"); err != nil {
+		return fmt.Errorf("heartbeat: %w", err)
 	}
-
 	return nil
 }
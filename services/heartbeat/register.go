@@ -9,4 +9,5 @@ func init() {
 	core.RegisterService("heartbeat", func(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Context) interface{} {
 		return NewService(deps, cfg, ctx)
 	})
+	core.RegisterPayload("service.heartbeat.v1", HeartbeatEvent{}, "heartbeat", "Periodic liveness report with the host's uptime.")
 }
@@ -32,9 +32,19 @@ func NewService(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Cont
 	}
 }
 
-// ValidateConfig returns configuration validation errors (none required for heartbeat).
+// Logical pub keys heartbeat publishes to, with the channels used when they are not configured.
+const (
+	eventsPub  = "events"
+	metricsPub = "metrics"
+	alertsPub  = "alerts"
+
+	defaultEventsChannel = "heartbeat"
+)
+
+// ValidateConfig returns configuration validation errors. No channels are required unless the
+// service runs in strict mode, where its events, metrics and alerts pubs must be declared.
 func (svc *Service) ValidateConfig() []error {
-	return nil
+	return svc.Cfg.ValidatePubs(eventsPub, metricsPub, alertsPub)
 }
 
 // Initialize registers payload types with the new messenger.
@@ -90,7 +100,7 @@ func (svc *Service) Check() error {
 		}
 		err := newMsgr.Publish(
 			svc.ctx,
-			"alerts",
+			svc.Cfg.PubChannel(alertsPub, core.AlertsChannel),
 			"core.alert.v1",
 			&alert,
 		)
@@ -101,7 +111,7 @@ func (svc *Service) Check() error {
 
 	eventErr := newMsgr.Publish(
 		svc.ctx,
-		"heartbeat",
+		svc.Cfg.PubChannel(eventsPub, defaultEventsChannel),
 		"service.heartbeat.v1",
 		&heartbeat,
 	)
@@ -112,7 +122,7 @@ func (svc *Service) Check() error {
 	// Also publish as a metric event for metric aggregation
 	metricErr := newMsgr.Publish(
 		svc.ctx,
-		"metrics",
+		svc.Cfg.PubChannel(metricsPub, core.MetricsChannel),
 		"core.metric.v1",
 		&core.MetricEvent{Hostname: hostname, Name: metricName, Value: float64(heartbeat.UptimeSeconds)},
 	)
@@ -202,3 +202,40 @@ func TestHeartbeatValidateConfig(t *testing.T) {
 	// ValidateConfig returns nil — no required channels.
 	assert.Nil(t, svc.ValidateConfig())
 }
+
+func TestHeartbeatCheck_ConfiguredChannels(t *testing.T) {
+	deps, messenger := makeDeps(t)
+	cfg := makeCfg("hb-service", nil)
+	cfg.Pubs = map[string]core.ChannelInfo{
+		"events":  {Name: "garage-heartbeat"},
+		"metrics": {Name: "garage-metrics"},
+	}
+
+	svc := NewService(deps, cfg, context.Background()).(*Service)
+	require.NoError(t, svc.Check())
+
+	channels := map[string]string{}
+	for _, msg := range messenger.PublishedMessages {
+		channels[msg.PayloadType] = msg.Channel
+	}
+	assert.Equal(t, map[string]string{
+		"core.alert.v1":        "alerts",
+		"service.heartbeat.v1": "garage-heartbeat",
+		"core.metric.v1":       "garage-metrics",
+	}, channels)
+}
+
+func TestHeartbeatValidateConfig_Strict(t *testing.T) {
+	strict := true
+	cfg := makeCfg("hb", nil)
+	cfg.Interceptors.EnforcePubs = &strict
+	cfg.Pubs = map[string]core.ChannelInfo{"events": {Name: "heartbeat"}}
+
+	svc := Service{Cfg: cfg}
+	assert.Len(t, svc.ValidateConfig(), 2)
+
+	cfg.Pubs["metrics"] = core.ChannelInfo{Name: "metrics"}
+	cfg.Pubs["alerts"] = core.ChannelInfo{Name: "alerts"}
+	svc = Service{Cfg: cfg}
+	assert.Empty(t, svc.ValidateConfig())
+}
@@ -0,0 +1,61 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpr_Match(t *testing.T) {
+	payload := map[string]any{
+		"tempC":    31.5,
+		"hostname": "garage-pi",
+		"tags":     []any{"outdoor", "north"},
+		"sensor":   map[string]any{"battery": 12.0, "ok": true},
+		"empty":    "",
+	}
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`tempC > 30`, true},
+		{`tempC >= 31.5 && tempC <= 31.5`, true},
+		{`tempC < 30 || hostname == "garage-pi"`, true},
+		{`!(tempC > 30)`, false},
+		{`hostname =~ '^garage-'`, true},
+		{`hostname != 'garage-pi'`, false},
+		{`"north" in tags`, true},
+		{`"pi" in hostname`, true},
+		{`hostname in ["a", "b"]`, false},
+		{`sensor.battery < 20 && sensor.ok`, true},
+		{`missing > 1`, false},
+		{`missing == null`, true},
+		{`empty`, false},
+		{`tempC`, true},
+		{`sensor.missing.deeper == null`, true},
+		{`tempC == -1`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			e, err := CompileExpr(tc.expr)
+			require.NoError(t, err)
+			got, err := e.Match(payload)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExpr_Errors(t *testing.T) {
+	for _, src := range []string{`tempC >`, `(a == 1`, `a == "open`, `a ==== 1`, `a =~ "("`, `a # 1`, `a b`} {
+		_, err := CompileExpr(src)
+		assert.Error(t, err, src)
+	}
+
+	e, err := CompileExpr(`hostname > 3`)
+	require.NoError(t, err)
+	_, err = e.Match(map[string]any{"hostname": "pi"})
+	assert.ErrorContains(t, err, "cannot compare string")
+}
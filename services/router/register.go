@@ -0,0 +1,13 @@
+package router
+
+import (
+	"context"
+
+	"github.com/wu/keyop/core"
+)
+
+func init() {
+	core.RegisterService("router", func(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Context) interface{} {
+		return NewService(deps, cfg, ctx)
+	})
+}
@@ -0,0 +1,359 @@
+// Package router implements a service that forwards, transforms and drops messages by rule.
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/wu/keyop/core"
+
+	km "github.com/wu/keyop-messenger"
+	"gopkg.in/yaml.v3"
+)
+
+// RuleConfig is one routing rule from the service's config.rules list.
+//
+//	rules:
+//	  - name: hot-temps
+//	    source: temps
+//	    payloadType: core.temp.*      # exact type or path.Match glob; empty matches all
+//	    where: tempC > 30             # optional predicate, see CompileExpr
+//	    map:                          # output field -> payload field path, values keep their type
+//	      value: tempC
+//	    set:                          # output field -> text/template over the payload
+//	      name: "temp.{{.sensorName}}"
+//	    outputType: core.metric.v1    # defaults to the incoming payload type
+//	    destinations: [hot-temps]
+//
+// Without map or set the payload is forwarded unchanged. With them a new object is built, or
+// the original payload is updated when merge is true. Dotted output fields create nested objects.
+type RuleConfig struct {
+	Name         string            `yaml:"name"`
+	Source       string            `yaml:"source"`
+	PayloadType  string            `yaml:"payloadType"`
+	Where        string            `yaml:"where"`
+	Map          map[string]string `yaml:"map"`
+	Set          map[string]string `yaml:"set"`
+	Merge        bool              `yaml:"merge"`
+	OutputType   string            `yaml:"outputType"`
+	Destinations []string          `yaml:"destinations"`
+}
+
+// RuleStats counts what a rule did with the messages it saw.
+type RuleStats struct {
+	Matched uint64 // forwarded to the destinations
+	Dropped uint64 // wrong payload type or predicate false
+	Errors  uint64 // predicate or transform failed
+}
+
+type rule struct {
+	RuleConfig
+	where     *Expr
+	templates map[string]*template.Template
+
+	matched, dropped, errors atomic.Uint64
+
+	mu        sync.Mutex
+	pendingID string          // message whose destinations are being published
+	published map[string]bool // destinations pendingID has been published to
+}
+
+// Service routes messages between channels according to its rules.
+type Service struct {
+	Deps  core.Dependencies
+	Cfg   core.ServiceConfig
+	ctx   context.Context
+	rules []*rule
+}
+
+// NewService creates a router service instance.
+func NewService(deps core.Dependencies, cfg core.ServiceConfig, ctx context.Context) core.Service {
+	return &Service{Deps: deps, Cfg: cfg, ctx: ctx}
+}
+
+// ValidateConfig parses the rules, compiling their predicates and templates. In strict mode
+// every destination must also be declared in pubs.
+func (svc *Service) ValidateConfig() []error {
+	rules, errs := parseRules(svc.Cfg.Config["rules"])
+	errs = append(errs, svc.Cfg.ValidatePubs("metrics")...)
+	if svc.Cfg.Strict() {
+		declared := map[string]bool{}
+		for _, info := range svc.Cfg.Pubs {
+			declared[info.Name] = true
+		}
+		for _, r := range rules {
+			for _, dest := range r.Destinations {
+				if !declared[dest] {
+					errs = append(errs, fmt.Errorf("router rule %q: strict mode: destination %q is not declared in pubs", r.Name, dest))
+				}
+			}
+		}
+	}
+	if len(errs) == 0 {
+		svc.rules = rules
+	}
+	return errs
+}
+
+func parseRules(raw any) ([]*rule, []error) {
+	if raw == nil {
+		return nil, []error{fmt.Errorf("router: config.rules is required")}
+	}
+	b, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, []error{fmt.Errorf("router: encode rules: %w", err)}
+	}
+	var cfgs []RuleConfig
+	if err := yaml.Unmarshal(b, &cfgs); err != nil {
+		return nil, []error{fmt.Errorf("router: config.rules must be a list of rules: %w", err)}
+	}
+
+	var rules []*rule
+	var errs []error
+	names := map[string]bool{}
+	for i, rc := range cfgs {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		r, ruleErrs := compileRule(rc)
+		if names[rc.Name] {
+			ruleErrs = append(ruleErrs, fmt.Errorf("duplicate rule name"))
+		}
+		names[rc.Name] = true
+		for _, e := range ruleErrs {
+			errs = append(errs, fmt.Errorf("router rule %q: %w", rc.Name, e))
+		}
+		rules = append(rules, r)
+	}
+	return rules, errs
+}
+
+func compileRule(rc RuleConfig) (*rule, []error) {
+	r := &rule{RuleConfig: rc, templates: map[string]*template.Template{}}
+	var errs []error
+	if err := km.ValidateChannelName(rc.Source); err != nil {
+		errs = append(errs, fmt.Errorf("source: %w", err))
+	}
+	if len(rc.Destinations) == 0 {
+		errs = append(errs, fmt.Errorf("at least one destination is required"))
+	}
+	for _, dest := range rc.Destinations {
+		if err := km.ValidateChannelName(dest); err != nil {
+			errs = append(errs, fmt.Errorf("destination: %w", err))
+		} else if dest == rc.Source {
+			errs = append(errs, fmt.Errorf("destination %q is the source channel", dest))
+		}
+	}
+	if _, err := path.Match(rc.PayloadType, ""); err != nil {
+		errs = append(errs, fmt.Errorf("payloadType: %w", err))
+	}
+	if rc.Where != "" {
+		expr, err := CompileExpr(rc.Where)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		r.where = expr
+	}
+	for field, text := range rc.Set {
+		tmpl, err := template.New(field).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("set %s: %w", field, err))
+			continue
+		}
+		r.templates[field] = tmpl
+	}
+	return r, errs
+}
+
+// Initialize subscribes each rule to its source channel.
+func (svc *Service) Initialize() error {
+	if svc.rules == nil {
+		if errs := svc.ValidateConfig(); len(errs) > 0 {
+			return errs[0]
+		}
+	}
+	msgr := svc.Deps.MustGetMessenger()
+	for _, r := range svc.rules {
+		subscriberID := svc.Cfg.Name + "-" + r.Name
+		if err := msgr.Subscribe(svc.ctx, r.Source, subscriberID, svc.handler(r)); err != nil {
+			return fmt.Errorf("router rule %q: subscribe to %q: %w", r.Name, r.Source, err)
+		}
+	}
+	return nil
+}
+
+// Check publishes each rule's cumulative matched, dropped and error counts as metrics.
+func (svc *Service) Check() error {
+	msgr := svc.Deps.MustGetMessenger()
+	channel := svc.Cfg.PubChannel("metrics", core.MetricsChannel)
+	hostname := msgr.InstanceName()
+	for _, r := range svc.rules {
+		stats := r.stats()
+		for _, m := range []struct {
+			name  string
+			value uint64
+		}{{"matched", stats.Matched}, {"dropped", stats.Dropped}, {"errors", stats.Errors}} {
+			ev := &core.MetricEvent{
+				Hostname: hostname,
+				Name:     fmt.Sprintf("%s.%s.%s", svc.Cfg.Name, r.Name, m.name),
+				Value:    float64(m.value),
+			}
+			if err := msgr.Publish(svc.ctx, channel, ev.PayloadType(), ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns the counts for each rule by name.
+func (svc *Service) Stats() map[string]RuleStats {
+	out := make(map[string]RuleStats, len(svc.rules))
+	for _, r := range svc.rules {
+		out[r.Name] = r.stats()
+	}
+	return out
+}
+
+func (r *rule) stats() RuleStats {
+	return RuleStats{Matched: r.matched.Load(), Dropped: r.dropped.Load(), Errors: r.errors.Load()}
+}
+
+func (svc *Service) handler(r *rule) km.HandlerFunc {
+	logger := svc.Deps.MustGetLogger()
+	msgr := svc.Deps.MustGetMessenger()
+	return func(ctx context.Context, msg km.Message) error {
+		if r.PayloadType != "" {
+			if ok, _ := path.Match(r.PayloadType, msg.PayloadType); !ok {
+				r.dropped.Add(1)
+				return nil
+			}
+		}
+		payload, err := payloadObject(msg.Payload)
+		if err != nil {
+			r.errors.Add(1)
+			logger.Warn("router: payload is not an object", "rule", r.Name, "id", msg.ID, "error", err)
+			return nil
+		}
+		if r.where != nil {
+			ok, err := r.where.Match(payload)
+			if err != nil {
+				r.errors.Add(1)
+				logger.Warn("router: predicate failed", "rule", r.Name, "id", msg.ID, "error", err)
+				return nil
+			}
+			if !ok {
+				r.dropped.Add(1)
+				return nil
+			}
+		}
+		out, err := r.transform(payload)
+		if err != nil {
+			r.errors.Add(1)
+			logger.Warn("router: transform failed", "rule", r.Name, "id", msg.ID, "error", err)
+			return nil
+		}
+		payloadType := r.OutputType
+		if payloadType == "" {
+			payloadType = msg.PayloadType
+		}
+
+		// a failed publish fails the handler, and the retry only publishes to the destinations
+		// the message has not reached yet
+		ctx = km.WithServiceName(ctx, km.ServiceNameFromContext(svc.ctx))
+		for _, dest := range r.Destinations {
+			if r.isPublished(msg.ID, dest) {
+				continue
+			}
+			if err := msgr.Publish(ctx, dest, payloadType, out); err != nil {
+				return fmt.Errorf("router rule %q: publish to %q: %w", r.Name, dest, err)
+			}
+			r.setPublished(msg.ID, dest)
+		}
+		r.matched.Add(1)
+		return nil
+	}
+}
+
+// isPublished reports whether an earlier attempt published message id to dest. Only the latest
+// message is remembered: a subscription delivers the next message once this one is handled or
+// dead-lettered.
+func (r *rule) isPublished(id, dest string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pendingID == id && r.published[dest]
+}
+
+func (r *rule) setPublished(id, dest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pendingID != id {
+		r.pendingID = id
+		r.published = map[string]bool{}
+	}
+	r.published[dest] = true
+}
+
+// transform applies the rule's map and set fields to payload.
+func (r *rule) transform(payload map[string]any) (map[string]any, error) {
+	if len(r.Map) == 0 && len(r.Set) == 0 {
+		return payload, nil
+	}
+	out := map[string]any{}
+	if r.Merge {
+		out = payload
+	}
+	for field, src := range r.Map {
+		setPath(out, field, lookupPath(payload, strings.Split(src, ".")))
+	}
+	for field, tmpl := range r.templates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, payload); err != nil {
+			return nil, fmt.Errorf("set %s: %w", field, err)
+		}
+		setPath(out, field, buf.String())
+	}
+	return out, nil
+}
+
+// payloadObject returns the payload as a generic JSON object; a fresh copy, so transforms can
+// modify it.
+func payloadObject(payload any) (map[string]any, error) {
+	var raw []byte
+	if r, ok := payload.(json.RawMessage); ok {
+		raw = r
+	} else {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		obj = map[string]any{}
+	}
+	return obj, nil
+}
+
+func setPath(obj map[string]any, field string, v any) {
+	keys := strings.Split(field, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := obj[key].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			obj[key] = child
+		}
+		obj = child
+	}
+	obj[keys[len(keys)-1]] = v
+}
@@ -0,0 +1,221 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/adapter"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	km "github.com/wu/keyop-messenger"
+	"gopkg.in/yaml.v3"
+)
+
+const routerTestRules = `
+rules:
+  - name: hot
+    source: temps
+    payloadType: core.temp.*
+    where: tempC > 30
+    map:
+      value: tempC
+      source.host: hostname
+    set:
+      name: "temp.{{.sensorName}}"
+    outputType: core.metric.v1
+    destinations: [hot-metrics, archive]
+  - source: temps
+    where: hostname == "pi2"
+    destinations: [pi2-temps]
+`
+
+func newRouterTest(t *testing.T, rules string) (*Service, core.MessengerApi) {
+	t.Helper()
+	m := adapter.NewMemoryMessenger(adapter.MemoryMessengerConfig{Name: "router-test", RetryDelay: time.Millisecond}, &testutil.FakeLogger{})
+	t.Cleanup(func() { _ = m.Close() })
+	require.NoError(t, m.RegisterPayloadType("core.temp.v1", core.TempEvent{}))
+	require.NoError(t, m.RegisterPayloadType("core.metric.v1", core.MetricEvent{}))
+
+	var config map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(rules), &config))
+
+	deps := core.Dependencies{}
+	deps.SetLogger(&testutil.FakeLogger{})
+	deps.SetMessenger(m)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	svc := NewService(deps, core.ServiceConfig{Name: "router", Type: "router", Config: config}, km.WithServiceName(ctx, "router")).(*Service)
+	return svc, m
+}
+
+type collector struct {
+	mu   sync.Mutex
+	msgs map[string][]km.Message
+}
+
+func collect(t *testing.T, m core.MessengerApi, channels ...string) *collector {
+	t.Helper()
+	c := &collector{msgs: map[string][]km.Message{}}
+	for _, ch := range channels {
+		require.NoError(t, m.Subscribe(context.Background(), ch, "collector", func(_ context.Context, msg km.Message) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.msgs[ch] = append(c.msgs[ch], msg)
+			return nil
+		}))
+	}
+	return c
+}
+
+func (c *collector) count(ch string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.msgs[ch])
+}
+
+func TestRouter_ForwardsTransformsAndDrops(t *testing.T) {
+	svc, m := newRouterTest(t, routerTestRules)
+	require.Empty(t, svc.ValidateConfig())
+	require.NoError(t, svc.Initialize())
+	out := collect(t, m, "hot-metrics", "archive", "pi2-temps", "metrics")
+
+	ctx := context.Background()
+	require.NoError(t, m.Publish(ctx, "temps", "core.temp.v1", core.TempEvent{TempC: 35, Hostname: "pi1", SensorName: "attic"}))
+	require.NoError(t, m.Publish(ctx, "temps", "core.temp.v1", core.TempEvent{TempC: 20, Hostname: "pi2", SensorName: "cellar"}))
+	require.NoError(t, m.Publish(ctx, "temps", "core.alert.v1", core.AlertEvent{Summary: "not a temp"}))
+
+	require.Eventually(t, func() bool {
+		stats := svc.Stats()
+		return stats["hot"].Matched+stats["hot"].Dropped == 3 && stats["rule2"].Matched+stats["rule2"].Dropped == 3
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, RuleStats{Matched: 1, Dropped: 2}, svc.Stats()["hot"])
+	assert.Equal(t, RuleStats{Matched: 1, Dropped: 2}, svc.Stats()["rule2"])
+
+	require.Eventually(t, func() bool {
+		return out.count("hot-metrics") == 1 && out.count("archive") == 1 && out.count("pi2-temps") == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	out.mu.Lock()
+	metric := out.msgs["hot-metrics"][0]
+	forwarded := out.msgs["pi2-temps"][0]
+	out.mu.Unlock()
+	assert.Equal(t, "core.metric.v1", metric.PayloadType)
+	assert.Equal(t, "router", metric.ServiceName)
+	ev, err := core.DecodePayload[core.MetricEvent](metric)
+	require.NoError(t, err)
+	assert.Equal(t, "temp.attic", ev.Name)
+	assert.InDelta(t, 35.0, ev.Value, 0.001)
+
+	assert.Equal(t, "core.temp.v1", forwarded.PayloadType)
+	temp, err := core.DecodePayload[core.TempEvent](forwarded)
+	require.NoError(t, err)
+	assert.Equal(t, "cellar", temp.SensorName)
+
+	// counters are published as metrics
+	require.NoError(t, svc.Check())
+	require.Eventually(t, func() bool { return out.count("metrics") == 6 }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestRouter_Transform(t *testing.T) {
+	r, errs := compileRule(RuleConfig{
+		Source: "a", Destinations: []string{"b"}, Merge: true,
+		Map: map[string]string{"copy.value": "reading.value"},
+		Set: map[string]string{"label": "{{.reading.unit}}!"},
+	})
+	require.Empty(t, errs)
+	out, err := r.transform(map[string]any{"keep": 1.0, "reading": map[string]any{"value": 2.0, "unit": "C"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"keep":    1.0,
+		"reading": map[string]any{"value": 2.0, "unit": "C"},
+		"copy":    map[string]any{"value": 2.0},
+		"label":   "C!",
+	}, out)
+}
+
+func TestRouter_ValidateConfig(t *testing.T) {
+	svc, _ := newRouterTest(t, `
+rules:
+  - name: loop
+    source: temps
+    destinations: [temps]
+  - name: bad
+    source: temps
+    where: "tempC >"
+    set:
+      x: "{{.unclosed"
+  - name: loop
+    source: temps
+    destinations: [other]
+`)
+	errs := svc.ValidateConfig()
+	require.Len(t, errs, 5)
+	assert.ErrorContains(t, errs[0], `destination "temps" is the source channel`)
+	assert.ErrorContains(t, errs[1], "at least one destination")
+	assert.ErrorContains(t, errs[4], "duplicate rule name")
+
+	svc, _ = newRouterTest(t, `other: 1`)
+	assert.Len(t, svc.ValidateConfig(), 1)
+}
+
+func TestRouter_ValidateConfigStrict(t *testing.T) {
+	svc, _ := newRouterTest(t, routerTestRules)
+	strict := true
+	svc.Cfg.Interceptors.EnforcePubs = &strict
+	svc.Cfg.Pubs = map[string]core.ChannelInfo{
+		"metrics": {Name: "metrics"},
+		"hot":     {Name: "hot-metrics"},
+		"archive": {Name: "archive"},
+	}
+	errs := svc.ValidateConfig()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], `router rule "rule2": strict mode: destination "pi2-temps" is not declared in pubs`)
+
+	svc.Cfg.Pubs["pi2"] = core.ChannelInfo{Name: "pi2-temps"}
+	assert.Empty(t, svc.ValidateConfig())
+}
+
+// failingMessenger fails the first publish to each channel in failOnce.
+type failingMessenger struct {
+	*testutil.FakeMessenger
+	failOnce map[string]bool
+}
+
+func (f *failingMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	if f.failOnce[channel] {
+		f.failOnce[channel] = false
+		return errors.New("unavailable")
+	}
+	return f.FakeMessenger.Publish(ctx, channel, payloadType, payload)
+}
+
+func TestRouter_RetryPublishesOnlyToMissedDestinations(t *testing.T) {
+	svc, _ := newRouterTest(t, `
+rules:
+  - source: temps
+    destinations: [first, second, third]
+`)
+	require.Empty(t, svc.ValidateConfig())
+	fake := &failingMessenger{FakeMessenger: testutil.NewFakeMessenger(), failOnce: map[string]bool{"second": true}}
+	svc.Deps.SetMessenger(fake)
+	handler := svc.handler(svc.rules[0])
+	msg := km.Message{ID: "m1", Channel: "temps", PayloadType: "core.temp.v1", Payload: map[string]any{"tempC": 20}}
+
+	require.ErrorContains(t, handler(context.Background(), msg), `publish to "second"`)
+	require.NoError(t, handler(context.Background(), msg))
+	for _, ch := range []string{"first", "second", "third"} {
+		assert.Len(t, fake.MessagesOn(ch), 1, ch)
+	}
+	assert.Equal(t, RuleStats{Matched: 1}, svc.Stats()["rule1"])
+
+	// the next message is published to every destination again
+	msg.ID = "m2"
+	require.NoError(t, handler(context.Background(), msg))
+	assert.Len(t, fake.MessagesOn("first"), 2)
+}
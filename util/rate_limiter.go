@@ -50,57 +50,74 @@ func NewRateLimiterConfig(limit int, window time.Duration, buckets int) *RateLim
 
 // AddEventAt records an event occurring at the provided time and returns whether the
 // event is allowed (not exceeding the configured limit) and whether this event is the
-// first dropped event since the last successful allowed event.
+// first dropped event since the last successful allowed event. Dropped events count towards
+// the limit too, so a steady stream above it is dropped entirely until it slows down.
 func (r *RateLimiter) AddEventAt(now time.Time) (allowed bool, firstDrop bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.advance(now)
+	r.buckets[r.current]++
+	if r.totalLocked() > r.limit {
+		return r.drop()
+	}
+	r.droppedSinceWarning = 0
+	return true, false
+}
+
+// AllowEventAt is AddEventAt counting only allowed events, so at most the limit is allowed in
+// any window however many events are dropped.
+func (r *RateLimiter) AllowEventAt(now time.Time) (allowed bool, firstDrop bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now)
+	if r.totalLocked() >= r.limit {
+		return r.drop()
+	}
+	r.buckets[r.current]++
+	r.droppedSinceWarning = 0
+	return true, false
+}
 
+// advance rotates the buckets to now. r.mu must be held.
+func (r *RateLimiter) advance(now time.Time) {
 	if r.start.IsZero() {
 		r.start = now
 		r.current = 0
 	}
-
-	// advance buckets according to elapsed time
 	elapsed := now.Sub(r.start)
 	steps := int(elapsed / r.bucketDuration)
-	if steps > 0 {
-		if steps >= r.bucketCount {
-			// too much time passed, clear all
-			for i := range r.buckets {
-				r.buckets[i] = 0
-			}
-			r.current = 0
-			r.start = now
-		} else {
-			for i := 0; i < steps; i++ {
-				r.current = (r.current + 1) % r.bucketCount
-				r.buckets[r.current] = 0
-			}
-			r.start = r.start.Add(time.Duration(steps) * r.bucketDuration)
+	if steps <= 0 {
+		return
+	}
+	if steps >= r.bucketCount {
+		// too much time passed, clear all
+		for i := range r.buckets {
+			r.buckets[i] = 0
 		}
+		r.current = 0
+		r.start = now
+		return
+	}
+	for i := 0; i < steps; i++ {
+		r.current = (r.current + 1) % r.bucketCount
+		r.buckets[r.current] = 0
 	}
+	r.start = r.start.Add(time.Duration(steps) * r.bucketDuration)
+}
 
-	// record this event
-	r.buckets[r.current]++
+// drop records a dropped event. r.mu must be held.
+func (r *RateLimiter) drop() (allowed bool, firstDrop bool) {
+	r.droppedSinceWarning++
+	return false, r.droppedSinceWarning == 1
+}
 
-	// compute total in window
+// totalLocked is Total with r.mu held.
+func (r *RateLimiter) totalLocked() int {
 	total := 0
 	for _, v := range r.buckets {
 		total += v
 	}
-
-	if total > r.limit {
-		r.droppedSinceWarning++
-		first := r.droppedSinceWarning == 1
-		return false, first
-	}
-
-	// allowed -- reset dropped counter
-	if r.droppedSinceWarning > 0 {
-		r.droppedSinceWarning = 0
-	}
-
-	return true, false
+	return total
 }
 
 // AddEvent records an event occurring now and returns allowed, firstDrop.
@@ -126,9 +143,13 @@ func (r *RateLimiter) Limit() int {
 func (r *RateLimiter) Total() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	total := 0
-	for _, v := range r.buckets {
-		total += v
-	}
-	return total
+	return r.totalLocked()
+}
+
+// Dropped returns the number of events dropped since the last allowed event. Callers that check
+// it before AddEventAt can tell when an allowed event ends a run of drops.
+func (r *RateLimiter) Dropped() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.droppedSinceWarning
 }
@@ -88,3 +88,43 @@ func TestRateLimiter_BucketRotationAccumulatesAcrossBuckets(t *testing.T) {
 	r.AddEventAt(mid)
 	assert.Equal(t, 3, r.Total())
 }
+
+func TestRateLimiter_DroppedCountsUntilNextAllowedEvent(t *testing.T) {
+	r := NewRateLimiterConfig(1, 6*time.Second, 3)
+	base := time.Now()
+
+	r.AddEventAt(base)
+	r.AddEventAt(base)
+	r.AddEventAt(base)
+	assert.Equal(t, 2, r.Dropped())
+
+	// once the window has passed the next event is allowed and the run of drops ends
+	allowed, _ := r.AddEventAt(base.Add(7 * time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, 0, r.Dropped())
+}
+
+func TestRateLimiter_AllowEventAtCountsOnlyAllowedEvents(t *testing.T) {
+	r := NewRateLimiterConfig(2, 6*time.Second, 3)
+	base := time.Now()
+
+	// one event a second is above the limit, yet two get through in every window
+	var allowedAt []int
+	for i := range 12 {
+		if allowed, _ := r.AllowEventAt(base.Add(time.Duration(i) * time.Second)); allowed {
+			allowedAt = append(allowedAt, i)
+		}
+	}
+	assert.Equal(t, []int{0, 1, 6, 7}, allowedAt)
+	assert.Equal(t, 2, r.Total(), "dropped events are not recorded")
+
+	// AddEventAt records the drops too, so the same stream is dropped after the first window
+	r = NewRateLimiterConfig(2, 6*time.Second, 3)
+	allowedAt = nil
+	for i := range 12 {
+		if allowed, _ := r.AddEventAt(base.Add(time.Duration(i) * time.Second)); allowed {
+			allowedAt = append(allowedAt, i)
+		}
+	}
+	assert.Equal(t, []int{0, 1}, allowedAt)
+}
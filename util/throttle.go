@@ -0,0 +1,304 @@
+//nolint:revive
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wu/keyop/core"
+)
+
+// ThrottleMessenger is a MessengerApi decorator that deduplicates and rate-limits publishes per
+// channel according to core.ThrottleConfig. Dropped publishes return nil.
+//
+// Rate limits are tracked per key (the configured payload fields, e.g. an alert's summary and
+// hostname) with a RateLimiter that counts only published messages, so a key publishing faster
+// than the limit still gets Limit messages through per window. When a key starts dropping, and
+// again when the next message for it is allowed or the key has gone quiet, a single AlertEvent
+// summarising the drops is published to the alert channel, bypassing the throttle. Only published messages count as seen for
+// deduplication.
+type ThrottleMessenger struct {
+	core.MessengerApi
+	service string
+	configs map[string]core.ThrottleConfig
+	logger  core.Logger
+	now     func() time.Time
+	// retention is how long dedup hashes and idle keys are kept: the longest configured window
+	retention time.Duration
+
+	mu         sync.Mutex
+	limiters   map[string]*throttleKey
+	seen       map[string]time.Time // dedup hash -> last publish
+	lastPrune  time.Time
+	flushTimer *time.Timer // reports keys that go quiet while dropping; nil when none are
+}
+
+type throttleKey struct {
+	limiter  *RateLimiter
+	lastSeen time.Time
+	channel  string
+	label    string
+	cfg      core.ThrottleConfig
+}
+
+// throttleSummary is a summary alert waiting to be published once t.mu is released.
+type throttleSummary struct {
+	cfg   core.ThrottleConfig
+	alert *core.AlertEvent
+}
+
+// NewThrottleMessenger wraps m for the service named service with per-channel configs keyed by
+// channel name, or "*" for channels without their own entry.
+func NewThrottleMessenger(m core.MessengerApi, service string, configs map[string]core.ThrottleConfig, logger core.Logger) *ThrottleMessenger {
+	retention := time.Duration(0)
+	for _, cfg := range configs {
+		retention = max(retention, throttleWindow(cfg), cfg.DedupWindow)
+	}
+	return &ThrottleMessenger{
+		MessengerApi: m,
+		retention:    retention,
+		service:      service,
+		configs:      configs,
+		logger:       logger,
+		now:          time.Now,
+		limiters:     map[string]*throttleKey{},
+		seen:         map[string]time.Time{},
+	}
+}
+
+func (t *ThrottleMessenger) configFor(channel string) (core.ThrottleConfig, bool) {
+	if cfg, ok := t.configs[channel]; ok {
+		return cfg, true
+	}
+	cfg, ok := t.configs["*"]
+	return cfg, ok
+}
+
+// Publish forwards the message unless it duplicates a recent one or its key is over the limit.
+func (t *ThrottleMessenger) Publish(ctx context.Context, channel string, payloadType string, payload interface{}) error {
+	cfg, ok := t.configFor(channel)
+	if !ok {
+		return t.MessengerApi.Publish(ctx, channel, payloadType, payload)
+	}
+	obj, err := throttlePayloadObject(payload)
+	if err != nil {
+		// not an object: nothing to key on, so only whole-payload dedup would apply; let it through
+		return t.MessengerApi.Publish(ctx, channel, payloadType, payload)
+	}
+
+	now := t.now()
+	t.mu.Lock()
+	summaries := t.prune(now)
+
+	hash := ""
+	if cfg.DedupWindow > 0 {
+		hash = dedupHash(channel, payloadType, obj, cfg.DedupIgnore)
+		if last, ok := t.seen[hash]; ok && now.Sub(last) < cfg.DedupWindow {
+			t.mu.Unlock()
+			t.publishSummaries(ctx, summaries)
+			t.logger.Debug("throttle: dropped duplicate", "service", t.service, "channel", channel)
+			return nil
+		}
+	}
+
+	allowed := true
+	if cfg.Limit > 0 {
+		label := rateKey(obj, cfg.Key)
+		key := channel + "|" + label
+		tk, ok := t.limiters[key]
+		if !ok {
+			tk = &throttleKey{limiter: NewRateLimiterConfig(cfg.Limit, throttleWindow(cfg), 10), channel: channel, label: label, cfg: cfg}
+			t.limiters[key] = tk
+		}
+		tk.lastSeen = now
+		pending := tk.limiter.Dropped()
+		var firstDrop bool
+		allowed, firstDrop = tk.limiter.AllowEventAt(now)
+		switch {
+		case firstDrop:
+			summaries = append(summaries, throttleSummary{cfg: cfg, alert: &core.AlertEvent{
+				Timestamp: now,
+				Hostname:  t.InstanceName(),
+				Summary:   fmt.Sprintf("%s: throttling %s", t.service, channel),
+				Text:      fmt.Sprintf("%s is publishing more than %d messages per %s to %s%s; dropping until the rate falls", t.service, cfg.Limit, throttleWindow(cfg), channel, keySuffix(label)),
+				Level:     "warning",
+			}})
+			t.scheduleFlush(ctx)
+		case allowed && pending > 0:
+			summaries = append(summaries, t.endedSummary(tk, pending, now))
+		}
+	}
+	t.mu.Unlock()
+	t.publishSummaries(ctx, summaries)
+	if !allowed {
+		return nil
+	}
+	if err := t.MessengerApi.Publish(ctx, channel, payloadType, payload); err != nil {
+		return err
+	}
+	if hash != "" {
+		t.mu.Lock()
+		t.seen[hash] = now
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// endedSummary returns the alert reporting the pending drops of tk. Called with t.mu held.
+func (t *ThrottleMessenger) endedSummary(tk *throttleKey, pending int, now time.Time) throttleSummary {
+	return throttleSummary{cfg: tk.cfg, alert: &core.AlertEvent{
+		Timestamp: now,
+		Hostname:  t.InstanceName(),
+		Summary:   fmt.Sprintf("%s: throttling of %s ended", t.service, tk.channel),
+		Text:      fmt.Sprintf("%s dropped %d messages to %s%s", t.service, pending, tk.channel, keySuffix(tk.label)),
+		Level:     "info",
+	}}
+}
+
+func (t *ThrottleMessenger) publishSummaries(ctx context.Context, summaries []throttleSummary) {
+	for _, s := range summaries {
+		if err := t.publishSummary(ctx, s.cfg, s.alert); err != nil {
+			t.logger.Error("throttle: failed to publish summary alert", "service", t.service, "error", err)
+		}
+	}
+}
+
+// scheduleFlush arranges for flushIdle to run once the retention has passed, so keys that stop
+// publishing while dropping still get their summary. Called with t.mu held.
+func (t *ThrottleMessenger) scheduleFlush(ctx context.Context) {
+	if t.flushTimer != nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	t.flushTimer = time.AfterFunc(t.retention, func() { t.flushIdle(ctx) })
+}
+
+// flushIdle publishes the summaries of keys that went quiet while dropping, and checks again
+// later while other keys are still dropping.
+func (t *ThrottleMessenger) flushIdle(ctx context.Context) {
+	t.mu.Lock()
+	t.flushTimer = nil
+	summaries := t.sweep(t.now())
+	for _, tk := range t.limiters {
+		if tk.limiter.Dropped() > 0 {
+			t.scheduleFlush(ctx)
+			break
+		}
+	}
+	t.mu.Unlock()
+	t.publishSummaries(ctx, summaries)
+}
+
+func (t *ThrottleMessenger) publishSummary(ctx context.Context, cfg core.ThrottleConfig, alert *core.AlertEvent) error {
+	channel := cfg.AlertChannel
+	if channel == "" {
+		channel = "alerts"
+	}
+	return t.MessengerApi.Publish(ctx, channel, alert.PayloadType(), alert)
+}
+
+// prune sweeps at most once per retention so publishing stays cheap. Called with t.mu held.
+func (t *ThrottleMessenger) prune(now time.Time) []throttleSummary {
+	if now.Sub(t.lastPrune) < t.retention {
+		return nil
+	}
+	return t.sweep(now)
+}
+
+// sweep forgets dedup hashes and idle keys so memory stays bounded, and returns the summaries of
+// idle keys that still had drops to report. Called with t.mu held.
+func (t *ThrottleMessenger) sweep(now time.Time) []throttleSummary {
+	interval := t.retention
+	t.lastPrune = now
+	for hash, last := range t.seen {
+		if now.Sub(last) >= interval {
+			delete(t.seen, hash)
+		}
+	}
+	var summaries []throttleSummary
+	for key, tk := range t.limiters {
+		if now.Sub(tk.lastSeen) < interval {
+			continue
+		}
+		if pending := tk.limiter.Dropped(); pending > 0 {
+			summaries = append(summaries, t.endedSummary(tk, pending, now))
+		}
+		delete(t.limiters, key)
+	}
+	return summaries
+}
+
+func throttleWindow(cfg core.ThrottleConfig) time.Duration {
+	if cfg.Window <= 0 {
+		return time.Minute
+	}
+	return cfg.Window
+}
+
+func keySuffix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return " (" + label + ")"
+}
+
+// rateKey joins the values of the key fields; without key fields the whole channel shares a key.
+func rateKey(obj map[string]any, fields []string) string {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		var cur any = obj
+		for _, k := range strings.Split(f, ".") {
+			m, ok := cur.(map[string]any)
+			if !ok {
+				cur = nil
+				break
+			}
+			cur = m[k]
+		}
+		if cur == nil {
+			parts = append(parts, "")
+		} else {
+			parts = append(parts, fmt.Sprint(cur))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func dedupHash(channel, payloadType string, obj map[string]any, ignore []string) string {
+	if len(ignore) > 0 {
+		trimmed := make(map[string]any, len(obj))
+		for k, v := range obj {
+			trimmed[k] = v
+		}
+		for _, k := range ignore {
+			delete(trimmed, k)
+		}
+		obj = trimmed
+	}
+	// map keys are marshalled in sorted order, so equal payloads hash equally
+	b, _ := json.Marshal(obj)
+	sum := sha256.Sum256(append([]byte(channel+"|"+payloadType+"|"), b...))
+	return string(sum[:])
+}
+
+func throttlePayloadObject(payload any) (map[string]any, error) {
+	var raw []byte
+	if r, ok := payload.(json.RawMessage); ok {
+		raw = r
+	} else {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
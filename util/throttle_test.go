@@ -0,0 +1,180 @@
+//nolint:revive
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wu/keyop/core"
+	"github.com/wu/keyop/core/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestThrottle(configs map[string]core.ThrottleConfig) (*ThrottleMessenger, *testutil.FakeMessenger, *time.Time) {
+	fake := testutil.NewFakeMessenger()
+	fake.InstanceNameValue = "pi1"
+	clock := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	t := NewThrottleMessenger(fake, "monitor", configs, &testutil.FakeLogger{})
+	t.now = func() time.Time { return clock }
+	return t, fake, &clock
+}
+
+func channelMessages(fake *testutil.FakeMessenger, channel string) []testutil.PublishedMessage {
+	var out []testutil.PublishedMessage
+	for _, m := range fake.PublishedMessages {
+		if m.Channel == channel {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func TestThrottleMessenger_Dedup(t *testing.T) {
+	m, fake, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"status": {DedupWindow: time.Minute, DedupIgnore: []string{"timestamp"}},
+	})
+	ctx := context.Background()
+	alert := func(summary string) *core.AlertEvent {
+		return &core.AlertEvent{Timestamp: *clock, Summary: summary}
+	}
+
+	require.NoError(t, m.Publish(ctx, "status", "core.alert.v1", alert("disk full")))
+	*clock = clock.Add(10 * time.Second)
+	require.NoError(t, m.Publish(ctx, "status", "core.alert.v1", alert("disk full")))
+	require.NoError(t, m.Publish(ctx, "status", "core.alert.v1", alert("disk ok")))
+	*clock = clock.Add(time.Minute)
+	require.NoError(t, m.Publish(ctx, "status", "core.alert.v1", alert("disk full")))
+
+	// other channels are not throttled
+	require.NoError(t, m.Publish(ctx, "other", "core.alert.v1", alert("disk full")))
+	require.NoError(t, m.Publish(ctx, "other", "core.alert.v1", alert("disk full")))
+
+	assert.Len(t, channelMessages(fake, "status"), 3)
+	assert.Len(t, channelMessages(fake, "other"), 2)
+}
+
+func TestThrottleMessenger_RateLimitByKey(t *testing.T) {
+	m, fake, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"*": {Limit: 2, Window: time.Minute, Key: []string{"summary", "hostname"}, AlertChannel: "ops"},
+	})
+	ctx := context.Background()
+	publish := func(summary string) {
+		require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: summary, Hostname: "pi1"}))
+	}
+
+	for i := 0; i < 5; i++ {
+		publish("flapping")
+	}
+	publish("other problem")
+	assert.Len(t, channelMessages(fake, "alerts"), 3)
+
+	ops := channelMessages(fake, "ops")
+	require.Len(t, ops, 1, "a single summary when drops start")
+	started := ops[0].Payload.(*core.AlertEvent)
+	assert.Equal(t, "warning", started.Level)
+	assert.Equal(t, "pi1", started.Hostname)
+	assert.Contains(t, started.Text, "(flapping/pi1)")
+
+	*clock = clock.Add(2 * time.Minute)
+	publish("flapping")
+	assert.Len(t, channelMessages(fake, "alerts"), 4)
+	ops = channelMessages(fake, "ops")
+	require.Len(t, ops, 2, "and one when they end")
+	ended := ops[1].Payload.(*core.AlertEvent)
+	assert.Equal(t, "info", ended.Level)
+	assert.Contains(t, ended.Text, "dropped 3 messages")
+}
+
+func TestThrottleMessenger_PrunesIdleKeys(t *testing.T) {
+	m, _, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"metrics": {Limit: 10, Key: []string{"name"}, DedupWindow: time.Second},
+	})
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, m.Publish(ctx, "metrics", "core.metric.v1", core.MetricEvent{Name: name}))
+	}
+	assert.Len(t, m.limiters, 3)
+
+	*clock = clock.Add(2 * time.Minute)
+	require.NoError(t, m.Publish(ctx, "metrics", "core.metric.v1", core.MetricEvent{Name: "d"}))
+	assert.Len(t, m.limiters, 1)
+	assert.Len(t, m.seen, 1)
+}
+
+func TestThrottleMessenger_DropsAreNotCounted(t *testing.T) {
+	fake := testutil.NewFakeMessenger()
+	counter := core.NewPublishCounter()
+	count := core.ServiceCounter(core.DefaultInterceptorConfig, core.ServiceConfig{Name: "monitor"}, counter)
+	m := NewThrottleMessenger(core.NewInterceptedMessenger(fake, count), "monitor",
+		map[string]core.ThrottleConfig{"status": {DedupWindow: time.Minute}}, &testutil.FakeLogger{})
+
+	for range 3 {
+		require.NoError(t, m.Publish(context.Background(), "status", "core.alert.v1", &core.AlertEvent{Summary: "disk full"}))
+	}
+	assert.Equal(t, []core.PublishCount{{Service: "monitor", Channel: "status", Published: 1}}, counter.Snapshot())
+}
+
+func TestThrottleMessenger_SummaryWhenKeyGoesQuiet(t *testing.T) {
+	m, fake, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"alerts": {Limit: 1, Window: time.Minute, AlertChannel: "ops"},
+	})
+	ctx := context.Background()
+	for range 4 {
+		require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: "flapping"}))
+	}
+	require.Len(t, channelMessages(fake, "ops"), 1)
+	require.NotNil(t, m.flushTimer, "a flush is scheduled once drops start")
+
+	*clock = clock.Add(2 * time.Minute)
+	m.flushIdle(ctx)
+	ops := channelMessages(fake, "ops")
+	require.Len(t, ops, 2, "the publisher went quiet, the drops are still reported")
+	assert.Contains(t, ops[1].Payload.(*core.AlertEvent).Text, "dropped 3 messages")
+	assert.Empty(t, m.limiters)
+	assert.Nil(t, m.flushTimer)
+}
+
+func TestThrottleMessenger_RateLimitedMessageIsNotADuplicate(t *testing.T) {
+	m, fake, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"alerts": {Limit: 1, Window: time.Minute, DedupWindow: 10 * time.Minute, AlertChannel: "ops"},
+	})
+	ctx := context.Background()
+	require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: "first"}))
+	require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: "second"}))
+	assert.Len(t, channelMessages(fake, "alerts"), 1)
+
+	*clock = clock.Add(2 * time.Minute)
+	require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: "second"}))
+	assert.Len(t, channelMessages(fake, "alerts"), 2, "the retry of a rate-limited message is published")
+}
+
+func TestThrottleMessenger_SteadyStreamAboveLimitKeepsPublishing(t *testing.T) {
+	m, fake, clock := newTestThrottle(map[string]core.ThrottleConfig{
+		"alerts": {Limit: 2, Window: time.Minute, AlertChannel: "ops"},
+	})
+	ctx := context.Background()
+
+	// one message every 10s is three times the limit; the drops do not lock the key out
+	for range 18 {
+		require.NoError(t, m.Publish(ctx, "alerts", "core.alert.v1", core.AlertEvent{Summary: "flapping"}))
+		*clock = clock.Add(10 * time.Second)
+	}
+	published := len(channelMessages(fake, "alerts"))
+	assert.Equal(t, 6, published, "two messages per window over three minutes")
+
+	// the last run of drops is reported once the key goes quiet
+	*clock = clock.Add(time.Minute)
+	m.flushIdle(ctx)
+	dropped := 0
+	for _, msg := range channelMessages(fake, "ops") {
+		var n int
+		if _, err := fmt.Sscanf(msg.Payload.(*core.AlertEvent).Text, "monitor dropped %d messages", &n); err == nil {
+			dropped += n
+		}
+	}
+	assert.Equal(t, 18-published, dropped, "every drop is reported in a summary")
+}